@@ -25,6 +25,14 @@ func GetIntOrDefault(key string, def int) (int, error) {
 	}
 }
 
+func GetFloatOrDefault(key string, def float64) (float64, error) {
+	if str, found := GetString(key); found {
+		return strconv.ParseFloat(str, 64)
+	} else {
+		return def, nil
+	}
+}
+
 func GetString(key string) (string, bool) {
 	return os.LookupEnv(key)
 }
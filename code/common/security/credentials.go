@@ -0,0 +1,178 @@
+package security
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"tp1.aba.distros.fi.uba.ar/common/config"
+)
+
+//=================================================================================================
+// Credentials
+//-------------------------------------------------------------------------------------------------
+
+// Servers may require write requests to be signed by a known client. Each client has an ID and a
+// secret shared with the server, and signs its requests with an HMAC-SHA256 over the request, a
+// timestamp and a random nonce. Servers only accept each nonce once, and only within a window
+// around the current time, so that signed requests cannot be replayed.
+//
+// Clients take their credentials from configuration (ClientId and ClientSecret). Servers require
+// signed writes when given a keys file (AuthKeysFile), which holds a line for each client with
+// its ID and secret separated by an equals sign. Empty lines and lines starting with # are
+// skipped.
+
+const NonceLength int = 16
+const SignatureLength int = sha256.Size
+
+const defaultMaxClockSkew int = 300
+
+// The credentials a client signs its requests with.
+type Credentials struct {
+	ClientId string
+	secret   []byte
+}
+
+func CreateCredentials(clientId string, secret string) *Credentials {
+	return &Credentials{clientId, []byte(secret)}
+}
+
+// The configured client credentials, or nil if requests should not be signed.
+func ClientCredentials() (*Credentials, error) {
+	clientId := config.GetStringOrDefault("ClientId", "")
+	secret := config.GetStringOrDefault("ClientSecret", "")
+	if clientId == "" && secret == "" {
+		return nil, nil
+	}
+	if clientId == "" || secret == "" {
+		return nil, errors.New("ClientId and ClientSecret must be set together")
+	}
+	return CreateCredentials(clientId, secret), nil
+}
+
+// Compute the signature of the given content.
+func (credentials *Credentials) Sign(content []byte) []byte {
+	return sign(credentials.secret, content)
+}
+
+func sign(secret []byte, content []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(content)
+	return mac.Sum(nil)
+}
+
+//=================================================================================================
+// Verifier
+//-------------------------------------------------------------------------------------------------
+
+// Checks the signatures of requests against the secrets of known clients. Safe for concurrent
+// use.
+type Verifier struct {
+	keys          map[string][]byte
+	maxClockSkew  time.Duration
+	lock          sync.Mutex
+	nonces        map[string]time.Time
+	nextPruneTime time.Time
+}
+
+func CreateVerifier(keys map[string][]byte, maxClockSkew time.Duration) *Verifier {
+	verifier := &Verifier{}
+	verifier.keys = keys
+	verifier.maxClockSkew = maxClockSkew
+	verifier.nonces = make(map[string]time.Time)
+	return verifier
+}
+
+// A verifier for the keys file in configuration, or nil if requests should not be checked.
+func ServerVerifier() (*Verifier, error) {
+	path := config.GetStringOrDefault("AuthKeysFile", "")
+	if path == "" {
+		return nil, nil
+	}
+	keys, err := LoadKeys(path)
+	if err != nil {
+		return nil, err
+	}
+	seconds, err := config.GetIntOrDefault("AuthMaxClockSkew", defaultMaxClockSkew)
+	if err != nil || seconds <= 0 {
+		seconds = defaultMaxClockSkew
+	}
+	return CreateVerifier(keys, time.Duration(seconds)*time.Second), nil
+}
+
+// Load the secrets of clients from the given keys file, by client ID.
+func LoadKeys(path string) (map[string][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read keys file: %w", err)
+	}
+	defer file.Close()
+
+	keys := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		separator := strings.Index(line, "=")
+		if separator <= 0 || separator == len(line)-1 {
+			return nil, fmt.Errorf("malformed keys file, line %d", lineNumber)
+		}
+		keys[line[:separator]] = []byte(line[separator+1:])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read keys file: %w", err)
+	}
+	return keys, nil
+}
+
+// Checks that the content was signed by the given client at the given time, and that the nonce
+// was not used before.
+func (verifier *Verifier) Verify(clientId string, timestamp time.Time, nonce []byte, content []byte, signature []byte) error {
+	secret, found := verifier.keys[clientId]
+	if !found {
+		return fmt.Errorf("unknown client %s", clientId)
+	}
+	if !hmac.Equal(sign(secret, content), signature) {
+		return errors.New("invalid signature")
+	}
+
+	now := time.Now()
+	if timestamp.Before(now.Add(-verifier.maxClockSkew)) || timestamp.After(now.Add(verifier.maxClockSkew)) {
+		return errors.New("request timestamp out of range")
+	}
+
+	verifier.lock.Lock()
+	defer verifier.lock.Unlock()
+
+	verifier.pruneNonces(now)
+	key := clientId + ":" + string(nonce)
+	if _, seen := verifier.nonces[key]; seen {
+		return errors.New("replayed request")
+	}
+	// Once the timestamp is out of range the request is rejected anyway, so the nonce can be
+	// forgotten by then.
+	verifier.nonces[key] = timestamp.Add(verifier.maxClockSkew)
+	return nil
+}
+
+// Forget the nonces of requests that would be rejected by their timestamp already. Runs at most
+// once per clock skew window.
+func (verifier *Verifier) pruneNonces(now time.Time) {
+	if now.Before(verifier.nextPruneTime) {
+		return
+	}
+	for key, expiration := range verifier.nonces {
+		if expiration.Before(now) {
+			delete(verifier.nonces, key)
+		}
+	}
+	verifier.nextPruneTime = now.Add(verifier.maxClockSkew)
+}
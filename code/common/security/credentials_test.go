@@ -0,0 +1,74 @@
+package security
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	contents := "# Known clients\nclient-1=secret\n\nclient-2=with=equals\n"
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("could not write keys file: %s", err.Error())
+	}
+
+	keys, err := LoadKeys(path)
+	if err != nil {
+		t.Fatalf("could not load keys: %s", err.Error())
+	}
+	if len(keys) != 2 || string(keys["client-1"]) != "secret" || string(keys["client-2"]) != "with=equals" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	if err := os.WriteFile(path, []byte("client-1\n"), 0600); err != nil {
+		t.Fatalf("could not write keys file: %s", err.Error())
+	}
+	if _, err := LoadKeys(path); err == nil {
+		t.Fatal("expected a malformed keys file to fail")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	verifier := CreateVerifier(map[string][]byte{"client": []byte("secret")}, time.Minute)
+	credentials := CreateCredentials("client", "secret")
+	content := []byte("request")
+	now := time.Now()
+
+	if err := verifier.Verify("client", now, []byte("nonce-1"), content, credentials.Sign(content)); err != nil {
+		t.Fatalf("valid request rejected: %s", err.Error())
+	}
+	if err := verifier.Verify("client", now, []byte("nonce-1"), content, credentials.Sign(content)); err == nil {
+		t.Fatal("expected a replayed request to be rejected")
+	}
+
+	// Requests signed with the wrong secret, by unknown clients, or too long ago are rejected.
+	other := CreateCredentials("client", "other secret")
+	if err := verifier.Verify("client", now, []byte("nonce-2"), content, other.Sign(content)); err == nil {
+		t.Fatal("expected a request with the wrong signature to be rejected")
+	}
+	if err := verifier.Verify("stranger", now, []byte("nonce-3"), content, credentials.Sign(content)); err == nil {
+		t.Fatal("expected a request from an unknown client to be rejected")
+	}
+	old := now.Add(-2 * time.Minute)
+	if err := verifier.Verify("client", old, []byte("nonce-4"), content, credentials.Sign(content)); err == nil {
+		t.Fatal("expected an old request to be rejected")
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	t.Setenv("ClientId", "")
+	t.Setenv("ClientSecret", "")
+	if credentials, err := ClientCredentials(); err != nil || credentials != nil {
+		t.Fatal("expected no credentials")
+	}
+	t.Setenv("ClientId", "client")
+	if _, err := ClientCredentials(); err == nil {
+		t.Fatal("expected a client ID without secret to fail")
+	}
+	t.Setenv("ClientSecret", "secret")
+	if credentials, err := ClientCredentials(); err != nil || credentials.ClientId != "client" {
+		t.Fatal("expected the configured credentials")
+	}
+}
@@ -0,0 +1,134 @@
+package security
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+
+	"tp1.aba.distros.fi.uba.ar/common/config"
+)
+
+//=================================================================================================
+// TLS
+//-------------------------------------------------------------------------------------------------
+
+// Connections are encrypted with TLS when configured to, and are plain TCP otherwise.
+//
+// Servers use TLS when given a certificate (TLSCertFile and TLSKeyFile), and also require clients
+// to present a certificate signed by the authority in TLSClientCAFile when it is set.
+//
+// Clients use TLS when given the authority to check server certificates against (TLSCAFile) or a
+// certificate of their own (TLSClientCertFile and TLSClientKeyFile), which is presented to servers
+// that require one. Without TLSCAFile, server certificates are checked against the certificate
+// authorities of the system. The server certificate is never used by clients, so a node can serve
+// over TLS while connecting to plain servers and the other way around.
+
+// Listens for connections on the given address, over TLS if configured.
+func Listen(address string) (net.Listener, error) {
+	tlsConfig, err := ServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		return listener, nil
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
+
+// Connects to the given address, over TLS if configured.
+func Dial(address string) (net.Conn, error) {
+	tlsConfig, err := ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		return net.Dial("tcp", address)
+	}
+	return tls.Dial("tcp", address, tlsConfig)
+}
+
+// The TLS configuration for servers, or nil if servers should not use TLS.
+func ServerConfig() (*tls.Config, error) {
+	certificate, err := loadCertificate("TLSCertFile", "TLSKeyFile")
+	if err != nil || certificate == nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{}
+	tlsConfig.MinVersion = tls.VersionTLS12
+	tlsConfig.Certificates = []tls.Certificate{*certificate}
+
+	if path, found := config.GetString("TLSClientCAFile"); found && path != "" {
+		clientCAs, err := loadCertPool(path)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// The TLS configuration for clients, or nil if clients should not use TLS.
+func ClientConfig() (*tls.Config, error) {
+	certificate, err := loadCertificate("TLSClientCertFile", "TLSClientKeyFile")
+	if err != nil {
+		return nil, err
+	}
+	path, found := config.GetString("TLSCAFile")
+	if certificate == nil && (!found || path == "") {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	tlsConfig.MinVersion = tls.VersionTLS12
+	if certificate != nil {
+		tlsConfig.Certificates = []tls.Certificate{*certificate}
+	}
+	if found && path != "" {
+		rootCAs, err := loadCertPool(path)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	return tlsConfig, nil
+}
+
+// Load the certificate and key in the files given by the settings with the given names, or nil if
+// none is configured.
+func loadCertificate(certKey string, keyKey string) (*tls.Certificate, error) {
+	certFile := config.GetStringOrDefault(certKey, "")
+	keyFile := config.GetStringOrDefault(keyKey, "")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("%s and %s must be set together", certKey, keyKey)
+	}
+
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load TLS certificate: %w", err)
+	}
+	return &certificate, nil
+}
+
+// Load a pool with the PEM encoded certificates in the given file.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read certificate authority: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(contents) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
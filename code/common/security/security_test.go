@@ -0,0 +1,203 @@
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPlainWhenUnconfigured(t *testing.T) {
+	setConfig(t, "", "", "", "")
+	if tlsConfig, err := ServerConfig(); err != nil || tlsConfig != nil {
+		t.Fatal("expected servers not to use TLS")
+	}
+	if tlsConfig, err := ClientConfig(); err != nil || tlsConfig != nil {
+		t.Fatal("expected clients not to use TLS")
+	}
+	if err := echo(t, func(address string) (net.Conn, error) { return Dial(address) }); err != nil {
+		t.Fatalf("plain connection failed: %s", err.Error())
+	}
+}
+
+func TestServerCertificate(t *testing.T) {
+	dir := t.TempDir()
+	writeAuthority(t, dir, "ca")
+	setConfig(t, filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"), "", filepath.Join(dir, "ca.pem"))
+
+	if err := echo(t, func(address string) (net.Conn, error) { return Dial(address) }); err != nil {
+		t.Fatalf("TLS connection failed: %s", err.Error())
+	}
+	// Plain clients cannot talk to TLS servers.
+	if err := echo(t, func(address string) (net.Conn, error) { return net.Dial("tcp", address) }); err == nil {
+		t.Fatal("expected a plain connection to fail")
+	}
+	// Clients do not trust servers whose certificates were not signed by the configured authority.
+	otherDir := t.TempDir()
+	writeAuthority(t, otherDir, "ca")
+	t.Setenv("TLSCAFile", filepath.Join(otherDir, "ca.pem"))
+	if err := echo(t, func(address string) (net.Conn, error) { return Dial(address) }); err == nil {
+		t.Fatal("expected an untrusted server to be rejected")
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	writeAuthority(t, dir, "ca")
+	ca := filepath.Join(dir, "ca.pem")
+	setConfig(t, ca, filepath.Join(dir, "ca-key.pem"), ca, ca)
+	t.Setenv("TLSClientCertFile", ca)
+	t.Setenv("TLSClientKeyFile", filepath.Join(dir, "ca-key.pem"))
+
+	if err := echo(t, func(address string) (net.Conn, error) { return Dial(address) }); err != nil {
+		t.Fatalf("mutual TLS connection failed: %s", err.Error())
+	}
+	// Clients without a certificate are rejected.
+	if err := echo(t, func(address string) (net.Conn, error) {
+		return tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true})
+	}); err == nil {
+		t.Fatal("expected a client without certificate to be rejected")
+	}
+	// Clients do not present the server certificate.
+	t.Setenv("TLSClientCertFile", "")
+	t.Setenv("TLSClientKeyFile", "")
+	if err := echo(t, func(address string) (net.Conn, error) { return Dial(address) }); err == nil {
+		t.Fatal("expected a client without certificate of its own to be rejected")
+	}
+}
+
+func TestTLSServerDialsPlainServer(t *testing.T) {
+	dir := t.TempDir()
+	writeAuthority(t, dir, "ca")
+	setConfig(t, filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"), "", "")
+
+	if tlsConfig, err := ClientConfig(); err != nil || tlsConfig != nil {
+		t.Fatal("expected clients not to use TLS")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err.Error())
+	}
+	if err := echoThrough(listener, Dial); err != nil {
+		t.Fatalf("plain connection from a TLS server failed: %s", err.Error())
+	}
+}
+
+func TestIncompleteConfig(t *testing.T) {
+	setConfig(t, "cert.pem", "", "", "")
+	if _, err := ServerConfig(); err == nil {
+		t.Fatal("expected a certificate without key to fail")
+	}
+	setConfig(t, "", "", "", "missing.pem")
+	if _, err := ClientConfig(); err == nil {
+		t.Fatal("expected a missing certificate authority to fail")
+	}
+	setConfig(t, "", "", "", "")
+	t.Setenv("TLSClientCertFile", "cert.pem")
+	if _, err := ClientConfig(); err == nil {
+		t.Fatal("expected a client certificate without key to fail")
+	}
+}
+
+//=================================================================================================
+// Helpers
+//-------------------------------------------------------------------------------------------------
+
+// Sets the TLS configuration for the duration of the test.
+func setConfig(t *testing.T, certFile string, keyFile string, clientCAFile string, caFile string) {
+	t.Setenv("TLSCertFile", certFile)
+	t.Setenv("TLSKeyFile", keyFile)
+	t.Setenv("TLSClientCAFile", clientCAFile)
+	t.Setenv("TLSCAFile", caFile)
+	t.Setenv("TLSClientCertFile", "")
+	t.Setenv("TLSClientKeyFile", "")
+}
+
+// Sends a message to a server that echoes it back, connecting through the given function.
+func echo(t *testing.T, dial func(address string) (net.Conn, error)) error {
+	listener, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err.Error())
+	}
+	return echoThrough(listener, dial)
+}
+
+// Sends a message to a server that echoes it back on the given listener, which is closed
+// afterwards.
+func echoThrough(listener net.Listener, dial func(address string) (net.Conn, error)) error {
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := dial(listener.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("ping, ping, ping")); err != nil {
+		return err
+	}
+	response := make([]byte, 16)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Writes a self-signed certificate valid for the loopback address, for both servers and clients,
+// along with its key.
+func writeAuthority(t *testing.T, dir string, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %s", err.Error())
+	}
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("could not encode key: %s", err.Error())
+	}
+
+	writePEM(t, filepath.Join(dir, name+".pem"), "CERTIFICATE", certificate)
+	writePEM(t, filepath.Join(dir, name+"-key.pem"), "EC PRIVATE KEY", keyBytes)
+}
+
+func writePEM(t *testing.T, path string, blockType string, bytes []byte) {
+	contents := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: bytes})
+	if err := os.WriteFile(path, contents, 0600); err != nil {
+		t.Fatalf("could not write %s: %s", path, err.Error())
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"sync"
 
 	"tp1.aba.distros.fi.uba.ar/common/logging"
+	"tp1.aba.distros.fi.uba.ar/common/security"
 )
 
 //=================================================================================================
@@ -20,21 +21,33 @@ type ServerConfig struct {
 	WorkerCount uint
 }
 
+// Handles a connection until the client hangs up. Connections may carry many requests, which
+// the handler passes to the workers of the server as tasks through the submit function, so that
+// the amount of requests handled at once is bounded by the worker count.
+type ConnectionHandler = func(conn *net.Conn, submit func(task func()))
+
 type Server struct {
 	Config        *ServerConfig
 	Control       chan int
 	workerControl [](chan<- int)
-	work          func(*net.Conn)
+	work          ConnectionHandler
 	topGroup      *sync.WaitGroup
+	tasks         chan func()
+	// Open connections, to be closed when quitting.
+	connections     map[*net.Conn]bool
+	closing         bool
+	connectionLock  sync.Mutex
+	connectionGroup sync.WaitGroup
 }
 
-func CreateNew(config *ServerConfig, handleConnection func(*net.Conn)) *Server {
+func CreateNew(config *ServerConfig, handleConnection ConnectionHandler) *Server {
 	return &Server{
-		config,
-		make(chan int),
-		make([](chan<- int), 0, config.WorkerCount),
-		handleConnection,
-		nil,
+		Config:        config,
+		Control:       make(chan int),
+		workerControl: make([](chan<- int), 0, config.WorkerCount),
+		work:          handleConnection,
+		tasks:         make(chan func()),
+		connections:   make(map[*net.Conn]bool),
 	}
 }
 
@@ -57,8 +70,8 @@ func (server *Server) Run() error {
 	// Instantiate a wait group to wait for all goroutines to finish on quit.
 	waitGroup := &sync.WaitGroup{}
 
-	// Instantiate a TCP listener on the given port.
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", server.Config.Port))
+	// Instantiate a TCP listener on the given port, over TLS if configured.
+	ln, err := security.Listen(fmt.Sprintf(":%d", server.Config.Port))
 	// Return any error that may have occurred.
 	if err != nil {
 		return err
@@ -66,13 +79,13 @@ func (server *Server) Run() error {
 
 	// Launch the acceptor goroutine to accept new connections on the listener.
 	// The acceptor will handle closing the listener when quit is requested.
-	acc := createAcceptor(&ln, waitGroup)
+	acc := createAcceptor(&ln, waitGroup, server.handle)
 	acc.run()
 
 	// Instantiate a fixed, given amount of worker goroutines.
 	serverLog(fmt.Sprintf("Launching %d workers", server.Config.WorkerCount))
 	for i := uint(0); i < server.Config.WorkerCount; i++ {
-		controlChannel := launchWorker(i, acc.connectionQueue, waitGroup, server.work)
+		controlChannel := launchWorker(i, server.tasks, waitGroup)
 		server.workerControl = append(server.workerControl, controlChannel)
 	}
 
@@ -91,6 +104,9 @@ func (server *Server) Run() error {
 			// Finalize the acceptor.
 			serverLog("Closing listener")
 			acc.quit()
+			// Close open connections and wait for their requests to be handled.
+			serverLog("Closing connections")
+			server.closeConnections()
 			// Propagate the signal to the workers.
 			serverLog("Finalizing workers")
 			for _, controlChannel := range server.workerControl {
@@ -113,6 +129,45 @@ func (server *Server) Run() error {
 	return nil
 }
 
+// Handles a connection in its own goroutine, closing it once the client hangs up.
+func (server *Server) handle(conn *net.Conn) {
+	server.connectionLock.Lock()
+	if server.closing {
+		server.connectionLock.Unlock()
+		(*conn).Close()
+		return
+	}
+	server.connections[conn] = true
+	server.connectionGroup.Add(1)
+	server.connectionLock.Unlock()
+
+	go func() {
+		defer server.connectionGroup.Done()
+		server.work(conn, server.submit)
+
+		server.connectionLock.Lock()
+		delete(server.connections, conn)
+		server.connectionLock.Unlock()
+		// Ensure that the connection is finally closed.
+		(*conn).Close()
+	}()
+}
+
+// Hands a task to the first worker that becomes available.
+func (server *Server) submit(task func()) {
+	server.tasks <- task
+}
+
+func (server *Server) closeConnections() {
+	server.connectionLock.Lock()
+	server.closing = true
+	for conn := range server.connections {
+		(*conn).Close()
+	}
+	server.connectionLock.Unlock()
+	server.connectionGroup.Wait()
+}
+
 func serverLog(msg string) {
 	log.Println(serverMessage(msg))
 }
@@ -124,9 +179,9 @@ func serverMessage(msg string) string {
 //=================================================================================================
 // Worker
 //-------------------------------------------------------------------------------------------------
-// Launches a worker that handles a given connection in a separate goroutine.
+// Launches a worker that runs tasks from the given queue in a separate goroutine.
 // Returns a control channel to pass control signals to the worker.
-func launchWorker(id uint, connQueue <-chan *net.Conn, wg *sync.WaitGroup, work func(*net.Conn)) chan<- int {
+func launchWorker(id uint, taskQueue <-chan func(), wg *sync.WaitGroup) chan<- int {
 	// Increase the worker count by one.
 	wg.Add(1)
 	// Instantiate a control channel.
@@ -145,12 +200,10 @@ func launchWorker(id uint, connQueue <-chan *net.Conn, wg *sync.WaitGroup, work
 				wg.Done()
 				return
 
-			case conn := <-connQueue:
-				// Have the connection be handled by the worker function.
-				workerLog(id, "Handling incoming connection")
-				work(conn)
-				// Ensure that the connection is finally closed.
-				(*conn).Close()
+			case task := <-taskQueue:
+				// Run the task, which handles a single request.
+				workerLog(id, "Handling incoming request")
+				task()
 			}
 		}
 	}()
@@ -170,22 +223,19 @@ func workerMessage(id uint, msg string) string {
 // Acceptor
 //-------------------------------------------------------------------------------------------------
 type acceptor struct {
-	connectionQueueWrite chan<- *net.Conn
-	connectionQueue      <-chan *net.Conn
-	quitRequested        bool
-	quitLock             sync.Mutex
-	waitGroup            *sync.WaitGroup
-	listener             *net.Listener
+	handleConnection func(*net.Conn)
+	quitRequested    bool
+	quitLock         sync.Mutex
+	waitGroup        *sync.WaitGroup
+	listener         *net.Listener
 }
 
-func createAcceptor(ln *net.Listener, wg *sync.WaitGroup) *acceptor {
-	connectionQueue := make(chan *net.Conn)
+func createAcceptor(ln *net.Listener, wg *sync.WaitGroup, handleConnection func(*net.Conn)) *acceptor {
 	return &acceptor{
-		connectionQueueWrite: connectionQueue,
-		connectionQueue:      connectionQueue,
-		quitRequested:        false,
-		waitGroup:            wg,
-		listener:             ln,
+		handleConnection: handleConnection,
+		quitRequested:    false,
+		waitGroup:        wg,
+		listener:         ln,
 	}
 }
 
@@ -211,12 +261,13 @@ func (acc *acceptor) run() {
 				} else {
 					// There was an actual error.
 					logging.LogError("Connection error", err)
+					continue
 				}
 			}
 
-			// Push the connection into the queue for a worker to handle.
-			serverLog("New connection received, pushing into the work queue")
-			acc.connectionQueueWrite <- &conn
+			// Start handling the connection.
+			serverLog("New connection received")
+			acc.handleConnection(&conn)
 		}
 	}()
 }
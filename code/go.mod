@@ -1,3 +1,3 @@
 module tp1.aba.distros.fi.uba.ar
 
-go 1.16
+go 1.18
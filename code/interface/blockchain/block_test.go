@@ -2,6 +2,8 @@ package blockchain
 
 import (
 	"bytes"
+	"encoding/binary"
+	"math/big"
 	"math/rand"
 	"testing"
 	"time"
@@ -97,6 +99,69 @@ func TestReadWrite(t *testing.T) {
 	testEntryContents(block2, t)
 }
 
+func TestReadMalformedBlock(t *testing.T) {
+	block := testBlock(t)
+	buffer := bytes.NewBuffer(make([]byte, 0, 256))
+	block.WriteWithMetadata(buffer)
+	valid := buffer.Bytes()
+	// The block buffer begins after its length and hash.
+	dataOffset := 36 + int(headerOffset["Data"])
+
+	corrupt := func(change func(data []byte) []byte) []byte {
+		data := make([]byte, len(valid))
+		copy(data, valid)
+		return change(data)
+	}
+	cases := map[string][]byte{
+		"truncated": corrupt(func(data []byte) []byte {
+			return data[:len(data)-1]
+		}),
+		"trailing bytes": corrupt(func(data []byte) []byte {
+			binary.LittleEndian.PutUint32(data[0:4], binary.LittleEndian.Uint32(data[0:4])+1)
+			return append(data, 0)
+		}),
+		"entry out of bounds": corrupt(func(data []byte) []byte {
+			binary.LittleEndian.PutUint16(data[dataOffset:dataOffset+2], 1000)
+			return data
+		}),
+		"too many entries": corrupt(func(data []byte) []byte {
+			data[36+headerOffset["EntryCount"]]++
+			return data
+		}),
+		"shorter than header": corrupt(func(data []byte) []byte {
+			binary.LittleEndian.PutUint32(data[0:4], 10)
+			return data[:46]
+		}),
+		"too long": corrupt(func(data []byte) []byte {
+			binary.LittleEndian.PutUint32(data[0:4], MaxBlockLength()+1)
+			return data
+		}),
+	}
+
+	for name, data := range cases {
+		if _, err := ReadBlock(bytes.NewReader(data)); err == nil {
+			t.Fatalf("expected reading a block with %s to fail", name)
+		}
+	}
+}
+
+func FuzzReadBlock(f *testing.F) {
+	buffer := bytes.NewBuffer(make([]byte, 0, 256))
+	CreateDummyBlock().WriteWithMetadata(buffer)
+	f.Add(buffer.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		block, err := ReadBlock(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		// Every entry of a block that was read successfully must be within bounds.
+		for it := block.Entries(); it.HasNext(); it.Advance() {
+			it.Chunk()
+		}
+	})
+}
+
 func testEntryContents(block *Block, t *testing.T) {
 	// Create a slice to collect test data from the chunks.
 	entries := make([]string, 0, 2)
@@ -144,6 +209,84 @@ func TestHashAttempt(t *testing.T) {
 	}
 }
 
+func TestTargetMatchesDifficulty(t *testing.T) {
+	block := testBlock(t)
+	hardest := make([]byte, 32)
+	for i := range hardest {
+		hardest[i] = 0xff
+	}
+	difficulties := []*b32.Big32{
+		b32.One,
+		b32.FromBig(big.NewInt(2)),
+		b32.FromBig(big.NewInt(3)),
+		b32.FromBig(big.NewInt(256)),
+		b32.FromSlice(hardest),
+		random32(),
+	}
+
+	// Checking against the target gives the same result as checking against the difficulty, and
+	// leaves the hash of the block up to date.
+	for _, difficulty := range difficulties {
+		block.setDifficulty(difficulty)
+		target := CreateTarget(difficulty)
+		for i := 0; i < 200; i++ {
+			block.SetNonce(0, uint64(i))
+			if block.MeetsTarget(target) != block.IsHashValidForDifficulty() {
+				t.Fatalf("target and difficulty %s disagree", difficulty.Hex())
+			}
+			if !block.Hash().Equals(block.ComputeHash()) {
+				t.Fatal("unexpected hash after checking the target")
+			}
+		}
+	}
+
+	// Hashes right at the target do not meet it.
+	target := CreateTarget(b32.FromBig(big.NewInt(2)))
+	hash := [32]byte{0x80}
+	if target.IsMetBy(&hash) {
+		t.Fatal("unexpected hash at the target meeting it")
+	}
+	hash[0] = 0x7f
+	if !target.IsMetBy(&hash) {
+		t.Fatal("expected hash below the target to meet it")
+	}
+}
+
+// Measures how many nonces per second a miner tries for blocks of different lengths, checking
+// hashes against the difficulty as done before targets, and against a target computed once.
+func BenchmarkMining(b *testing.B) {
+	lengths := map[string]int{"small": 16, "large": 60 * 1024}
+	for _, name := range []string{"small", "large"} {
+		block, err := CreateBlock(previousHash, difficulty, CreateChunk(make([]byte, lengths[name])))
+		if err != nil {
+			b.Fatal("could not create block")
+		}
+		b.Run(name+"/difficulty", func(b *testing.B) {
+			benchmarkAttempts(b, block, func(position uint64) bool {
+				block.SetNonce(0, position)
+				return block.IsHashValidForDifficulty()
+			})
+		})
+		b.Run(name+"/target", func(b *testing.B) {
+			target := CreateTarget(block.Difficulty())
+			benchmarkAttempts(b, block, func(position uint64) bool {
+				block.SetNonce(0, position)
+				return block.MeetsTarget(target)
+			})
+		})
+	}
+}
+
+func benchmarkAttempts(b *testing.B, block *Block, attempt func(position uint64) bool) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(block.Buffer())))
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		attempt(uint64(i))
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "hashes/s")
+}
+
 func random32() *b32.Big32 {
 	buff := make([]byte, 32)
 	rand.Read(buff)
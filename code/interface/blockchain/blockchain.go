@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"math/big"
 	"math/rand"
@@ -89,6 +90,22 @@ func (chunk *Chunk) SetNext(next *Chunk) {
 	chunk.next = next
 }
 
+func (chunk *Chunk) Next() *Chunk {
+	return chunk.next
+}
+
+// Get the length that the chunk takes in a block: its data preceded by its length.
+func (chunk *Chunk) EntryLength() uint32 {
+	return 2 + uint32(chunk.Length)
+}
+
+// Get the SHA-256 hash of the data of the chunk, which identifies its content regardless of the
+// block it is stored in.
+func (chunk *Chunk) ContentHash() *b32.Big32 {
+	hash := sha256.Sum256(chunk.Data[:chunk.Length])
+	return b32.FromBytes(&hash)
+}
+
 func CreateBlockFromBuffer(hash *b32.Big32, buffer []byte, bufferLength uint32) *Block {
 	block := &Block{}
 	block.buffer = make([]byte, bufferLength)
@@ -116,9 +133,12 @@ func CreateBlock(previousHash *b32.Big32, difficulty *b32.Big32, entries *Chunk)
 	var count uint8 = 0
 
 	for current := entries; current != nil; current = current.next {
+		// The entry count must fit in a single byte.
+		if int(count) == MaxEntryCount {
+			return nil, errors.New("too many entries")
+		}
 		count++
-		total += uint32(current.Length)
-		total += 2 // Add to bytes per entry to store its length.
+		total += current.EntryLength()
 	}
 
 	// Add the length of the header into the total.
@@ -126,6 +146,11 @@ func CreateBlock(previousHash *b32.Big32, difficulty *b32.Big32, entries *Chunk)
 		total += value
 	}
 
+	// Do not create blocks that would be rejected when read.
+	if total > MaxBlockLength() {
+		return nil, fmt.Errorf("block length %d exceeds the maximum of %d", total, MaxBlockLength())
+	}
+
 	// Create a Block object and proceed to initialize data elements.
 	block := &Block{}
 	block.bufferDirty = true
@@ -187,6 +212,13 @@ func (block *Block) Hash() *b32.Big32 {
 	return b32.FromBytes(&block.hash)
 }
 
+// Computes the hash of the block buffer from scratch, ignoring the cached value. Useful to check
+// that the hash stored along with a block actually matches its content.
+func (block *Block) ComputeHash() *b32.Big32 {
+	hash := sha256.Sum256(block.buffer)
+	return b32.FromBytes(&hash)
+}
+
 func (block *Block) PreviousHash() *b32.Big32 {
 	return block.getBig32("PreviousHash")
 }
@@ -207,12 +239,28 @@ func (block *Block) Nonce() *b32.Big32 {
 	return block.getBig32("Nonce")
 }
 
+// The position of the nonce in the buffer, looked up once since miners set it on every attempt.
+var nonceOffset, nonceLength uint32 = getFieldPositionInfo("Nonce")
+
 func (block *Block) GenerateNonce() {
 	offset, length := getFieldPositionInfo("Nonce")
 	rand.Read(block.buffer[offset : offset+length])
 	block.bufferDirty = true
 }
 
+// Sets the nonce to the given position of the given range. Ranges are identified by the first 8
+// bytes of the nonce and positions by the last 8 bytes, so that miners searching different
+// ranges never try the same nonce.
+func (block *Block) SetNonce(rangeId uint64, position uint64) {
+	nonce := block.buffer[nonceOffset : nonceOffset+nonceLength]
+	binary.BigEndian.PutUint64(nonce[0:8], rangeId)
+	for i := 8; i < 24; i++ {
+		nonce[i] = 0
+	}
+	binary.BigEndian.PutUint64(nonce[24:32], position)
+	block.bufferDirty = true
+}
+
 func (block *Block) EntryCount() uint8 {
 	return block.buffer[headerOffset["EntryCount"]]
 }
@@ -242,48 +290,45 @@ func (block *Block) setTimestamp(timestamp int64) {
 }
 
 // Reads a block from the given reader, assuming that it was previously written through
-// the WriteWithMetadata method.
+// the WriteWithMetadata method. Returns io.EOF if there is nothing to read, and
+// io.ErrUnexpectedEOF if the block is incomplete. Blocks that are too long or whose structure is
+// not valid are rejected with ErrMalformedBlock.
 func ReadBlock(reader io.Reader) (*Block, error) {
 	// Read the length of the buffer.
 	blocklenBuffer := make([]byte, 4)
-	if err := communication.Read(reader, blocklenBuffer); err != nil {
+	if _, err := io.ReadFull(reader, blocklenBuffer); err != nil {
 		return nil, err
 	}
 	blocklen := binary.LittleEndian.Uint32(blocklenBuffer)
+	// Check the length before allocating anything for the block.
+	if blocklen > MaxBlockLength() {
+		return nil, fmt.Errorf("%w: length %d exceeds the maximum of %d", ErrMalformedBlock, blocklen, MaxBlockLength())
+	}
 	// Read the hash of the block.
 	hash := make([]byte, 32)
-	if err := communication.Read(reader, hash); err != nil {
+	if err := readRest(reader, hash); err != nil {
 		return nil, err
 	}
 	// Read the actual block buffer.
 	blockBuffer := make([]byte, blocklen)
-	var err error = communication.Read(reader, blockBuffer)
-	// Check if there is an error and is not an EOF.
-	if err != nil && !errors.Is(err, io.EOF) {
+	if err := readRest(reader, blockBuffer); err != nil {
+		return nil, err
+	}
+	// Ensure that the entries can be safely iterated before handing out the block.
+	if err := validateBuffer(blockBuffer); err != nil {
 		return nil, err
 	}
-	// Instantiate a block from the buffer and return. Return the error as well, which
-	// if EOF will indicate the end of the file.
-	block := CreateBlockFromBuffer(b32.FromSlice(hash), blockBuffer, blocklen)
 
-	/*
-		fmt.Println("DEBUG: RECEIVED BLOCK")
-		fmt.Println(block.buffer)
-		fmt.Println("Hash")
-		fmt.Println(block.Hash().Bytes)
-		fmt.Println("Previous Hash")
-		fmt.Println(block.PreviousHash().Bytes)
-		fmt.Println("Nonce")
-		fmt.Println(block.Nonce().Bytes)
-		fmt.Println("Timestamp")
-		fmt.Println(block.Timestamp())
-		fmt.Println("Entry Count")
-		fmt.Println(block.EntryCount())
-		fmt.Println("Difficulty")
-		fmt.Println(block.Difficulty().Bytes)
-	*/
+	return CreateBlockFromBuffer(b32.FromSlice(hash), blockBuffer, blocklen), nil
+}
 
-	return block, err
+// Reads the rest of a block, which is incomplete if the reader ends.
+func readRest(reader io.Reader, buffer []byte) error {
+	if _, err := io.ReadFull(reader, buffer); errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	} else {
+		return err
+	}
 }
 
 func (block *Block) WriteWithMetadata(writer io.Writer) error {
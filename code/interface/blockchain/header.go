@@ -0,0 +1,68 @@
+package blockchain
+
+import (
+	"io"
+
+	b32 "tp1.aba.distros.fi.uba.ar/common/number/big32"
+)
+
+//=================================================================================================
+// Headers
+//-------------------------------------------------------------------------------------------------
+
+// The length of the header of a block, which holds every field but the entries.
+var HeaderLength uint32 = headerOffset["Data"]
+
+// The header of a block along with its hash, for when its entries are not needed.
+type Header struct {
+	// A block holding just the header, whose entries must not be accessed.
+	block *Block
+}
+
+// Get the header of the block.
+func (block *Block) Header() *Header {
+	return &Header{CreateBlockFromBuffer(block.Hash(), block.buffer, HeaderLength)}
+}
+
+// Reads a header from the given reader, assuming that it was previously written through the
+// Write method.
+func ReadHeader(reader io.Reader) (*Header, error) {
+	buffer := make([]byte, 32+HeaderLength)
+	if _, err := io.ReadFull(reader, buffer); err != nil {
+		return nil, err
+	}
+	return &Header{CreateBlockFromBuffer(b32.FromSlice(buffer[:32]), buffer[32:], HeaderLength)}, nil
+}
+
+// Writes the hash of the block followed by the header.
+func (header *Header) Write(writer io.Writer) error {
+	if err := writeAll(header.block.hash[:], 32, writer); err != nil {
+		return err
+	}
+	return header.block.Write(writer)
+}
+
+func (header *Header) Hash() *b32.Big32 {
+	return header.block.Hash()
+}
+
+func (header *Header) PreviousHash() *b32.Big32 {
+	return header.block.PreviousHash()
+}
+
+func (header *Header) Difficulty() *b32.Big32 {
+	return header.block.Difficulty()
+}
+
+func (header *Header) Nonce() *b32.Big32 {
+	return header.block.Nonce()
+}
+
+func (header *Header) Timestamp() int64 {
+	return header.block.Timestamp()
+}
+
+// The amount of entries in the block.
+func (header *Header) EntryCount() uint8 {
+	return header.block.EntryCount()
+}
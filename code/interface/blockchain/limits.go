@@ -0,0 +1,83 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"tp1.aba.distros.fi.uba.ar/common/config"
+)
+
+//=================================================================================================
+// Limits
+//-------------------------------------------------------------------------------------------------
+
+// Blocks are read from the network and from disk, so their lengths cannot be trusted. Blocks
+// longer than the configured maximum are rejected before allocating any memory for them, and the
+// structure of every block read is validated before handing it out, so that iterating through
+// its entries is always safe.
+
+const defaultMaxBlockLength int = 4 * 1024 * 1024
+const defaultMaxChunkLength int = 65535
+
+// The most entries that a block can hold, since their amount is stored in a single byte.
+const MaxEntryCount int = 255
+
+// Returned when decoding a block whose structure is not valid.
+var ErrMalformedBlock error = errors.New("malformed block")
+
+// The maximum length of a block buffer, header included, taken from configuration.
+func MaxBlockLength() uint32 {
+	length, err := config.GetIntOrDefault("MaxBlockSize", defaultMaxBlockLength)
+	if err != nil || length <= 0 {
+		return uint32(defaultMaxBlockLength)
+	}
+	return uint32(length)
+}
+
+// The maximum length of the data of a chunk, taken from configuration. Never more than what fits
+// in the 2 byte length of an entry.
+func MaxChunkLength() uint16 {
+	length, err := config.GetIntOrDefault("MaxChunkSize", defaultMaxChunkLength)
+	if err != nil || length <= 0 || length > defaultMaxChunkLength {
+		return uint16(defaultMaxChunkLength)
+	}
+	return uint16(length)
+}
+
+// Checks that the buffer holds a complete header followed by exactly as many entries as the
+// header says, none of them longer than allowed, with no bytes left over.
+func validateBuffer(buffer []byte) error {
+	length := uint32(len(buffer))
+	dataOffset := headerOffset["Data"]
+
+	if length > MaxBlockLength() {
+		return fmt.Errorf("%w: length %d exceeds the maximum of %d", ErrMalformedBlock, length, MaxBlockLength())
+	}
+	if length < dataOffset {
+		return fmt.Errorf("%w: length %d is shorter than the header", ErrMalformedBlock, length)
+	}
+
+	maxChunkLength := MaxChunkLength()
+	entryCount := buffer[headerOffset["EntryCount"]]
+	offset := dataOffset
+
+	for entry := uint8(0); entry < entryCount; entry++ {
+		if offset+2 > length {
+			return fmt.Errorf("%w: entry %d is out of bounds", ErrMalformedBlock, entry)
+		}
+		chunkLength := binary.LittleEndian.Uint16(buffer[offset : offset+2])
+		if chunkLength > maxChunkLength {
+			return fmt.Errorf("%w: entry %d is longer than the maximum of %d", ErrMalformedBlock, entry, maxChunkLength)
+		}
+		offset += 2 + uint32(chunkLength)
+		if offset > length {
+			return fmt.Errorf("%w: entry %d is out of bounds", ErrMalformedBlock, entry)
+		}
+	}
+
+	if offset != length {
+		return fmt.Errorf("%w: %d bytes after the last entry", ErrMalformedBlock, length-offset)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/big"
+
+	b32 "tp1.aba.distros.fi.uba.ar/common/number/big32"
+)
+
+//=================================================================================================
+// Mining target
+//-------------------------------------------------------------------------------------------------
+
+// Miners try many nonces for the same block, so the value that its hash must stay below is
+// computed once per block rather than once per attempt, and hashes are compared with it as bytes.
+//
+// The hash of a block covers its whole buffer, and the nonce lies within the first 64 bytes that
+// SHA-256 processes, so no intermediate state can be reused between attempts: every attempt
+// hashes the entries again. Hashing a fixed-size header that commits to the entries instead would
+// change the hash of every block, and with it the validation done by the blockchain server.
+
+// The value that the hash of a block must stay below to meet a difficulty, as a big endian number.
+type Target struct {
+	max [32]byte
+	// Whether every hash meets the difficulty, which happens when its target does not fit in 32
+	// bytes.
+	any bool
+}
+
+// Computes the target for the given difficulty, which is 2^256 divided by the difficulty. Every
+// hash meets a difficulty of zero or one.
+func CreateTarget(difficulty *b32.Big32) *Target {
+	target := &Target{}
+	divisor := difficulty.ToBig()
+	if divisor.Cmp(big.NewInt(1)) <= 0 {
+		target.any = true
+		return target
+	}
+	numerator := new(big.Int).Lsh(big.NewInt(1), 256)
+	new(big.Int).Div(numerator, divisor).FillBytes(target.max[:])
+	return target
+}
+
+// Whether the given hash is below the target.
+func (target *Target) IsMetBy(hash *[32]byte) bool {
+	return target.any || bytes.Compare(hash[:], target.max[:]) < 0
+}
+
+// Hashes the block and tells whether its hash is below the given target, the same as
+// IsHashValidForDifficulty would for the difficulty of the target, but without allocating. The
+// hash is kept, so that Hash does not compute it again.
+func (block *Block) MeetsTarget(target *Target) bool {
+	block.hash = sha256.Sum256(block.buffer)
+	block.bufferDirty = false
+	return target.IsMetBy(&block.hash)
+}
@@ -8,10 +8,11 @@ func Read(reader io.Reader, buffer []byte) error {
 	var err error = nil
 
 	for total < len(buffer) {
-		if current, err = reader.Read(buffer[total:]); err != nil {
+		// Readers may return the last bytes along with an error.
+		current, err = reader.Read(buffer[total:])
+		total += current
+		if err != nil && total < len(buffer) {
 			return err
-		} else {
-			total += current
 		}
 	}
 
@@ -0,0 +1,204 @@
+package message
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"tp1.aba.distros.fi.uba.ar/common/security"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+)
+
+//=================================================================================================
+// Signed request
+//-------------------------------------------------------------------------------------------------
+
+// Wraps a request along with the signature of the client that sent it. Servers that require
+// signed writes answer the wrapped request as usual once the signature is checked, and reject it
+// with an unauthorized error otherwise.
+//
+// Opcode           : 1 byte
+// Client ID length : 1 byte
+// Client ID        : variable
+// Timestamp        : 8 bytes
+// Nonce            : 16 bytes
+// Request length   : 4 bytes
+// Request          : variable, opcode included
+// Signature        : 32 bytes, over everything after the opcode up to the signature
+type SignedRequest struct {
+	message
+	request Message
+}
+
+// Signs the given request with the given credentials.
+func CreateSignedRequest(request Message, credentials *security.Credentials) (*SignedRequest, error) {
+	if len(credentials.ClientId) > 255 {
+		return nil, errors.New("client ID too long")
+	}
+	buffer := bytes.NewBuffer(make([]byte, 0, 64+request.DataLength()))
+	if err := request.Write(buffer); err != nil {
+		return nil, err
+	}
+	encodedRequest := buffer.Bytes()
+
+	nonce := make([]byte, security.NonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, signedRequestLength(len(credentials.ClientId), len(encodedRequest)))
+	data = append(data, uint8(len(credentials.ClientId)))
+	data = append(data, credentials.ClientId...)
+	data = appendUint64(data, uint64(time.Now().UnixNano()))
+	data = append(data, nonce...)
+	data = appendUint32(data, uint32(len(encodedRequest)))
+	data = append(data, encodedRequest...)
+	data = append(data, credentials.Sign(data)...)
+
+	signed := &SignedRequest{}
+	signed.opcode = opcodes["SignedRequest"]
+	signed.datalen = uint64(len(data))
+	signed.data = data
+	signed.request = request
+	return signed, nil
+}
+
+// Signs the request with the credentials in configuration, if any. Otherwise, the request is
+// returned as is.
+func Sign(request Message) (Message, error) {
+	credentials, err := security.ClientCredentials()
+	if err != nil || credentials == nil {
+		return request, err
+	}
+	return CreateSignedRequest(request, credentials)
+}
+
+// Signed requests are read with the handler of the request they wrap, so their own handler is
+// registered once all handlers are.
+func init() {
+	handlers[opcodes["SignedRequest"]] = handleSignedRequest
+}
+
+func handleSignedRequest(opcode uint8, reader io.Reader) (Message, error) {
+	// Read the client ID.
+	clientIdLength := make([]byte, 1)
+	if err := read(reader, clientIdLength); err != nil {
+		return nil, err
+	}
+	clientId := make([]byte, clientIdLength[0])
+	if err := read(reader, clientId); err != nil {
+		return nil, err
+	}
+	// Read the timestamp, the nonce and the length of the request.
+	fields := make([]byte, 8+security.NonceLength+4)
+	if err := read(reader, fields); err != nil {
+		return nil, err
+	}
+	requestLength := binary.LittleEndian.Uint32(fields[8+security.NonceLength:])
+	if requestLength > maxSignedRequestLength() {
+		return nil, fmt.Errorf("%w: signed request exceeds the maximum length of %d", ErrBadRequest, maxSignedRequestLength())
+	}
+	// Read the request and the signature.
+	rest := make([]byte, int(requestLength)+security.SignatureLength)
+	if err := read(reader, rest); err != nil {
+		return nil, err
+	}
+	encodedRequest := rest[:requestLength]
+	if len(encodedRequest) > 0 && encodedRequest[0] == opcodes["SignedRequest"] {
+		return nil, fmt.Errorf("%w: nested signed request", ErrBadRequest)
+	}
+	request, err := ReadMessage(bytes.NewReader(encodedRequest))
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, signedRequestLength(len(clientId), len(encodedRequest)))
+	data = append(data, clientIdLength...)
+	data = append(data, clientId...)
+	data = append(data, fields...)
+	data = append(data, rest...)
+
+	signed := &SignedRequest{}
+	signed.opcode = opcode
+	signed.datalen = uint64(len(data))
+	signed.data = data
+	signed.request = request
+	return signed, nil
+}
+
+// The request that was signed.
+func (r *SignedRequest) Request() Message {
+	return r.request
+}
+
+func (r *SignedRequest) ClientId() string {
+	return string(r.data[1 : 1+r.data[0]])
+}
+
+// The time at which the client signed the request.
+func (r *SignedRequest) Timestamp() time.Time {
+	offset := 1 + int(r.data[0])
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(r.data[offset:offset+8])))
+}
+
+func (r *SignedRequest) nonce() []byte {
+	offset := 1 + int(r.data[0]) + 8
+	return r.data[offset : offset+security.NonceLength]
+}
+
+func (r *SignedRequest) signature() []byte {
+	return r.data[len(r.data)-security.SignatureLength:]
+}
+
+// Checks the signature of the request.
+func (r *SignedRequest) Verify(verifier *security.Verifier) error {
+	content := r.data[:len(r.data)-security.SignatureLength]
+	return verifier.Verify(r.ClientId(), r.Timestamp(), r.nonce(), content, r.signature())
+}
+
+// Get the request to handle from the given message, checking its signature with the given
+// verifier. Requests must be signed unless the verifier is nil; the returned error wraps
+// ErrUnauthorized if they are not, or if their signature is not valid.
+func Authenticate(msg Message, verifier *security.Verifier) (Message, error) {
+	signed, isSigned := msg.(*SignedRequest)
+	if verifier == nil {
+		if isSigned {
+			return signed.Request(), nil
+		}
+		return msg, nil
+	}
+
+	if !isSigned {
+		return nil, fmt.Errorf("%w: request not signed", ErrUnauthorized)
+	}
+	if err := signed.Verify(verifier); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnauthorized, err.Error())
+	}
+	return signed.Request(), nil
+}
+
+// The largest request that can be signed is a block write: the opcode, the length and hash of
+// the block, and the block itself.
+func maxSignedRequestLength() uint32 {
+	return 1 + 4 + 32 + blockchain.MaxBlockLength()
+}
+
+func signedRequestLength(clientIdLength int, requestLength int) int {
+	return 1 + clientIdLength + 8 + security.NonceLength + 4 + requestLength + security.SignatureLength
+}
+
+func appendUint64(buffer []byte, n uint64) []byte {
+	encoded := make([]byte, 8)
+	binary.LittleEndian.PutUint64(encoded, n)
+	return append(buffer, encoded...)
+}
+
+func appendUint32(buffer []byte, n uint32) []byte {
+	encoded := make([]byte, 4)
+	binary.LittleEndian.PutUint32(encoded, n)
+	return append(buffer, encoded...)
+}
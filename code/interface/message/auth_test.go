@@ -0,0 +1,82 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"tp1.aba.distros.fi.uba.ar/common/security"
+)
+
+var testVerifier *security.Verifier = security.CreateVerifier(
+	map[string][]byte{"client": []byte("secret")}, time.Minute)
+
+// Writes the message and reads it back, as servers receive it.
+func roundTrip(t *testing.T, msg Message) Message {
+	buffer := bytes.NewBuffer(make([]byte, 0, 256))
+	if err := msg.Write(buffer); err != nil {
+		t.Fatal(err.Error())
+	}
+	output, err := ReadMessage(buffer)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return output
+}
+
+func TestSignedRequest(t *testing.T) {
+	request := CreateWriteChunk([]byte("some data"), 9)
+	signed, err := CreateSignedRequest(request, security.CreateCredentials("client", "secret"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	output := roundTrip(t, signed)
+	if output.(*SignedRequest).ClientId() != "client" {
+		t.Fatal("unexpected client ID")
+	}
+	authenticated, err := Authenticate(output, testVerifier)
+	if err != nil {
+		t.Fatalf("signed request rejected: %s", err.Error())
+	}
+	if !bytes.Equal(authenticated.(*WriteChunk).ChunkData(), []byte("some data")) {
+		t.Fatal("unexpected request")
+	}
+
+	// The same request cannot be sent twice.
+	if _, err := Authenticate(roundTrip(t, signed), testVerifier); !errors.Is(err, ErrUnauthorized) {
+		t.Fatal("expected a replayed request to be rejected")
+	}
+}
+
+func TestUnauthorizedRequests(t *testing.T) {
+	request := CreateWriteChunk([]byte("some data"), 9)
+
+	// Unsigned requests are only accepted when signatures are not required.
+	if _, err := Authenticate(request, testVerifier); !errors.Is(err, ErrUnauthorized) {
+		t.Fatal("expected an unsigned request to be rejected")
+	}
+	if authenticated, err := Authenticate(request, nil); err != nil || authenticated != request {
+		t.Fatal("expected an unsigned request to be accepted")
+	}
+
+	// Requests signed with the wrong secret are rejected.
+	signed, _ := CreateSignedRequest(request, security.CreateCredentials("client", "guess"))
+	if _, err := Authenticate(roundTrip(t, signed), testVerifier); !errors.Is(err, ErrUnauthorized) {
+		t.Fatal("expected a request with the wrong secret to be rejected")
+	}
+
+	// Tampering with the request breaks the signature.
+	signed, _ = CreateSignedRequest(request, security.CreateCredentials("client", "secret"))
+	signed.data[len(signed.data)-security.SignatureLength-1] ^= 0xff
+	if _, err := Authenticate(roundTrip(t, signed), testVerifier); !errors.Is(err, ErrUnauthorized) {
+		t.Fatal("expected a tampered request to be rejected")
+	}
+
+	// Rejections are sent as error responses that clients turn back into the same error.
+	_, err := Authenticate(request, testVerifier)
+	if !errors.Is(CreateErrorResponseFromError(err).Err(), ErrUnauthorized) {
+		t.Fatal("unexpected error response")
+	}
+}
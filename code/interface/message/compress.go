@@ -0,0 +1,123 @@
+package message
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"tp1.aba.distros.fi.uba.ar/common/config"
+)
+
+//=================================================================================================
+// Compression
+//-------------------------------------------------------------------------------------------------
+
+// Clients may ask for the responses to a request to be compressed by setting a flag in its
+// frames. Servers then compress the payload of the responses that carry blocks with deflate, and
+// flag their frames as compressed; other responses are sent as usual. Servers that do not know
+// about compression ignore the flag, so clients must read both kinds of responses.
+
+// Opcodes of the responses that carry blocks, which are compressed when asked for.
+var compressibleOpcodes map[uint8]bool = map[uint8]bool{
+	opcodes["GetBlockByHashResponse"]:     true,
+	opcodes["GetBlockByHeightResponse"]:   true,
+	opcodes["ReadBlocksInMinuteResponse"]: true,
+	opcodes["ReadBlocksInRangeResponse"]:  true,
+	opcodes["BlockNotification"]:          true,
+}
+
+// Whether clients ask for compressed responses, as configured.
+func compressResponses() bool {
+	compress, _ := config.GetIntOrDefault("CompressResponses", 0)
+	return compress != 0
+}
+
+// The amount of compressed messages and their length before and after compression.
+type CompressionStats struct {
+	Messages        uint64
+	RawBytes        uint64
+	CompressedBytes uint64
+}
+
+// The amount of bytes that compression kept from being transferred, negative if it did not pay
+// off.
+func (stats CompressionStats) SavedBytes() int64 {
+	return int64(stats.RawBytes) - int64(stats.CompressedBytes)
+}
+
+func (stats CompressionStats) String() string {
+	return fmt.Sprintf("%d messages, %d bytes compressed to %d, %d bytes saved",
+		stats.Messages, stats.RawBytes, stats.CompressedBytes, stats.SavedBytes())
+}
+
+// Counters of the compressed messages sent and received by this process.
+var sentCompressed, receivedCompressed CompressionStats
+
+// Get the statistics of the compressed messages sent and received so far.
+func CompressionStatistics() (sent CompressionStats, received CompressionStats) {
+	return loadStats(&sentCompressed), loadStats(&receivedCompressed)
+}
+
+func loadStats(stats *CompressionStats) CompressionStats {
+	return CompressionStats{
+		Messages:        atomic.LoadUint64(&stats.Messages),
+		RawBytes:        atomic.LoadUint64(&stats.RawBytes),
+		CompressedBytes: atomic.LoadUint64(&stats.CompressedBytes),
+	}
+}
+
+//-------------------------------------------------------------------------------------------------
+
+// Counts the bytes written through it.
+type countingWriter struct {
+	writer io.Writer
+	count  *uint64
+}
+
+func (cw *countingWriter) Write(data []byte) (int, error) {
+	written, err := cw.writer.Write(data)
+	atomic.AddUint64(cw.count, uint64(written))
+	return written, err
+}
+
+// Counts the bytes read through it.
+type countingReader struct {
+	reader io.Reader
+	count  *uint64
+}
+
+func (cr *countingReader) Read(buffer []byte) (int, error) {
+	count, err := cr.reader.Read(buffer)
+	atomic.AddUint64(cr.count, uint64(count))
+	return count, err
+}
+
+// Writes the message compressed into the given frames. The opcode goes in the frame header, so
+// only what comes after it is compressed.
+func writeCompressed(msg Message, fw *frameWriter) error {
+	compressor, err := flate.NewWriter(&countingWriter{fw, &sentCompressed.CompressedBytes}, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+
+	raw := &countingWriter{compressor, &sentCompressed.RawBytes}
+	if err := msg.Write(&opcodeSkipper{raw, true}); err != nil {
+		// Send whatever was written before ending the message, as uncompressed messages do.
+		compressor.Flush()
+		fw.Abort()
+		return err
+	}
+	if err := compressor.Close(); err != nil {
+		return err
+	}
+	atomic.AddUint64(&sentCompressed.Messages, 1)
+	return fw.Close()
+}
+
+// Reads the compressed payload of a message.
+func readCompressed(payload io.Reader) io.Reader {
+	atomic.AddUint64(&receivedCompressed.Messages, 1)
+	decompressor := flate.NewReader(&countingReader{payload, &receivedCompressed.CompressedBytes})
+	return &countingReader{decompressor, &receivedCompressed.RawBytes}
+}
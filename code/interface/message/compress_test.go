@@ -0,0 +1,124 @@
+package message
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+
+	b32 "tp1.aba.distros.fi.uba.ar/common/number/big32"
+)
+
+// Creates a block whose entries hold text, which compresses well.
+func createTextBlock(t *testing.T) *blockchain.Block {
+	entries := blockchain.CreateChunk(bytes.Repeat([]byte("some text "), 6000))
+	entries.SetNext(blockchain.CreateChunk(bytes.Repeat([]byte("more text "), 6000)))
+	block, err := blockchain.CreateBlock(b32.One, b32.One, entries)
+	if err != nil {
+		t.Fatalf("could not create block: %s", err.Error())
+	}
+	return block
+}
+
+// Serves block by hash requests with the given block, and any other request with mining info.
+func serveBlock(block *blockchain.Block) func(netConn net.Conn) {
+	return func(netConn net.Conn) {
+		conn, err := Accept(netConn, false)
+		if err != nil {
+			return
+		}
+		conn.Serve(func(request Message, writer ResponseWriter) {
+			switch request.Opcode() {
+			case OpGetBlockWithHash:
+				writer.WriteMessage(CreateGetBlockByHashResponse(block))
+			case OpReadBlocksInRange:
+				sent := 0
+				writer.WriteMessage(CreateReadBlocksInRangeResponse(func() (*blockchain.Block, *RangeCursor, error) {
+					if sent++; sent > 3 {
+						return nil, nil, nil
+					}
+					return block, nil, nil
+				}))
+			default:
+				writer.WriteMessage(CreateGetMiningInfoResponse(b32.One, b32.One, 1))
+			}
+		}, func(task func()) { task() })
+	}
+}
+
+func TestCompressedResponses(t *testing.T) {
+	t.Setenv("CompressResponses", "1")
+	block := createTextBlock(t)
+	client, err := CreateClient(pipe(t, serveBlock(block)))
+	if err != nil {
+		t.Fatalf("could not start client: %s", err.Error())
+	}
+	defer client.Close()
+
+	// Blocks are compressed, which is transparent to the client.
+	_, before := CompressionStatistics()
+	response, err := client.Request(CreateGetBlockByHashRequest(block.Hash()))
+	if err != nil {
+		t.Fatalf("request failed: %s", err.Error())
+	}
+	if !bytes.Equal(response.(*GetBlockByHashResponse).Block().BufferWithMetadata(), block.BufferWithMetadata()) {
+		t.Fatal("unexpected block")
+	}
+	_, after := CompressionStatistics()
+	if after.Messages != before.Messages+1 {
+		t.Fatal("expected the response to be compressed")
+	}
+	saved := after.SavedBytes() - before.SavedBytes()
+	if saved < int64(block.LengthWithMetadata())/2 {
+		t.Fatalf("expected compression to save at least half of the block, saved %d bytes", saved)
+	}
+
+	// Streamed responses are compressed as a whole.
+	count := 0
+	err = client.Stream(CreateReadBlocksInRange(0, 60, 0, nil), func(msg Message) error {
+		r := msg.(*ReadBlocksInRangeResponse)
+		for received, err := r.Next(); received != nil || err != nil; received, err = r.Next() {
+			if err != nil {
+				return err
+			}
+			if !received.Hash().Equals(block.Hash()) {
+				t.Fatal("unexpected block in range")
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil || count != 3 {
+		t.Fatalf("unexpected range response with %d blocks: %v", count, err)
+	}
+
+	// Responses that do not carry blocks are sent as usual.
+	_, before = CompressionStatistics()
+	if _, err := client.Request(CreateGetMiningInfoRequest()); err != nil {
+		t.Fatalf("request failed: %s", err.Error())
+	}
+	if _, after = CompressionStatistics(); after.Messages != before.Messages {
+		t.Fatal("unexpected compressed response")
+	}
+}
+
+func TestUncompressedResponses(t *testing.T) {
+	t.Setenv("CompressResponses", "0")
+	block := createTextBlock(t)
+	client, err := CreateClient(pipe(t, serveBlock(block)))
+	if err != nil {
+		t.Fatalf("could not start client: %s", err.Error())
+	}
+	defer client.Close()
+
+	// Clients that do not ask for compression get blocks as usual.
+	_, before := CompressionStatistics()
+	response, err := client.Request(CreateGetBlockByHashRequest(block.Hash()))
+	if err != nil || !response.(*GetBlockByHashResponse).Block().Hash().Equals(block.Hash()) {
+		t.Fatal("unexpected response")
+	}
+	if _, after := CompressionStatistics(); after.Messages != before.Messages {
+		t.Fatal("unexpected compressed response")
+	}
+}
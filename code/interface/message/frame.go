@@ -0,0 +1,463 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+//=================================================================================================
+// Framing
+//-------------------------------------------------------------------------------------------------
+
+// Messages are sent inside frames, each one starting with a header:
+//
+// Magic          : 2 bytes
+// Version        : 1 byte
+// Flags          : 1 byte
+// Opcode         : 1 byte
+// Request ID     : 4 bytes
+// Payload length : 4 bytes
+//
+// The payload holds everything that comes after the opcode in the message, compressed if the
+// compressed flag is set. Messages longer than
+// the maximum payload length, and messages streamed without knowing their length in advance, are
+// split into several consecutive frames with the same opcode and request ID; all but the last one
+// have the continuation flag set. Since the length of every frame is known, a message that does
+// not consume its whole payload does not desynchronize the connection. A message that cannot be
+// written completely, for instance because the blocks it streams cannot be read, ends with a frame
+// that has the aborted flag set instead, so that the reader gets an error once it gets there.
+//
+// Responses carry the ID of the request they answer. Before sending any message, the client
+// sends a hello frame with the range of protocol versions it supports, and the server answers
+// with the version to use from then on.
+//
+// Peers built before framing was introduced send bare messages, which start with their opcode.
+// No opcode matches the first magic byte, so servers can detect them and either serve them in
+// compatibility mode or reject them.
+
+const ProtocolVersion uint8 = 1
+const MinProtocolVersion uint8 = 1
+
+var frameMagic []byte = []byte{0x42, 0x43}
+
+const frameHeaderLength int = 13
+const maxFramePayloadLength int = 64 * 1024
+
+const frameFlagContinued uint8 = 0x01
+const frameFlagAcceptsCompression uint8 = 0x02
+const frameFlagCompressed uint8 = 0x04
+const frameFlagAborted uint8 = 0x08
+
+// Returned when the peer does not speak a compatible version of the protocol.
+var ErrUnsupportedProtocol error = errors.New("unsupported protocol")
+
+// Returned when reading a message that the peer could not finish writing.
+var ErrMessageAborted error = errors.New("message aborted by the peer")
+
+type frameHeader struct {
+	version   uint8
+	flags     uint8
+	opcode    uint8
+	requestId uint32
+	length    uint32
+}
+
+func (header *frameHeader) encode() []byte {
+	buffer := make([]byte, frameHeaderLength)
+	copy(buffer[0:2], frameMagic)
+	buffer[2] = header.version
+	buffer[3] = header.flags
+	buffer[4] = header.opcode
+	binary.LittleEndian.PutUint32(buffer[5:9], header.requestId)
+	binary.LittleEndian.PutUint32(buffer[9:13], header.length)
+	return buffer
+}
+
+func readFrameHeader(reader io.Reader) (*frameHeader, error) {
+	buffer := make([]byte, frameHeaderLength)
+	if err := read(reader, buffer); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(buffer[0:2], frameMagic) {
+		return nil, fmt.Errorf("%w: unexpected frame magic", ErrBadRequest)
+	}
+
+	header := &frameHeader{}
+	header.version = buffer[2]
+	header.flags = buffer[3]
+	header.opcode = buffer[4]
+	header.requestId = binary.LittleEndian.Uint32(buffer[5:9])
+	header.length = binary.LittleEndian.Uint32(buffer[9:13])
+
+	if header.length > uint32(maxFramePayloadLength) {
+		return nil, fmt.Errorf("%w: frame payload of %d bytes is too long", ErrBadRequest, header.length)
+	}
+	return header, nil
+}
+
+//-------------------------------------------------------------------------------------------------
+
+// Splits everything written to it into frames. Frames are only sent once full, or when closed.
+type frameWriter struct {
+	writer  io.Writer
+	version uint8
+	// Flags set in every frame.
+	flags     uint8
+	opcode    uint8
+	requestId uint32
+	buffer    []byte
+}
+
+func (fw *frameWriter) Write(data []byte) (int, error) {
+	written := len(data)
+	for len(data) > 0 {
+		free := maxFramePayloadLength - len(fw.buffer)
+		if free > len(data) {
+			free = len(data)
+		}
+		fw.buffer = append(fw.buffer, data[:free]...)
+		data = data[free:]
+
+		// Only send full frames here, since there may be more to come.
+		if len(fw.buffer) == maxFramePayloadLength {
+			if err := fw.flush(frameFlagContinued); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// Sends the last frame of the message.
+func (fw *frameWriter) Close() error {
+	return fw.flush(0)
+}
+
+// Ends a message that could not be written completely, sending what is left of it in a last frame
+// flagged as aborted.
+func (fw *frameWriter) Abort() error {
+	return fw.flush(frameFlagAborted)
+}
+
+func (fw *frameWriter) flush(flags uint8) error {
+	header := &frameHeader{fw.version, fw.flags | flags, fw.opcode, fw.requestId, uint32(len(fw.buffer))}
+	frame := append(header.encode(), fw.buffer...)
+	fw.buffer = fw.buffer[:0]
+	return writeAll(fw.writer, frame)
+}
+
+// Messages write their opcode first, but it goes in the frame header instead. Drops the first
+// byte written through it.
+type opcodeSkipper struct {
+	writer     io.Writer
+	skipOpcode bool
+}
+
+func (skipper *opcodeSkipper) Write(data []byte) (int, error) {
+	written := len(data)
+	if skipper.skipOpcode && len(data) > 0 {
+		skipper.skipOpcode = false
+		data = data[1:]
+	}
+	if _, err := skipper.writer.Write(data); err != nil {
+		return 0, err
+	}
+	return written, nil
+}
+
+//-------------------------------------------------------------------------------------------------
+
+// Reads the payload of a message, going through its frames as needed. Reading past the end of
+// the payload of the last frame returns io.ErrUnexpectedEOF instead of reading the next message,
+// or ErrMessageAborted if the peer could not finish writing it.
+type payloadReader struct {
+	reader    io.Reader
+	header    *frameHeader
+	remaining uint32
+}
+
+func (pr *payloadReader) Read(buffer []byte) (int, error) {
+	for pr.remaining == 0 {
+		if pr.header.flags&frameFlagAborted != 0 {
+			return 0, ErrMessageAborted
+		}
+		if pr.header.flags&frameFlagContinued == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		next, err := readFrameHeader(pr.reader)
+		if err != nil {
+			return 0, err
+		}
+		if next.opcode != pr.header.opcode || next.requestId != pr.header.requestId {
+			return 0, fmt.Errorf("%w: unexpected frame in the middle of a message", ErrBadRequest)
+		}
+		pr.header = next
+		pr.remaining = next.length
+	}
+
+	if uint32(len(buffer)) > pr.remaining {
+		buffer = buffer[:pr.remaining]
+	}
+	count, err := pr.reader.Read(buffer)
+	pr.remaining -= uint32(count)
+	return count, err
+}
+
+// Skips whatever part of the payload was not read.
+func (pr *payloadReader) drain() error {
+	for {
+		if pr.remaining > 0 {
+			if _, err := io.CopyN(io.Discard, pr.reader, int64(pr.remaining)); err != nil {
+				return err
+			}
+			pr.remaining = 0
+		}
+		if pr.header.flags&frameFlagContinued == 0 {
+			return nil
+		}
+		if _, err := pr.Read(nil); err != nil {
+			return err
+		}
+	}
+}
+
+//=================================================================================================
+// Connections
+//-------------------------------------------------------------------------------------------------
+
+// A connection through which framed messages are exchanged, or bare messages in compatibility
+// mode. Clients send requests and read their responses; servers read requests and respond to
+// the request last read. Reads must not happen concurrently, but writes may.
+type Conn struct {
+	reader  *bufio.Reader
+	writer  io.Writer
+	version uint8
+	legacy  bool
+	// The ID of the request last sent, for clients, or last read, for servers.
+	requestId uint32
+	server    bool
+	// The payload of the message last read, which may not have been completely consumed, and the
+	// flags of its first frame.
+	pending      *payloadReader
+	pendingFlags uint8
+	// Messages are written whole, so that their frames are not interleaved.
+	writeLock sync.Mutex
+	// Closed once the server stops reading requests.
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// Starts a connection as a client, agreeing on a protocol version with the server.
+func Handshake(rw io.ReadWriter) (*Conn, error) {
+	conn := &Conn{}
+	conn.reader = bufio.NewReader(rw)
+	conn.writer = rw
+	conn.version = ProtocolVersion
+	conn.done = make(chan struct{})
+
+	if err := conn.WriteMessage(CreateHello(MinProtocolVersion, ProtocolVersion)); err != nil {
+		return nil, err
+	}
+
+	// Servers that do not know about frames either close the connection or answer with a bare
+	// error message.
+	first, err := conn.reader.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("%w: connection closed during the handshake, the server may not support framing",
+			ErrUnsupportedProtocol)
+	}
+	if first[0] != frameMagic[0] {
+		if response, err := ReadMessage(conn.reader); err == nil && response.Opcode() == OpErrorResponse {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedProtocol, response.(*ErrorResponse).Reason())
+		}
+		return nil, fmt.Errorf("%w: the server does not support framing", ErrUnsupportedProtocol)
+	}
+
+	response, err := conn.ReadResponse()
+	if err != nil {
+		return nil, err
+	}
+	hello, ok := response.(*HelloResponse)
+	if !ok {
+		return nil, fmt.Errorf("%w: unexpected handshake response", ErrUnsupportedProtocol)
+	}
+	if hello.Version() < MinProtocolVersion || hello.Version() > ProtocolVersion {
+		return nil, fmt.Errorf("%w: the server chose version %d", ErrUnsupportedProtocol, hello.Version())
+	}
+
+	conn.version = hello.Version()
+	return conn, nil
+}
+
+// Starts a connection as a server, agreeing on a protocol version with the client. Clients that
+// send bare messages are served in compatibility mode if allowed, or sent a bare error response.
+func Accept(rw io.ReadWriter, allowLegacy bool) (*Conn, error) {
+	conn := &Conn{}
+	conn.reader = bufio.NewReader(rw)
+	conn.writer = rw
+	conn.version = ProtocolVersion
+	conn.done = make(chan struct{})
+	conn.server = true
+
+	first, err := conn.reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] != frameMagic[0] {
+		if _, known := handlers[first[0]]; !known {
+			return nil, fmt.Errorf("%w: unexpected first byte %d", ErrBadRequest, first[0])
+		}
+		if !allowLegacy {
+			reason := "unframed messages are no longer supported, upgrade the client"
+			CreateErrorResponse(ErrorCodeBadRequest, reason).Write(rw)
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedProtocol, reason)
+		}
+		conn.legacy = true
+		return conn, nil
+	}
+
+	// Read the hello message and choose the highest version supported by both sides.
+	request, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	hello, ok := request.(*Hello)
+	if !ok {
+		reason := "expected a hello message"
+		conn.WriteMessage(CreateErrorResponse(ErrorCodeBadRequest, reason))
+		return nil, fmt.Errorf("%w: %s", ErrBadRequest, reason)
+	}
+
+	version := hello.MaxVersion()
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	if version < hello.MinVersion() || version < MinProtocolVersion {
+		reason := fmt.Sprintf("no common protocol version, versions %d to %d are supported",
+			MinProtocolVersion, ProtocolVersion)
+		conn.WriteMessage(CreateErrorResponse(ErrorCodeBadRequest, reason))
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedProtocol, reason)
+	}
+
+	conn.version = version
+	if err := conn.WriteMessage(CreateHelloResponse(version)); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Closed once the client hangs up, for servers.
+func (conn *Conn) Done() <-chan struct{} {
+	return conn.done
+}
+
+func (conn *Conn) hangUp() {
+	conn.doneOnce.Do(func() { close(conn.done) })
+}
+
+// Whether the peer sends bare messages.
+func (conn *Conn) Legacy() bool {
+	return conn.legacy
+}
+
+// Sends a message. Clients send it as a new request, and servers as the response to the request
+// last read.
+func (conn *Conn) WriteMessage(msg Message) error {
+	if !conn.server {
+		conn.requestId++
+	}
+	return conn.writeMessage(msg, conn.requestId, 0)
+}
+
+// Sends a message with the given request ID, setting the given flags in its frames. The payload
+// is compressed if the compressed flag is set.
+func (conn *Conn) writeMessage(msg Message, requestId uint32, flags uint8) error {
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+
+	if conn.legacy {
+		return msg.Write(conn.writer)
+	}
+
+	fw := &frameWriter{conn.writer, conn.version, flags, msg.Opcode(), requestId, nil}
+	if flags&frameFlagCompressed != 0 {
+		return writeCompressed(msg, fw)
+	}
+	if err := msg.Write(&opcodeSkipper{fw, true}); err != nil {
+		// Some frames may have been sent already, so the message must still be ended.
+		fw.Abort()
+		return err
+	}
+	return fw.Close()
+}
+
+// Reads the next message. Whatever part of the previous message was not consumed is skipped.
+func (conn *Conn) ReadMessage() (Message, error) {
+	if conn.legacy {
+		return ReadMessage(conn.reader)
+	}
+
+	msg, requestId, err := conn.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	if conn.server {
+		conn.requestId = requestId
+	} else if requestId != conn.requestId {
+		return nil, fmt.Errorf("%w: response to unexpected request %d", ErrBadRequest, requestId)
+	}
+	return msg, nil
+}
+
+// Reads the next framed message along with its request ID.
+func (conn *Conn) readMessage() (Message, uint32, error) {
+	if conn.pending != nil {
+		if err := conn.pending.drain(); err != nil {
+			return nil, 0, err
+		}
+		conn.pending = nil
+	}
+
+	header, err := readFrameHeader(conn.reader)
+	if err != nil {
+		return nil, 0, err
+	}
+	if header.version != conn.version {
+		return nil, 0, fmt.Errorf("%w: unexpected protocol version %d", ErrUnsupportedProtocol, header.version)
+	}
+
+	payload := &payloadReader{conn.reader, header, header.length}
+	conn.pending = payload
+	conn.pendingFlags = header.flags
+
+	var reader io.Reader = payload
+	if header.flags&frameFlagCompressed != 0 {
+		reader = readCompressed(payload)
+	}
+
+	if handler, ok := handlers[header.opcode]; ok {
+		msg, err := handler(header.opcode, reader)
+		return msg, header.requestId, err
+	} else {
+		return nil, header.requestId, fmt.Errorf("%w: unexpected opcode %d", ErrBadRequest, header.opcode)
+	}
+}
+
+// Reads a response, turning error responses into errors.
+func (conn *Conn) ReadResponse() (Message, error) {
+	response, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if errorResponse, ok := response.(*ErrorResponse); ok {
+		return nil, errorResponse.Err()
+	}
+	return response, nil
+}
@@ -0,0 +1,331 @@
+package message
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+)
+
+// Runs the given server function on a loopback connection, and returns the client end. Unlike
+// net.Pipe, connections are buffered, so peers can write without waiting for the other end.
+func pipe(t *testing.T, serve func(conn net.Conn)) net.Conn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err.Error())
+	}
+	go func() {
+		defer listener.Close()
+		if server, err := listener.Accept(); err == nil {
+			defer server.Close()
+			serve(server)
+		}
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect: %s", err.Error())
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestFramedRequests(t *testing.T) {
+	block := blockchain.CreateDummyBlock()
+	client := pipe(t, func(netConn net.Conn) {
+		conn, err := Accept(netConn, false)
+		if err != nil {
+			return
+		}
+		// Answer requests until the client hangs up.
+		for {
+			msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if msg.Opcode() != OpGetBlockByHeight {
+				conn.WriteMessage(CreateErrorResponse(ErrorCodeBadRequest, "unexpected opcode"))
+				continue
+			}
+			conn.WriteMessage(CreateGetBlockByHeightResponse(block))
+		}
+	})
+
+	conn, err := Handshake(client)
+	if err != nil {
+		t.Fatalf("handshake failed: %s", err.Error())
+	}
+	if conn.Legacy() {
+		t.Fatal("framed connection in compatibility mode")
+	}
+
+	// Several requests can be sent through the same connection.
+	for i := 0; i < 3; i++ {
+		if err := conn.WriteMessage(CreateGetBlockByHeightRequest(int64(i))); err != nil {
+			t.Fatalf("could not send request %d: %s", i, err.Error())
+		}
+		response, err := conn.ReadResponse()
+		if err != nil {
+			t.Fatalf("could not read response %d: %s", i, err.Error())
+		}
+		if read := response.(*GetBlockByHeightResponse).Block(); !read.Hash().Equals(block.Hash()) {
+			t.Fatalf("unexpected block in response %d", i)
+		}
+	}
+
+	// Error responses are turned into errors.
+	conn.WriteMessage(CreateGetMiningInfoRequest())
+	if _, err := conn.ReadResponse(); !errors.Is(err, ErrBadRequest) {
+		t.Fatal("expected an error response")
+	}
+}
+
+func TestStreamSpanningFrames(t *testing.T) {
+	// Enough blocks not to fit in a single frame.
+	block := blockchain.CreateDummyBlock()
+	count := 2*maxFramePayloadLength/int(block.LengthWithMetadata()) + 1
+
+	client := pipe(t, func(netConn net.Conn) {
+		conn, err := Accept(netConn, false)
+		if err != nil {
+			return
+		}
+		for {
+			if _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+			produced := 0
+			conn.WriteMessage(CreateReadBlocksInRangeResponse(func() (*blockchain.Block, *RangeCursor, error) {
+				if produced < count {
+					produced++
+					return block, nil, nil
+				}
+				return nil, &RangeCursor{60, 1}, nil
+			}))
+		}
+	})
+
+	conn, err := Handshake(client)
+	if err != nil {
+		t.Fatalf("handshake failed: %s", err.Error())
+	}
+
+	// Read the whole response.
+	conn.WriteMessage(CreateReadBlocksInRange(0, 60, 0, nil))
+	response, err := conn.ReadResponse()
+	if err != nil {
+		t.Fatalf("could not read response: %s", err.Error())
+	}
+	read := 0
+	for {
+		next, err := response.(*ReadBlocksInRangeResponse).Next()
+		if err != nil {
+			t.Fatalf("could not read block %d: %s", read, err.Error())
+		}
+		if next == nil {
+			break
+		}
+		read++
+	}
+	if read != count {
+		t.Fatalf("unexpected block count: %d", read)
+	}
+	if cursor := response.(*ReadBlocksInRangeResponse).Cursor(); cursor == nil || cursor.Skip != 1 {
+		t.Fatal("unexpected cursor")
+	}
+
+	// Only read the first block of the next response. The rest must be skipped when reading the
+	// one after it.
+	for i := 0; i < 2; i++ {
+		conn.WriteMessage(CreateReadBlocksInRange(0, 60, 0, nil))
+		response, err := conn.ReadResponse()
+		if err != nil {
+			t.Fatalf("could not read response %d: %s", i, err.Error())
+		}
+		if next, err := response.(*ReadBlocksInRangeResponse).Next(); err != nil || next == nil {
+			t.Fatalf("could not read the first block of response %d", i)
+		}
+	}
+}
+
+// A message that fails after writing the first bytes of another one, as a streamed response
+// whose blocks cannot all be read would.
+type truncatedMessage struct {
+	Message
+	length int
+}
+
+func (msg *truncatedMessage) Write(writer io.Writer) error {
+	buffer := &bytes.Buffer{}
+	msg.Message.Write(buffer)
+	if err := writeAll(writer, buffer.Bytes()[:msg.length]); err != nil {
+		return err
+	}
+	return errors.New("could not produce the rest of the message")
+}
+
+func TestAbortedStream(t *testing.T) {
+	// Enough blocks not to fit in a single frame, cut in the middle.
+	block := blockchain.CreateDummyBlock()
+	count := 2*maxFramePayloadLength/int(block.LengthWithMetadata()) + 1
+	length := 1 + count*(1+int(block.LengthWithMetadata()))/2
+
+	for _, compress := range []bool{false, true} {
+		client, err := CreateClient(pipe(t, func(netConn net.Conn) {
+			conn, err := Accept(netConn, false)
+			if err != nil {
+				return
+			}
+			conn.Serve(func(request Message, writer ResponseWriter) {
+				if request.Opcode() != OpReadBlocksInRange {
+					writer.WriteMessage(CreateGetBlockByHeightResponse(block))
+					return
+				}
+				produced := 0
+				writer.WriteMessage(&truncatedMessage{CreateReadBlocksInRangeResponse(
+					func() (*blockchain.Block, *RangeCursor, error) {
+						if produced < count {
+							produced++
+							return block, nil, nil
+						}
+						return nil, nil, nil
+					}), length})
+			}, func(task func()) {
+				task()
+			})
+		}))
+		if err != nil {
+			t.Fatalf("could not start client: %s", err.Error())
+		}
+		defer client.Close()
+		client.compress = compress
+
+		// The blocks sent before the failure are read, and then reading fails.
+		read := 0
+		err = client.Stream(CreateReadBlocksInRange(0, 60, 0, nil), func(response Message) error {
+			for {
+				next, err := response.(*ReadBlocksInRangeResponse).Next()
+				if err != nil || next == nil {
+					return err
+				}
+				read++
+			}
+		})
+		if !errors.Is(err, ErrMessageAborted) {
+			t.Fatalf("expected the stream to be aborted, got %v", err)
+		}
+		if read == 0 || read >= count {
+			t.Fatalf("unexpected block count: %d", read)
+		}
+
+		// The connection can still be used for other requests.
+		if client.Broken() {
+			t.Fatal("the connection was given up on")
+		}
+		response, err := client.Request(CreateGetBlockByHeightRequest(1))
+		if err != nil {
+			t.Fatalf("could not send a request after the aborted one: %s", err.Error())
+		}
+		if !response.(*GetBlockByHeightResponse).Block().Hash().Equals(block.Hash()) {
+			t.Fatal("unexpected response after the aborted one")
+		}
+	}
+}
+
+func TestLegacyClients(t *testing.T) {
+	block := blockchain.CreateDummyBlock()
+	serve := func(allowLegacy bool) func(net.Conn) {
+		return func(netConn net.Conn) {
+			conn, err := Accept(netConn, allowLegacy)
+			if err != nil {
+				return
+			}
+			if !conn.Legacy() {
+				return
+			}
+			if _, err := conn.ReadMessage(); err == nil {
+				conn.WriteMessage(CreateGetBlockByHeightResponse(block))
+			}
+		}
+	}
+
+	// Clients that send bare messages are served in compatibility mode.
+	client := pipe(t, serve(true))
+	if err := CreateGetBlockByHeightRequest(1).Write(client); err != nil {
+		t.Fatalf("could not send request: %s", err.Error())
+	}
+	if response, err := ReadResponse(client); err != nil {
+		t.Fatalf("could not read response: %s", err.Error())
+	} else if !response.(*GetBlockByHeightResponse).Block().Hash().Equals(block.Hash()) {
+		t.Fatal("unexpected block in response")
+	}
+
+	// Or sent a bare error response if not allowed.
+	client = pipe(t, serve(false))
+	if err := CreateGetBlockByHeightRequest(1).Write(client); err != nil {
+		t.Fatalf("could not send request: %s", err.Error())
+	}
+	if _, err := ReadResponse(client); !errors.Is(err, ErrBadRequest) {
+		t.Fatal("expected the legacy client to be rejected")
+	}
+}
+
+func TestHandshakeWithLegacyServer(t *testing.T) {
+	// Servers that do not know about frames fail to read the hello message.
+	client := pipe(t, func(conn net.Conn) {
+		if _, err := ReadMessage(conn); err != nil {
+			CreateErrorResponse(ErrorCodeBadRequest, err.Error()).Write(conn)
+		}
+	})
+
+	if _, err := Handshake(client); !errors.Is(err, ErrUnsupportedProtocol) {
+		t.Fatal("expected the handshake to fail")
+	}
+}
+
+func TestHandshakeWithoutCommonVersion(t *testing.T) {
+	client := pipe(t, func(conn net.Conn) {
+		Accept(conn, false)
+	})
+
+	// Claim to only support future versions.
+	conn := &Conn{}
+	conn.writer = client
+	conn.version = ProtocolVersion
+	if err := conn.WriteMessage(CreateHello(ProtocolVersion+1, ProtocolVersion+2)); err != nil {
+		t.Fatalf("could not send hello: %s", err.Error())
+	}
+
+	conn.reader = bufio.NewReader(client)
+	if _, err := conn.ReadResponse(); !errors.Is(err, ErrBadRequest) {
+		t.Fatal("expected the handshake to be rejected")
+	}
+}
+
+func TestMalformedFrames(t *testing.T) {
+	// Frames longer than allowed are rejected before reading their payload.
+	header := &frameHeader{ProtocolVersion, 0, OpGetMiningInfo, 1, uint32(maxFramePayloadLength + 1)}
+	if _, err := readFrameHeader(bytes.NewReader(header.encode())); !errors.Is(err, ErrBadRequest) {
+		t.Fatal("expected a frame that is too long to be rejected")
+	}
+
+	// Handlers cannot read past the end of the payload.
+	header = &frameHeader{ProtocolVersion, 0, OpGetBlockByHeight, 1, 4}
+	conn := &Conn{}
+	conn.reader = bufio.NewReader(bytes.NewReader(append(header.encode(), 1, 2, 3, 4, 5, 6, 7, 8)))
+	conn.version = ProtocolVersion
+	conn.server = true
+	if _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("expected a truncated payload to fail")
+	}
+	// Compressed payloads that cannot be decompressed fail to be read.
+	header = &frameHeader{ProtocolVersion, frameFlagCompressed, opcodes["GetBlockByHashResponse"], 1, 8}
+	conn.reader = bufio.NewReader(bytes.NewReader(append(header.encode(), 0xff, 2, 3, 4, 5, 6, 7, 8)))
+	if _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("expected a malformed compressed payload to fail")
+	}
+}
@@ -0,0 +1,324 @@
+package message
+
+import (
+	"bytes"
+	"testing"
+
+	b32 "tp1.aba.distros.fi.uba.ar/common/number/big32"
+	"tp1.aba.distros.fi.uba.ar/common/security"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+)
+
+// Every handler is fuzzed with whatever may follow its opcode. Handlers must never panic, and the
+// messages they return must be safe to inspect and to write back.
+
+// Fuzzes the handler of the given opcode, seeded with the given messages without their opcode.
+// Messages decoded without errors are passed to the given function to exercise their accessors.
+func fuzzHandler(f *testing.F, opcode uint8, seeds []Message, inspect func(msg Message)) {
+	for _, seed := range seeds {
+		buffer := bytes.NewBuffer(make([]byte, 0, 256))
+		if err := seed.Write(buffer); err != nil {
+			f.Fatalf("could not write seed: %s", err.Error())
+		}
+		f.Add(buffer.Bytes()[1:])
+	}
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := handlers[opcode](opcode, bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if inspect != nil {
+			inspect(msg)
+		}
+		// Streamed responses are consumed while inspecting them, so they cannot be written back.
+		if _, streamed := msg.(*ReadBlocksInRangeResponse); streamed {
+			return
+		}
+		if err := msg.Write(&bytes.Buffer{}); err != nil {
+			t.Fatalf("could not write decoded message: %s", err.Error())
+		}
+	})
+}
+
+// Walks through all entries of the block.
+func inspectBlock(block *blockchain.Block) {
+	if block == nil {
+		return
+	}
+	block.Hash()
+	for it := block.Entries(); it.HasNext(); it.Advance() {
+		it.Chunk().ContentHash()
+	}
+}
+
+func fuzzBlock() *blockchain.Block {
+	chunk := blockchain.CreateChunk([]byte("some data"))
+	chunk.SetNext(blockchain.CreateChunk([]byte("more data")))
+	block, _ := blockchain.CreateBlock(b32.One, b32.One, chunk)
+	return block
+}
+
+func FuzzGetMiningInfo(f *testing.F) {
+	fuzzHandler(f, opcodes["GetMiningInfo"], []Message{CreateGetMiningInfoRequest()}, nil)
+}
+
+func FuzzGetMiningInfoResponse(f *testing.F) {
+	seeds := []Message{CreateGetMiningInfoResponse(b32.One, b32.One, 10)}
+	fuzzHandler(f, opcodes["GetMiningInfoResponse"], seeds, func(msg Message) {
+		response := msg.(*GetMiningInfoResponse)
+		response.PreviousHash()
+		response.Difficulty()
+		response.Height()
+	})
+}
+
+func FuzzGetBlockByHash(f *testing.F) {
+	seeds := []Message{CreateGetBlockByHashRequest(b32.One)}
+	fuzzHandler(f, opcodes["GetBlockByHash"], seeds, func(msg Message) {
+		msg.(*GetBlockByHashRequest).Hash()
+	})
+}
+
+func FuzzGetBlockByHashResponse(f *testing.F) {
+	seeds := []Message{CreateGetBlockByHashResponse(fuzzBlock()), CreateGetBlockByHashResponse(nil)}
+	fuzzHandler(f, opcodes["GetBlockByHashResponse"], seeds, func(msg Message) {
+		inspectBlock(msg.(*GetBlockByHashResponse).Block())
+	})
+}
+
+func FuzzReadBlocksInMinute(f *testing.F) {
+	seeds := []Message{CreateReadBlocksInMinute(60)}
+	fuzzHandler(f, opcodes["ReadBlocksInMinute"], seeds, func(msg Message) {
+		msg.(*ReadBlocksInMinuteRequest).Timestamp()
+	})
+}
+
+func FuzzReadBlocksInMinuteResponse(f *testing.F) {
+	response, _ := CreateReadBlocksInMinuteResponse(60, []*blockchain.Block{fuzzBlock(), fuzzBlock()})
+	fuzzHandler(f, opcodes["ReadBlocksInMinuteResponse"], []Message{response}, func(msg Message) {
+		for _, block := range msg.(*ReadBlocksInMinuteResponse).Blocks() {
+			inspectBlock(block)
+		}
+	})
+}
+
+func FuzzWriteBlock(f *testing.F) {
+	seeds := []Message{CreateWriteBlock(fuzzBlock())}
+	fuzzHandler(f, opcodes["WriteBlock"], seeds, func(msg Message) {
+		inspectBlock(msg.(*WriteBlock).Block())
+	})
+}
+
+func FuzzWriteBlockResponse(f *testing.F) {
+	seeds := []Message{CreateWriteBlockResponse(true, b32.One, b32.One)}
+	fuzzHandler(f, opcodes["WriteBlockResponse"], seeds, func(msg Message) {
+		response := msg.(*WriteBlockResponse)
+		response.Ok()
+		response.NewPreviousHash()
+		response.NewDifficulty()
+	})
+}
+
+func FuzzWriteChunk(f *testing.F) {
+	seeds := []Message{CreateWriteChunk([]byte("some data"), 9)}
+	fuzzHandler(f, opcodes["WriteChunk"], seeds, func(msg Message) {
+		msg.(*WriteChunk).ChunkData()
+	})
+}
+
+func FuzzWriteChunkResponse(f *testing.F) {
+	seeds := []Message{CreateWriteChunkResponse(true)}
+	fuzzHandler(f, opcodes["WriteChunkResponse"], seeds, func(msg Message) {
+		msg.(*WriteChunkResponse).Accepted()
+	})
+}
+
+func FuzzGetMiningStatistics(f *testing.F) {
+	fuzzHandler(f, opcodes["GetMiningStatistics"], []Message{CreateGetMiningStatistics()}, nil)
+}
+
+func FuzzGetMiningStatisticsResponse(f *testing.F) {
+	stats := []*MiningStats{CreateMiningStats(1, 2, 3), CreateMiningStats(4, 5, 6)}
+	seeds := []Message{CreateGetMiningStatisticsResponse(stats)}
+	fuzzHandler(f, opcodes["GetMiningStatisticsResponse"], seeds, func(msg Message) {
+		msg.(*GetMiningStatisticsResponse).MinerStats()
+	})
+}
+
+func FuzzGetBlockByHeight(f *testing.F) {
+	seeds := []Message{CreateGetBlockByHeightRequest(10)}
+	fuzzHandler(f, opcodes["GetBlockByHeight"], seeds, func(msg Message) {
+		msg.(*GetBlockByHeightRequest).Height()
+	})
+}
+
+func FuzzGetBlockByHeightResponse(f *testing.F) {
+	seeds := []Message{CreateGetBlockByHeightResponse(fuzzBlock()), CreateGetBlockByHeightResponse(nil)}
+	fuzzHandler(f, opcodes["GetBlockByHeightResponse"], seeds, func(msg Message) {
+		inspectBlock(msg.(*GetBlockByHeightResponse).Block())
+	})
+}
+
+func FuzzReadBlocksInRange(f *testing.F) {
+	seeds := []Message{
+		CreateReadBlocksInRange(1, 10, 5, nil),
+		CreateReadBlocksInRange(1, 10, 5, &RangeCursor{3, 0}),
+	}
+	fuzzHandler(f, opcodes["ReadBlocksInRange"], seeds, func(msg Message) {
+		request := msg.(*ReadBlocksInRangeRequest)
+		request.From()
+		request.To()
+		request.Limit()
+		request.Cursor()
+	})
+}
+
+func FuzzReadBlocksInRangeResponse(f *testing.F) {
+	blocks := []*blockchain.Block{fuzzBlock(), fuzzBlock()}
+	seeds := []Message{CreateReadBlocksInRangeResponse(func() (*blockchain.Block, *RangeCursor, error) {
+		if len(blocks) == 0 {
+			return nil, &RangeCursor{3, 0}, nil
+		}
+		block := blocks[0]
+		blocks = blocks[1:]
+		return block, nil, nil
+	})}
+	// Blocks are only read as they are consumed, so consume all of them while inspecting.
+	fuzzHandler(f, opcodes["ReadBlocksInRangeResponse"], seeds, func(msg Message) {
+		response := msg.(*ReadBlocksInRangeResponse)
+		for {
+			block, err := response.Next()
+			if err != nil || block == nil {
+				break
+			}
+			inspectBlock(block)
+		}
+		response.Cursor()
+	})
+}
+
+func FuzzGetCacheStatistics(f *testing.F) {
+	fuzzHandler(f, opcodes["GetCacheStatistics"], []Message{CreateGetCacheStatistics()}, nil)
+}
+
+func FuzzGetCacheStatisticsResponse(f *testing.F) {
+	stats := &CacheStats{1, 2, 3, 4}
+	seeds := []Message{CreateGetCacheStatisticsResponse(stats, stats)}
+	fuzzHandler(f, opcodes["GetCacheStatisticsResponse"], seeds, func(msg Message) {
+		response := msg.(*GetCacheStatisticsResponse)
+		response.BlockCacheStats()
+		response.MinuteCacheStats()
+	})
+}
+
+func FuzzFindChunk(f *testing.F) {
+	seeds := []Message{CreateFindChunkRequest(b32.One)}
+	fuzzHandler(f, opcodes["FindChunk"], seeds, func(msg Message) {
+		msg.(*FindChunkRequest).ContentHash()
+	})
+}
+
+func FuzzFindChunkResponse(f *testing.F) {
+	seeds := []Message{CreateFindChunkResponse(true, b32.One, 1, 60), CreateFindChunkResponse(false, nil, 0, 0)}
+	fuzzHandler(f, opcodes["FindChunkResponse"], seeds, func(msg Message) {
+		response := msg.(*FindChunkResponse)
+		response.Found()
+		response.BlockHash()
+		response.Entry()
+		response.Timestamp()
+	})
+}
+
+func FuzzHello(f *testing.F) {
+	seeds := []Message{CreateHello(1, 2)}
+	fuzzHandler(f, opcodes["Hello"], seeds, func(msg Message) {
+		msg.(*Hello).MinVersion()
+		msg.(*Hello).MaxVersion()
+	})
+}
+
+func FuzzHelloResponse(f *testing.F) {
+	seeds := []Message{CreateHelloResponse(1)}
+	fuzzHandler(f, opcodes["HelloResponse"], seeds, func(msg Message) {
+		msg.(*HelloResponse).Version()
+	})
+}
+
+func FuzzErrorResponse(f *testing.F) {
+	seeds := []Message{CreateErrorResponse(ErrorCodeUnavailable, "unavailable")}
+	fuzzHandler(f, opcodes["ErrorResponse"], seeds, func(msg Message) {
+		response := msg.(*ErrorResponse)
+		response.Code()
+		response.Reason()
+		response.Err()
+	})
+}
+
+func FuzzSignedRequest(f *testing.F) {
+	credentials := security.CreateCredentials("client", "secret")
+	signedChunk, _ := CreateSignedRequest(CreateWriteChunk([]byte("some data"), 9), credentials)
+	signedBlock, _ := CreateSignedRequest(CreateWriteBlock(fuzzBlock()), credentials)
+	fuzzHandler(f, opcodes["SignedRequest"], []Message{signedChunk, signedBlock}, func(msg Message) {
+		signed := msg.(*SignedRequest)
+		signed.ClientId()
+		signed.Timestamp()
+		signed.Request()
+		Authenticate(signed, testVerifier)
+	})
+}
+
+func FuzzSubscribeBlocks(f *testing.F) {
+	seeds := []Message{CreateSubscribeBlocks(b32.One, true), CreateSubscribeBlocks(nil, false)}
+	fuzzHandler(f, opcodes["SubscribeBlocks"], seeds, func(msg Message) {
+		msg.(*SubscribeBlocksRequest).HeadersOnly()
+		msg.(*SubscribeBlocksRequest).From()
+	})
+}
+
+func FuzzBlockNotification(f *testing.F) {
+	seeds := []Message{CreateBlockNotification(fuzzBlock(), 1, false), CreateBlockNotification(fuzzBlock(), 2, true)}
+	fuzzHandler(f, opcodes["BlockNotification"], seeds, func(msg Message) {
+		notification := msg.(*BlockNotification)
+		notification.Height()
+		notification.Header().Hash()
+		notification.Header().EntryCount()
+		if block := notification.Block(); block != nil {
+			inspectBlock(block)
+		}
+	})
+}
+
+func FuzzGetMiningRanges(f *testing.F) {
+	fuzzHandler(f, opcodes["GetMiningRanges"], []Message{CreateGetMiningRanges()}, nil)
+}
+
+func FuzzGetMiningTelemetry(f *testing.F) {
+	fuzzHandler(f, opcodes["GetMiningTelemetry"], []Message{CreateGetMiningTelemetry(5)}, nil)
+}
+
+func FuzzGetMiningTelemetryResponse(f *testing.F) {
+	seeds := []Message{CreateGetMiningTelemetryResponse(testTelemetry())}
+	fuzzHandler(f, opcodes["GetMiningTelemetryResponse"], seeds, func(msg Message) {
+		msg.(*GetMiningTelemetryResponse).Telemetry()
+	})
+}
+
+func FuzzGetMiningRangesResponse(f *testing.F) {
+	seeds := []Message{CreateGetMiningRangesResponse([]*RangeStats{{1, 2, 3, 4}, {5, -1, 6, 0}})}
+	fuzzHandler(f, opcodes["GetMiningRangesResponse"], seeds, func(msg Message) {
+		msg.(*GetMiningRangesResponse).Ranges()
+	})
+}
+
+func FuzzGetDeadLetters(f *testing.F) {
+	fuzzHandler(f, opcodes["GetDeadLetters"], []Message{CreateGetDeadLetters()}, nil)
+}
+
+func FuzzGetDeadLettersResponse(f *testing.F) {
+	seeds := []Message{CreateGetDeadLettersResponse(testDeadLetters())}
+	fuzzHandler(f, opcodes["GetDeadLettersResponse"], seeds, func(msg Message) {
+		msg.(*GetDeadLettersResponse).Letters()
+	})
+}
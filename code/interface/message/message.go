@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"time"
 
+	"tp1.aba.distros.fi.uba.ar/common/config"
 	number "tp1.aba.distros.fi.uba.ar/common/number/big32"
 	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
 	"tp1.aba.distros.fi.uba.ar/interface/communication"
@@ -21,6 +25,17 @@ const OpGetBlocksInMinute uint8 = 0x04
 const OpWriteBlock uint8 = 0x06
 const OpWriteChunk uint8 = 0x08
 const OpGetMiningStatistics uint8 = 0x0a
+const OpGetBlockByHeight uint8 = 0x0c
+const OpReadBlocksInRange uint8 = 0x0e
+const OpGetCacheStatistics uint8 = 0x10
+const OpFindChunk uint8 = 0x12
+const OpSignedRequest uint8 = 0x14
+const OpSubscribeBlocks uint8 = 0x16
+const OpGetMiningRanges uint8 = 0x18
+const OpGetMiningTelemetry uint8 = 0x1a
+const OpGetDeadLetters uint8 = 0x1c
+const OpHello uint8 = 0xf0
+const OpErrorResponse uint8 = 0xff
 
 var opcodes map[string]uint8 = map[string]uint8{
 	"GetMiningInfo":               OpGetMiningInfo,
@@ -35,6 +50,26 @@ var opcodes map[string]uint8 = map[string]uint8{
 	"WriteChunkResponse":          0x09,
 	"GetMiningStatistics":         OpGetMiningStatistics,
 	"GetMiningStatisticsResponse": 0x0b,
+	"GetBlockByHeight":            OpGetBlockByHeight,
+	"GetBlockByHeightResponse":    0x0d,
+	"ReadBlocksInRange":           OpReadBlocksInRange,
+	"ReadBlocksInRangeResponse":   0x0f,
+	"GetCacheStatistics":          OpGetCacheStatistics,
+	"GetCacheStatisticsResponse":  0x11,
+	"FindChunk":                   OpFindChunk,
+	"FindChunkResponse":           0x13,
+	"SignedRequest":               OpSignedRequest,
+	"SubscribeBlocks":             OpSubscribeBlocks,
+	"BlockNotification":           0x17,
+	"GetMiningRanges":             OpGetMiningRanges,
+	"GetMiningRangesResponse":     0x19,
+	"GetMiningTelemetry":          OpGetMiningTelemetry,
+	"GetMiningTelemetryResponse":  0x1b,
+	"GetDeadLetters":              OpGetDeadLetters,
+	"GetDeadLettersResponse":      0x1d,
+	"Hello":                       OpHello,
+	"HelloResponse":               0xf1,
+	"ErrorResponse":               OpErrorResponse,
 }
 
 var handlers map[uint8]handler = map[uint8]handler{
@@ -50,6 +85,25 @@ var handlers map[uint8]handler = map[uint8]handler{
 	opcodes["WriteChunkResponse"]:          handleWriteChunkResponse,
 	opcodes["GetMiningStatistics"]:         handleGetMiningStatistics,
 	opcodes["GetMiningStatisticsResponse"]: handleGetMiningStatisticsResponse,
+	opcodes["GetBlockByHeight"]:            handleGetBlockByHeight,
+	opcodes["GetBlockByHeightResponse"]:    handleGetBlockByHeightResponse,
+	opcodes["ReadBlocksInRange"]:           handleReadBlocksInRange,
+	opcodes["ReadBlocksInRangeResponse"]:   handleReadBlocksInRangeResponse,
+	opcodes["GetCacheStatistics"]:          handleGetCacheStatistics,
+	opcodes["GetCacheStatisticsResponse"]:  handleGetCacheStatisticsResponse,
+	opcodes["FindChunk"]:                   handleFindChunk,
+	opcodes["FindChunkResponse"]:           handleFindChunkResponse,
+	opcodes["SubscribeBlocks"]:             handleSubscribeBlocks,
+	opcodes["BlockNotification"]:           handleBlockNotification,
+	opcodes["GetMiningRanges"]:             handleGetMiningRanges,
+	opcodes["GetMiningRangesResponse"]:     handleGetMiningRangesResponse,
+	opcodes["GetMiningTelemetry"]:          handleGetMiningTelemetry,
+	opcodes["GetMiningTelemetryResponse"]:  handleGetMiningTelemetryResponse,
+	opcodes["GetDeadLetters"]:              handleGetDeadLetters,
+	opcodes["GetDeadLettersResponse"]:      handleGetDeadLettersResponse,
+	opcodes["Hello"]:                       handleHello,
+	opcodes["HelloResponse"]:               handleHelloResponse,
+	opcodes["ErrorResponse"]:               handleErrorResponse,
 }
 
 //=================================================================================================
@@ -117,6 +171,18 @@ func (m *message) Write(writer io.Writer) error {
 // Readers
 //-------------------------------------------------------------------------------------------------
 
+const defaultMaxResponseLength int = 64 * 1024 * 1024
+
+// The maximum length of responses that are read whole into memory, taken from configuration.
+// Responses that are streamed are not limited, since they are consumed as they are read.
+func MaxResponseLength() uint64 {
+	length, err := config.GetIntOrDefault("MaxResponseSize", defaultMaxResponseLength)
+	if err != nil || length <= 0 {
+		return uint64(defaultMaxResponseLength)
+	}
+	return uint64(length)
+}
+
 func ReadMessage(reader io.Reader) (Message, error) {
 	// Read the opcode of the message.
 	opcode := make([]byte, 1)
@@ -132,6 +198,18 @@ func ReadMessage(reader io.Reader) (Message, error) {
 	}
 }
 
+// Reads a response, turning error responses into errors.
+func ReadResponse(reader io.Reader) (Message, error) {
+	response, err := ReadMessage(reader)
+	if err != nil {
+		return nil, err
+	}
+	if errorResponse, ok := response.(*ErrorResponse); ok {
+		return nil, errorResponse.Err()
+	}
+	return response, nil
+}
+
 func readCount(opcode uint8, reader io.Reader, datalength int) (*message, error) {
 	// Read a fixed amount of bytes as data for the message.
 	data := make([]byte, datalength)
@@ -178,15 +256,18 @@ func handleGetMiningInfo(opcode uint8, reader io.Reader) (Message, error) {
 // Opcode        :  1 byte
 // Previous hash : 32 bytes
 // Difficulty    : 32 bytes
+// Height        :  8 bytes
 type GetMiningInfoResponse struct {
 	message
 }
 
-func CreateGetMiningInfoResponse(previousHash *number.Big32, difficulty *number.Big32) *GetMiningInfoResponse {
+func CreateGetMiningInfoResponse(
+	previousHash *number.Big32, difficulty *number.Big32, height int64) *GetMiningInfoResponse {
 	// Construct the data buffer.
-	data := make([]byte, 64)
+	data := make([]byte, 72)
 	copy(data[0:32], previousHash.Bytes[:])
 	copy(data[32:64], difficulty.Bytes[:])
+	binary.LittleEndian.PutUint64(data[64:72], uint64(height))
 	// Construct and return the response.
 	response := &GetMiningInfoResponse{}
 	response.opcode = opcodes["GetMiningInfoResponse"]
@@ -196,8 +277,8 @@ func CreateGetMiningInfoResponse(previousHash *number.Big32, difficulty *number.
 }
 
 func handleGetMiningInfoResponse(opcode uint8, reader io.Reader) (Message, error) {
-	// Read 64 bytes from the reader (hash and difficulty).
-	msg, err := readCount(opcode, reader, 64)
+	// Read 72 bytes from the reader (hash, difficulty and height).
+	msg, err := readCount(opcode, reader, 72)
 	if err != nil {
 		return nil, err
 	}
@@ -217,6 +298,11 @@ func (m *GetMiningInfoResponse) Difficulty() *number.Big32 {
 	return number.FromSlice(data)
 }
 
+// The height of the block the previous hash belongs to, which is zero for an empty blockchain.
+func (m *GetMiningInfoResponse) Height() int64 {
+	return int64(binary.LittleEndian.Uint64(m.data[64:72]))
+}
+
 //=================================================================================================
 // Get block by hash
 //-------------------------------------------------------------------------------------------------
@@ -293,7 +379,12 @@ func handleGetBlockByHashResponse(opcode uint8, reader io.Reader) (Message, erro
 	response.opcode = opcode
 	// Read the byte that tells whether the block was found or not.
 	b := make([]byte, 1)
-	read(reader, b)
+	if err := read(reader, b); err != nil {
+		return nil, err
+	}
+	if b[0] > 1 {
+		return nil, fmt.Errorf("%w: unexpected found flag %d", ErrBadRequest, b[0])
+	}
 	found := (b[0] == 1)
 	// If found, proceed to read the block as well.
 	if found {
@@ -306,6 +397,9 @@ func handleGetBlockByHashResponse(opcode uint8, reader io.Reader) (Message, erro
 			response.data[0] = 1
 			copy(response.data[1:], block.BufferWithMetadata())
 		}
+	} else {
+		response.datalen = 1
+		response.data = []byte{0}
 	}
 	return response, nil
 }
@@ -319,6 +413,67 @@ func (m *GetBlockByHashResponse) Found() bool {
 	return m.data[0] == 1
 }
 
+//=================================================================================================
+// Get block by height
+//-------------------------------------------------------------------------------------------------
+
+// Opcode :  1 byte
+// Height :  8 bytes
+type GetBlockByHeightRequest struct {
+	message
+}
+
+func CreateGetBlockByHeightRequest(height int64) *GetBlockByHeightRequest {
+	// The data for the request is just the height.
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, uint64(height))
+	// Instantiate the request.
+	request := &GetBlockByHeightRequest{}
+	request.opcode = opcodes["GetBlockByHeight"]
+	request.datalen = uint64(len(data))
+	request.data = data
+	return request
+}
+
+func handleGetBlockByHeight(opcode uint8, reader io.Reader) (Message, error) {
+	// Read 8 bytes of data (the height).
+	msg, err := readCount(opcode, reader, 8)
+	if err != nil {
+		return nil, err
+	}
+	// Initialize the concrete message.
+	request := &GetBlockByHeightRequest{*msg}
+	return request, nil
+}
+
+func (r *GetBlockByHeightRequest) Height() int64 {
+	return int64(binary.LittleEndian.Uint64(r.data[0:8]))
+}
+
+// Same format as the response to a request by hash.
+//
+// Opcode : 1 byte
+// Found  : 1 byte
+// Block  : dynamic
+type GetBlockByHeightResponse struct {
+	GetBlockByHashResponse
+}
+
+func CreateGetBlockByHeightResponse(block *blockchain.Block) *GetBlockByHeightResponse {
+	response := &GetBlockByHeightResponse{*CreateGetBlockByHashResponse(block)}
+	response.opcode = opcodes["GetBlockByHeightResponse"]
+	return response
+}
+
+func handleGetBlockByHeightResponse(opcode uint8, reader io.Reader) (Message, error) {
+	// Read the response as if it were a response to a request by hash.
+	if msg, err := handleGetBlockByHashResponse(opcode, reader); err != nil {
+		return nil, err
+	} else {
+		return &GetBlockByHeightResponse{*msg.(*GetBlockByHashResponse)}, nil
+	}
+}
+
 //=================================================================================================
 // Read blocks in minute
 //-------------------------------------------------------------------------------------------------
@@ -400,21 +555,30 @@ func CreateReadBlocksInMinuteResponse(timestamp int64, blocks []*blockchain.Bloc
 func handleReadBlocksInMinuteResponse(opcode uint8, reader io.Reader) (Message, error) {
 	// Read the timestamp.
 	timestamp := make([]byte, 8)
-	read(reader, timestamp)
+	if err := read(reader, timestamp); err != nil {
+		return nil, err
+	}
 	// Read the block count.
 	countBytes := make([]byte, 4)
-	read(reader, countBytes)
+	if err := read(reader, countBytes); err != nil {
+		return nil, err
+	}
 	count := binary.LittleEndian.Uint32(countBytes)
-	// Read all blocks one by one into a list.
-	blocks := make([]*blockchain.Block, count)
-	length := uint32(0)
+	// Read all blocks one by one into a list. The count cannot be trusted, so the list grows as
+	// blocks are read, and reading stops if the response gets too long.
+	blocks := make([]*blockchain.Block, 0)
+	length := uint64(0)
+	maxLength := MaxResponseLength()
 
 	for i := uint32(0); i < count; i++ {
 		if block, err := blockchain.ReadBlock(reader); err != nil {
 			return nil, err
 		} else {
-			blocks[i] = block
-			length += block.LengthWithMetadata()
+			blocks = append(blocks, block)
+			length += uint64(block.LengthWithMetadata())
+		}
+		if length > maxLength {
+			return nil, fmt.Errorf("%w: response exceeds the maximum length of %d", ErrBadRequest, maxLength)
 		}
 	}
 
@@ -462,6 +626,610 @@ func (m *ReadBlocksInMinuteResponse) Blocks() []*blockchain.Block {
 	return blocks
 }
 
+//=================================================================================================
+// Read blocks in range
+//-------------------------------------------------------------------------------------------------
+
+// Identifies where a range query left off: the minute of the next block to return, and the
+// amount of blocks created in that minute that were already returned.
+type RangeCursor struct {
+	Minute int64
+	Skip   uint32
+}
+
+const rangeCursorLength int = 12
+
+func (cursor *RangeCursor) encode(buffer []byte) {
+	binary.LittleEndian.PutUint64(buffer[0:8], uint64(cursor.Minute))
+	binary.LittleEndian.PutUint32(buffer[8:12], cursor.Skip)
+}
+
+func decodeRangeCursor(buffer []byte) *RangeCursor {
+	cursor := &RangeCursor{}
+	cursor.Minute = int64(binary.LittleEndian.Uint64(buffer[0:8]))
+	cursor.Skip = binary.LittleEndian.Uint32(buffer[8:12])
+	return cursor
+}
+
+// Opcode         : 1 byte
+// From timestamp : 8 bytes (inclusive)
+// To timestamp   : 8 bytes (exclusive)
+// Limit          : 4 bytes (0 to let the server choose)
+// Cursor         : 12 bytes (all zero to start from the beginning of the range)
+type ReadBlocksInRangeRequest struct {
+	message
+}
+
+func CreateReadBlocksInRange(from int64, to int64, limit uint32, cursor *RangeCursor) *ReadBlocksInRangeRequest {
+	data := make([]byte, 20+rangeCursorLength)
+	binary.LittleEndian.PutUint64(data[0:8], uint64(from))
+	binary.LittleEndian.PutUint64(data[8:16], uint64(to))
+	binary.LittleEndian.PutUint32(data[16:20], limit)
+	if cursor != nil {
+		cursor.encode(data[20:])
+	}
+	// Instantiate and return the request.
+	request := &ReadBlocksInRangeRequest{}
+	request.opcode = opcodes["ReadBlocksInRange"]
+	request.datalen = uint64(len(data))
+	request.data = data
+	return request
+}
+
+func handleReadBlocksInRange(opcode uint8, reader io.Reader) (Message, error) {
+	msg, err := readCount(opcode, reader, 20+rangeCursorLength)
+	if err != nil {
+		return nil, err
+	}
+	return &ReadBlocksInRangeRequest{*msg}, nil
+}
+
+func (r *ReadBlocksInRangeRequest) From() int64 {
+	return int64(binary.LittleEndian.Uint64(r.data[0:8]))
+}
+
+func (r *ReadBlocksInRangeRequest) To() int64 {
+	return int64(binary.LittleEndian.Uint64(r.data[8:16]))
+}
+
+func (r *ReadBlocksInRangeRequest) Limit() uint32 {
+	return binary.LittleEndian.Uint32(r.data[16:20])
+}
+
+// The cursor to continue from, or nil if the query starts from the beginning of the range.
+func (r *ReadBlocksInRangeRequest) Cursor() *RangeCursor {
+	cursor := decodeRangeCursor(r.data[20:])
+	if cursor.Minute == 0 && cursor.Skip == 0 {
+		return nil
+	}
+	return cursor
+}
+
+// Produces the blocks of a streamed response one at a time. Once there are no more blocks it
+// returns a nil block, along with the cursor to continue from if the response was cut short.
+type BlockSource = func() (*blockchain.Block, *RangeCursor, error)
+
+// The response is streamed: blocks are written as they are produced instead of being buffered,
+// so the length of the response is not known in advance and DataLength is always zero.
+//
+// Opcode : 1 byte
+// Blocks, each one preceded by a byte set to 1, and then:
+// End    : 1 byte set to 0
+// More   : 1 byte, set to 1 if there are more blocks to fetch with the cursor
+// Cursor : 12 bytes
+//
+// If the blocks cannot all be produced, the response ends early with an error instead:
+// Failed        : 1 byte set to 2
+// Error code    : 1 byte
+// Reason length : 2 bytes
+// Reason        : variable, UTF-8
+type ReadBlocksInRangeResponse struct {
+	message
+	source BlockSource
+	cursor *RangeCursor
+	done   bool
+	// The error that cut the response short, if any.
+	err error
+}
+
+func CreateReadBlocksInRangeResponse(source BlockSource) *ReadBlocksInRangeResponse {
+	response := &ReadBlocksInRangeResponse{}
+	response.opcode = opcodes["ReadBlocksInRangeResponse"]
+	response.source = source
+	return response
+}
+
+func handleReadBlocksInRangeResponse(opcode uint8, reader io.Reader) (Message, error) {
+	// Blocks are read from the reader as they are requested, so the reader must not be closed
+	// until the whole response has been consumed.
+	response := &ReadBlocksInRangeResponse{}
+	response.opcode = opcode
+	response.source = func() (*blockchain.Block, *RangeCursor, error) {
+		flag := make([]byte, 1)
+		if err := read(reader, flag); err != nil {
+			return nil, nil, err
+		}
+		if flag[0] == 1 {
+			block, err := blockchain.ReadBlock(reader)
+			return block, nil, err
+		}
+		if flag[0] == 2 {
+			// The server could not produce the rest of the blocks.
+			failure, err := handleErrorResponse(OpErrorResponse, reader)
+			if err != nil {
+				return nil, nil, err
+			}
+			return nil, nil, failure.(*ErrorResponse).Err()
+		}
+		// Reached the end of the response, read the cursor.
+		trailer := make([]byte, 1+rangeCursorLength)
+		if err := read(reader, trailer); err != nil {
+			return nil, nil, err
+		}
+		if trailer[0] == 1 {
+			return nil, decodeRangeCursor(trailer[1:]), nil
+		}
+		return nil, nil, nil
+	}
+	return response, nil
+}
+
+// Get the next block of the response, or nil once all blocks were consumed. Fails if the response
+// was cut short, for instance because the server could not read the rest of the blocks.
+func (m *ReadBlocksInRangeResponse) Next() (*blockchain.Block, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.done {
+		return nil, nil
+	}
+	block, cursor, err := m.source()
+	if err != nil {
+		m.err = err
+		return nil, err
+	}
+	if block == nil {
+		m.done = true
+		m.cursor = cursor
+	}
+	return block, nil
+}
+
+// The cursor to continue from once all blocks were consumed, or nil if the range is exhausted.
+func (m *ReadBlocksInRangeResponse) Cursor() *RangeCursor {
+	return m.cursor
+}
+
+// Writes the response, consuming its blocks. Can only be called once. If the blocks cannot all
+// be produced, the response is ended with the error, which is also returned.
+func (m *ReadBlocksInRangeResponse) Write(writer io.Writer) error {
+	if err := writeAll(writer, []byte{m.opcode}); err != nil {
+		return err
+	}
+
+	for {
+		block, err := m.Next()
+		if err != nil {
+			failure := CreateErrorResponseFromError(err)
+			if writeErr := writeAll(writer, append([]byte{2}, failure.data...)); writeErr != nil {
+				return writeErr
+			}
+			return err
+		}
+		if block == nil {
+			break
+		}
+		if err := writeAll(writer, []byte{1}); err != nil {
+			return err
+		}
+		if err := block.WriteWithMetadata(writer); err != nil {
+			return err
+		}
+	}
+
+	// Write the end marker and the cursor.
+	trailer := make([]byte, 2+rangeCursorLength)
+	if m.cursor != nil {
+		trailer[1] = 1
+		m.cursor.encode(trailer[2:])
+	}
+	return writeAll(writer, trailer)
+}
+
+func writeAll(writer io.Writer, data []byte) error {
+	for total := 0; total < len(data); {
+		if current, err := writer.Write(data[total:]); err != nil {
+			return err
+		} else {
+			total += current
+		}
+	}
+	return nil
+}
+
+//=================================================================================================
+// Find chunk
+//-------------------------------------------------------------------------------------------------
+
+// Opcode       :  1 byte
+// Content hash : 32 bytes (SHA-256 of the chunk data)
+type FindChunkRequest struct {
+	message
+}
+
+func CreateFindChunkRequest(contentHash *number.Big32) *FindChunkRequest {
+	request := &FindChunkRequest{}
+	request.opcode = opcodes["FindChunk"]
+	request.datalen = 32
+	request.data = make([]byte, request.datalen)
+	copy(request.data, contentHash.Bytes[:])
+	return request
+}
+
+func handleFindChunk(opcode uint8, reader io.Reader) (Message, error) {
+	msg, err := readCount(opcode, reader, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &FindChunkRequest{*msg}, nil
+}
+
+func (r *FindChunkRequest) ContentHash() *number.Big32 {
+	return number.FromSlice(r.data[0:32])
+}
+
+// Opcode     :  1 byte
+// Found      :  1 byte
+// Block hash : 32 bytes
+// Entry      :  1 byte
+// Timestamp  :  8 bytes
+//
+// All fields after the found flag are zero if the chunk was not found.
+type FindChunkResponse struct {
+	message
+}
+
+const findChunkResponseLength int = 1 + 32 + 1 + 8
+
+func CreateFindChunkResponse(found bool, blockHash *number.Big32, entry int, timestamp int64) *FindChunkResponse {
+	response := &FindChunkResponse{}
+	response.opcode = opcodes["FindChunkResponse"]
+	response.datalen = uint64(findChunkResponseLength)
+	response.data = make([]byte, response.datalen)
+	if found {
+		response.data[0] = 1
+		copy(response.data[1:33], blockHash.Bytes[:])
+		response.data[33] = byte(entry)
+		binary.LittleEndian.PutUint64(response.data[34:42], uint64(timestamp))
+	}
+	return response
+}
+
+func handleFindChunkResponse(opcode uint8, reader io.Reader) (Message, error) {
+	msg, err := readCount(opcode, reader, findChunkResponseLength)
+	if err != nil {
+		return nil, err
+	}
+	return &FindChunkResponse{*msg}, nil
+}
+
+func (m *FindChunkResponse) Found() bool {
+	return m.data[0] == 1
+}
+
+// The hash of the block that holds the chunk.
+func (m *FindChunkResponse) BlockHash() *number.Big32 {
+	return number.FromSlice(m.data[1:33])
+}
+
+// The position of the chunk among the entries of the block, starting from 0.
+func (m *FindChunkResponse) Entry() int {
+	return int(m.data[33])
+}
+
+// The timestamp of the block that holds the chunk.
+func (m *FindChunkResponse) Timestamp() int64 {
+	return int64(binary.LittleEndian.Uint64(m.data[34:42]))
+}
+
+//=================================================================================================
+// Subscribe blocks
+//-------------------------------------------------------------------------------------------------
+
+// Asks to be sent every block as soon as it is written. Blocks are sent as block notifications,
+// all of them answering this request, until the connection is closed. If a starting hash is
+// given, the blocks written after that one are sent first; the zero hash stands for the start
+// of the chain.
+//
+// Opcode     :  1 byte
+// Flags      :  1 byte
+// Start hash : 32 bytes, only used if the catch up flag is set
+type SubscribeBlocksRequest struct {
+	message
+}
+
+const subscribeFlagHeadersOnly uint8 = 0x01
+const subscribeFlagCatchUp uint8 = 0x02
+
+// Subscribe to blocks written from now on, after catching up from the given hash unless nil.
+// Only the headers of blocks are sent if requested.
+func CreateSubscribeBlocks(from *number.Big32, headersOnly bool) *SubscribeBlocksRequest {
+	request := &SubscribeBlocksRequest{}
+	request.opcode = opcodes["SubscribeBlocks"]
+	request.datalen = 33
+	request.data = make([]byte, request.datalen)
+	if headersOnly {
+		request.data[0] |= subscribeFlagHeadersOnly
+	}
+	if from != nil {
+		request.data[0] |= subscribeFlagCatchUp
+		copy(request.data[1:33], from.Bytes[:])
+	}
+	return request
+}
+
+func handleSubscribeBlocks(opcode uint8, reader io.Reader) (Message, error) {
+	msg, err := readCount(opcode, reader, 33)
+	if err != nil {
+		return nil, err
+	}
+	return &SubscribeBlocksRequest{*msg}, nil
+}
+
+// Whether to only send the headers of blocks.
+func (r *SubscribeBlocksRequest) HeadersOnly() bool {
+	return r.data[0]&subscribeFlagHeadersOnly != 0
+}
+
+// The hash of the block to catch up from, or nil to only send new blocks.
+func (r *SubscribeBlocksRequest) From() *number.Big32 {
+	if r.data[0]&subscribeFlagCatchUp == 0 {
+		return nil
+	}
+	return number.FromSlice(r.data[1:33])
+}
+
+// Opcode  : 1 byte
+// Kind    : 1 byte, 0 for a whole block, 1 for a header
+// Height  : 8 bytes
+// Block   : a block with metadata, or a hash followed by a header
+type BlockNotification struct {
+	message
+	block  *blockchain.Block
+	header *blockchain.Header
+}
+
+const notificationKindBlock uint8 = 0
+const notificationKindHeader uint8 = 1
+
+// Notifies about the given block, sending only its header if requested.
+func CreateBlockNotification(block *blockchain.Block, height int64, headerOnly bool) *BlockNotification {
+	buffer := bytes.NewBuffer(make([]byte, 0, 9+block.LengthWithMetadata()))
+	buffer.WriteByte(notificationKindBlock)
+	binary.Write(buffer, binary.LittleEndian, uint64(height))
+
+	notification := &BlockNotification{}
+	notification.header = block.Header()
+	if headerOnly {
+		buffer.Bytes()[0] = notificationKindHeader
+		notification.header.Write(buffer)
+	} else {
+		notification.block = block
+		block.WriteWithMetadata(buffer)
+	}
+	notification.opcode = opcodes["BlockNotification"]
+	notification.datalen = uint64(buffer.Len())
+	notification.data = buffer.Bytes()
+	return notification
+}
+
+func handleBlockNotification(opcode uint8, reader io.Reader) (Message, error) {
+	fields := make([]byte, 9)
+	if err := read(reader, fields); err != nil {
+		return nil, err
+	}
+
+	notification := &BlockNotification{}
+	switch fields[0] {
+	case notificationKindBlock:
+		block, err := blockchain.ReadBlock(reader)
+		if err != nil {
+			return nil, err
+		}
+		notification.block = block
+		notification.header = block.Header()
+		fields = append(fields, block.BufferWithMetadata()...)
+	case notificationKindHeader:
+		header, err := blockchain.ReadHeader(reader)
+		if err != nil {
+			return nil, err
+		}
+		notification.header = header
+		buffer := bytes.NewBuffer(fields)
+		header.Write(buffer)
+		fields = buffer.Bytes()
+	default:
+		return nil, fmt.Errorf("%w: unexpected notification kind %d", ErrBadRequest, fields[0])
+	}
+
+	notification.opcode = opcode
+	notification.datalen = uint64(len(fields))
+	notification.data = fields
+	return notification, nil
+}
+
+// The height of the block in the chain.
+func (m *BlockNotification) Height() int64 {
+	return int64(binary.LittleEndian.Uint64(m.data[1:9]))
+}
+
+func (m *BlockNotification) Header() *blockchain.Header {
+	return m.header
+}
+
+// The whole block, or nil if only its header was sent.
+func (m *BlockNotification) Block() *blockchain.Block {
+	return m.block
+}
+
+//=================================================================================================
+// Hello
+//-------------------------------------------------------------------------------------------------
+
+// Sent by clients as the first message of every connection.
+//
+// Opcode      : 1 byte
+// Min version : 1 byte
+// Max version : 1 byte
+type Hello struct {
+	message
+}
+
+func CreateHello(minVersion uint8, maxVersion uint8) *Hello {
+	request := &Hello{}
+	request.opcode = opcodes["Hello"]
+	request.datalen = 2
+	request.data = []byte{minVersion, maxVersion}
+	return request
+}
+
+func handleHello(opcode uint8, reader io.Reader) (Message, error) {
+	msg, err := readCount(opcode, reader, 2)
+	if err != nil {
+		return nil, err
+	}
+	return &Hello{*msg}, nil
+}
+
+// The lowest protocol version supported by the client.
+func (r *Hello) MinVersion() uint8 {
+	return r.data[0]
+}
+
+// The highest protocol version supported by the client.
+func (r *Hello) MaxVersion() uint8 {
+	return r.data[1]
+}
+
+// Opcode  : 1 byte
+// Version : 1 byte
+type HelloResponse struct {
+	message
+}
+
+func CreateHelloResponse(version uint8) *HelloResponse {
+	response := &HelloResponse{}
+	response.opcode = opcodes["HelloResponse"]
+	response.datalen = 1
+	response.data = []byte{version}
+	return response
+}
+
+func handleHelloResponse(opcode uint8, reader io.Reader) (Message, error) {
+	msg, err := readCount(opcode, reader, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &HelloResponse{*msg}, nil
+}
+
+// The protocol version chosen by the server.
+func (m *HelloResponse) Version() uint8 {
+	return m.data[0]
+}
+
+//=================================================================================================
+// Error response
+//-------------------------------------------------------------------------------------------------
+
+// Error codes sent in error responses.
+const ErrorCodeNotFound uint8 = 0x01
+const ErrorCodeRejected uint8 = 0x02
+const ErrorCodeBadRequest uint8 = 0x03
+const ErrorCodeUnavailable uint8 = 0x04
+const ErrorCodeUnauthorized uint8 = 0x05
+
+// Errors that error responses are turned into, one for each error code. Use errors.Is to check
+// for them, since they are wrapped along with the reason sent by the server.
+var ErrNotFound error = errors.New("not found")
+var ErrRejected error = errors.New("rejected")
+var ErrBadRequest error = errors.New("bad request")
+var ErrUnavailable error = errors.New("unavailable")
+var ErrUnauthorized error = errors.New("unauthorized")
+
+var errorsByCode map[uint8]error = map[uint8]error{
+	ErrorCodeNotFound:     ErrNotFound,
+	ErrorCodeRejected:     ErrRejected,
+	ErrorCodeBadRequest:   ErrBadRequest,
+	ErrorCodeUnavailable:  ErrUnavailable,
+	ErrorCodeUnauthorized: ErrUnauthorized,
+}
+
+// Sent instead of the expected response whenever a request cannot be handled.
+//
+// Opcode        : 1 byte
+// Error code    : 1 byte
+// Reason length : 2 bytes
+// Reason        : variable, UTF-8
+type ErrorResponse struct {
+	message
+}
+
+func CreateErrorResponse(code uint8, reason string) *ErrorResponse {
+	if len(reason) > 65535 {
+		reason = reason[:65535]
+	}
+	response := &ErrorResponse{}
+	response.opcode = opcodes["ErrorResponse"]
+	response.datalen = uint64(3 + len(reason))
+	response.data = make([]byte, response.datalen)
+	response.data[0] = code
+	binary.LittleEndian.PutUint16(response.data[1:3], uint16(len(reason)))
+	copy(response.data[3:], reason)
+	return response
+}
+
+// Creates an error response from the given error, keeping the error code if the error came from
+// another error response. Any other error is considered to mean that the request cannot be
+// handled at the moment.
+func CreateErrorResponseFromError(err error) *ErrorResponse {
+	for code, codeErr := range errorsByCode {
+		if errors.Is(err, codeErr) {
+			return CreateErrorResponse(code, err.Error())
+		}
+	}
+	return CreateErrorResponse(ErrorCodeUnavailable, err.Error())
+}
+
+func handleErrorResponse(opcode uint8, reader io.Reader) (Message, error) {
+	// Read the error code and the length of the reason.
+	header := make([]byte, 3)
+	if err := read(reader, header); err != nil {
+		return nil, err
+	}
+	reason := make([]byte, binary.LittleEndian.Uint16(header[1:3]))
+	if err := read(reader, reason); err != nil {
+		return nil, err
+	}
+	return CreateErrorResponse(header[0], string(reason)), nil
+}
+
+func (r *ErrorResponse) Code() uint8 {
+	return r.data[0]
+}
+
+func (r *ErrorResponse) Reason() string {
+	return string(r.data[3:])
+}
+
+// Get the error that the response stands for, which wraps the error matching its code.
+func (r *ErrorResponse) Err() error {
+	if codeErr, ok := errorsByCode[r.Code()]; ok {
+		return fmt.Errorf("%w: %s", codeErr, r.Reason())
+	}
+	return fmt.Errorf("unknown error code %d: %s", r.Code(), r.Reason())
+}
+
 //=================================================================================================
 // Write block
 //-------------------------------------------------------------------------------------------------
@@ -587,6 +1355,9 @@ func handleWriteChunk(opcode uint8, reader io.Reader) (Message, error) {
 		return nil, err
 	}
 	datalen := binary.LittleEndian.Uint16(datalenBuffer)
+	if datalen > blockchain.MaxChunkLength() {
+		return nil, fmt.Errorf("%w: chunk length %d exceeds the maximum of %d", ErrBadRequest, datalen, blockchain.MaxChunkLength())
+	}
 	// Read data.
 	data := make([]byte, datalen)
 	if err := read(reader, data); err != nil {
@@ -737,7 +1508,7 @@ func handleGetMiningStatisticsResponse(opcode uint8, reader io.Reader) (Message,
 	minerCount := binary.LittleEndian.Uint16(minerCountBuffer)
 
 	// Compute the length of the remaining data and create a buffer.
-	minerDataBuffer := make([]byte, uint16(MiningStatisticsResponseEntryLength)*minerCount)
+	minerDataBuffer := make([]byte, MiningStatisticsResponseEntryLength*int(minerCount))
 
 	// Read each miner entry. Instantiate a MiningStats object from each one of them.
 	minerStatObjects := make([]*MiningStats, minerCount)
@@ -789,3 +1560,571 @@ func handleGetMiningStatisticsResponse(opcode uint8, reader io.Reader) (Message,
 
 	return response, nil
 }
+
+//=================================================================================================
+// Get Mining Ranges
+//-------------------------------------------------------------------------------------------------
+
+// Asks for the statistics of the ranges of nonces handed out to miners.
+//
+// Opcode: 1 byte
+type GetMiningRanges struct {
+	message
+}
+
+// The statistics of a range of nonces, along with the miner it is handed out to, or -1 if none.
+type RangeStats struct {
+	RangeId  uint64
+	MinerId  int
+	Attempts uint64
+	// The amount of times that every nonce in the range was tried.
+	Exhausted uint64
+}
+
+func CreateGetMiningRanges() *GetMiningRanges {
+	request := &GetMiningRanges{}
+	request.opcode = OpGetMiningRanges
+	return request
+}
+
+func handleGetMiningRanges(opcode uint8, reader io.Reader) (Message, error) {
+	request := &GetMiningRanges{}
+	request.opcode = opcode
+	return request, nil
+}
+
+// Opcode      : 1 byte
+// Range count : 4 bytes
+// Range entries, 26 bytes each:
+// * Range ID (8 bytes)
+// * Miner ID (2 bytes), all ones if the range is not handed out
+// * Attempts (8 bytes)
+// * Times exhausted (8 bytes)
+type GetMiningRangesResponse struct {
+	message
+	ranges []*RangeStats
+}
+
+const miningRangesEntryLength int = 26
+const noMinerId uint16 = 0xffff
+
+func CreateGetMiningRangesResponse(ranges []*RangeStats) *GetMiningRangesResponse {
+	data := make([]byte, 4, 4+miningRangesEntryLength*len(ranges))
+	binary.LittleEndian.PutUint32(data, uint32(len(ranges)))
+	for _, stats := range ranges {
+		minerId := noMinerId
+		if stats.MinerId >= 0 {
+			minerId = uint16(stats.MinerId)
+		}
+		entry := make([]byte, miningRangesEntryLength)
+		binary.LittleEndian.PutUint64(entry[0:8], stats.RangeId)
+		binary.LittleEndian.PutUint16(entry[8:10], minerId)
+		binary.LittleEndian.PutUint64(entry[10:18], stats.Attempts)
+		binary.LittleEndian.PutUint64(entry[18:26], stats.Exhausted)
+		data = append(data, entry...)
+	}
+
+	response := &GetMiningRangesResponse{}
+	response.opcode = opcodes["GetMiningRangesResponse"]
+	response.datalen = uint64(len(data))
+	response.data = data
+	response.ranges = ranges
+	return response
+}
+
+func handleGetMiningRangesResponse(opcode uint8, reader io.Reader) (Message, error) {
+	header := make([]byte, 4)
+	if err := read(reader, header); err != nil {
+		return nil, err
+	}
+	count := uint64(binary.LittleEndian.Uint32(header))
+	if count*uint64(miningRangesEntryLength) > MaxResponseLength() {
+		return nil, fmt.Errorf("%w: too many ranges (%d)", ErrBadRequest, count)
+	}
+
+	entries := make([]byte, count*uint64(miningRangesEntryLength))
+	if err := read(reader, entries); err != nil {
+		return nil, err
+	}
+	ranges := make([]*RangeStats, count)
+	for i := range ranges {
+		entry := entries[i*miningRangesEntryLength : (i+1)*miningRangesEntryLength]
+		stats := &RangeStats{}
+		stats.RangeId = binary.LittleEndian.Uint64(entry[0:8])
+		stats.MinerId = int(binary.LittleEndian.Uint16(entry[8:10]))
+		if stats.MinerId == int(noMinerId) {
+			stats.MinerId = -1
+		}
+		stats.Attempts = binary.LittleEndian.Uint64(entry[10:18])
+		stats.Exhausted = binary.LittleEndian.Uint64(entry[18:26])
+		ranges[i] = stats
+	}
+
+	response := &GetMiningRangesResponse{}
+	response.opcode = opcode
+	response.datalen = uint64(len(header) + len(entries))
+	response.data = append(header, entries...)
+	response.ranges = ranges
+	return response, nil
+}
+
+func (r *GetMiningRangesResponse) Ranges() []*RangeStats {
+	return r.ranges
+}
+
+//=================================================================================================
+// Get Mining Telemetry
+//-------------------------------------------------------------------------------------------------
+
+// Asks for the statistics kept about mining since the service was first started, along with the
+// latest blocks mined, up to the given amount.
+//
+// Opcode         : 1 byte
+// History length : 2 bytes
+type GetMiningTelemetry struct {
+	message
+}
+
+// The statistics kept about mining. Counts include those from earlier runs of the service when
+// they are saved to disk.
+type MiningTelemetry struct {
+	BlocksMined uint64
+	Attempts    uint64
+	// The time spent mining the blocks mined.
+	MiningTime time.Duration
+	// The attempts per second over the last 1, 5 and 15 minutes.
+	Hashrate [3]float64
+	Miners   []*MiningStats
+	// The latest blocks mined, oldest first.
+	History []*MinedBlockStats
+}
+
+// How a single block was mined.
+type MinedBlockStats struct {
+	Hash       *number.Big32
+	Difficulty *number.Big32
+	MinedAt    time.Time
+	// The time between handing out the block to miners and one of them finding a valid nonce.
+	Duration time.Duration
+	Attempts uint64
+	MinerId  int
+}
+
+// The version of the mining telemetry response written. Fields are only ever added, so readers
+// take any version at least as recent as the one they know, and skip what they do not know.
+const MiningTelemetryVersion uint8 = 1
+
+func CreateGetMiningTelemetry(historyLength uint16) *GetMiningTelemetry {
+	request := &GetMiningTelemetry{}
+	request.opcode = OpGetMiningTelemetry
+	request.datalen = 2
+	request.data = make([]byte, 2)
+	binary.LittleEndian.PutUint16(request.data, historyLength)
+	return request
+}
+
+func handleGetMiningTelemetry(opcode uint8, reader io.Reader) (Message, error) {
+	request := &GetMiningTelemetry{}
+	request.opcode = opcode
+	request.datalen = 2
+	request.data = make([]byte, 2)
+	if err := read(reader, request.data); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// The amount of latest blocks mined to include in the response.
+func (r *GetMiningTelemetry) HistoryLength() uint16 {
+	return binary.LittleEndian.Uint16(r.data)
+}
+
+// Opcode        : 1 byte
+// Version       : 1 byte
+// Length        : 4 bytes, of what follows
+// Blocks mined  : 8 bytes
+// Attempts      : 8 bytes
+// Mining time   : 8 bytes, in milliseconds
+// Hashrate      : 24 bytes, three IEEE 754 doubles for the last 1, 5 and 15 minutes
+// Miner count   : 2 bytes
+// Miner entries, 18 bytes each, as in GetMiningStatisticsResponse
+// History count : 2 bytes
+// History entries, 90 bytes each:
+// * Hash (32 bytes)
+// * Difficulty (32 bytes)
+// * Mined at (8 bytes), unix time in milliseconds
+// * Duration (8 bytes), in milliseconds
+// * Attempts (8 bytes)
+// * Miner ID (2 bytes)
+//
+// Later versions may add fields after these, which the length accounts for.
+type GetMiningTelemetryResponse struct {
+	message
+	telemetry *MiningTelemetry
+}
+
+const miningTelemetryHeaderLength int = 5
+const miningTelemetryTotalsLength int = 48
+const minedBlockEntryLength int = 90
+
+func CreateGetMiningTelemetryResponse(telemetry *MiningTelemetry) *GetMiningTelemetryResponse {
+	data := make([]byte, miningTelemetryHeaderLength+miningTelemetryTotalsLength+2)
+	data[0] = MiningTelemetryVersion
+	body := data[miningTelemetryHeaderLength:]
+	binary.LittleEndian.PutUint64(body[0:8], telemetry.BlocksMined)
+	binary.LittleEndian.PutUint64(body[8:16], telemetry.Attempts)
+	binary.LittleEndian.PutUint64(body[16:24], uint64(telemetry.MiningTime.Milliseconds()))
+	for i, hashrate := range telemetry.Hashrate {
+		binary.LittleEndian.PutUint64(body[24+8*i:32+8*i], math.Float64bits(hashrate))
+	}
+	binary.LittleEndian.PutUint16(body[48:50], uint16(len(telemetry.Miners)))
+
+	for _, stat := range telemetry.Miners {
+		entry := make([]byte, MiningStatisticsResponseEntryLength)
+		binary.LittleEndian.PutUint16(entry[0:2], uint16(stat.MinerId))
+		binary.LittleEndian.PutUint64(entry[2:10], uint64(stat.MiningSuccessCount))
+		binary.LittleEndian.PutUint64(entry[10:18], uint64(stat.MiningFailureCount))
+		data = append(data, entry...)
+	}
+
+	count := make([]byte, 2)
+	binary.LittleEndian.PutUint16(count, uint16(len(telemetry.History)))
+	data = append(data, count...)
+	for _, stats := range telemetry.History {
+		entry := make([]byte, minedBlockEntryLength)
+		copy(entry[0:32], stats.Hash.Bytes[:])
+		copy(entry[32:64], stats.Difficulty.Bytes[:])
+		binary.LittleEndian.PutUint64(entry[64:72], uint64(stats.MinedAt.UnixNano()/int64(time.Millisecond)))
+		binary.LittleEndian.PutUint64(entry[72:80], uint64(stats.Duration.Milliseconds()))
+		binary.LittleEndian.PutUint64(entry[80:88], stats.Attempts)
+		binary.LittleEndian.PutUint16(entry[88:90], uint16(stats.MinerId))
+		data = append(data, entry...)
+	}
+	binary.LittleEndian.PutUint32(data[1:5], uint32(len(data)-miningTelemetryHeaderLength))
+
+	response := &GetMiningTelemetryResponse{}
+	response.opcode = opcodes["GetMiningTelemetryResponse"]
+	response.datalen = uint64(len(data))
+	response.data = data
+	response.telemetry = telemetry
+	return response
+}
+
+func handleGetMiningTelemetryResponse(opcode uint8, reader io.Reader) (Message, error) {
+	header := make([]byte, miningTelemetryHeaderLength)
+	if err := read(reader, header); err != nil {
+		return nil, err
+	}
+	if header[0] < MiningTelemetryVersion {
+		return nil, fmt.Errorf("%w: unknown mining telemetry version %d", ErrBadRequest, header[0])
+	}
+	length := binary.LittleEndian.Uint32(header[1:5])
+	if uint64(length) > MaxResponseLength() {
+		return nil, fmt.Errorf("%w: mining telemetry too long (%d bytes)", ErrBadRequest, length)
+	}
+	body := make([]byte, length)
+	if err := read(reader, body); err != nil {
+		return nil, err
+	}
+
+	telemetry, err := parseMiningTelemetry(body)
+	if err != nil {
+		return nil, err
+	}
+	response := &GetMiningTelemetryResponse{}
+	response.opcode = opcode
+	response.datalen = uint64(len(header) + len(body))
+	response.data = append(header, body...)
+	response.telemetry = telemetry
+	return response, nil
+}
+
+// Parses the fields known to this version of the response, ignoring any that follow.
+func parseMiningTelemetry(body []byte) (*MiningTelemetry, error) {
+	malformed := fmt.Errorf("%w: malformed mining telemetry", ErrBadRequest)
+	if len(body) < miningTelemetryTotalsLength+2 {
+		return nil, malformed
+	}
+	telemetry := &MiningTelemetry{}
+	telemetry.BlocksMined = binary.LittleEndian.Uint64(body[0:8])
+	telemetry.Attempts = binary.LittleEndian.Uint64(body[8:16])
+	telemetry.MiningTime = time.Duration(binary.LittleEndian.Uint64(body[16:24])) * time.Millisecond
+	for i := range telemetry.Hashrate {
+		telemetry.Hashrate[i] = math.Float64frombits(binary.LittleEndian.Uint64(body[24+8*i : 32+8*i]))
+	}
+
+	minerCount := int(binary.LittleEndian.Uint16(body[48:50]))
+	offset := miningTelemetryTotalsLength + 2
+	if len(body) < offset+minerCount*MiningStatisticsResponseEntryLength+2 {
+		return nil, malformed
+	}
+	telemetry.Miners = make([]*MiningStats, minerCount)
+	for i := range telemetry.Miners {
+		entry := body[offset : offset+MiningStatisticsResponseEntryLength]
+		stats := &MiningStats{}
+		stats.MinerId = int(binary.LittleEndian.Uint16(entry[0:2]))
+		stats.MiningSuccessCount = int(binary.LittleEndian.Uint64(entry[2:10]))
+		stats.MiningFailureCount = int(binary.LittleEndian.Uint64(entry[10:18]))
+		telemetry.Miners[i] = stats
+		offset += MiningStatisticsResponseEntryLength
+	}
+
+	historyCount := int(binary.LittleEndian.Uint16(body[offset : offset+2]))
+	offset += 2
+	if len(body) < offset+historyCount*minedBlockEntryLength {
+		return nil, malformed
+	}
+	telemetry.History = make([]*MinedBlockStats, historyCount)
+	for i := range telemetry.History {
+		entry := body[offset : offset+minedBlockEntryLength]
+		stats := &MinedBlockStats{}
+		stats.Hash = number.FromSlice(entry[0:32])
+		stats.Difficulty = number.FromSlice(entry[32:64])
+		minedAt := int64(binary.LittleEndian.Uint64(entry[64:72]))
+		stats.MinedAt = time.Unix(0, minedAt*int64(time.Millisecond)).UTC()
+		stats.Duration = time.Duration(binary.LittleEndian.Uint64(entry[72:80])) * time.Millisecond
+		stats.Attempts = binary.LittleEndian.Uint64(entry[80:88])
+		stats.MinerId = int(binary.LittleEndian.Uint16(entry[88:90]))
+		telemetry.History[i] = stats
+		offset += minedBlockEntryLength
+	}
+	return telemetry, nil
+}
+
+func (r *GetMiningTelemetryResponse) Telemetry() *MiningTelemetry {
+	return r.telemetry
+}
+
+//=================================================================================================
+// Get Dead Letters
+//-------------------------------------------------------------------------------------------------
+
+// Asks for the chunks that the service gave up on writing after too many failed block writes.
+//
+// Opcode: 1 byte
+type GetDeadLetters struct {
+	message
+}
+
+// A chunk that could not be written. Its data is not kept.
+type DeadLetter struct {
+	// The SHA-256 hash of the data of the chunk.
+	ContentHash *number.Big32
+	Length      int
+	// The hash of the last block that the chunk was sent in.
+	BlockHash *number.Big32
+	// The amount of block writes that failed with the chunk, and when the last one did.
+	Failures int
+	FailedAt time.Time
+	// Why the last block write failed.
+	Reason string
+}
+
+func CreateGetDeadLetters() *GetDeadLetters {
+	request := &GetDeadLetters{}
+	request.opcode = OpGetDeadLetters
+	return request
+}
+
+func handleGetDeadLetters(opcode uint8, reader io.Reader) (Message, error) {
+	request := &GetDeadLetters{}
+	request.opcode = opcode
+	return request, nil
+}
+
+// Opcode       : 1 byte
+// Length       : 4 bytes, of what follows
+// Letter count : 4 bytes
+// Letter entries, oldest first, each one with:
+// * Content hash (32 bytes)
+// * Block hash (32 bytes)
+// * Chunk length (2 bytes)
+// * Failures (2 bytes)
+// * Failed at (8 bytes), in milliseconds since the epoch
+// * Reason length (2 bytes)
+// * Reason
+type GetDeadLettersResponse struct {
+	message
+	letters []*DeadLetter
+}
+
+// The length of an entry without its reason.
+const deadLetterEntryLength int = 78
+
+func CreateGetDeadLettersResponse(letters []*DeadLetter) *GetDeadLettersResponse {
+	data := make([]byte, 8, 8+deadLetterEntryLength*len(letters))
+	binary.LittleEndian.PutUint32(data[4:8], uint32(len(letters)))
+	for _, letter := range letters {
+		reason := letter.Reason
+		if len(reason) > 0xffff {
+			reason = reason[:0xffff]
+		}
+		entry := make([]byte, deadLetterEntryLength)
+		copy(entry[0:32], letter.ContentHash.Bytes[:])
+		copy(entry[32:64], letter.BlockHash.Bytes[:])
+		binary.LittleEndian.PutUint16(entry[64:66], uint16(letter.Length))
+		binary.LittleEndian.PutUint16(entry[66:68], uint16(letter.Failures))
+		binary.LittleEndian.PutUint64(entry[68:76], uint64(letter.FailedAt.UnixNano()/int64(time.Millisecond)))
+		binary.LittleEndian.PutUint16(entry[76:78], uint16(len(reason)))
+		data = append(append(data, entry...), reason...)
+	}
+	binary.LittleEndian.PutUint32(data[0:4], uint32(len(data)-4))
+
+	response := &GetDeadLettersResponse{}
+	response.opcode = opcodes["GetDeadLettersResponse"]
+	response.datalen = uint64(len(data))
+	response.data = data
+	response.letters = letters
+	return response
+}
+
+func handleGetDeadLettersResponse(opcode uint8, reader io.Reader) (Message, error) {
+	header := make([]byte, 4)
+	if err := read(reader, header); err != nil {
+		return nil, err
+	}
+	length := uint64(binary.LittleEndian.Uint32(header))
+	if length > MaxResponseLength() {
+		return nil, fmt.Errorf("%w: dead letters too long (%d bytes)", ErrBadRequest, length)
+	}
+	body := make([]byte, length)
+	if err := read(reader, body); err != nil {
+		return nil, err
+	}
+
+	malformed := fmt.Errorf("%w: malformed dead letters", ErrBadRequest)
+	if len(body) < 4 {
+		return nil, malformed
+	}
+	count := binary.LittleEndian.Uint32(body[0:4])
+	if uint64(count)*uint64(deadLetterEntryLength) > length {
+		return nil, malformed
+	}
+	letters := make([]*DeadLetter, count)
+	offset := 4
+	for i := range letters {
+		if len(body) < offset+deadLetterEntryLength {
+			return nil, malformed
+		}
+		entry := body[offset : offset+deadLetterEntryLength]
+		letter := &DeadLetter{}
+		letter.ContentHash = number.FromSlice(entry[0:32])
+		letter.BlockHash = number.FromSlice(entry[32:64])
+		letter.Length = int(binary.LittleEndian.Uint16(entry[64:66]))
+		letter.Failures = int(binary.LittleEndian.Uint16(entry[66:68]))
+		failedAt := int64(binary.LittleEndian.Uint64(entry[68:76]))
+		letter.FailedAt = time.Unix(0, failedAt*int64(time.Millisecond)).UTC()
+		reasonLength := int(binary.LittleEndian.Uint16(entry[76:78]))
+		offset += deadLetterEntryLength
+		if len(body) < offset+reasonLength {
+			return nil, malformed
+		}
+		letter.Reason = string(body[offset : offset+reasonLength])
+		offset += reasonLength
+		letters[i] = letter
+	}
+
+	response := &GetDeadLettersResponse{}
+	response.opcode = opcode
+	response.datalen = uint64(len(header) + len(body))
+	response.data = append(header, body...)
+	response.letters = letters
+	return response, nil
+}
+
+func (r *GetDeadLettersResponse) Letters() []*DeadLetter {
+	return r.letters
+}
+
+//=================================================================================================
+// Get Cache Statistics
+//-------------------------------------------------------------------------------------------------
+
+// Opcode: 1 byte
+type GetCacheStatistics struct {
+	message
+}
+
+type CacheStats struct {
+	Hits     int
+	Misses   int
+	Entries  int
+	Capacity int
+}
+
+func CreateGetCacheStatistics() *GetCacheStatistics {
+	stats := &GetCacheStatistics{}
+	stats.opcode = OpGetCacheStatistics
+	stats.datalen = 0
+	stats.data = nil
+	return stats
+}
+
+func handleGetCacheStatistics(opcode uint8, reader io.Reader) (Message, error) {
+	stats := &GetCacheStatistics{}
+	stats.opcode = opcode
+	stats.datalen = 0
+	stats.data = nil
+	return stats, nil
+}
+
+// Opcode: 1 byte
+// Block cache entry: 32 bytes
+// Minute cache entry: 32 bytes
+// Each entry has the following fields:
+// * Hits (8 bytes)
+// * Misses (8 bytes)
+// * Cached entries (8 bytes)
+// * Capacity (8 bytes)
+type GetCacheStatisticsResponse struct {
+	message
+}
+
+const CacheStatisticsResponseEntryLength int = 32
+
+func CreateGetCacheStatisticsResponse(blockStats *CacheStats, minuteStats *CacheStats) *GetCacheStatisticsResponse {
+	res := &GetCacheStatisticsResponse{}
+	res.opcode = opcodes["GetCacheStatisticsResponse"]
+	res.datalen = uint64(2 * CacheStatisticsResponseEntryLength)
+	res.data = make([]byte, res.datalen)
+	encodeCacheStats(blockStats, res.data[0:CacheStatisticsResponseEntryLength])
+	encodeCacheStats(minuteStats, res.data[CacheStatisticsResponseEntryLength:])
+	return res
+}
+
+func handleGetCacheStatisticsResponse(opcode uint8, reader io.Reader) (Message, error) {
+	response := &GetCacheStatisticsResponse{}
+	response.opcode = opcode
+	response.datalen = uint64(2 * CacheStatisticsResponseEntryLength)
+	response.data = make([]byte, response.datalen)
+	if err := read(reader, response.data); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Usage of the cache of blocks by hash.
+func (res *GetCacheStatisticsResponse) BlockCacheStats() *CacheStats {
+	return decodeCacheStats(res.data[0:CacheStatisticsResponseEntryLength])
+}
+
+// Usage of the cache of blocks by minute.
+func (res *GetCacheStatisticsResponse) MinuteCacheStats() *CacheStats {
+	return decodeCacheStats(res.data[CacheStatisticsResponseEntryLength:])
+}
+
+func encodeCacheStats(stats *CacheStats, buffer []byte) {
+	binary.LittleEndian.PutUint64(buffer[0:8], uint64(stats.Hits))
+	binary.LittleEndian.PutUint64(buffer[8:16], uint64(stats.Misses))
+	binary.LittleEndian.PutUint64(buffer[16:24], uint64(stats.Entries))
+	binary.LittleEndian.PutUint64(buffer[24:32], uint64(stats.Capacity))
+}
+
+func decodeCacheStats(buffer []byte) *CacheStats {
+	stats := &CacheStats{}
+	stats.Hits = int(binary.LittleEndian.Uint64(buffer[0:8]))
+	stats.Misses = int(binary.LittleEndian.Uint64(buffer[8:16]))
+	stats.Entries = int(binary.LittleEndian.Uint64(buffer[16:24]))
+	stats.Capacity = int(binary.LittleEndian.Uint64(buffer[24:32]))
+	return stats
+}
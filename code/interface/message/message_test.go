@@ -3,6 +3,7 @@ package message
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
 	"testing"
 	"time"
 
@@ -44,7 +45,7 @@ func TestGetMiningInfoRequest(t *testing.T) {
 
 func TestGetMiningInfoResponse(t *testing.T) {
 	// Instantiate the response.
-	response := CreateGetMiningInfoResponse(random32(), random32())
+	response := CreateGetMiningInfoResponse(random32(), random32(), 1234)
 	// Write the response to a buffer.
 	buffer := bytes.NewBuffer(make([]byte, 0, response.DataLength()))
 	if err := response.Write(buffer); err != nil {
@@ -69,6 +70,9 @@ func TestGetMiningInfoResponse(t *testing.T) {
 	if !response2.Difficulty().Equals(response.Difficulty()) {
 		t.Fatal("unexpected difficulty")
 	}
+	if response2.Height() != 1234 {
+		t.Fatal("unexpected height")
+	}
 }
 
 func TestGetBlockByHashRequest(t *testing.T) {
@@ -136,6 +140,67 @@ func TestGetBlockByHashResponse(t *testing.T) {
 
 }
 
+func TestGetBlockByHeightRequest(t *testing.T) {
+	// Instantiate the request.
+	request := CreateGetBlockByHeightRequest(42)
+	// Write the request into a buffer.
+	buffer := bytes.NewBuffer(make([]byte, 0, request.DataLength()))
+	if err := request.Write(buffer); err != nil {
+		t.Fatalf("could not write buffer: %s", err.Error())
+	}
+	// Read the request from the buffer.
+	msg, err := ReadMessage(buffer)
+
+	if err != nil {
+		t.Fatal("could not read request after writing")
+	}
+
+	// Ensure that the fields are what is expected.
+	request2 := msg.(*GetBlockByHeightRequest)
+	if request2.Opcode() != OpGetBlockByHeight {
+		t.Fatal("unexpected opcode")
+	}
+	if request2.Height() != 42 {
+		t.Fatal("unexpected height")
+	}
+}
+
+func TestGetBlockByHeightResponse(t *testing.T) {
+	// Create a block.
+	block := blockchain.CreateDummyBlock()
+
+	// Write both a found and a not found response into a buffer.
+	buffer := bytes.NewBuffer(make([]byte, 0, 1024))
+	if err := CreateGetBlockByHeightResponse(block).Write(buffer); err != nil {
+		t.Fatalf("could not write buffer: %s", err.Error())
+	}
+	if err := CreateGetBlockByHeightResponse(nil).Write(buffer); err != nil {
+		t.Fatalf("could not write buffer: %s", err.Error())
+	}
+
+	// Read the first response, which holds the block.
+	msg, err := ReadMessage(buffer)
+	if err != nil {
+		t.Fatal("could not read response after writing")
+	}
+	response := msg.(*GetBlockByHeightResponse)
+	if response.Opcode() != opcodes["GetBlockByHeightResponse"] {
+		t.Fatal("unexpected opcode")
+	}
+	if !response.Found() || !response.Block().Hash().Equals(block.Hash()) {
+		t.Fatal("unexpected block")
+	}
+
+	// Read the second response.
+	msg, err = ReadMessage(buffer)
+	if err != nil {
+		t.Fatal("could not read response after writing")
+	}
+	if msg.(*GetBlockByHeightResponse).Found() {
+		t.Fatal("unexpected block in not found response")
+	}
+}
+
 func TestHandleReadBlocksInMinute(t *testing.T) {
 	// Create the timestamp.
 	now := time.Now().UTC().Unix()
@@ -221,6 +286,113 @@ func TestHandleReadBlocksInMinuteResponse(t *testing.T) {
 	}
 }
 
+func TestReadBlocksInRange(t *testing.T) {
+	// Instantiate the request.
+	request := CreateReadBlocksInRange(100, 200, 10, &RangeCursor{120, 3})
+	// Write the request into a buffer.
+	buffer := bytes.NewBuffer(make([]byte, 0, request.DataLength()))
+	if err := request.Write(buffer); err != nil {
+		t.Fatalf("could not write buffer: %s", err.Error())
+	}
+	// Read the request from the buffer.
+	msg, err := ReadMessage(buffer)
+	if err != nil {
+		t.Fatal("could not read request after writing")
+	}
+
+	// Ensure that the fields are what is expected.
+	request2 := msg.(*ReadBlocksInRangeRequest)
+	if request2.From() != 100 || request2.To() != 200 || request2.Limit() != 10 {
+		t.Fatal("unexpected range")
+	}
+	if cursor := request2.Cursor(); cursor == nil || cursor.Minute != 120 || cursor.Skip != 3 {
+		t.Fatal("unexpected cursor")
+	}
+	if CreateReadBlocksInRange(100, 200, 10, nil).Cursor() != nil {
+		t.Fatal("unexpected cursor in request without cursor")
+	}
+}
+
+func TestReadBlocksInRangeResponse(t *testing.T) {
+	// Create a response that streams a few blocks and ends with a cursor.
+	blocks := []*blockchain.Block{blockchain.CreateDummyBlock(), blockchain.CreateDummyBlock()}
+	produced := 0
+	response := CreateReadBlocksInRangeResponse(func() (*blockchain.Block, *RangeCursor, error) {
+		if produced < len(blocks) {
+			produced++
+			return blocks[produced-1], nil, nil
+		}
+		return nil, &RangeCursor{60, 2}, nil
+	})
+
+	// Write the response into a buffer.
+	buffer := bytes.NewBuffer(make([]byte, 0, 1024))
+	if err := response.Write(buffer); err != nil {
+		t.Fatalf("could not write buffer: %s", err.Error())
+	}
+	// Read the response from the buffer.
+	msg, err := ReadMessage(buffer)
+	if err != nil {
+		t.Fatal("could not read response after writing")
+	}
+
+	response2 := msg.(*ReadBlocksInRangeResponse)
+	for i, block := range blocks {
+		read, err := response2.Next()
+		if err != nil {
+			t.Fatalf("could not read block %d: %s", i, err.Error())
+		}
+		if read == nil || !read.Hash().Equals(block.Hash()) {
+			t.Fatalf("unexpected block %d", i)
+		}
+	}
+	if read, _ := response2.Next(); read != nil {
+		t.Fatal("unexpected block after the end of the response")
+	}
+	if cursor := response2.Cursor(); cursor == nil || cursor.Minute != 60 || cursor.Skip != 2 {
+		t.Fatal("unexpected cursor")
+	}
+	if buffer.Len() != 0 {
+		t.Fatal("the response was not completely read")
+	}
+}
+
+func TestReadBlocksInRangeResponseCutShort(t *testing.T) {
+	// Create a response whose blocks cannot all be read.
+	block := blockchain.CreateDummyBlock()
+	produced := 0
+	response := CreateReadBlocksInRangeResponse(func() (*blockchain.Block, *RangeCursor, error) {
+		if produced == 0 {
+			produced++
+			return block, nil, nil
+		}
+		return nil, nil, errors.New("disk failure")
+	})
+
+	// The error is returned, and also sent along with the blocks produced before it.
+	buffer := bytes.NewBuffer(make([]byte, 0, 1024))
+	if err := response.Write(buffer); err == nil {
+		t.Fatal("expected writing the response to fail")
+	}
+	msg, err := ReadMessage(buffer)
+	if err != nil {
+		t.Fatal("could not read response after writing")
+	}
+
+	response2 := msg.(*ReadBlocksInRangeResponse)
+	if read, err := response2.Next(); err != nil || read == nil || !read.Hash().Equals(block.Hash()) {
+		t.Fatal("unexpected first block")
+	}
+	for i := 0; i < 2; i++ {
+		if read, err := response2.Next(); read != nil || !errors.Is(err, ErrUnavailable) {
+			t.Fatal("expected the response to fail")
+		}
+	}
+	if buffer.Len() != 0 {
+		t.Fatal("the response was not completely read")
+	}
+}
+
 func TestWriteBlock(t *testing.T) {
 	block := blockchain.CreateDummyBlock()
 	request := CreateWriteBlock(block)
@@ -401,6 +573,269 @@ func TestGetMiningStatisticsResponse(t *testing.T) {
 	}
 }
 
+func TestGetMiningRanges(t *testing.T) {
+	if roundTrip(t, CreateGetMiningRanges()).Opcode() != OpGetMiningRanges {
+		t.Fatal("unexpected request opcode")
+	}
+
+	ranges := []*RangeStats{{0, 3, 1000, 2}, {1, -1, 50, 0}}
+	response := roundTrip(t, CreateGetMiningRangesResponse(ranges)).(*GetMiningRangesResponse)
+	if len(response.Ranges()) != len(ranges) {
+		t.Fatal("unexpected range count")
+	}
+	for i, stats := range response.Ranges() {
+		if *stats != *ranges[i] {
+			t.Fatalf("unexpected statistics for range %d", i)
+		}
+	}
+}
+
+// Creates telemetry with a couple of miners and mined blocks.
+func testTelemetry() *MiningTelemetry {
+	telemetry := &MiningTelemetry{}
+	telemetry.BlocksMined = 2
+	telemetry.Attempts = 123456
+	telemetry.MiningTime = 1500 * time.Millisecond
+	telemetry.Hashrate = [3]float64{1000.5, 800, 0}
+	telemetry.Miners = []*MiningStats{{0, 1, 100000}, {1, 1, 23454}}
+	minedAt := time.Unix(1600000000, 250*int64(time.Millisecond)).UTC()
+	telemetry.History = []*MinedBlockStats{
+		{random32(), random32(), minedAt, time.Second, 100000, 0},
+		{random32(), random32(), minedAt.Add(time.Second), 500 * time.Millisecond, 23456, 1},
+	}
+	return telemetry
+}
+
+func TestGetMiningTelemetry(t *testing.T) {
+	request := roundTrip(t, CreateGetMiningTelemetry(10)).(*GetMiningTelemetry)
+	if request.Opcode() != OpGetMiningTelemetry || request.HistoryLength() != 10 {
+		t.Fatal("unexpected request")
+	}
+
+	telemetry := testTelemetry()
+	response := roundTrip(t, CreateGetMiningTelemetryResponse(telemetry)).(*GetMiningTelemetryResponse)
+	received := response.Telemetry()
+	if received.BlocksMined != telemetry.BlocksMined || received.Attempts != telemetry.Attempts ||
+		received.MiningTime != telemetry.MiningTime || received.Hashrate != telemetry.Hashrate {
+		t.Fatal("unexpected totals")
+	}
+	if len(received.Miners) != 2 || *received.Miners[1] != *telemetry.Miners[1] {
+		t.Fatal("unexpected miner statistics")
+	}
+	if len(received.History) != 2 {
+		t.Fatal("unexpected history length")
+	}
+	for i, stats := range received.History {
+		expected := telemetry.History[i]
+		if !stats.Hash.Equals(expected.Hash) || !stats.Difficulty.Equals(expected.Difficulty) ||
+			!stats.MinedAt.Equal(expected.MinedAt) || stats.Duration != expected.Duration ||
+			stats.Attempts != expected.Attempts || stats.MinerId != expected.MinerId {
+			t.Fatalf("unexpected history entry %d", i)
+		}
+	}
+}
+
+func TestGetMiningTelemetryFromLaterVersion(t *testing.T) {
+	// Later versions may append fields, which are skipped.
+	telemetry := testTelemetry()
+	data := CreateGetMiningTelemetryResponse(telemetry).data
+	data = append(data, 1, 2, 3)
+	data[0] = MiningTelemetryVersion + 1
+	data[1] += 3
+
+	buffer := bytes.NewBuffer([]byte{opcodes["GetMiningTelemetryResponse"]})
+	buffer.Write(data)
+	buffer.WriteByte(opcodes["GetMiningTelemetry"])
+	buffer.Write([]byte{0, 0})
+
+	response, err := ReadMessage(buffer)
+	if err != nil {
+		t.Fatalf("could not read response: %s", err.Error())
+	}
+	if response.(*GetMiningTelemetryResponse).Telemetry().Attempts != telemetry.Attempts {
+		t.Fatal("unexpected telemetry")
+	}
+	// The extra fields are not left behind for the next message.
+	if next, err := ReadMessage(buffer); err != nil || next.Opcode() != OpGetMiningTelemetry {
+		t.Fatal("unexpected message after the response")
+	}
+}
+
+func testDeadLetters() []*DeadLetter {
+	failedAt := time.Unix(1600000000, 250*int64(time.Millisecond)).UTC()
+	return []*DeadLetter{
+		{random32(), 1000, random32(), 4, failedAt, "write rejected by the blockchain server"},
+		{random32(), 5, random32(), 1, failedAt.Add(time.Second), ""},
+	}
+}
+
+func TestGetDeadLetters(t *testing.T) {
+	if roundTrip(t, CreateGetDeadLetters()).Opcode() != OpGetDeadLetters {
+		t.Fatal("unexpected request opcode")
+	}
+
+	letters := testDeadLetters()
+	response := roundTrip(t, CreateGetDeadLettersResponse(letters)).(*GetDeadLettersResponse)
+	if len(response.Letters()) != len(letters) {
+		t.Fatal("unexpected letter count")
+	}
+	for i, letter := range response.Letters() {
+		expected := letters[i]
+		if !letter.ContentHash.Equals(expected.ContentHash) || !letter.BlockHash.Equals(expected.BlockHash) ||
+			letter.Length != expected.Length || letter.Failures != expected.Failures ||
+			!letter.FailedAt.Equal(expected.FailedAt) || letter.Reason != expected.Reason {
+			t.Fatalf("unexpected letter %d", i)
+		}
+	}
+}
+
+func TestFindChunk(t *testing.T) {
+	// Write a request and two responses, one for a chunk that was found and one for a chunk
+	// that was not, to a buffer.
+	contentHash := random32()
+	blockHash := random32()
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	if err := CreateFindChunkRequest(contentHash).Write(buffer); err != nil {
+		t.Fatalf("could not write request: %s", err.Error())
+	}
+	if err := CreateFindChunkResponse(true, blockHash, 3, 1234).Write(buffer); err != nil {
+		t.Fatalf("could not write response: %s", err.Error())
+	}
+	if err := CreateFindChunkResponse(false, nil, 0, 0).Write(buffer); err != nil {
+		t.Fatalf("could not write response: %s", err.Error())
+	}
+
+	// Read them back.
+	msg, err := ReadMessage(buffer)
+	if err != nil {
+		t.Fatalf("could not read request: %s", err.Error())
+	}
+	if !msg.(*FindChunkRequest).ContentHash().Equals(contentHash) {
+		t.Fatal("unexpected content hash")
+	}
+	msg, err = ReadMessage(buffer)
+	if err != nil {
+		t.Fatalf("could not read response: %s", err.Error())
+	}
+	response := msg.(*FindChunkResponse)
+	if !response.Found() || !response.BlockHash().Equals(blockHash) {
+		t.Fatal("unexpected block hash")
+	}
+	if response.Entry() != 3 || response.Timestamp() != 1234 {
+		t.Fatal("unexpected chunk location")
+	}
+	msg, err = ReadMessage(buffer)
+	if err != nil {
+		t.Fatalf("could not read response: %s", err.Error())
+	}
+	if msg.(*FindChunkResponse).Found() {
+		t.Fatal("unexpected found flag")
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	// Write an error response to a buffer.
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	if err := CreateErrorResponse(ErrorCodeNotFound, "no such block").Write(buffer); err != nil {
+		t.Fatalf("could not write response: %s", err.Error())
+	}
+
+	// Reading it as a response must yield a typed error.
+	_, err := ReadResponse(bytes.NewReader(buffer.Bytes()))
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	msg, err := ReadMessage(buffer)
+	if err != nil {
+		t.Fatalf("could not read response: %s", err.Error())
+	}
+	response := msg.(*ErrorResponse)
+	if response.Code() != ErrorCodeNotFound || response.Reason() != "no such block" {
+		t.Fatal("unexpected error response")
+	}
+
+	// Error codes must survive being forwarded.
+	if CreateErrorResponseFromError(response.Err()).Code() != ErrorCodeNotFound {
+		t.Fatal("unexpected error code after forwarding")
+	}
+	if CreateErrorResponseFromError(errors.New("connection refused")).Code() != ErrorCodeUnavailable {
+		t.Fatal("unexpected error code for a generic error")
+	}
+}
+
+func TestGetCacheStatistics(t *testing.T) {
+	// Write a request and a response to a buffer.
+	buffer := bytes.NewBuffer(make([]byte, 0))
+	if err := CreateGetCacheStatistics().Write(buffer); err != nil {
+		t.Fatalf("could not write request: %s", err.Error())
+	}
+	blockStats := &CacheStats{10, 2, 5, 1024}
+	minuteStats := &CacheStats{3, 7, 4, 256}
+	if err := CreateGetCacheStatisticsResponse(blockStats, minuteStats).Write(buffer); err != nil {
+		t.Fatalf("could not write response: %s", err.Error())
+	}
+
+	// Read them back.
+	msg, err := ReadMessage(buffer)
+	if err != nil {
+		t.Fatalf("could not read request: %s", err.Error())
+	}
+	if msg.Opcode() != OpGetCacheStatistics {
+		t.Fatal("unexpected request opcode")
+	}
+	msg, err = ReadMessage(buffer)
+	if err != nil {
+		t.Fatalf("could not read response: %s", err.Error())
+	}
+	response := msg.(*GetCacheStatisticsResponse)
+
+	if *response.BlockCacheStats() != *blockStats {
+		t.Fatal("unexpected block cache statistics")
+	}
+	if *response.MinuteCacheStats() != *minuteStats {
+		t.Fatal("unexpected minute cache statistics")
+	}
+}
+
+func TestSubscribeBlocks(t *testing.T) {
+	from := random32()
+	request := roundTrip(t, CreateSubscribeBlocks(from, true)).(*SubscribeBlocksRequest)
+	if !request.HeadersOnly() || !request.From().Equals(from) {
+		t.Fatal("unexpected subscription")
+	}
+	request = roundTrip(t, CreateSubscribeBlocks(nil, false)).(*SubscribeBlocksRequest)
+	if request.HeadersOnly() || request.From() != nil {
+		t.Fatal("unexpected subscription without starting hash")
+	}
+}
+
+func TestBlockNotification(t *testing.T) {
+	block := blockchain.CreateDummyBlock()
+
+	// Whole blocks carry their entries.
+	notification := roundTrip(t, CreateBlockNotification(block, 12, false)).(*BlockNotification)
+	if notification.Height() != 12 || notification.Block() == nil {
+		t.Fatal("unexpected notification")
+	}
+	if !notification.Block().Hash().Equals(block.Hash()) || notification.Block().EntryCount() != block.EntryCount() {
+		t.Fatal("unexpected block")
+	}
+
+	// Headers do not, but keep every other field.
+	notification = roundTrip(t, CreateBlockNotification(block, 13, true)).(*BlockNotification)
+	if notification.Height() != 13 || notification.Block() != nil {
+		t.Fatal("unexpected header notification")
+	}
+	header := notification.Header()
+	if !header.Hash().Equals(block.Hash()) || !header.PreviousHash().Equals(block.PreviousHash()) {
+		t.Fatal("unexpected header hashes")
+	}
+	if header.Timestamp() != block.Timestamp() || header.EntryCount() != block.EntryCount() {
+		t.Fatal("unexpected header fields")
+	}
+}
+
 func random32() *b32.Big32 {
 	buff := make([]byte, 32)
 	rand.Read(buff)
@@ -0,0 +1,415 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"tp1.aba.distros.fi.uba.ar/common/security"
+)
+
+//=================================================================================================
+// Serving requests
+//-------------------------------------------------------------------------------------------------
+
+// Connections are long lived and carry many requests. Servers may handle the requests read from
+// a connection concurrently, and send their responses in whatever order they are ready; the
+// request ID in each response tells clients which request it answers.
+
+// Sends the response to a single request.
+type ResponseWriter interface {
+	WriteMessage(msg Message) error
+	// Closed once the client hangs up, after which no more responses can be sent.
+	Done() <-chan struct{}
+}
+
+type responseWriter struct {
+	conn      *Conn
+	requestId uint32
+	// Whether the client asked for responses carrying blocks to be compressed.
+	compress bool
+}
+
+func (writer *responseWriter) WriteMessage(msg Message) error {
+	var flags uint8 = 0
+	if writer.compress && compressibleOpcodes[msg.Opcode()] {
+		flags = frameFlagCompressed
+	}
+	return writer.conn.writeMessage(msg, writer.requestId, flags)
+}
+
+func (writer *responseWriter) Done() <-chan struct{} {
+	return writer.conn.Done()
+}
+
+// Whether many responses can be pushed through the writer, as they become available, while
+// other requests are served. Clients that do not frame their messages expect one response per
+// request.
+func SupportsPush(writer ResponseWriter) bool {
+	_, framed := writer.(*responseWriter)
+	return framed
+}
+
+// Reads the next request, along with the writer to send its response through. Responses may be
+// written from any goroutine, and in any order.
+func (conn *Conn) ReadRequest() (Message, ResponseWriter, error) {
+	if conn.legacy {
+		msg, err := ReadMessage(conn.reader)
+		return msg, conn, err
+	}
+
+	msg, requestId, err := conn.readMessage()
+	// Error responses sent for requests that could not be read answer the last one.
+	conn.requestId = requestId
+	if err != nil {
+		return nil, nil, err
+	}
+	compress := conn.pendingFlags&frameFlagAcceptsCompression != 0
+	return msg, &responseWriter{conn, requestId, compress}, nil
+}
+
+// Reads requests until the client hangs up, passing each of them to the given handler as a task
+// for the given submit function to run. Returns once all requests were handled. Clients that do
+// not frame their messages are handled one request at a time, since they expect responses in
+// order.
+func (conn *Conn) Serve(handle func(request Message, writer ResponseWriter), submit func(task func())) error {
+	pending := &sync.WaitGroup{}
+	defer pending.Wait()
+	defer conn.hangUp()
+
+	for {
+		request, writer, err := conn.ReadRequest()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		pending.Add(1)
+		submit(func() {
+			defer pending.Done()
+			handle(request, writer)
+		})
+
+		if conn.legacy {
+			pending.Wait()
+		}
+	}
+}
+
+//=================================================================================================
+// Client
+//-------------------------------------------------------------------------------------------------
+
+// A connection to a server through which many requests can be in flight at once. Responses are
+// matched with their requests by ID, so they may arrive in any order. Safe for concurrent use.
+type Client struct {
+	conn   *Conn
+	closer io.Closer
+	lock   sync.Mutex
+	nextId uint32
+	calls  map[uint32]*call
+	// Set once the connection is lost, after which all requests fail.
+	err error
+	// Closed once the connection is lost.
+	closed chan struct{}
+	// Whether to ask for responses carrying blocks to be compressed.
+	compress bool
+}
+
+// A request waiting for its responses.
+type call struct {
+	deliveries chan *delivery
+	// Subscriptions are answered many times, until the connection is closed.
+	subscription bool
+}
+
+type delivery struct {
+	response Message
+	err      error
+	// Closed once the response has been consumed, so that the next one can be read.
+	done chan struct{}
+}
+
+// Connects to the server at the given address, over TLS if configured.
+func Dial(address string) (*Client, error) {
+	netConn, err := security.Dial(address)
+	if err != nil {
+		// The server cannot be reached, so requests cannot be handled for now.
+		return nil, fmt.Errorf("%w: %s", ErrUnavailable, err.Error())
+	}
+	client, err := CreateClient(netConn)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// Starts a client over the given connection, agreeing on a protocol version with the server. The
+// connection is closed along with the client.
+func CreateClient(rwc io.ReadWriteCloser) (*Client, error) {
+	conn, err := Handshake(rwc)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Client{}
+	client.conn = conn
+	client.closer = rwc
+	client.nextId = conn.requestId
+	client.calls = make(map[uint32]*call)
+	client.closed = make(chan struct{})
+	client.compress = compressResponses()
+	go client.receive()
+	return client, nil
+}
+
+// Sends the request and waits for its response. Error responses are turned into errors. Streamed
+// responses must be read with Stream instead.
+func (client *Client) Request(request Message) (Message, error) {
+	var response Message
+	err := client.Stream(request, func(msg Message) error {
+		response = msg
+		return nil
+	})
+	return response, err
+}
+
+// Sends the request and hands the response to the given callback, for responses that are read as
+// they arrive. No other response can be read until the callback returns.
+func (client *Client) Stream(request Message, callback func(Message) error) error {
+	call, err := client.send(request, false)
+	if err != nil {
+		return err
+	}
+	return consume(<-call.deliveries, callback)
+}
+
+// Sends the request and hands each of its responses to the given callback, until an error
+// response arrives, the callback fails or the connection is closed. The connection is closed
+// once done, since the server may still be sending responses.
+func (client *Client) subscribe(request Message, callback func(Message) error) error {
+	defer client.Close()
+
+	call, err := client.send(request, true)
+	if err != nil {
+		return err
+	}
+	for {
+		if err := consume(<-call.deliveries, callback); err != nil {
+			return err
+		}
+	}
+}
+
+// Registers the request and sends it.
+func (client *Client) send(request Message, subscription bool) (*call, error) {
+	// Room for the error delivered when the connection is lost, besides a pending response.
+	call := &call{make(chan *delivery, 2), subscription}
+
+	client.lock.Lock()
+	if client.err != nil {
+		client.lock.Unlock()
+		return nil, client.err
+	}
+	client.nextId++
+	requestId := client.nextId
+	client.calls[requestId] = call
+	client.lock.Unlock()
+
+	var flags uint8 = 0
+	if client.compress {
+		flags = frameFlagAcceptsCompression
+	}
+	if err := client.conn.writeMessage(request, requestId, flags); err != nil {
+		// Part of the request may have been written, so the connection cannot be used anymore.
+		client.fail(err)
+	}
+	return call, nil
+}
+
+// Hands a response to the callback, turning error responses into errors.
+func consume(result *delivery, callback func(Message) error) error {
+	if result.done != nil {
+		defer close(result.done)
+	}
+	if result.err != nil {
+		return result.err
+	}
+
+	if errorResponse, ok := result.response.(*ErrorResponse); ok {
+		return errorResponse.Err()
+	}
+	return callback(result.response)
+}
+
+// Whether the connection was lost or closed.
+func (client *Client) Broken() bool {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	return client.err != nil
+}
+
+// Closes the connection. Requests in flight fail.
+func (client *Client) Close() {
+	client.fail(errors.New("connection closed"))
+}
+
+// Reads responses and hands them to the requests waiting for them, until the connection fails.
+func (client *Client) receive() {
+	for {
+		// Messages that the server could not finish are still read whole, so only the request
+		// they answer fails.
+		response, requestId, err := client.conn.readMessage()
+		if err != nil && !errors.Is(err, ErrMessageAborted) {
+			client.fail(err)
+			return
+		}
+
+		client.lock.Lock()
+		call, found := client.calls[requestId]
+		if found && !call.subscription {
+			delete(client.calls, requestId)
+		}
+		client.lock.Unlock()
+
+		if !found {
+			client.fail(fmt.Errorf("%w: response to unexpected request %d", ErrBadRequest, requestId))
+			return
+		}
+
+		// The response may be read from the connection as it is consumed, so wait until it is.
+		done := make(chan struct{})
+		call.deliveries <- &delivery{response, err, done}
+		select {
+		case <-done:
+		case <-client.closed:
+			// Subscriptions may stop reading responses once the connection is closed.
+			return
+		}
+	}
+}
+
+// Marks the connection as lost, failing all requests waiting for a response.
+func (client *Client) fail(err error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if client.err != nil {
+		return
+	}
+	client.err = fmt.Errorf("%w: connection lost: %s", ErrUnavailable, err.Error())
+	for requestId, call := range client.calls {
+		call.deliveries <- &delivery{nil, client.err, nil}
+		delete(client.calls, requestId)
+	}
+	close(client.closed)
+	client.closer.Close()
+}
+
+// Subscribes to the server at the given address through a connection of its own, handing each
+// response to the given callback as it arrives. Returns once the given channel is closed, without
+// error, or once the subscription ends because of an error response, a failing callback or a lost
+// connection.
+func Subscribe(address string, request Message, done <-chan struct{}, callback func(Message) error) error {
+	client, err := Dial(address)
+	if err != nil {
+		return err
+	}
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-done:
+			client.Close()
+		case <-stopped:
+		}
+	}()
+
+	err = client.subscribe(request, callback)
+	select {
+	case <-done:
+		return nil
+	default:
+		return err
+	}
+}
+
+//=================================================================================================
+// Pool
+//-------------------------------------------------------------------------------------------------
+
+// Keeps up to a fixed amount of connections to a server, which requests are spread across. They
+// are dialed when first needed, and dialed again once lost. Safe for concurrent use.
+type Pool struct {
+	address string
+	clients []*Client
+	next    int
+	lock    sync.Mutex
+}
+
+func CreatePool(address string, size int) *Pool {
+	if size < 1 {
+		size = 1
+	}
+	pool := &Pool{}
+	pool.address = address
+	pool.clients = make([]*Client, size)
+	return pool
+}
+
+// Sends the request through one of the connections and waits for its response.
+func (pool *Pool) Request(request Message) (Message, error) {
+	client, err := pool.get()
+	if err != nil {
+		return nil, err
+	}
+	return client.Request(request)
+}
+
+// Sends the request through one of the connections and hands the response to the given callback.
+func (pool *Pool) Stream(request Message, callback func(Message) error) error {
+	client, err := pool.get()
+	if err != nil {
+		return err
+	}
+	return client.Stream(request, callback)
+}
+
+// Closes all connections.
+func (pool *Pool) Close() {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	for i, client := range pool.clients {
+		if client != nil {
+			client.Close()
+			pool.clients[i] = nil
+		}
+	}
+}
+
+// Get the next connection in turn, dialing it if needed.
+func (pool *Pool) get() (*Client, error) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	index := pool.next
+	pool.next = (pool.next + 1) % len(pool.clients)
+
+	if client := pool.clients[index]; client != nil && !client.Broken() {
+		return client, nil
+	}
+
+	client, err := Dial(pool.address)
+	if err != nil {
+		return nil, err
+	}
+	pool.clients[index] = client
+	return client, nil
+}
@@ -0,0 +1,212 @@
+package message
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+
+	b32 "tp1.aba.distros.fi.uba.ar/common/number/big32"
+)
+
+// Serves block by height requests, answering each one with a block whose timestamp is the
+// requested height. Requests are answered in pairs, the second one first.
+func serveHeights(netConn net.Conn) {
+	conn, err := Accept(netConn, false)
+	if err != nil {
+		return
+	}
+
+	held := make([]func(), 0)
+	conn.Serve(func(request Message, writer ResponseWriter) {
+		block := blockchain.CreateDummyBlock()
+		block.SetCreationTime(time.Unix(request.(*GetBlockByHeightRequest).Height(), 0))
+		held = append(held, func() { writer.WriteMessage(CreateGetBlockByHeightResponse(block)) })
+
+		if len(held) == 2 {
+			held[1]()
+			held[0]()
+			held = held[:0]
+		}
+	}, func(task func()) {
+		// Run tasks in the reading goroutine, which makes the order of responses predictable.
+		task()
+	})
+}
+
+func TestOutOfOrderResponses(t *testing.T) {
+	client, err := CreateClient(pipe(t, serveHeights))
+	if err != nil {
+		t.Fatalf("could not start client: %s", err.Error())
+	}
+	defer client.Close()
+
+	// Responses to concurrent requests arrive in the opposite order.
+	heights := []int64{10, 20}
+	results := make([]int64, len(heights))
+	wg := &sync.WaitGroup{}
+	for i, height := range heights {
+		wg.Add(1)
+		go func(i int, height int64) {
+			defer wg.Done()
+			if response, err := client.Request(CreateGetBlockByHeightRequest(height)); err == nil {
+				results[i] = response.(*GetBlockByHeightResponse).Block().Timestamp()
+			}
+		}(i, height)
+	}
+	wg.Wait()
+
+	for i, height := range heights {
+		if results[i] != height {
+			t.Fatalf("unexpected response to request %d: %d", i, results[i])
+		}
+	}
+}
+
+func TestLostConnections(t *testing.T) {
+	// A server that hangs up without answering.
+	client, err := CreateClient(pipe(t, func(netConn net.Conn) {
+		if conn, err := Accept(netConn, false); err == nil {
+			conn.ReadMessage()
+		}
+	}))
+	if err != nil {
+		t.Fatalf("could not start client: %s", err.Error())
+	}
+
+	if _, err := client.Request(CreateGetMiningInfoRequest()); !errors.Is(err, ErrUnavailable) {
+		t.Fatal("expected the request to fail")
+	}
+	if !client.Broken() {
+		t.Fatal("the connection was not marked as lost")
+	}
+	if _, err := client.Request(CreateGetMiningInfoRequest()); !errors.Is(err, ErrUnavailable) {
+		t.Fatal("expected requests through a lost connection to fail")
+	}
+}
+
+func TestPoolReconnects(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err.Error())
+	}
+	defer listener.Close()
+
+	// Every connection only serves one request.
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer netConn.Close()
+				if conn, err := Accept(netConn, false); err == nil {
+					if _, err := conn.ReadMessage(); err == nil {
+						conn.WriteMessage(CreateGetBlockByHeightResponse(nil))
+					}
+				}
+			}()
+		}
+	}()
+
+	pool := CreatePool(listener.Addr().String(), 1)
+	defer pool.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := pool.Request(CreateGetBlockByHeightRequest(1)); err != nil {
+			t.Fatalf("request %d failed: %s", i, err.Error())
+		}
+		// Wait for the server to hang up before sending the next request.
+		client := pool.clients[0]
+		for !client.Broken() {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// Serves subscriptions by pushing the given amount of notifications, followed by an error
+// response if the amount is odd.
+func servePushes(netConn net.Conn) {
+	defer netConn.Close()
+	conn, err := Accept(netConn, true)
+	if err != nil {
+		return
+	}
+
+	conn.Serve(func(request Message, writer ResponseWriter) {
+		if !SupportsPush(writer) {
+			writer.WriteMessage(CreateErrorResponse(ErrorCodeBadRequest, "push not supported"))
+			return
+		}
+		count := int(request.(*SubscribeBlocksRequest).From().Bytes[31])
+		go func() {
+			for height := 1; height <= count; height++ {
+				notification := CreateBlockNotification(blockchain.CreateDummyBlock(), int64(height), true)
+				if writer.WriteMessage(notification) != nil {
+					return
+				}
+			}
+			if count%2 == 1 {
+				writer.WriteMessage(CreateErrorResponse(ErrorCodeNotFound, "no more blocks"))
+			}
+			<-writer.Done()
+		}()
+	}, func(task func()) { go task() })
+}
+
+func TestSubscribe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err.Error())
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go servePushes(netConn)
+		}
+	}()
+
+	subscribe := func(count uint8, done chan struct{}) (int, error) {
+		from := &b32.Big32{}
+		from.Bytes[31] = count
+		received := 0
+		err := Subscribe(listener.Addr().String(), CreateSubscribeBlocks(from, true), done, func(msg Message) error {
+			received++
+			if msg.(*BlockNotification).Height() != int64(received) {
+				return errors.New("unexpected height")
+			}
+			if received == int(count) && count%2 == 0 {
+				close(done)
+			}
+			return nil
+		})
+		return received, err
+	}
+
+	// Subscriptions last until cancelled, or until the server sends an error response.
+	if received, err := subscribe(4, make(chan struct{})); err != nil || received != 4 {
+		t.Fatalf("unexpected end of subscription after %d notifications: %v", received, err)
+	}
+	if received, err := subscribe(3, make(chan struct{})); !errors.Is(err, ErrNotFound) || received != 3 {
+		t.Fatalf("unexpected end of subscription after %d notifications: %v", received, err)
+	}
+
+	// Clients that do not frame their messages cannot subscribe.
+	netConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect: %s", err.Error())
+	}
+	defer netConn.Close()
+	CreateSubscribeBlocks(nil, false).Write(netConn)
+	if _, err := ReadResponse(netConn); !errors.Is(err, ErrBadRequest) {
+		t.Fatal("expected a legacy subscription to be rejected")
+	}
+}
@@ -20,6 +20,18 @@ func main() {
 	case "blockchain":
 		// Run the blockchain.
 		blockchain.Run()
+	case "verify":
+		// Verify the integrity of the blockchain files.
+		blockchain.Verify()
+	case "reindex":
+		// Rebuild the indexes and the head file from the blockchain files.
+		blockchain.Reindex()
+	case "migrate":
+		// Move blocks from minute files to segments.
+		blockchain.Migrate()
+	case "simulate":
+		// Replay block timestamps through the configured difficulty policy.
+		blockchain.Simulate()
 	case "autoclient":
 		// Run the autoclient.
 		autoclient.Run()
@@ -214,13 +214,18 @@ func writeDataChunk(writerId int, data []byte) {
 		logging.Log(fmt.Sprintf("[Writer %d] Sending write chunk request", writerId))
 	}
 
-	// Instantiate the write chunk request.
-	request := message.CreateWriteChunk(data, uint16(len(data)))
+	// Instantiate the write chunk request, signed if credentials are configured.
+	request, err := message.Sign(message.CreateWriteChunk(data, uint16(len(data))))
+	if err != nil {
+		logging.LogError(fmt.Sprintf("[Writer %d] Could not sign write request", writerId), err)
+		return
+	}
 	serverPort, _ := config.GetIntOrDefault("WriteServerPort", DefaultWriteServerPort)
 	response, err := send(request, serverPort)
 
 	if err != nil {
 		logging.LogError(fmt.Sprintf("[Writer %d] Chunk could not be written", writerId), err)
+		return
 	}
 
 	r := response.(*message.WriteChunkResponse)
@@ -280,27 +285,33 @@ func parseTimestamp(unixTimestamp string) (time.Time, int64, error) {
 //=================================================================================================
 // Network functions.
 //-------------------------------------------------------------------------------------------------
-func send(request message.Message, serverPort int) (message.Message, error) {
-	// Open a connection with the blockchain service.
-	serverName := config.GetStringOrDefault("ServiceHostName", "localhost")
+// Pools of connections to the service, by port, shared by all readers and writers.
+var pools map[int]*message.Pool = make(map[int]*message.Pool)
+var poolLock sync.Mutex
 
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", serverName, serverPort))
+// Get the pool of connections to the service listening on the given port.
+func pool(serverPort int) *message.Pool {
+	poolLock.Lock()
+	defer poolLock.Unlock()
 
-	if err != nil {
-		logging.LogError("Could not connect to server", err)
+	if pool, found := pools[serverPort]; found {
+		return pool
 	}
 
-	defer conn.Close()
+	serverName := config.GetStringOrDefault("ServiceHostName", "localhost")
+	connectionCount, _ := config.GetIntOrDefault("ConnectionCount", 2)
+	pool := message.CreatePool(net.JoinHostPort(serverName, strconv.Itoa(serverPort)), connectionCount)
+	pools[serverPort] = pool
+	return pool
+}
 
-	// Send the request through the channel.
-	if err := request.Write(conn); err != nil {
-		logging.LogError("Could not send message", err)
-	}
-	// Attempt to receive a response.
-	response, err := message.ReadMessage(conn)
+func send(request message.Message, serverPort int) (message.Message, error) {
+	// Send the request through one of the connections with the blockchain service, and wait for
+	// the response. Error responses are turned into errors.
+	response, err := pool(serverPort).Request(request)
 
 	if err != nil {
-		logging.LogError("Could not receive response", err)
+		return nil, fmt.Errorf("request failed: %w", err)
 	}
 
 	return response, nil
@@ -2,6 +2,7 @@ package domain
 
 import (
 	"errors"
+	"fmt"
 	"math/big"
 	"sync"
 	"time"
@@ -15,23 +16,43 @@ import (
 
 type Blockchain struct {
 	writeLock         sync.Mutex
-	repository        *repository.BlockRepository
+	repository        repository.Storage
 	currentDifficulty *number.Big32
-	lastWrite         time.Time
-	minedCount        int
+	// Decides the difficulty of each block from the ones written before it.
+	policy DifficultyPolicy
+	// Subscriptions to the blocks being written.
+	subscriptions map[*Subscription]bool
 }
 
-func CreateBlockchain(repo *repository.BlockRepository) *Blockchain {
+// Creates a blockchain whose difficulty is decided by the default policy.
+func CreateBlockchain(repo repository.Storage) *Blockchain {
+	settings := &DifficultySettings{}
+	settings.TargetBlockTime = int64(defaultTargetBlockTime)
+	settings.Window = defaultDifficultyWindow
+	settings.MinDifficulty = big.NewInt(1)
+	policy, _ := CreateDifficultyPolicy(DifficultyPolicyInterval, settings, time.Now().UTC())
+	return CreateBlockchainWithPolicy(repo, policy)
+}
+
+// Creates a blockchain whose difficulty is decided by the given policy, which continues from the
+// retarget state stored along with the head of the chain.
+func CreateBlockchainWithPolicy(repo repository.Storage, policy DifficultyPolicy) *Blockchain {
 	blockchain := &Blockchain{}
 	blockchain.repository = repo
 	// When booting up, set the current difficulty to be equal to the
-	// difficulty of the block last written, and set the write time
-	// to be now.
+	// difficulty of the block last written.
 	blockchain.currentDifficulty = repo.PreviousBlockDifficulty()
-	blockchain.lastWrite = time.Now().UTC()
-	// Keep track of the amount of blocks mined to update mining
-	// difficulty every fixed amount of successful mining requests.
-	blockchain.minedCount = 0
+	// Without a stored state, such as when the head was written by an earlier version, the
+	// policy starts over as if no block had been written.
+	if state := repo.RetargetState(); len(state) > 0 {
+		if err := policy.Restore(state); err != nil {
+			logging.LogError("Could not restore the retarget state, starting over", err)
+		} else {
+			logging.Log("Restored the retarget state")
+		}
+	}
+	blockchain.policy = policy
+	blockchain.subscriptions = make(map[*Subscription]bool)
 	return blockchain
 }
 
@@ -43,6 +64,10 @@ func (blockchain *Blockchain) CurrentPreviousHash() *number.Big32 {
 	return blockchain.repository.PreviousBlockHash()
 }
 
+func (blockchain *Blockchain) CurrentHeight() int64 {
+	return blockchain.repository.PreviousBlockHeight()
+}
+
 // Writes the given block to the storage. There can be only a single thread
 // writing, although there can be multiple readers reading at the same time.
 func (blockchain *Blockchain) WriteBlock(block *blockchain.Block) error {
@@ -59,39 +84,20 @@ func (blockchain *Blockchain) WriteBlock(block *blockchain.Block) error {
 		return errors.New("unexpected hash value for the given difficulty")
 	}
 
-	// Try writing the block to the storage.
+	// Try writing the block to the storage. The policy only learns about the block once written.
 	var newDifficulty *number.Big32 = nil
-	writeTime := time.Now().UTC()
-
-	computeDifficulty := func() *number.Big32 {
-		// Only update the difficulty every 256 mined blocks.
-		if (blockchain.minedCount % 256) != 0 {
-			// Return difficulty as is. Do not update difficulty yet.
-			newDifficulty = number.Copy(block.Difficulty())
-			return newDifficulty
-		}
-
-		// The block has been accepted, so we mark the successful write attempt
-		// and recompute difficulty.
-		logging.Log("Updating difficulty")
-		deltaSeconds := int64(writeTime.Sub(blockchain.lastWrite).Seconds())
-		// Adjust the amount of seconds to avoid dividing by zero.
-		if deltaSeconds == 0 {
-			deltaSeconds = 1
+	policy := blockchain.policy.Clone()
+	written := &WrittenBlock{}
+	written.Difficulty = block.Difficulty()
+	written.Timestamp = time.Unix(block.Timestamp(), 0).UTC()
+	written.WriteTime = time.Now().UTC()
+
+	computeDifficulty := func() (*number.Big32, []byte) {
+		newDifficulty = policy.Next(written)
+		if !newDifficulty.Equals(written.Difficulty) {
+			logging.Log(fmt.Sprintf("Updating difficulty to %s", newDifficulty.ToBig().String()))
 		}
-
-		// Convert previous difficulty into a big.
-		difficulty := block.Difficulty().ToBig()
-		// The formula is: new difficulty = (previous difficulty)*(12/(deltaSeconds/256))
-		// Compute the denominator.
-		denominator := big.NewInt(deltaSeconds)
-		// Compute the numerator.
-		numerator := new(big.Int).Mul(difficulty, big.NewInt(12*256))
-
-		// Compute the division.
-		difficulty = new(big.Int).Div(numerator, denominator)
-		newDifficulty = number.FromBig(difficulty)
-		return newDifficulty
+		return newDifficulty, policy.State()
 	}
 
 	if err := blockchain.repository.Save(block, computeDifficulty); err != nil {
@@ -100,8 +106,8 @@ func (blockchain *Blockchain) WriteBlock(block *blockchain.Block) error {
 
 	// Keep track of the current difficulty.
 	blockchain.currentDifficulty = newDifficulty
-	blockchain.lastWrite = writeTime
-	blockchain.minedCount++
+	blockchain.policy = policy
+	blockchain.publish(block, blockchain.repository.PreviousBlockHeight())
 	return nil
 }
 
@@ -109,6 +115,23 @@ func (blockchain *Blockchain) GetOneWithHash(hash *number.Big32) (*blockchain.Bl
 	return blockchain.repository.GetOneWithHash(hash)
 }
 
+func (blockchain *Blockchain) GetOneWithHeight(height int64) (*blockchain.Block, error) {
+	return blockchain.repository.GetOneWithHeight(height)
+}
+
 func (blockchain *Blockchain) GetBlocksFromMinute(timestamp time.Time) ([]*blockchain.Block, error) {
 	return blockchain.repository.GetBlocksFromMinute(timestamp)
 }
+
+func (blockchain *Blockchain) FindChunk(contentHash *number.Big32) (*repository.ChunkLocation, error) {
+	return blockchain.repository.FindChunk(contentHash)
+}
+
+// Get the usage of the block cache and of the minute cache. Both are empty if the storage is
+// not cached.
+func (blockchain *Blockchain) CacheStats() (*repository.CacheStats, *repository.CacheStats) {
+	if cached, ok := blockchain.repository.(*repository.CachedStorage); ok {
+		return cached.CacheStats()
+	}
+	return &repository.CacheStats{}, &repository.CacheStats{}
+}
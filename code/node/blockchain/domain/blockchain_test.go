@@ -1,6 +1,7 @@
 package domain
 
 import (
+	"bytes"
 	"testing"
 	"time"
 
@@ -10,8 +11,17 @@ import (
 )
 
 func TestBlockchain(t *testing.T) {
+	// Run the same tests against every storage backend.
+	for _, backend := range []string{repository.StorageBackendFile, repository.StorageBackendMemory} {
+		t.Run(backend, func(t *testing.T) {
+			testBlockchain(t, backend)
+		})
+	}
+}
+
+func testBlockchain(t *testing.T, backend string) {
 	// Instantiate a repository and ensure cleanup.
-	repo := createRepository(t)
+	repo := createRepository(t, backend)
 	defer repo.Cleanup()
 	// Instantiate the blockchain itself.
 	blockchain := CreateBlockchain(repo)
@@ -23,14 +33,50 @@ func TestBlockchain(t *testing.T) {
 	testRetrievalByTimestamp(blockchain, t)
 }
 
-func createRepository(t *testing.T) *repository.BlockRepository {
-	repo, err := repository.CreateBlockRepository()
+func TestRetargetStateSurvivesRestarts(t *testing.T) {
+	repo := createRepository(t, repository.StorageBackendFile)
+	defer repo.Cleanup()
+	policy, _ := CreateDifficultyPolicy(DifficultyPolicyInterval, testSettings(3), time.Now().UTC())
+	blockchain := CreateBlockchainWithPolicy(repo, policy)
+
+	for i := 0; i < 2; i++ {
+		block := blocks.CreateDummyBlockWithKnownData(
+			blockchain.CurrentPreviousHash(),
+			blockchain.CurrentDifficulty())
+		mine(block)
+		if err := blockchain.WriteBlock(block); err != nil {
+			t.Fatalf("could not write block: %s", err.Error())
+		}
+	}
+
+	// A blockchain created later from the same files continues the current window instead of
+	// starting a new one.
+	later, _ := CreateDifficultyPolicy(DifficultyPolicyInterval, testSettings(3), time.Now().Add(time.Hour))
+	restarted := CreateBlockchainWithPolicy(createRepository(t, repository.StorageBackendFile), later)
+	if !restarted.CurrentDifficulty().Equals(blockchain.CurrentDifficulty()) {
+		t.Fatal("unexpected difficulty after restarting")
+	}
+	if !bytes.Equal(restarted.policy.State(), blockchain.policy.State()) {
+		t.Fatal("unexpected retarget state after restarting")
+	}
+}
+
+func createRepository(t *testing.T, backend string) repository.Storage {
+	t.Setenv("StorageBackend", backend)
+
+	repo, err := repository.CreateStorage()
 	if err != nil {
 		t.Fatal("could not create repository")
 	}
 	return repo
 }
 
+// Finds a nonce for which the hash of the block is valid for its difficulty.
+func mine(block *blocks.Block) {
+	for !block.AttemptHash() {
+	}
+}
+
 func validateSeedStatus(blockchain *Blockchain, t *testing.T) {
 	if !blockchain.CurrentDifficulty().IsOne() {
 		t.Fatal("unexpected initial difficulty")
@@ -81,7 +127,10 @@ func testRetrievalByTimestamp(blockchain *Blockchain, t *testing.T) {
 	timeA := time.Now().UTC().Add(10 * time.Minute)
 	timeA = timeA.Add(-time.Duration(timeA.Second()) * time.Second)
 	blockA.SetCreationTime(timeA)
-	blockchain.WriteBlock(blockA)
+	mine(blockA)
+	if err := blockchain.WriteBlock(blockA); err != nil {
+		t.Fatalf("could not write block A: %s", err.Error())
+	}
 
 	// Create a second block a few seconds after the current one.
 	blockB := blocks.CreateDummyBlockWithKnownData(
@@ -90,7 +139,10 @@ func testRetrievalByTimestamp(blockchain *Blockchain, t *testing.T) {
 
 	timeB := timeA.Add(5 * time.Second)
 	blockB.SetCreationTime(timeB)
-	blockchain.WriteBlock(blockB)
+	mine(blockB)
+	if err := blockchain.WriteBlock(blockB); err != nil {
+		t.Fatalf("could not write block B: %s", err.Error())
+	}
 
 	// Attempt to retrieve the blocks in the minute of time A.
 	blocks, err := blockchain.GetBlocksFromMinute(timeA)
@@ -110,4 +162,12 @@ func testRetrievalByTimestamp(blockchain *Blockchain, t *testing.T) {
 	if !blocks[1].Hash().Equals(blockB.Hash()) {
 		t.Fatal("unexpected hash in block B")
 	}
+
+	// Ensure that heights were assigned in order.
+	if blockchain.CurrentHeight() != 3 {
+		t.Fatalf("unexpected height: %d", blockchain.CurrentHeight())
+	}
+	if retrieved, _ := blockchain.GetOneWithHeight(3); retrieved == nil || !retrieved.Hash().Equals(blockB.Hash()) {
+		t.Fatal("unexpected block with height 3")
+	}
 }
@@ -0,0 +1,113 @@
+package domain
+
+import (
+	"time"
+
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+)
+
+// Iterates through the blocks created in a time range, in the order in which they were written.
+// Only the blocks of a single minute are held in memory at any time.
+type BlockRangeIterator struct {
+	blockchain *Blockchain
+	from       time.Time
+	to         time.Time
+	// The maximum amount of blocks to return.
+	limit int
+	// The minutes with blocks in the range, and the position of the current one.
+	minutes     []time.Time
+	minuteIndex int
+	// The blocks of the current minute, and the position of the next one to look at.
+	blocks     []*blockchain.Block
+	blockIndex int
+	// The amount of blocks returned so far.
+	returned int
+}
+
+// Iterates through the blocks created from the first time (inclusive) to the last one
+// (exclusive), returning at most limit blocks. The iteration starts from the given minute,
+// skipping the given amount of blocks of that minute, if that is later than the start of
+// the range.
+func (blockchain *Blockchain) ReadBlocksInRange(
+	from time.Time, to time.Time, limit int, startMinute time.Time, skip int) (*BlockRangeIterator, error) {
+
+	it := &BlockRangeIterator{}
+	it.blockchain = blockchain
+	it.from = from
+	it.to = to
+	it.limit = limit
+
+	// Start from the minute given by the cursor, if it is within the range.
+	start := from
+	if startMinute.After(from) {
+		start = startMinute
+	}
+	if minutes, err := blockchain.repository.MinutesWithBlocks(start, to); err != nil {
+		return nil, err
+	} else {
+		it.minutes = minutes
+	}
+	if len(it.minutes) > 0 && it.minutes[0].Equal(startMinute) {
+		it.blockIndex = skip
+	}
+
+	return it, nil
+}
+
+// Get the next block in the range, or nil if there are no more blocks or the limit was reached.
+func (it *BlockRangeIterator) Next() (*blockchain.Block, error) {
+	if it.returned >= it.limit {
+		return nil, nil
+	}
+	if found, err := it.seek(); err != nil || !found {
+		return nil, err
+	}
+
+	block := it.blocks[it.blockIndex]
+	it.blockIndex++
+	it.returned++
+	return block, nil
+}
+
+// Moves on to the next block in the range without consuming it. Returns false if there are no
+// more blocks in the range.
+func (it *BlockRangeIterator) seek() (bool, error) {
+	for it.minuteIndex < len(it.minutes) {
+		// Load the blocks of the current minute if needed.
+		if it.blocks == nil {
+			blocks, err := it.blockchain.repository.GetBlocksFromMinute(it.minutes[it.minuteIndex])
+			if err != nil {
+				return false, err
+			}
+			it.blocks = blocks
+		}
+
+		// Move on to the next minute once all blocks of the current one were seen.
+		if it.blockIndex >= len(it.blocks) {
+			it.minuteIndex++
+			it.blockIndex = 0
+			it.blocks = nil
+			continue
+		}
+
+		// The first and last minutes may have blocks out of the range.
+		timestamp := time.Unix(it.blocks[it.blockIndex].Timestamp(), 0)
+		if timestamp.Before(it.from) || !timestamp.Before(it.to) {
+			it.blockIndex++
+			continue
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// Get the position from which to continue the iteration: the minute of the next block and the
+// amount of blocks of that minute already seen. The third value is false if there are no more
+// blocks in the range, so that the limit being reached on the last block does not lead to an
+// empty page.
+func (it *BlockRangeIterator) Cursor() (time.Time, int, bool, error) {
+	if found, err := it.seek(); err != nil || !found {
+		return time.Time{}, 0, false, err
+	}
+	return it.minutes[it.minuteIndex], it.blockIndex, true, nil
+}
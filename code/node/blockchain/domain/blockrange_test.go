@@ -0,0 +1,94 @@
+package domain
+
+import (
+	"testing"
+	"time"
+
+	"tp1.aba.distros.fi.uba.ar/node/blockchain/repository"
+
+	blocks "tp1.aba.distros.fi.uba.ar/interface/blockchain"
+)
+
+// Writes two blocks in each one of five consecutive minutes from the given time.
+func writeBlocksInMinutes(t *testing.T, blockchain *Blockchain, start time.Time) []*blocks.Block {
+	written := make([]*blocks.Block, 0)
+	for i := 0; i < 10; i++ {
+		block := blocks.CreateDummyBlockWithKnownData(
+			blockchain.CurrentPreviousHash(),
+			blockchain.CurrentDifficulty())
+		block.SetCreationTime(start.Add(time.Duration(i*30) * time.Second))
+		mine(block)
+		if err := blockchain.WriteBlock(block); err != nil {
+			t.Fatalf("could not write block %d: %s", i, err.Error())
+		}
+		written = append(written, block)
+	}
+	return written
+}
+
+// Reads the given range the given amount of blocks at a time, following cursors. Returns the
+// blocks read and the amount of pages it took.
+func readPages(t *testing.T, blockchain *Blockchain, from time.Time, to time.Time, limit int) ([]*blocks.Block, int) {
+	read := make([]*blocks.Block, 0)
+	var minute time.Time
+	skip := 0
+	for pages := 1; ; pages++ {
+		if pages > 10 {
+			t.Fatal("the iteration does not end")
+		}
+		it, err := blockchain.ReadBlocksInRange(from, to, limit, minute, skip)
+		if err != nil {
+			t.Fatalf("could not read range: %s", err.Error())
+		}
+		for block, _ := it.Next(); block != nil; block, _ = it.Next() {
+			read = append(read, block)
+		}
+		var more bool
+		if minute, skip, more, err = it.Cursor(); err != nil {
+			t.Fatalf("could not get cursor: %s", err.Error())
+		} else if !more {
+			return read, pages
+		}
+	}
+}
+
+func TestReadBlocksInRange(t *testing.T) {
+	blockchain := CreateBlockchain(repository.CreateMemoryRepository())
+	start := time.Now().UTC().Truncate(time.Minute)
+	written := writeBlocksInMinutes(t, blockchain, start)
+
+	// Read the blocks from the middle of the second minute to the end of the fourth one, three
+	// at a time.
+	from := start.Add(90 * time.Second)
+	to := start.Add(4 * time.Minute)
+	expected := written[3:8]
+	read, pages := readPages(t, blockchain, from, to, 3)
+
+	if pages != 2 {
+		t.Fatalf("unexpected page count: %d", pages)
+	}
+	if len(read) != len(expected) {
+		t.Fatalf("unexpected block count: %d", len(read))
+	}
+	for i := range expected {
+		if !read[i].Hash().Equals(expected[i].Hash()) {
+			t.Fatalf("unexpected block %d", i)
+		}
+	}
+}
+
+func TestReadBlocksInRangeEndingOnLimit(t *testing.T) {
+	blockchain := CreateBlockchain(repository.CreateMemoryRepository())
+	start := time.Now().UTC().Truncate(time.Minute)
+	writeBlocksInMinutes(t, blockchain, start)
+
+	// Ranges that end on the last block of a page, either in the middle of a minute or with
+	// the last block written, take no extra page.
+	for _, count := range []int{5, 10} {
+		to := start.Add(time.Duration(count*30) * time.Second)
+		read, pages := readPages(t, blockchain, start, to, 5)
+		if len(read) != count || pages != count/5 {
+			t.Fatalf("read %d blocks in %d pages", len(read), pages)
+		}
+	}
+}
@@ -0,0 +1,437 @@
+package domain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"time"
+
+	"tp1.aba.distros.fi.uba.ar/common/config"
+	number "tp1.aba.distros.fi.uba.ar/common/number/big32"
+)
+
+//=================================================================================================
+// Difficulty policies
+//-------------------------------------------------------------------------------------------------
+
+// The difficulty of each block is decided from the blocks written before it by the policy named
+// DifficultyPolicy in configuration:
+//
+// interval : every window of blocks, scales the difficulty by how long the last block took to
+//            write compared to the target for the whole window, as measured by the clock of the
+//            server. The default, which retargets as the server always did.
+// epoch    : like interval, but compares how long the whole window took to write with the target
+//            for it, so that a single fast or slow block does not decide the difficulty.
+// window   : after every block, sets the difficulty to the average difficulty of the last window
+//            of blocks, scaled by how long their timestamps say that they took to mine compared
+//            to the target.
+// ema      : after every block, sets the difficulty to an exponential moving average of the
+//            difficulty of blocks, scaled by how an exponential moving average of the time
+//            between their timestamps compares to the target. Averages are smoothed over the
+//            window, and adjustments are clamped to a factor of 4 unless configured otherwise.
+//
+// Policies are tuned with:
+//
+// TargetBlockTime         : the seconds that mining a block should take, 12 by default
+// DifficultyWindow        : the amount of blocks that policies look at, 256 by default
+// MaxDifficultyAdjustment : the most that the difficulty may be multiplied or divided by at once,
+//                           unlimited if zero
+// MinDifficulty           : the lowest difficulty allowed, 1 by default
+//
+// What each policy knows about the blocks written is stored along with the head of the chain, so
+// that restarting the server does not change the difficulties that follow.
+
+const DifficultyPolicyInterval string = "interval"
+const DifficultyPolicyEpoch string = "epoch"
+const DifficultyPolicyWindow string = "window"
+const DifficultyPolicyEMA string = "ema"
+
+const defaultTargetBlockTime int = 12
+const defaultDifficultyWindow int = 256
+const defaultEMAMaxAdjustment float64 = 4
+
+// Returned when configuration names a difficulty policy that does not exist.
+var ErrUnknownDifficultyPolicy error = errors.New("unknown difficulty policy")
+
+// Returned when restoring a policy from a state that it did not save.
+var ErrInvalidDifficultyState error = errors.New("invalid difficulty policy state")
+
+// The highest difficulty that fits in a block.
+var maxDifficulty *big.Int = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+
+// Decides the difficulty of the block that follows each block written.
+type DifficultyPolicy interface {
+	// Get the difficulty that the block after the given one must have. Called once for every
+	// block written, in order.
+	Next(block *WrittenBlock) *number.Big32
+	// Get a copy of the policy, which can be handed the next block without changing the original
+	// until the block is known to be written.
+	Clone() DifficultyPolicy
+	// Get what the policy knows about the blocks written so far, to be stored along with the head
+	// of the chain.
+	State() []byte
+	// Continues from a state returned by State, so that the difficulties that follow are the same
+	// as if the policy had been handed every block written. Leaves the policy as it was if the
+	// state can not be read.
+	Restore(state []byte) error
+}
+
+// What policies know about a block written.
+type WrittenBlock struct {
+	Difficulty *number.Big32
+	// The timestamp set by the miner of the block.
+	Timestamp time.Time
+	// When the block was written by the server.
+	WriteTime time.Time
+}
+
+type DifficultySettings struct {
+	// The seconds that mining a block should take.
+	TargetBlockTime int64
+	// The amount of blocks that policies look at.
+	Window int
+	// The most that the difficulty may be multiplied or divided by at once, unlimited if zero.
+	MaxAdjustment float64
+	MinDifficulty *big.Int
+}
+
+// Reads the settings of the given policy from configuration.
+func DifficultySettingsFromConfig(policy string) (*DifficultySettings, error) {
+	settings := &DifficultySettings{}
+	target, err := config.GetIntOrDefault("TargetBlockTime", defaultTargetBlockTime)
+	if err != nil || target < 1 {
+		return nil, fmt.Errorf("invalid target block time %s", config.GetStringOrDefault("TargetBlockTime", ""))
+	}
+	settings.TargetBlockTime = int64(target)
+
+	settings.Window, err = config.GetIntOrDefault("DifficultyWindow", defaultDifficultyWindow)
+	if err != nil || settings.Window < 1 {
+		return nil, fmt.Errorf("invalid difficulty window %s", config.GetStringOrDefault("DifficultyWindow", ""))
+	}
+
+	defaultMaxAdjustment := 0.0
+	if policy == DifficultyPolicyEMA {
+		defaultMaxAdjustment = defaultEMAMaxAdjustment
+	}
+	settings.MaxAdjustment, err = config.GetFloatOrDefault("MaxDifficultyAdjustment", defaultMaxAdjustment)
+	if err != nil || (settings.MaxAdjustment != 0 && settings.MaxAdjustment < 1) {
+		return nil, fmt.Errorf("invalid maximum difficulty adjustment %s",
+			config.GetStringOrDefault("MaxDifficultyAdjustment", ""))
+	}
+
+	minimum := config.GetStringOrDefault("MinDifficulty", "1")
+	settings.MinDifficulty = new(big.Int)
+	if _, ok := settings.MinDifficulty.SetString(minimum, 10); !ok || settings.MinDifficulty.Sign() <= 0 {
+		return nil, fmt.Errorf("invalid minimum difficulty %s", minimum)
+	}
+	return settings, nil
+}
+
+// Creates the policy selected in configuration. The clock of the server is taken to have started
+// measuring at the given time.
+func DifficultyPolicyFromConfig(start time.Time) (DifficultyPolicy, error) {
+	name := config.GetStringOrDefault("DifficultyPolicy", DifficultyPolicyInterval)
+	settings, err := DifficultySettingsFromConfig(name)
+	if err != nil {
+		return nil, err
+	}
+	return CreateDifficultyPolicy(name, settings, start)
+}
+
+func CreateDifficultyPolicy(name string, settings *DifficultySettings, start time.Time) (DifficultyPolicy, error) {
+	switch name {
+	case DifficultyPolicyInterval:
+		return &intervalPolicy{settings: settings, since: start}, nil
+	case DifficultyPolicyEpoch:
+		return &intervalPolicy{settings: settings, wholeWindow: true, since: start}, nil
+	case DifficultyPolicyWindow:
+		return &windowPolicy{settings: settings}, nil
+	case DifficultyPolicyEMA:
+		return &emaPolicy{settings: settings}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownDifficultyPolicy, name)
+	}
+}
+
+// Clamps the difficulty that follows the given one to the configured limits.
+func (settings *DifficultySettings) limit(previous *big.Int, next *big.Int) *number.Big32 {
+	if settings.MaxAdjustment > 0 {
+		factor := new(big.Float).SetFloat64(settings.MaxAdjustment)
+		highest, _ := new(big.Float).Mul(new(big.Float).SetInt(previous), factor).Int(nil)
+		lowest, _ := new(big.Float).Quo(new(big.Float).SetInt(previous), factor).Int(nil)
+		if next.Cmp(highest) > 0 {
+			next = highest
+		} else if next.Cmp(lowest) < 0 {
+			next = lowest
+		}
+	}
+	if next.Cmp(settings.MinDifficulty) < 0 {
+		next = settings.MinDifficulty
+	}
+	if next.Cmp(maxDifficulty) > 0 {
+		next = maxDifficulty
+	}
+	return number.FromBig(next)
+}
+
+// Every state starts with a byte telling the policy that saved it, so that a policy does not
+// continue from the state of another one after configuration changes.
+const (
+	intervalStateKind byte = iota + 1
+	windowStateKind
+	emaStateKind
+	epochStateKind
+)
+
+// Checks that the given state was saved by the kind of policy given and has at least the given
+// length, and returns what follows the kind.
+func readState(state []byte, kind byte, length int) ([]byte, error) {
+	if len(state) < 1+length || state[0] != kind {
+		return nil, ErrInvalidDifficultyState
+	}
+	return state[1:], nil
+}
+
+// The seconds between two times, at least one, so that they can be divided by.
+func secondsBetween(from time.Time, to time.Time) int64 {
+	if seconds := int64(to.Sub(from).Seconds()); seconds > 0 {
+		return seconds
+	}
+	return 1
+}
+
+//-------------------------------------------------------------------------------------------------
+
+type intervalPolicy struct {
+	settings *DifficultySettings
+	// Whether to measure the time taken by the whole window, rather than by its last block.
+	wholeWindow bool
+	// The blocks written in the current window, and the time from which the next retarget
+	// measures: when the previous block was written, or when the window started.
+	count int
+	since time.Time
+}
+
+// Retargets with the first block written and then after every window of blocks.
+func (policy *intervalPolicy) Next(block *WrittenBlock) *number.Big32 {
+	retarget := policy.count == 0
+	policy.count = (policy.count + 1) % policy.settings.Window
+	since := policy.since
+	if retarget || !policy.wholeWindow {
+		policy.since = block.WriteTime
+	}
+	if !retarget {
+		return number.Copy(block.Difficulty)
+	}
+
+	// The formula is: new difficulty = (previous difficulty)*(target/(elapsed/window))
+	elapsed := secondsBetween(since, block.WriteTime)
+	previous := block.Difficulty.ToBig()
+	numerator := new(big.Int).Mul(previous, big.NewInt(policy.settings.TargetBlockTime*int64(policy.settings.Window)))
+	return policy.settings.limit(previous, numerator.Div(numerator, big.NewInt(elapsed)))
+}
+
+func (policy *intervalPolicy) Clone() DifficultyPolicy {
+	clone := *policy
+	return &clone
+}
+
+func (policy *intervalPolicy) stateKind() byte {
+	if policy.wholeWindow {
+		return epochStateKind
+	}
+	return intervalStateKind
+}
+
+// The state is the amount of blocks written in the current window (4 bytes) and the time the
+// next retarget measures from, in nanoseconds since the epoch (8 bytes).
+func (policy *intervalPolicy) State() []byte {
+	state := make([]byte, 13)
+	state[0] = policy.stateKind()
+	binary.LittleEndian.PutUint32(state[1:5], uint32(policy.count))
+	binary.LittleEndian.PutUint64(state[5:13], uint64(policy.since.UnixNano()))
+	return state
+}
+
+func (policy *intervalPolicy) Restore(state []byte) error {
+	fields, err := readState(state, policy.stateKind(), 12)
+	if err != nil {
+		return err
+	}
+	// The window may have been configured shorter since the state was saved.
+	policy.count = int(binary.LittleEndian.Uint32(fields[0:4])) % policy.settings.Window
+	policy.since = time.Unix(0, int64(binary.LittleEndian.Uint64(fields[4:12]))).UTC()
+	return nil
+}
+
+//-------------------------------------------------------------------------------------------------
+
+type windowPolicy struct {
+	settings *DifficultySettings
+	// The last blocks written, up to one more than the window, oldest first.
+	blocks []*WrittenBlock
+}
+
+func (policy *windowPolicy) Next(block *WrittenBlock) *number.Big32 {
+	policy.blocks = append(policy.blocks, block)
+	if excess := len(policy.blocks) - policy.settings.Window - 1; excess > 0 {
+		policy.blocks = policy.blocks[excess:]
+	}
+	if len(policy.blocks) < 2 {
+		return number.Copy(block.Difficulty)
+	}
+
+	// The time taken to mine the blocks after the first one is given by their timestamps, so
+	// the formula is: new difficulty = (sum of their difficulties)*target/(time taken)
+	first := policy.blocks[0]
+	elapsed := secondsBetween(first.Timestamp, block.Timestamp)
+	sum := new(big.Int)
+	for _, written := range policy.blocks[1:] {
+		sum.Add(sum, written.Difficulty.ToBig())
+	}
+	sum.Mul(sum, big.NewInt(policy.settings.TargetBlockTime))
+	return policy.settings.limit(block.Difficulty.ToBig(), sum.Div(sum, big.NewInt(elapsed)))
+}
+
+func (policy *windowPolicy) Clone() DifficultyPolicy {
+	clone := *policy
+	clone.blocks = append([]*WrittenBlock{}, policy.blocks...)
+	return &clone
+}
+
+// Each block kept takes this many bytes of state: its difficulty and its timestamp.
+const windowBlockStateLength int = 40
+
+// The state is the amount of blocks kept (4 bytes), followed by the difficulty (32 bytes) and the
+// timestamp in seconds since the epoch (8 bytes) of each of them, oldest first. Only timestamps
+// are used by the policy, so the time at which blocks were written is not kept.
+func (policy *windowPolicy) State() []byte {
+	state := make([]byte, 5+len(policy.blocks)*windowBlockStateLength)
+	state[0] = windowStateKind
+	binary.LittleEndian.PutUint32(state[1:5], uint32(len(policy.blocks)))
+	for i, block := range policy.blocks {
+		entry := state[5+i*windowBlockStateLength:]
+		copy(entry[0:32], block.Difficulty.Bytes[:])
+		binary.LittleEndian.PutUint64(entry[32:40], uint64(block.Timestamp.Unix()))
+	}
+	return state
+}
+
+func (policy *windowPolicy) Restore(state []byte) error {
+	fields, err := readState(state, windowStateKind, 4)
+	if err != nil {
+		return err
+	}
+	count := int(binary.LittleEndian.Uint32(fields[0:4]))
+	if len(fields) != 4+count*windowBlockStateLength {
+		return ErrInvalidDifficultyState
+	}
+
+	blocks := make([]*WrittenBlock, count)
+	for i := range blocks {
+		entry := fields[4+i*windowBlockStateLength:]
+		block := &WrittenBlock{}
+		block.Difficulty = &number.Big32{}
+		copy(block.Difficulty.Bytes[:], entry[0:32])
+		block.Timestamp = time.Unix(int64(binary.LittleEndian.Uint64(entry[32:40])), 0).UTC()
+		block.WriteTime = block.Timestamp
+		blocks[i] = block
+	}
+	// The window may have been configured shorter since the state was saved.
+	if excess := len(blocks) - policy.settings.Window - 1; excess > 0 {
+		blocks = blocks[excess:]
+	}
+	policy.blocks = blocks
+	return nil
+}
+
+//-------------------------------------------------------------------------------------------------
+
+type emaPolicy struct {
+	settings *DifficultySettings
+	// The averages of the difficulty of blocks and of the seconds between their timestamps, and
+	// the timestamp of the last block, unset until a block is written.
+	difficulty    *big.Float
+	interval      float64
+	lastTimestamp time.Time
+}
+
+// Intervals are averaged from this value up, so that the average can be divided by.
+const minimumAverageInterval float64 = 0.001
+
+func (policy *emaPolicy) Next(block *WrittenBlock) *number.Big32 {
+	previous := block.Difficulty.ToBig()
+	if policy.difficulty == nil {
+		// Start from the current difficulty being right on target.
+		policy.difficulty = new(big.Float).SetInt(previous)
+		policy.interval = float64(policy.settings.TargetBlockTime)
+		policy.lastTimestamp = block.Timestamp
+		return number.Copy(block.Difficulty)
+	}
+
+	// Smooth as a moving average over the window would.
+	alpha := 2 / (float64(policy.settings.Window) + 1)
+	interval := block.Timestamp.Sub(policy.lastTimestamp).Seconds()
+	if interval < 0 {
+		interval = 0
+	}
+	policy.lastTimestamp = block.Timestamp
+	policy.interval = alpha*interval + (1-alpha)*policy.interval
+	if policy.interval < minimumAverageInterval {
+		policy.interval = minimumAverageInterval
+	}
+	policy.difficulty = new(big.Float).Add(
+		new(big.Float).Mul(big.NewFloat(alpha), new(big.Float).SetInt(previous)),
+		new(big.Float).Mul(big.NewFloat(1-alpha), policy.difficulty))
+
+	// The formula is: new difficulty = (average difficulty)*target/(average interval), rounded
+	factor := float64(policy.settings.TargetBlockTime) / policy.interval
+	next, _ := new(big.Float).Add(
+		new(big.Float).Mul(policy.difficulty, big.NewFloat(factor)), big.NewFloat(0.5)).Int(nil)
+	return policy.settings.limit(previous, next)
+}
+
+func (policy *emaPolicy) Clone() DifficultyPolicy {
+	clone := *policy
+	return &clone
+}
+
+// The state is empty until a block is written. Then it is the average interval (8 bytes), the
+// timestamp of the last block in seconds since the epoch (8 bytes), and the average difficulty,
+// which keeps its fractional part.
+func (policy *emaPolicy) State() []byte {
+	if policy.difficulty == nil {
+		return []byte{emaStateKind}
+	}
+	difficulty, _ := policy.difficulty.GobEncode()
+	state := make([]byte, 17, 17+len(difficulty))
+	state[0] = emaStateKind
+	binary.LittleEndian.PutUint64(state[1:9], math.Float64bits(policy.interval))
+	binary.LittleEndian.PutUint64(state[9:17], uint64(policy.lastTimestamp.Unix()))
+	return append(state, difficulty...)
+}
+
+func (policy *emaPolicy) Restore(state []byte) error {
+	fields, err := readState(state, emaStateKind, 0)
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		policy.difficulty = nil
+		return nil
+	}
+	if len(fields) < 16 {
+		return ErrInvalidDifficultyState
+	}
+
+	difficulty := new(big.Float)
+	if err := difficulty.GobDecode(fields[16:]); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidDifficultyState, err.Error())
+	}
+	policy.difficulty = difficulty
+	policy.interval = math.Float64frombits(binary.LittleEndian.Uint64(fields[0:8]))
+	policy.lastTimestamp = time.Unix(int64(binary.LittleEndian.Uint64(fields[8:16])), 0).UTC()
+	return nil
+}
@@ -0,0 +1,194 @@
+package domain
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	number "tp1.aba.distros.fi.uba.ar/common/number/big32"
+)
+
+func testSettings(window int) *DifficultySettings {
+	settings := &DifficultySettings{}
+	settings.TargetBlockTime = 10
+	settings.Window = window
+	settings.MinDifficulty = big.NewInt(1)
+	return settings
+}
+
+// Hands the policy blocks written the given seconds apart, starting from the given difficulty,
+// and returns the difficulty after each of them.
+func replay(policy DifficultyPolicy, start time.Time, difficulty int64, intervals ...int64) []int64 {
+	current := number.FromBig(big.NewInt(difficulty))
+	timestamp := start
+	difficulties := make([]int64, 0, len(intervals))
+	for _, interval := range intervals {
+		timestamp = timestamp.Add(time.Duration(interval) * time.Second)
+		current = policy.Next(&WrittenBlock{current, timestamp, timestamp})
+		difficulties = append(difficulties, current.ToBig().Int64())
+	}
+	return difficulties
+}
+
+func expectDifficulties(t *testing.T, policy string, actual []int64, expected ...int64) {
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Fatalf("%s: unexpected difficulties %v, expected %v", policy, actual, expected)
+		}
+	}
+}
+
+func TestIntervalPolicy(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	policy, _ := CreateDifficultyPolicy(DifficultyPolicyInterval, testSettings(4), start)
+
+	// The first block retargets, and then every fourth block does, measuring from the block
+	// before it.
+	difficulties := replay(policy, start, 100, 40, 5, 5, 5, 5, 20, 20, 20, 20)
+	expectDifficulties(t, "interval", difficulties, 100, 100, 100, 100, 800, 800, 800, 800, 1600)
+}
+
+func TestEpochPolicy(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	policy, _ := CreateDifficultyPolicy(DifficultyPolicyEpoch, testSettings(4), start)
+
+	// The first block retargets, and then every fourth block does, measuring from the last one
+	// that retargeted.
+	difficulties := replay(policy, start, 100, 40, 5, 5, 5, 5, 20, 20, 20, 20)
+	expectDifficulties(t, "epoch", difficulties, 100, 100, 100, 100, 200, 200, 200, 200, 100)
+}
+
+func TestWindowPolicy(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	policy, _ := CreateDifficultyPolicy(DifficultyPolicyWindow, testSettings(2), start)
+
+	// Blocks on target keep the difficulty, and blocks twice as fast raise it to twice the
+	// average of the window.
+	difficulties := replay(policy, start, 100, 10, 10, 10, 5, 5)
+	expectDifficulties(t, "window", difficulties, 100, 100, 100, 133, 233)
+}
+
+func TestEMAPolicy(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	settings := testSettings(3)
+	policy, _ := CreateDifficultyPolicy(DifficultyPolicyEMA, settings, start)
+
+	// Blocks on target keep the difficulty.
+	difficulties := replay(policy, start, 100, 10, 10, 10, 10)
+	expectDifficulties(t, "ema", difficulties, 100, 100, 100, 100)
+
+	// A block twice as fast moves the average interval halfway there.
+	difficulties = replay(policy, start.Add(40*time.Second), 100, 5)
+	expectDifficulties(t, "ema", difficulties, 133)
+
+	// Adjustments are clamped.
+	settings.MaxAdjustment = 1.1
+	difficulties = replay(policy, start.Add(45*time.Second), 133, 0)
+	expectDifficulties(t, "ema", difficulties, 146)
+}
+
+func TestDifficultyLimits(t *testing.T) {
+	settings := testSettings(1)
+	settings.MinDifficulty = big.NewInt(50)
+	settings.MaxAdjustment = 2
+	if next := settings.limit(big.NewInt(100), big.NewInt(10)); next.ToBig().Int64() != 50 {
+		t.Fatal("expected the minimum difficulty")
+	}
+	if next := settings.limit(big.NewInt(100), big.NewInt(1000)); next.ToBig().Int64() != 200 {
+		t.Fatal("expected the adjustment to be clamped")
+	}
+
+	// Difficulties never overflow a block.
+	settings.MaxAdjustment = 0
+	if next := settings.limit(maxDifficulty, new(big.Int).Lsh(maxDifficulty, 1)); next.ToBig().Cmp(maxDifficulty) != 0 {
+		t.Fatal("expected the maximum difficulty")
+	}
+}
+
+func TestClonedPolicyLeavesOriginal(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	policy, _ := CreateDifficultyPolicy(DifficultyPolicyWindow, testSettings(2), start)
+	replay(policy, start, 100, 10)
+
+	clone := policy.Clone()
+	replay(clone, start.Add(10*time.Second), 100, 1)
+
+	// The original never saw the block handed to the clone.
+	difficulties := replay(policy, start.Add(10*time.Second), 100, 10)
+	expectDifficulties(t, "window", difficulties, 100)
+}
+
+func TestRestoredPolicyContinuesTheSame(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	intervals := []int64{40, 5, 5, 5, 5, 20, 20, 20, 20}
+
+	for _, name := range []string{DifficultyPolicyInterval, DifficultyPolicyEpoch, DifficultyPolicyWindow, DifficultyPolicyEMA} {
+		uninterrupted, _ := CreateDifficultyPolicy(name, testSettings(4), start)
+		expected := replay(uninterrupted, start, 100, intervals...)
+
+		// Stop after a few blocks and continue from the saved state in a policy that was
+		// created much later, as happens when the server restarts.
+		before, _ := CreateDifficultyPolicy(name, testSettings(4), start)
+		difficulties := replay(before, start, 100, intervals[:3]...)
+		after, _ := CreateDifficultyPolicy(name, testSettings(4), start.Add(time.Hour))
+		if err := after.Restore(before.State()); err != nil {
+			t.Fatalf("%s: could not restore state: %s", name, err.Error())
+		}
+		difficulties = append(difficulties,
+			replay(after, start.Add(50*time.Second), difficulties[2], intervals[3:]...)...)
+		expectDifficulties(t, name, difficulties, expected...)
+	}
+}
+
+func TestStateOfOtherPolicyIsRejected(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	interval, _ := CreateDifficultyPolicy(DifficultyPolicyInterval, testSettings(4), start)
+	window, _ := CreateDifficultyPolicy(DifficultyPolicyWindow, testSettings(4), start)
+	replay(window, start, 100, 10, 10)
+
+	if err := interval.Restore(window.State()); !errors.Is(err, ErrInvalidDifficultyState) {
+		t.Fatal("expected the state of another policy to be rejected")
+	}
+	epoch, _ := CreateDifficultyPolicy(DifficultyPolicyEpoch, testSettings(4), start)
+	if err := epoch.Restore(interval.State()); !errors.Is(err, ErrInvalidDifficultyState) {
+		t.Fatal("expected the state of the interval policy to be rejected")
+	}
+	if err := window.Restore(window.State()[:20]); !errors.Is(err, ErrInvalidDifficultyState) {
+		t.Fatal("expected a truncated state to be rejected")
+	}
+	// The policy that rejected the state is left as it was.
+	expectDifficulties(t, "interval", replay(interval, start, 100, 40), 100)
+}
+
+func TestDifficultyPolicyFromConfig(t *testing.T) {
+	t.Setenv("DifficultyPolicy", DifficultyPolicyEMA)
+	policy, err := DifficultyPolicyFromConfig(time.Now())
+	if err != nil {
+		t.Fatalf("could not create policy: %s", err.Error())
+	}
+	// The moving average is clamped by default.
+	if policy.(*emaPolicy).settings.MaxAdjustment != defaultEMAMaxAdjustment {
+		t.Fatal("unexpected maximum adjustment")
+	}
+
+	t.Setenv("DifficultyPolicy", "unknown")
+	if _, err := DifficultyPolicyFromConfig(time.Now()); !errors.Is(err, ErrUnknownDifficultyPolicy) {
+		t.Fatal("expected unknown policies to be rejected")
+	}
+
+	t.Setenv("DifficultyPolicy", DifficultyPolicyWindow)
+	for key, value := range map[string]string{
+		"TargetBlockTime":         "0",
+		"DifficultyWindow":        "none",
+		"MaxDifficultyAdjustment": "0.5",
+		"MinDifficulty":           "-1",
+	} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, value)
+			if _, err := DifficultyPolicyFromConfig(time.Now()); err == nil {
+				t.Fatalf("expected %s=%s to be rejected", key, value)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+
+	"tp1.aba.distros.fi.uba.ar/common/config"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+
+	number "tp1.aba.distros.fi.uba.ar/common/number/big32"
+)
+
+// Returned to subscribers that fell too far behind the blocks being written.
+var ErrSubscriberTooSlow = errors.New("subscriber too slow, too many blocks pending")
+
+// Returned when catching up from a block that is not part of the chain.
+var ErrUnknownBlock = errors.New("unknown block")
+
+// Hands out the blocks written to the blockchain, in order. Blocks that were already written
+// when subscribing are read from the storage, and the rest are handed out as they are written.
+// Not safe for concurrent use.
+type Subscription struct {
+	blockchain *Blockchain
+	// The height of the next block to read from the storage, and of the head when subscribing.
+	nextHeight int64
+	headHeight int64
+	// Blocks written since subscribing. Closed if the subscriber falls behind.
+	live chan *subscribedBlock
+}
+
+type subscribedBlock struct {
+	block  *blockchain.Block
+	height int64
+}
+
+// Subscribe to the blocks written from now on. If a hash is given, the blocks written after that
+// one are handed out first; the zero hash stands for the start of the chain.
+func (blockchain *Blockchain) Subscribe(after *number.Big32) (*Subscription, error) {
+	bufferSize, _ := config.GetIntOrDefault("SubscriptionBufferSize", 64)
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+
+	subscription := &Subscription{}
+	subscription.blockchain = blockchain
+	subscription.live = make(chan *subscribedBlock, bufferSize)
+
+	// Find the block to catch up from before taking the write lock, so that looking it up does
+	// not hold back writes. Blocks are only ever appended, so its height stays valid.
+	afterHeight := int64(-1)
+	if after != nil {
+		height, err := blockchain.heightOf(after)
+		if err != nil {
+			return nil, err
+		}
+		afterHeight = height
+	}
+
+	// Hold the write lock so that no block is written between reading the head and registering
+	// the subscription.
+	blockchain.writeLock.Lock()
+	defer blockchain.writeLock.Unlock()
+
+	subscription.headHeight = blockchain.repository.PreviousBlockHeight()
+	subscription.nextHeight = subscription.headHeight + 1
+	if afterHeight >= 0 {
+		subscription.nextHeight = afterHeight + 1
+	}
+
+	blockchain.subscriptions[subscription] = true
+	return subscription, nil
+}
+
+// Get the height of the block with the given hash, or 0 for the zero hash.
+func (blockchain *Blockchain) heightOf(hash *number.Big32) (int64, error) {
+	if hash.IsZero() {
+		return 0, nil
+	}
+
+	// Most hashes that are not part of the chain are not stored at all, which is quick to tell.
+	block, err := blockchain.repository.GetOneWithHash(hash)
+	if err != nil {
+		return 0, err
+	}
+	if block == nil {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownBlock, hash.Hex())
+	}
+
+	height, err := blockchain.repository.GetHeightWithHash(hash)
+	if err != nil {
+		return 0, err
+	}
+	if height == 0 {
+		return 0, fmt.Errorf("%w: %s", ErrUnknownBlock, hash.Hex())
+	}
+	return height, nil
+}
+
+// Get the next block written along with its height, waiting for it to be written if needed.
+// Returns a nil block if the given channel is closed first.
+func (subscription *Subscription) Next(done <-chan struct{}) (*blockchain.Block, int64, error) {
+	// Catch up from the storage first.
+	if subscription.nextHeight <= subscription.headHeight {
+		height := subscription.nextHeight
+		block, err := subscription.blockchain.repository.GetOneWithHeight(height)
+		if err != nil {
+			return nil, 0, err
+		}
+		if block == nil {
+			return nil, 0, fmt.Errorf("block at height %d is missing", height)
+		}
+		subscription.nextHeight++
+		return block, height, nil
+	}
+
+	select {
+	case written, ok := <-subscription.live:
+		if !ok {
+			return nil, 0, ErrSubscriberTooSlow
+		}
+		return written.block, written.height, nil
+	case <-done:
+		return nil, 0, nil
+	}
+}
+
+// Stops handing out blocks.
+func (subscription *Subscription) Close() {
+	blockchain := subscription.blockchain
+	blockchain.writeLock.Lock()
+	defer blockchain.writeLock.Unlock()
+	delete(blockchain.subscriptions, subscription)
+}
+
+// Hands the block just written to all subscribers. Subscribers that have too many blocks pending
+// are dropped, rather than holding up writes. Must be called holding the write lock.
+func (blockchain *Blockchain) publish(block *blockchain.Block, height int64) {
+	written := &subscribedBlock{block, height}
+	for subscription := range blockchain.subscriptions {
+		select {
+		case subscription.live <- written:
+		default:
+			close(subscription.live)
+			delete(blockchain.subscriptions, subscription)
+		}
+	}
+}
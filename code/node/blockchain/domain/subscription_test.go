@@ -0,0 +1,157 @@
+package domain
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"tp1.aba.distros.fi.uba.ar/node/blockchain/repository"
+
+	number "tp1.aba.distros.fi.uba.ar/common/number/big32"
+	blocks "tp1.aba.distros.fi.uba.ar/interface/blockchain"
+)
+
+// Writes a new block on top of the chain, a second after the given time.
+func writeNextBlock(t *testing.T, blockchain *Blockchain, start time.Time) *blocks.Block {
+	block := blocks.CreateDummyBlockWithKnownData(
+		blockchain.CurrentPreviousHash(),
+		blockchain.CurrentDifficulty())
+	block.SetCreationTime(start.Add(time.Duration(blockchain.CurrentHeight()+1) * time.Second))
+	mine(block)
+	if err := blockchain.WriteBlock(block); err != nil {
+		t.Fatalf("could not write block: %s", err.Error())
+	}
+	return block
+}
+
+// Reads the next block from the subscription and checks that it is the expected one.
+func expectNext(t *testing.T, subscription *Subscription, expected *blocks.Block, height int64) {
+	done := make(chan struct{})
+	timer := time.AfterFunc(time.Second, func() { close(done) })
+	defer timer.Stop()
+
+	block, blockHeight, err := subscription.Next(done)
+	if err != nil {
+		t.Fatalf("could not read next block: %s", err.Error())
+	}
+	if block == nil || !block.Hash().Equals(expected.Hash()) || blockHeight != height {
+		t.Fatalf("unexpected block at height %d", blockHeight)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	blockchain := CreateBlockchain(repository.CreateMemoryRepository())
+	start := time.Now().UTC().Truncate(time.Minute)
+	written := make([]*blocks.Block, 0)
+	for i := 0; i < 3; i++ {
+		written = append(written, writeNextBlock(t, blockchain, start))
+	}
+
+	// Catch up from the first block, then read blocks as they are written.
+	subscription, err := blockchain.Subscribe(written[0].Hash())
+	if err != nil {
+		t.Fatalf("could not subscribe: %s", err.Error())
+	}
+	defer subscription.Close()
+
+	written = append(written, writeNextBlock(t, blockchain, start))
+	for i := 1; i < len(written); i++ {
+		expectNext(t, subscription, written[i], int64(i+1))
+	}
+
+	// Subscriptions without a starting block only see new blocks, and the zero hash stands for
+	// the start of the chain.
+	live, _ := blockchain.Subscribe(nil)
+	defer live.Close()
+	full, _ := blockchain.Subscribe(&number.Big32{})
+	defer full.Close()
+
+	block := writeNextBlock(t, blockchain, start)
+	expectNext(t, live, block, 5)
+	expectNext(t, full, written[0], 1)
+
+	// Waiting stops once the given channel is closed.
+	done := make(chan struct{})
+	close(done)
+	if block, _, err := live.Next(done); block != nil || err != nil {
+		t.Fatal("expected no block")
+	}
+}
+
+func TestSubscribeFromUnknownBlock(t *testing.T) {
+	blockchain := CreateBlockchain(repository.CreateMemoryRepository())
+	if _, err := blockchain.Subscribe(number.One); !errors.Is(err, ErrUnknownBlock) {
+		t.Fatal("expected subscribing from an unknown block to fail")
+	}
+}
+
+// A storage in which looking up a given hash waits until released.
+type slowLookupStorage struct {
+	*repository.MemoryRepository
+	hash     *number.Big32
+	looking  chan struct{}
+	released chan struct{}
+}
+
+func (storage *slowLookupStorage) GetOneWithHash(hash *number.Big32) (*blocks.Block, error) {
+	if hash.Equals(storage.hash) {
+		close(storage.looking)
+		<-storage.released
+	}
+	return storage.MemoryRepository.GetOneWithHash(hash)
+}
+
+func TestSubscribeDoesNotHoldBackWrites(t *testing.T) {
+	storage := &slowLookupStorage{}
+	storage.MemoryRepository = repository.CreateMemoryRepository()
+	storage.hash = number.One
+	storage.looking = make(chan struct{})
+	storage.released = make(chan struct{})
+	blockchain := CreateBlockchain(storage)
+	start := time.Now().UTC().Truncate(time.Minute)
+
+	subscribed := make(chan error, 1)
+	go func() {
+		_, err := blockchain.Subscribe(number.One)
+		subscribed <- err
+	}()
+	<-storage.looking
+
+	// Blocks are written while the unknown block is being looked up.
+	written := make(chan struct{})
+	go func() {
+		writeNextBlock(t, blockchain, start)
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("writing a block waited for a subscription")
+	}
+
+	close(storage.released)
+	if err := <-subscribed; !errors.Is(err, ErrUnknownBlock) {
+		t.Fatal("expected subscribing from an unknown block to fail")
+	}
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	t.Setenv("SubscriptionBufferSize", "2")
+	blockchain := CreateBlockchain(repository.CreateMemoryRepository())
+	start := time.Now().UTC().Truncate(time.Minute)
+
+	subscription, _ := blockchain.Subscribe(nil)
+	defer subscription.Close()
+
+	written := make([]*blocks.Block, 0)
+	for i := 0; i < 3; i++ {
+		written = append(written, writeNextBlock(t, blockchain, start))
+	}
+
+	// Blocks pending are still handed out before failing.
+	expectNext(t, subscription, written[0], 1)
+	expectNext(t, subscription, written[1], 2)
+	if _, _, err := subscription.Next(nil); !errors.Is(err, ErrSubscriberTooSlow) {
+		t.Fatal("expected a slow subscriber to be dropped")
+	}
+}
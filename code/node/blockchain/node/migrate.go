@@ -0,0 +1,39 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"tp1.aba.distros.fi.uba.ar/common/config"
+	"tp1.aba.distros.fi.uba.ar/common/logging"
+	"tp1.aba.distros.fi.uba.ar/node/blockchain/repository"
+)
+
+// Move blocks stored in the per-minute layout of earlier versions to segments, rebuild the
+// indexes and write a JSON summary to the standard output. Must be run while the blockchain
+// server is stopped.
+func Migrate() {
+	logging.Initialize("Migrate")
+
+	// Load configuration to find out where the blockchain files are.
+	logging.Log("Loading configuration file")
+	config.UseFile(configPath)
+
+	logging.Log("Migrating minute files to segments")
+	report, err := repository.MigrateMinuteFiles()
+	if err != nil {
+		logging.LogError("Could not migrate minute files", err)
+		os.Exit(1)
+	}
+
+	logging.Log(fmt.Sprintf("Migrated %d blocks from %d minute files into %d segments",
+		report.MigratedBlocks, report.MinuteFiles, report.Segments))
+
+	output, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		logging.LogError("Could not encode migration report", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(output))
+}
@@ -1,6 +1,7 @@
 package node
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -10,10 +11,13 @@ import (
 
 	"tp1.aba.distros.fi.uba.ar/common/config"
 	"tp1.aba.distros.fi.uba.ar/common/logging"
+	"tp1.aba.distros.fi.uba.ar/common/security"
 	"tp1.aba.distros.fi.uba.ar/common/server"
 	"tp1.aba.distros.fi.uba.ar/interface/message"
 	"tp1.aba.distros.fi.uba.ar/node/blockchain/domain"
 	"tp1.aba.distros.fi.uba.ar/node/blockchain/repository"
+
+	blocks "tp1.aba.distros.fi.uba.ar/interface/blockchain"
 )
 
 // Define the path to a configuration file for the blockchain.
@@ -26,13 +30,31 @@ func Run() {
 	logging.Log("Loading configuration file")
 	config.UseFile(configPath)
 
-	// Instantiate a block repository object.
+	// Instantiate the storage backend selected in configuration.
 	logging.Log("Initializing repository")
-	repo, _ := repository.CreateBlockRepository()
+	repo, err := repository.CreateStorage()
+	if err != nil {
+		logging.LogError("Could not initialize repository", err)
+		return
+	}
+
+	// Load the keys of the clients allowed to write, if writes must be signed.
+	verifier, err := security.ServerVerifier()
+	if err != nil {
+		logging.LogError("Could not load client keys", err)
+		return
+	}
+
+	// Instantiate the difficulty policy selected in configuration.
+	policy, err := domain.DifficultyPolicyFromConfig(time.Now().UTC())
+	if err != nil {
+		logging.LogError("Could not initialize difficulty policy", err)
+		return
+	}
 
 	logging.Log("Initializing blockchain")
-	// Instantiate a Blockchain object.
-	blockchain := domain.CreateBlockchain(repo)
+	// Instantiate a Blockchain object. Reads go through an in-memory cache.
+	blockchain := domain.CreateBlockchainWithPolicy(repository.CreateCachedStorage(repo), policy)
 
 	// Instantiate read and write server configuration.
 	logging.Log("Reading server configuration")
@@ -49,11 +71,11 @@ func Run() {
 	}
 
 	// Instantiate the servers.
-	wServer := server.CreateNew(wServerConfig, func(conn *net.Conn) {
-		handleWriteConnection(blockchain, conn)
+	wServer := server.CreateNew(wServerConfig, func(conn *net.Conn, submit func(func())) {
+		handleWriteConnection(blockchain, verifier, conn, submit)
 	})
-	rServer := server.CreateNew(rServerConfig, func(conn *net.Conn) {
-		handleReadConnection(blockchain, conn)
+	rServer := server.CreateNew(rServerConfig, func(conn *net.Conn, submit func(func())) {
+		handleReadConnection(blockchain, conn, submit)
 	})
 
 	// Handle control connections.
@@ -81,17 +103,45 @@ func handleSignals(servers []*server.Server) {
 		logging.Log(fmt.Sprintf("Stopping server %d", i))
 		srv.Stop()
 	}
+
+	sent, _ := message.CompressionStatistics()
+	logging.Log(fmt.Sprintf("Compressed responses sent: %s", sent))
 }
 
-func handleWriteConnection(blockchain *domain.Blockchain, conn *net.Conn) {
-	msg, err := message.ReadMessage(*conn)
+func handleWriteConnection(
+	blockchain *domain.Blockchain, verifier *security.Verifier, netConn *net.Conn, submit func(func())) {
+
+	conn, err := accept(*netConn)
+	if err != nil {
+		logging.LogError("Write - Could not start connection", err)
+		return
+	}
+
+	// Handle requests until the client hangs up.
+	err = conn.Serve(func(msg message.Message, writer message.ResponseWriter) {
+		handleWriteRequest(blockchain, verifier, msg, writer)
+	}, submit)
 
 	if err != nil {
 		logging.LogError("Write - Could not read message", err)
+		writeError(conn, message.ErrorCodeBadRequest, err.Error())
+	}
+}
+
+func handleWriteRequest(
+	blockchain *domain.Blockchain, verifier *security.Verifier, signedMsg message.Message, conn message.ResponseWriter) {
+
+	// Check that the request comes from a known client, if required.
+	msg, err := message.Authenticate(signedMsg, verifier)
+	if err != nil {
+		logging.LogError("Write - Unauthorized request", err)
+		writeError(conn, message.ErrorCodeUnauthorized, err.Error())
 		return
 	}
+
 	if msg.Opcode() != message.OpWriteBlock {
-		logging.LogError("Write - Unexpected opcode in response", err)
+		logging.Log("Write - Unexpected opcode in request")
+		writeError(conn, message.ErrorCodeBadRequest, fmt.Sprintf("unexpected opcode %d", msg.Opcode()))
 		return
 	}
 
@@ -124,44 +174,98 @@ func handleWriteConnection(blockchain *domain.Blockchain, conn *net.Conn) {
 		logging.LogError("Write request rejected", err)
 	}
 
-	response.Write(*conn)
+	conn.WriteMessage(response)
 }
 
-func handleReadConnection(blockchain *domain.Blockchain, conn *net.Conn) {
-	msg, err := message.ReadMessage(*conn)
+func handleReadConnection(blockchain *domain.Blockchain, netConn *net.Conn, submit func(func())) {
+	conn, err := accept(*netConn)
+	if err != nil {
+		logging.LogError("Read - Could not start connection", err)
+		return
+	}
+
+	// Handle requests until the client hangs up. Requests are handled by as many workers as
+	// available, so responses may be sent in a different order.
+	err = conn.Serve(func(msg message.Message, writer message.ResponseWriter) {
+		handleReadRequest(blockchain, msg, writer)
+	}, submit)
 
 	if err != nil {
 		logging.LogError("Read - Could not read message", err)
-		return
+		writeError(conn, message.ErrorCodeBadRequest, err.Error())
 	}
+}
 
+func handleReadRequest(blockchain *domain.Blockchain, msg message.Message, conn message.ResponseWriter) {
 	switch msg.Opcode() {
 	case message.OpGetMiningInfo:
-		handleGetMiningInfo(blockchain, msg, *conn)
+		handleGetMiningInfo(blockchain, msg, conn)
 	case message.OpGetBlockWithHash:
-		handleGetBlockWithHash(blockchain, msg, *conn)
+		handleGetBlockWithHash(blockchain, msg, conn)
 	case message.OpGetBlocksInMinute:
-		handleGetBlocksInMinute(blockchain, msg, *conn)
+		handleGetBlocksInMinute(blockchain, msg, conn)
+	case message.OpGetBlockByHeight:
+		handleGetBlockWithHeight(blockchain, msg, conn)
+	case message.OpReadBlocksInRange:
+		handleGetBlocksInRange(blockchain, msg, conn)
+	case message.OpGetCacheStatistics:
+		handleGetCacheStatistics(blockchain, msg, conn)
+	case message.OpFindChunk:
+		handleFindChunk(blockchain, msg, conn)
+	case message.OpSubscribeBlocks:
+		handleSubscribeBlocks(blockchain, msg, conn)
+	default:
+		logging.Log("Read - Unexpected opcode in request")
+		writeError(conn, message.ErrorCodeBadRequest, fmt.Sprintf("unexpected opcode %d", msg.Opcode()))
 	}
 }
 
-func handleGetMiningInfo(blockchain *domain.Blockchain, msg message.Message, conn net.Conn) {
+// Starts a connection with a client. Clients that do not frame their messages are served as long
+// as allowed by configuration.
+func accept(conn net.Conn) (*message.Conn, error) {
+	allowLegacy, _ := config.GetIntOrDefault("AllowLegacyProtocol", 1)
+	return message.Accept(conn, allowLegacy != 0)
+}
+
+// Sends an error response to the client. The connection may already be broken, so failing to
+// send it is only logged.
+func writeError(conn message.ResponseWriter, code uint8, reason string) {
+	if err := conn.WriteMessage(message.CreateErrorResponse(code, reason)); err != nil {
+		logging.LogError("Could not send error response", err)
+	}
+}
+
+func handleGetMiningInfo(blockchain *domain.Blockchain, msg message.Message, conn message.ResponseWriter) {
 	logging.Log("Handling GetMiningInfo request")
 	previousHash := blockchain.CurrentPreviousHash()
 	currentDifficulty := blockchain.CurrentDifficulty()
-	response := message.CreateGetMiningInfoResponse(previousHash, currentDifficulty)
+	height := blockchain.CurrentHeight()
+	response := message.CreateGetMiningInfoResponse(previousHash, currentDifficulty, height)
 
-	// Log current previous hash and difficulty as returned to the client.
-	logging.Log(fmt.Sprintf("Writing GetMiningInfo response (%s, %s)",
+	// Log current previous hash, difficulty and height as returned to the client.
+	logging.Log(fmt.Sprintf("Writing GetMiningInfo response (%s, %s, %d)",
 		previousHash.Hex(),
-		currentDifficulty.Hex()))
+		currentDifficulty.Hex(),
+		height))
 
-	if err := response.Write(conn); err != nil {
+	if err := conn.WriteMessage(response); err != nil {
 		logging.LogError("Could not send response", err)
 	}
 }
 
-func handleGetBlockWithHash(blockchain *domain.Blockchain, msg message.Message, conn net.Conn) {
+func handleGetCacheStatistics(blockchain *domain.Blockchain, msg message.Message, conn message.ResponseWriter) {
+	logging.Log("Handling GetCacheStatistics request")
+	blockStats, minuteStats := blockchain.CacheStats()
+	response := message.CreateGetCacheStatisticsResponse(
+		(*message.CacheStats)(blockStats),
+		(*message.CacheStats)(minuteStats))
+
+	if err := conn.WriteMessage(response); err != nil {
+		logging.LogError("Could not send response", err)
+	}
+}
+
+func handleGetBlockWithHash(blockchain *domain.Blockchain, msg message.Message, conn message.ResponseWriter) {
 	logging.Log("Handling GetBlockByHash request")
 
 	request := msg.(*message.GetBlockByHashRequest)
@@ -171,18 +275,135 @@ func handleGetBlockWithHash(blockchain *domain.Blockchain, msg message.Message,
 
 	if block, err := blockchain.GetOneWithHash(hash); err != nil {
 		logging.LogError("Could not retrieve requested block", err)
+		writeError(conn, message.ErrorCodeUnavailable, err.Error())
 	} else {
-		logging.Log(fmt.Sprintf("Block %s found, sending response", block.Hash().Hex()))
+		if block != nil {
+			logging.Log(fmt.Sprintf("Block %s found, sending response", block.Hash().Hex()))
+		} else {
+			logging.Log("Block not found, sending response")
+		}
 		// Generate response.
 		response := message.CreateGetBlockByHashResponse(block)
 		// Send response back to the client.
-		if err := response.Write(conn); err != nil {
+		if err := conn.WriteMessage(response); err != nil {
 			logging.LogError("Could not send response", err)
 		}
 	}
 }
 
-func handleGetBlocksInMinute(blockchain *domain.Blockchain, msg message.Message, conn net.Conn) {
+func handleGetBlockWithHeight(blockchain *domain.Blockchain, msg message.Message, conn message.ResponseWriter) {
+	logging.Log("Handling GetBlockByHeight request")
+
+	request := msg.(*message.GetBlockByHeightRequest)
+	height := request.Height()
+
+	logging.Log(fmt.Sprintf("Requested height: %d", height))
+
+	if block, err := blockchain.GetOneWithHeight(height); err != nil {
+		logging.LogError("Could not retrieve requested block", err)
+		writeError(conn, message.ErrorCodeUnavailable, err.Error())
+	} else {
+		if block != nil {
+			logging.Log(fmt.Sprintf("Block %s found, sending response", block.Hash().Hex()))
+		} else {
+			logging.Log("Block not found, sending response")
+		}
+		// Generate response.
+		response := message.CreateGetBlockByHeightResponse(block)
+		// Send response back to the client.
+		if err := conn.WriteMessage(response); err != nil {
+			logging.LogError("Could not send response", err)
+		}
+	}
+}
+
+func handleFindChunk(blockchain *domain.Blockchain, msg message.Message, conn message.ResponseWriter) {
+	logging.Log("Handling FindChunk request")
+
+	request := msg.(*message.FindChunkRequest)
+	contentHash := request.ContentHash()
+
+	logging.Log(fmt.Sprintf("Requested chunk: %s", contentHash.Hex()))
+
+	if location, err := blockchain.FindChunk(contentHash); err != nil {
+		logging.LogError("Could not find requested chunk", err)
+		writeError(conn, message.ErrorCodeUnavailable, err.Error())
+	} else {
+		var response *message.FindChunkResponse
+		if location != nil {
+			logging.Log(fmt.Sprintf("Chunk found in block %s, sending response", location.BlockHash.Hex()))
+			response = message.CreateFindChunkResponse(true, location.BlockHash, location.Entry, location.Timestamp)
+		} else {
+			logging.Log("Chunk not found, sending response")
+			response = message.CreateFindChunkResponse(false, nil, 0, 0)
+		}
+		// Send response back to the client.
+		if err := conn.WriteMessage(response); err != nil {
+			logging.LogError("Could not send response", err)
+		}
+	}
+}
+
+func handleGetBlocksInRange(blockchain *domain.Blockchain, msg message.Message, conn message.ResponseWriter) {
+	logging.Log("Handling ReadBlocksInRange request")
+
+	request := msg.(*message.ReadBlocksInRangeRequest)
+	from := time.Unix(request.From(), 0).UTC()
+	to := time.Unix(request.To(), 0).UTC()
+
+	// Never return more blocks than allowed in a single response.
+	maxLimit, _ := config.GetIntOrDefault("RangeBlockLimit", 1000)
+	limit := int(request.Limit())
+	if limit == 0 || limit > maxLimit {
+		limit = maxLimit
+	}
+
+	// Continue from the cursor, if any.
+	var startMinute time.Time
+	skip := 0
+	if cursor := request.Cursor(); cursor != nil {
+		startMinute = time.Unix(cursor.Minute, 0).UTC()
+		skip = int(cursor.Skip)
+	}
+
+	logging.Log(fmt.Sprintf("Requested range: %d to %d, limit %d", request.From(), request.To(), limit))
+
+	it, err := blockchain.ReadBlocksInRange(from, to, limit, startMinute, skip)
+	if err != nil {
+		logging.LogError("Could not retrieve list of blocks", err)
+		writeError(conn, message.ErrorCodeUnavailable, err.Error())
+		return
+	}
+
+	// Stream blocks to the client as they are read.
+	count := 0
+	response := message.CreateReadBlocksInRangeResponse(func() (*blocks.Block, *message.RangeCursor, error) {
+		block, err := it.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if block != nil {
+			count++
+			return block, nil, nil
+		}
+		if minute, skip, more, err := it.Cursor(); err != nil {
+			return nil, nil, err
+		} else if more {
+			return nil, &message.RangeCursor{Minute: minute.Unix(), Skip: uint32(skip)}, nil
+		}
+		return nil, nil, nil
+	})
+	// Blocks that cannot be read end the response with an error, so that the client can tell a
+	// range that was cut short from a stalled one.
+	if err := conn.WriteMessage(response); err != nil {
+		logging.LogError(fmt.Sprintf("Could not send response after %d blocks", count), err)
+		return
+	}
+
+	logging.Log(fmt.Sprintf("Sent %d blocks", count))
+}
+
+func handleGetBlocksInMinute(blockchain *domain.Blockchain, msg message.Message, conn message.ResponseWriter) {
 	logging.Log("Handling ReadBlocksInMinute request")
 
 	request := msg.(*message.ReadBlocksInMinuteRequest)
@@ -194,6 +415,7 @@ func handleGetBlocksInMinute(blockchain *domain.Blockchain, msg message.Message,
 
 	if blocks, err := blockchain.GetBlocksFromMinute(requestedTime); err != nil {
 		logging.LogError("Could not retrieve list of blocks", err)
+		writeError(conn, message.ErrorCodeUnavailable, err.Error())
 	} else {
 		logging.Log(fmt.Sprintf("Found %d blocks", len(blocks)))
 		// Generate the response.
@@ -201,9 +423,55 @@ func handleGetBlocksInMinute(blockchain *domain.Blockchain, msg message.Message,
 
 		if err != nil {
 			logging.LogError("Could not create response", err)
+			writeError(conn, message.ErrorCodeUnavailable, err.Error())
+			return
 		}
-		if err := response.Write(conn); err != nil {
+		if err := conn.WriteMessage(response); err != nil {
 			logging.LogError("Could not send response", err)
 		}
 	}
 }
+
+func handleSubscribeBlocks(blockchain *domain.Blockchain, msg message.Message, conn message.ResponseWriter) {
+	logging.Log("Handling SubscribeBlocks request")
+
+	request := msg.(*message.SubscribeBlocksRequest)
+	if !message.SupportsPush(conn) {
+		writeError(conn, message.ErrorCodeBadRequest, "subscriptions require a framed connection")
+		return
+	}
+
+	subscription, err := blockchain.Subscribe(request.From())
+	if err != nil {
+		logging.LogError("Could not subscribe to blocks", err)
+		if errors.Is(err, domain.ErrUnknownBlock) {
+			writeError(conn, message.ErrorCodeNotFound, err.Error())
+		} else {
+			writeError(conn, message.ErrorCodeUnavailable, err.Error())
+		}
+		return
+	}
+
+	// Push blocks from a goroutine of its own, so that the subscription does not hold a worker
+	// for as long as the client stays connected.
+	go func() {
+		defer subscription.Close()
+		for {
+			block, height, err := subscription.Next(conn.Done())
+			if err != nil {
+				logging.LogError("Subscription ended", err)
+				writeError(conn, message.ErrorCodeUnavailable, err.Error())
+				return
+			}
+			if block == nil {
+				logging.Log("Subscriber hung up")
+				return
+			}
+			notification := message.CreateBlockNotification(block, height, request.HeadersOnly())
+			if err := conn.WriteMessage(notification); err != nil {
+				logging.LogError("Could not send block notification", err)
+				return
+			}
+		}
+	}()
+}
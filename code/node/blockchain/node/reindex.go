@@ -0,0 +1,45 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"tp1.aba.distros.fi.uba.ar/common/config"
+	"tp1.aba.distros.fi.uba.ar/common/logging"
+	"tp1.aba.distros.fi.uba.ar/node/blockchain/repository"
+)
+
+// Rebuild the indexes and the head file from the blockchain files and write a JSON summary to
+// the standard output. Must be run while the blockchain server is stopped.
+func Reindex() {
+	logging.Initialize("Reindex")
+
+	// Load configuration to find out where the blockchain files are.
+	logging.Log("Loading configuration file")
+	config.UseFile(configPath)
+
+	logging.Log("Initializing repository")
+	repo, err := repository.CreateBlockRepository()
+	if err != nil {
+		logging.LogError("Could not initialize repository", err)
+		os.Exit(1)
+	}
+
+	logging.Log("Rebuilding indexes")
+	report, err := repo.Reindex()
+	if err != nil {
+		logging.LogError("Could not rebuild indexes", err)
+		os.Exit(1)
+	}
+
+	logging.Log(fmt.Sprintf("Indexed %d blocks from %d files, chain length %d",
+		report.IndexedBlocks, report.Files, report.ChainLength))
+
+	output, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		logging.LogError("Could not encode reindex report", err)
+		os.Exit(1)
+	}
+	fmt.Println(string(output))
+}
@@ -0,0 +1,108 @@
+package node
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"tp1.aba.distros.fi.uba.ar/common/config"
+	"tp1.aba.distros.fi.uba.ar/common/logging"
+	"tp1.aba.distros.fi.uba.ar/node/blockchain/domain"
+
+	number "tp1.aba.distros.fi.uba.ar/common/number/big32"
+)
+
+// Replay a series of block timestamps through the difficulty policy selected in configuration,
+// and print the difficulty that each block would have had to the standard output.
+//
+// Usage: simulate <file> [initial difficulty]
+//
+// The file holds a unix timestamp in seconds per line, in the order blocks were written, and
+// may be - to read from the standard input. Empty lines and lines starting with # are skipped.
+// Blocks are taken to be written at their timestamps, and the first block at the given
+// difficulty, 1 by default. The output has a line per block with its height, timestamp, seconds
+// since the previous block and difficulty, separated by tabs.
+func Simulate() {
+	logging.Initialize("Simulate")
+	config.UseFile(configPath)
+
+	if len(os.Args) < 3 {
+		logging.Log("Usage: simulate <file> [initial difficulty]")
+		os.Exit(2)
+	}
+	timestamps, err := readTimestamps(os.Args[2])
+	if err != nil {
+		logging.LogError("Could not read timestamps", err)
+		os.Exit(2)
+	}
+	if len(timestamps) == 0 {
+		logging.Log("No timestamps to replay")
+		return
+	}
+
+	difficulty := number.One
+	if len(os.Args) > 3 {
+		initial, ok := new(big.Int).SetString(os.Args[3], 10)
+		if !ok || initial.Sign() <= 0 || initial.BitLen() > 256 {
+			logging.Log(fmt.Sprintf("Invalid initial difficulty %s", os.Args[3]))
+			os.Exit(2)
+		}
+		difficulty = number.FromBig(initial)
+	}
+
+	policy, err := domain.DifficultyPolicyFromConfig(timestamps[0])
+	if err != nil {
+		logging.LogError("Could not initialize difficulty policy", err)
+		os.Exit(2)
+	}
+	logging.Log(fmt.Sprintf("Replaying %d blocks through the %s difficulty policy", len(timestamps),
+		config.GetStringOrDefault("DifficultyPolicy", domain.DifficultyPolicyInterval)))
+
+	output := bufio.NewWriter(os.Stdout)
+	defer output.Flush()
+	fmt.Fprintln(output, "height\ttimestamp\tinterval\tdifficulty")
+	for i, timestamp := range timestamps {
+		interval := int64(0)
+		if i > 0 {
+			interval = timestamp.Unix() - timestamps[i-1].Unix()
+		}
+		fmt.Fprintf(output, "%d\t%d\t%d\t%s\n", i+1, timestamp.Unix(), interval, difficulty.ToBig().String())
+		difficulty = policy.Next(&domain.WrittenBlock{
+			Difficulty: difficulty,
+			Timestamp:  timestamp,
+			WriteTime:  timestamp,
+		})
+	}
+}
+
+func readTimestamps(path string) ([]time.Time, error) {
+	var input io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	timestamps := make([]time.Time, 0)
+	scanner := bufio.NewScanner(input)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		seconds, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		timestamps = append(timestamps, time.Unix(seconds, 0).UTC())
+	}
+	return timestamps, scanner.Err()
+}
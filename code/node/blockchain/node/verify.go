@@ -0,0 +1,51 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"tp1.aba.distros.fi.uba.ar/common/config"
+	"tp1.aba.distros.fi.uba.ar/common/logging"
+	"tp1.aba.distros.fi.uba.ar/node/blockchain/repository"
+)
+
+// Verify the integrity of the blockchain stored on disk and write a JSON summary to the
+// standard output. The process exits with a non zero status if any problem is found.
+// Intended to be run while the blockchain server is stopped.
+func Verify() {
+	logging.Initialize("Verify")
+
+	// Load configuration to find out where the blockchain files are.
+	logging.Log("Loading configuration file")
+	config.UseFile(configPath)
+
+	logging.Log("Initializing repository")
+	repo, err := repository.CreateBlockRepository()
+	if err != nil {
+		logging.LogError("Could not initialize repository", err)
+		os.Exit(2)
+	}
+
+	logging.Log("Verifying blockchain files")
+	report, err := repo.Verify()
+	if err != nil {
+		logging.LogError("Could not verify blockchain files", err)
+		os.Exit(2)
+	}
+
+	logging.Log(fmt.Sprintf("Verified %d blocks in %d files, chain length %d",
+		report.Blocks, report.Files, report.ChainLength))
+
+	output, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		logging.LogError("Could not encode verification report", err)
+		os.Exit(2)
+	}
+	fmt.Println(string(output))
+
+	if !report.Ok {
+		logging.Log(fmt.Sprintf("Found %d problems", len(report.Issues)))
+		os.Exit(1)
+	}
+}
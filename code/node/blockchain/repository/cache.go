@@ -0,0 +1,215 @@
+package repository
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"tp1.aba.distros.fi.uba.ar/common/config"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+
+	number "tp1.aba.distros.fi.uba.ar/common/number/big32"
+)
+
+//=================================================================================================
+// Block Cache
+//-------------------------------------------------------------------------------------------------
+
+// Default amount of entries held by each cache.
+const defaultBlockCacheSize int = 1024
+const defaultMinuteCacheSize int = 256
+
+// Counters describing how a cache has been used.
+type CacheStats struct {
+	Hits     int
+	Misses   int
+	Entries  int
+	Capacity int
+}
+
+// A storage that keeps recently read blocks, by hash, and recently read lists of blocks, by
+// minute, in memory. Reads that miss the cache go to the underlying storage and fill the cache.
+// All other calls go straight to the underlying storage.
+type CachedStorage struct {
+	Storage
+	blocks  *lruCache
+	minutes *lruCache
+}
+
+// Wraps the given storage with caches whose sizes are taken from configuration. A size of zero
+// disables the corresponding cache.
+func CreateCachedStorage(storage Storage) *CachedStorage {
+	blockCacheSize, _ := config.GetIntOrDefault("BlockCacheSize", defaultBlockCacheSize)
+	minuteCacheSize, _ := config.GetIntOrDefault("MinuteCacheSize", defaultMinuteCacheSize)
+
+	cached := &CachedStorage{}
+	cached.Storage = storage
+	cached.blocks = createLruCache(blockCacheSize)
+	cached.minutes = createLruCache(minuteCacheSize)
+	return cached
+}
+
+func (cached *CachedStorage) GetOneWithHash(hash *number.Big32) (*blockchain.Block, error) {
+	if value, found, generation := cached.blocks.Get(*hash); found {
+		return value.(*blockchain.Block), nil
+	} else {
+		block, err := cached.Storage.GetOneWithHash(hash)
+		// Blocks that were not found are not cached, since they may be written later.
+		if err == nil && block != nil {
+			cached.blocks.Put(*hash, block, generation)
+		}
+		return block, err
+	}
+}
+
+func (cached *CachedStorage) GetBlocksFromMinute(t time.Time) ([]*blockchain.Block, error) {
+	minute := minuteOf(t)
+
+	if value, found, generation := cached.minutes.Get(minute); found {
+		return copyBlockList(value.([]*blockchain.Block)), nil
+	} else {
+		blocks, err := cached.Storage.GetBlocksFromMinute(t)
+		if err == nil {
+			cached.minutes.Put(minute, copyBlockList(blocks), generation)
+		}
+		return blocks, err
+	}
+}
+
+func (cached *CachedStorage) Save(block *blockchain.Block, computeDifficulty func() (*number.Big32, []byte)) error {
+	if err := cached.Storage.Save(block, computeDifficulty); err != nil {
+		return err
+	}
+
+	// The list of blocks of the minute the block was created in no longer holds all blocks.
+	cached.minutes.Remove(minuteOf(time.Unix(block.Timestamp(), 0)))
+	// The block is likely to be requested soon.
+	cached.blocks.Put(*block.Hash(), block, cached.blocks.Generation())
+	return nil
+}
+
+func (cached *CachedStorage) Cleanup() {
+	cached.Storage.Cleanup()
+	cached.blocks.Clear()
+	cached.minutes.Clear()
+}
+
+// Usage of the block cache and of the minute cache.
+func (cached *CachedStorage) CacheStats() (*CacheStats, *CacheStats) {
+	return cached.blocks.Stats(), cached.minutes.Stats()
+}
+
+// Callers may modify the lists they get, so the cache keeps its own copy.
+func copyBlockList(blocks []*blockchain.Block) []*blockchain.Block {
+	copied := make([]*blockchain.Block, len(blocks))
+	copy(copied, blocks)
+	return copied
+}
+
+//=================================================================================================
+// LRU Cache
+//-------------------------------------------------------------------------------------------------
+
+// A thread safe cache holding up to a fixed amount of entries, which evicts the least recently
+// used entry when full.
+//
+// A value read from the underlying storage may be outdated by the time it is put in the cache if
+// an entry was removed in the meantime. To avoid caching such values, every removal increases a
+// generation counter. Misses return the current generation, and values are only put in the cache
+// if the generation did not change since the miss.
+type lruCache struct {
+	capacity   int
+	entries    map[interface{}]*list.Element
+	order      *list.List
+	generation uint64
+	hits       int
+	misses     int
+	lock       sync.Mutex
+}
+
+type lruEntry struct {
+	key   interface{}
+	value interface{}
+}
+
+func createLruCache(capacity int) *lruCache {
+	cache := &lruCache{}
+	cache.capacity = capacity
+	cache.Clear()
+	return cache
+}
+
+// Get the value stored with the given key, if any, along with the current generation.
+func (cache *lruCache) Get(key interface{}) (interface{}, bool, uint64) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if element, found := cache.entries[key]; found {
+		cache.hits++
+		cache.order.MoveToFront(element)
+		return element.Value.(*lruEntry).value, true, cache.generation
+	}
+
+	cache.misses++
+	return nil, false, cache.generation
+}
+
+// Stores the value with the given key, unless there were removals since the given generation.
+func (cache *lruCache) Put(key interface{}, value interface{}, generation uint64) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if cache.capacity <= 0 || generation != cache.generation {
+		return
+	}
+
+	if element, found := cache.entries[key]; found {
+		element.Value.(*lruEntry).value = value
+		cache.order.MoveToFront(element)
+		return
+	}
+
+	cache.entries[key] = cache.order.PushFront(&lruEntry{key, value})
+
+	// Evict the least recently used entry if there are too many.
+	if cache.order.Len() > cache.capacity {
+		last := cache.order.Back()
+		cache.order.Remove(last)
+		delete(cache.entries, last.Value.(*lruEntry).key)
+	}
+}
+
+func (cache *lruCache) Remove(key interface{}) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.generation++
+	if element, found := cache.entries[key]; found {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+	}
+}
+
+func (cache *lruCache) Generation() uint64 {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return cache.generation
+}
+
+// Removes all entries and resets counters.
+func (cache *lruCache) Clear() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.generation++
+	cache.entries = make(map[interface{}]*list.Element)
+	cache.order = list.New()
+	cache.hits = 0
+	cache.misses = 0
+}
+
+func (cache *lruCache) Stats() *CacheStats {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return &CacheStats{cache.hits, cache.misses, cache.order.Len(), cache.capacity}
+}
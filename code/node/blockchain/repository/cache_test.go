@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCachedReads(t *testing.T) {
+	repo := CreateCachedStorage(CreateMemoryRepository())
+	defer repo.Cleanup()
+
+	// Save two blocks in the same minute.
+	minute := time.Now().UTC().Truncate(time.Minute)
+	first := verifiableBlock(t, repo.PreviousBlockHash(), minute)
+	if err := repo.Save(first, computeDifficulty); err != nil {
+		t.Fatalf("could not save block: %s", err.Error())
+	}
+
+	// Reading the minute twice must only miss once.
+	for i := 0; i < 2; i++ {
+		if blocks, _ := repo.GetBlocksFromMinute(minute); len(blocks) != 1 {
+			t.Fatalf("unexpected block count: %d", len(blocks))
+		}
+	}
+	if _, minuteStats := repo.CacheStats(); minuteStats.Hits != 1 || minuteStats.Misses != 1 {
+		t.Fatalf("unexpected minute cache usage: %d hits, %d misses", minuteStats.Hits, minuteStats.Misses)
+	}
+
+	// Saving a block in the minute must invalidate the cached list.
+	second := verifiableBlock(t, repo.PreviousBlockHash(), minute.Add(time.Second))
+	if err := repo.Save(second, computeDifficulty); err != nil {
+		t.Fatalf("could not save block: %s", err.Error())
+	}
+	if blocks, _ := repo.GetBlocksFromMinute(minute); len(blocks) != 2 {
+		t.Fatalf("unexpected block count after saving: %d", len(blocks))
+	}
+
+	// Saved blocks are cached by hash.
+	if retrieved, _ := repo.GetOneWithHash(first.Hash()); retrieved == nil || !retrieved.Hash().Equals(first.Hash()) {
+		t.Fatal("unexpected block retrieved by hash")
+	}
+	if blockStats, _ := repo.CacheStats(); blockStats.Hits != 1 || blockStats.Entries != 2 {
+		t.Fatalf("unexpected block cache usage: %d hits, %d entries", blockStats.Hits, blockStats.Entries)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	t.Setenv("BlockCacheSize", "2")
+
+	repo := CreateCachedStorage(CreateMemoryRepository())
+	defer repo.Cleanup()
+
+	timebase := time.Now().UTC()
+	for i := 0; i < 3; i++ {
+		block := verifiableBlock(t, repo.PreviousBlockHash(), timebase.Add(time.Duration(i)*time.Second))
+		if err := repo.Save(block, computeDifficulty); err != nil {
+			t.Fatalf("could not save block %d: %s", i, err.Error())
+		}
+	}
+
+	if blockStats, _ := repo.CacheStats(); blockStats.Entries != 2 || blockStats.Capacity != 2 {
+		t.Fatalf("unexpected block cache size: %d entries", blockStats.Entries)
+	}
+}
+
+func TestStaleValuesAreNotCached(t *testing.T) {
+	cache := createLruCache(4)
+
+	// A removal between a miss and the corresponding put must prevent caching the value.
+	_, _, generation := cache.Get("key")
+	cache.Remove("key")
+	cache.Put("key", "stale", generation)
+
+	if _, found, _ := cache.Get("key"); found {
+		t.Fatal("a stale value was cached")
+	}
+}
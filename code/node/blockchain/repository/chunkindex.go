@@ -0,0 +1,136 @@
+package repository
+
+import (
+	"encoding/binary"
+	"os"
+	"strings"
+
+	"tp1.aba.distros.fi.uba.ar/common/logging"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+
+	number "tp1.aba.distros.fi.uba.ar/common/number/big32"
+)
+
+//=================================================================================================
+// Chunk Index
+//-------------------------------------------------------------------------------------------------
+
+// Every chunk stored in the blockchain is indexed by the SHA-256 hash of its data, so that whoever
+// wrote it can later prove that it is part of the chain. The chunk index is a hash index whose
+// values are the hash of the block holding the chunk (32 bytes), the position of the chunk among
+// the entries of the block (1 byte) and the timestamp of the block (8 bytes). If the same data
+// was stored more than once, the first block it was stored in is the one found.
+
+const chunkIndexPrefix string = "chunk"
+const chunkLocationLength int = 32 + 1 + 8
+
+func encodeChunkLocation(location *ChunkLocation) []byte {
+	value := make([]byte, chunkLocationLength)
+	copy(value[0:32], location.BlockHash.Bytes[:])
+	value[32] = byte(location.Entry)
+	binary.LittleEndian.PutUint64(value[33:41], uint64(location.Timestamp))
+	return value
+}
+
+func decodeChunkLocation(value []byte) *ChunkLocation {
+	location := &ChunkLocation{}
+	location.BlockHash = number.FromSlice(value[0:32])
+	location.Entry = int(value[32])
+	location.Timestamp = int64(binary.LittleEndian.Uint64(value[33:41]))
+	return location
+}
+
+// Calls the callback with the content hash and the location of every chunk in the given block.
+func forEachChunk(block *blockchain.Block, callback func(contentHash *number.Big32, location *ChunkLocation) error) error {
+	entry := 0
+	for it := block.Entries(); it.HasNext(); it.Advance() {
+		location := &ChunkLocation{block.Hash(), entry, block.Timestamp()}
+		if err := callback(it.Chunk().ContentHash(), location); err != nil {
+			return err
+		}
+		entry++
+	}
+	return nil
+}
+
+// Find where the chunk whose data has the given SHA-256 hash is stored. Returns nil if there is
+// no such chunk.
+func (repo *BlockRepository) FindChunk(contentHash *number.Big32) (*ChunkLocation, error) {
+	value, err := repo.chunks.Lookup(contentHash.Bytes[:])
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return decodeChunkLocation(value), nil
+}
+
+// Adds every chunk in the given block to the chunk index.
+func (repo *BlockRepository) indexChunks(block *blockchain.Block) error {
+	return forEachChunk(block, func(contentHash *number.Big32, location *ChunkLocation) error {
+		return repo.chunks.Insert(contentHash.Bytes[:], encodeChunkLocation(location))
+	})
+}
+
+// Get the paths of the chunk index logs that indexing the given block appends to, without
+// repetitions.
+func (repo *BlockRepository) chunkAppendTargets(block *blockchain.Block) []string {
+	paths := make([]string, 0)
+	found := make(map[string]bool)
+	forEachChunk(block, func(contentHash *number.Big32, location *ChunkLocation) error {
+		if path := repo.chunks.appendTarget(contentHash.Bytes[:]); !found[path] {
+			found[path] = true
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths
+}
+
+// Keeps the logs the given block was indexed in short.
+func (repo *BlockRepository) compactChunks(block *blockchain.Block) error {
+	return forEachChunk(block, func(contentHash *number.Big32, location *ChunkLocation) error {
+		return repo.chunks.Compact(contentHash.Bytes[:])
+	})
+}
+
+// Rewrites the chunk index from the blocks in the chain, from the first one up to the head.
+func (repo *BlockRepository) rebuildChunkIndex() error {
+	if err := repo.chunks.reset(); err != nil {
+		return err
+	}
+
+	for height := int64(1); height <= repo.PreviousBlockHeight(); height++ {
+		block, err := repo.GetOneWithHeight(height)
+		if err != nil {
+			return err
+		}
+		if block == nil {
+			continue
+		}
+		if err := repo.indexChunks(block); err != nil {
+			return err
+		}
+	}
+
+	return repo.chunks.CompactAll()
+}
+
+// Repositories written by earlier versions have no chunk index. Build it from the chain if no
+// chunk index files can be found.
+func (repo *BlockRepository) migrateMissingChunkIndex() error {
+	if repo.PreviousBlockHeight() == 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(repo.IndexDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), chunkIndexPrefix+"-") {
+			return nil
+		}
+	}
+
+	logging.Log("Chunk index could not be found, indexing chunks from the chain")
+	return repo.rebuildChunkIndex()
+}
@@ -0,0 +1,55 @@
+package repository
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestFindChunk(t *testing.T) {
+	repo, _ := CreateBlockRepository()
+	defer cleanup(repo)
+
+	// Every test block holds the same chunks, so they must be found in the first block.
+	chain := saveVerifiableChain(t, repo, 3)
+	checkChunkLocations(t, repo, chain[0].Hash().Hex(), chain[0].Timestamp())
+
+	if location, _ := repo.FindChunk(testChunk("Missing").ContentHash()); location != nil {
+		t.Fatal("found a chunk that was never stored")
+	}
+
+	// A repository written before chunks were indexed must index them on startup.
+	entries, _ := os.ReadDir(repo.IndexDir)
+	for _, entry := range entries {
+		if entry.Name() != heightIndexFilename && !strings.HasPrefix(entry.Name(), "hash-") {
+			os.Remove(path.Join(repo.IndexDir, entry.Name()))
+		}
+	}
+	repo, err := CreateBlockRepository()
+	if err != nil {
+		t.Fatalf("could not recreate repository: %s", err.Error())
+	}
+	checkChunkLocations(t, repo, chain[0].Hash().Hex(), chain[0].Timestamp())
+
+	// Reindexing must rebuild the chunk index as well.
+	if _, err := repo.Reindex(); err != nil {
+		t.Fatalf("could not reindex: %s", err.Error())
+	}
+	checkChunkLocations(t, repo, chain[0].Hash().Hex(), chain[0].Timestamp())
+}
+
+func checkChunkLocations(t *testing.T, repo *BlockRepository, blockHash string, timestamp int64) {
+	for i, data := range []string{"Hello", "World"} {
+		location, err := repo.FindChunk(testChunk(data).ContentHash())
+		if err != nil {
+			t.Fatalf("could not find chunk %s: %s", data, err.Error())
+		}
+		if location == nil {
+			t.Fatalf("chunk %s could not be found", data)
+		}
+		if location.BlockHash.Hex() != blockHash || location.Entry != i || location.Timestamp != timestamp {
+			t.Fatalf("unexpected location for chunk %s", data)
+		}
+	}
+}
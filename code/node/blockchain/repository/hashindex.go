@@ -0,0 +1,334 @@
+package repository
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+//=================================================================================================
+// Hash Index
+//-------------------------------------------------------------------------------------------------
+
+// An on-disk index mapping 32 byte hashes to fixed length values. Keys are split into 256 buckets
+// by their last byte. Each bucket is made of two files of fixed width entries (key followed by
+// value):
+//
+// * A sorted file, binary searchable, which holds most of the entries.
+// * An append-only log holding the entries added since the sorted file was last rewritten.
+//
+// New entries are appended to the log. Once the log grows past a threshold it is merged into the
+// sorted file, which is rewritten and atomically replaced. To avoid reading the sorted file
+// entry by entry when searching, the index keeps in memory a sparse directory holding every Nth
+// key of each sorted file, so that finding a key takes a binary search in memory followed by a
+// single read of at most N entries from disk. Lookups are therefore O(log n) regardless of the
+// amount of entries, plus a scan of a log that never exceeds the threshold.
+
+const hashIndexKeyLength int = 32
+
+type hashIndex struct {
+	// The directory that holds the index files.
+	dir string
+	// The prefix of the name of every file of this index.
+	prefix string
+	// The length of the value stored along with each key.
+	valueLength int
+	// The amount of entries that the log of a bucket may hold before being merged.
+	logThreshold int
+	// The distance between two consecutive keys kept in a sparse directory.
+	sparseInterval int
+	// Sparse directories of the sorted files, loaded lazily.
+	directories     map[byte]*sparseDirectory
+	directoriesLock sync.Mutex
+	lock            sync.RWMutex
+}
+
+type sparseDirectory struct {
+	// The total amount of entries in the sorted file.
+	count int
+	// Every sparseInterval-th key of the sorted file, starting with the first one.
+	keys [][]byte
+}
+
+func createHashIndex(dir string, prefix string, valueLength int, logThreshold int, sparseInterval int) *hashIndex {
+	index := &hashIndex{}
+	index.dir = dir
+	index.prefix = prefix
+	index.valueLength = valueLength
+	index.logThreshold = logThreshold
+	index.sparseInterval = sparseInterval
+	index.directories = make(map[byte]*sparseDirectory)
+	return index
+}
+
+func (index *hashIndex) entryLength() int {
+	return hashIndexKeyLength + index.valueLength
+}
+
+func (index *hashIndex) sortedPath(bucket byte) string {
+	return path.Join(index.dir, fmt.Sprintf("%s-%d.sorted", index.prefix, bucket))
+}
+
+func (index *hashIndex) logPath(bucket byte) string {
+	return path.Join(index.dir, fmt.Sprintf("%s-%d.log", index.prefix, bucket))
+}
+
+func bucketForKey(key []byte) byte {
+	return key[hashIndexKeyLength-1]
+}
+
+// Get the path to the log file that an insertion of the given key appends to.
+func (index *hashIndex) appendTarget(key []byte) string {
+	return index.logPath(bucketForKey(key))
+}
+
+// Finds the value of the first entry inserted with the given key. Returns nil if there is none.
+func (index *hashIndex) Lookup(key []byte) ([]byte, error) {
+	index.lock.RLock()
+	defer index.lock.RUnlock()
+
+	bucket := bucketForKey(key)
+
+	if value, err := index.lookupSorted(bucket, key); err != nil || value != nil {
+		return value, err
+	}
+
+	// The key was not merged into the sorted file, so it can only be in the log.
+	entries, err := index.readEntries(index.logPath(bucket), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if bytes.Equal(entry[:hashIndexKeyLength], key) {
+			return entry[hashIndexKeyLength:], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Appends a new entry to the index. Use Compact afterwards to keep the log short.
+func (index *hashIndex) Insert(key []byte, value []byte) error {
+	if len(value) != index.valueLength {
+		return errors.New("unexpected index value length")
+	}
+
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	file, err := os.OpenFile(index.logPath(bucketForKey(key)), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	entry := make([]byte, 0, index.entryLength())
+	entry = append(entry, key[:hashIndexKeyLength]...)
+	entry = append(entry, value...)
+
+	if _, err := file.Write(entry); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// Merges the log of the bucket the given key belongs to into its sorted file, if the log has
+// grown past the threshold.
+func (index *hashIndex) Compact(key []byte) error {
+	bucket := bucketForKey(key)
+
+	info, err := os.Stat(index.logPath(bucket))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Size() < int64(index.logThreshold*index.entryLength()) {
+		return nil
+	}
+
+	index.lock.Lock()
+	defer index.lock.Unlock()
+	return index.merge(bucket)
+}
+
+// Merges the logs of all buckets into their sorted files.
+func (index *hashIndex) CompactAll() error {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	for bucket := 0; bucket < 256; bucket++ {
+		if err := index.merge(byte(bucket)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes every entry from the index.
+func (index *hashIndex) reset() error {
+	index.lock.Lock()
+	defer index.lock.Unlock()
+
+	for bucket := 0; bucket < 256; bucket++ {
+		for _, filepath := range []string{index.sortedPath(byte(bucket)), index.logPath(byte(bucket))} {
+			if err := os.Remove(filepath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	index.directoriesLock.Lock()
+	index.directories = make(map[byte]*sparseDirectory)
+	index.directoriesLock.Unlock()
+	return nil
+}
+
+func (index *hashIndex) merge(bucket byte) error {
+	logEntries, err := index.readEntries(index.logPath(bucket), 0, -1)
+	if err != nil || len(logEntries) == 0 {
+		return err
+	}
+	sortedEntries, err := index.readEntries(index.sortedPath(bucket), 0, -1)
+	if err != nil {
+		return err
+	}
+
+	// Sort stably so that, for repeated keys, the entry inserted first is found first.
+	entries := append(sortedEntries, logEntries...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i][:hashIndexKeyLength], entries[j][:hashIndexKeyLength]) < 0
+	})
+
+	// Write the merged entries to a temporary file that then replaces the sorted file.
+	temporaryPath := index.sortedPath(bucket) + ".tmp"
+	file, err := os.OpenFile(temporaryPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, err := file.Write(entry); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	file.Close()
+
+	if err := os.Rename(temporaryPath, index.sortedPath(bucket)); err != nil {
+		return err
+	}
+	delete(index.directories, bucket)
+
+	// If the process stops before the log is truncated, its entries will be merged again.
+	// Repeated entries are harmless, since the first one is always the one returned.
+	return os.Truncate(index.logPath(bucket), 0)
+}
+
+func (index *hashIndex) lookupSorted(bucket byte, key []byte) ([]byte, error) {
+	directory, err := index.directory(bucket)
+	if err != nil || directory.count == 0 {
+		return nil, err
+	}
+
+	// Find the first sampled key that is not less than the one being looked for. The first
+	// entry with the key is then either that sample or in the interval that precedes it.
+	position := sort.Search(len(directory.keys), func(i int) bool {
+		return bytes.Compare(directory.keys[i], key) >= 0
+	})
+
+	first := 0
+	if position > 0 {
+		first = (position - 1) * index.sparseInterval
+	}
+	entries, err := index.readEntries(index.sortedPath(bucket), first, index.sparseInterval+1)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		comparison := bytes.Compare(entry[:hashIndexKeyLength], key)
+		if comparison == 0 {
+			return entry[hashIndexKeyLength:], nil
+		} else if comparison > 0 {
+			break
+		}
+	}
+
+	return nil, nil
+}
+
+// Get the sparse directory of a sorted file, loading it if needed. Must be called with at least
+// a read lock on the index; concurrent loads of the same directory are harmless.
+func (index *hashIndex) directory(bucket byte) (*sparseDirectory, error) {
+	index.directoriesLock.Lock()
+	directory, found := index.directories[bucket]
+	index.directoriesLock.Unlock()
+
+	if found {
+		return directory, nil
+	}
+
+	entries, err := index.readEntries(index.sortedPath(bucket), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	directory = &sparseDirectory{}
+	directory.count = len(entries)
+	for i := 0; i < len(entries); i += index.sparseInterval {
+		directory.keys = append(directory.keys, entries[i][:hashIndexKeyLength])
+	}
+
+	index.directoriesLock.Lock()
+	index.directories[bucket] = directory
+	index.directoriesLock.Unlock()
+	return directory, nil
+}
+
+// Reads up to count entries from the given file, starting from the entry in the given position.
+// A negative count reads all remaining entries. A missing file has no entries. A trailing
+// incomplete entry, left by an interrupted write, is ignored.
+func (index *hashIndex) readEntries(filepath string, first int, count int) ([][]byte, error) {
+	file, err := os.Open(filepath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	length := index.entryLength()
+	available := int(info.Size())/length - first
+	if count < 0 || count > available {
+		count = available
+	}
+	if count <= 0 {
+		return nil, nil
+	}
+
+	// Read all requested entries at once.
+	buffer := make([]byte, count*length)
+	if _, err := file.ReadAt(buffer, int64(first*length)); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	entries := make([][]byte, count)
+	for i := 0; i < count; i++ {
+		entries[i] = buffer[i*length : (i+1)*length]
+	}
+	return entries, nil
+}
@@ -0,0 +1,68 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+func TestHashIndexLookups(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "hashindex")
+	defer os.RemoveAll(dir)
+
+	// Use small thresholds to exercise merges and sparse directories.
+	index := createHashIndex(dir, "test", 8, 4, 3)
+
+	keys := make([][]byte, 2000)
+	for i := range keys {
+		keys[i] = random32().Bytes[:]
+		if err := index.Insert(keys[i], indexValue(i)); err != nil {
+			t.Fatalf("could not insert key %d: %s", i, err.Error())
+		}
+		if err := index.Compact(keys[i]); err != nil {
+			t.Fatalf("could not compact after key %d: %s", i, err.Error())
+		}
+	}
+
+	for i, key := range keys {
+		value, err := index.Lookup(key)
+		if err != nil {
+			t.Fatalf("could not look up key %d: %s", i, err.Error())
+		}
+		if !bytes.Equal(value, indexValue(i)) {
+			t.Fatalf("unexpected value for key %d", i)
+		}
+	}
+
+	if value, _ := index.Lookup(random32().Bytes[:]); value != nil {
+		t.Fatal("found a value for a missing key")
+	}
+}
+
+func TestHashIndexRepeatedKeys(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "hashindex")
+	defer os.RemoveAll(dir)
+
+	index := createHashIndex(dir, "test", 8, 64, 2)
+	key := random32().Bytes[:]
+
+	// The value inserted first must be returned, both before and after merging.
+	for i := 0; i < 5; i++ {
+		index.Insert(random32().Bytes[:], indexValue(100+i))
+		index.Insert(key, indexValue(i))
+	}
+	if value, _ := index.Lookup(key); !bytes.Equal(value, indexValue(0)) {
+		t.Fatal("unexpected value before merging")
+	}
+	index.CompactAll()
+	if value, _ := index.Lookup(key); !bytes.Equal(value, indexValue(0)) {
+		t.Fatal("unexpected value after merging")
+	}
+}
+
+func indexValue(i int) []byte {
+	value := make([]byte, 8)
+	binary.LittleEndian.PutUint64(value, uint64(i))
+	return value
+}
@@ -0,0 +1,186 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"tp1.aba.distros.fi.uba.ar/common/logging"
+	"tp1.aba.distros.fi.uba.ar/common/synchro"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+
+	number "tp1.aba.distros.fi.uba.ar/common/number/big32"
+)
+
+//=================================================================================================
+// Height Index
+//-------------------------------------------------------------------------------------------------
+
+// Every saved block gets a height, which is its position in the chain starting from 1. Since
+// blocks are only ever appended to the head of the chain, heights are assigned in increasing
+// order without gaps, so the height index is a single file holding the location of each block
+// (as stored in the hash index) in the position given by its height. Finding a block by height
+// therefore takes a single read.
+
+const heightIndexFilename string = "height"
+
+func (repo *BlockRepository) heightIndexPath() string {
+	return path.Join(repo.IndexDir, heightIndexFilename)
+}
+
+func heightIndexOffset(height int64) int64 {
+	return (height - 1) * int64(blockLocationLength)
+}
+
+// Writes the location of the block with the given height to the height index.
+func (repo *BlockRepository) indexHeight(height int64, segment int64, fpos int64) error {
+	flags := os.O_WRONLY | os.O_CREATE
+	return synchro.HandleFileAtomically(repo.heightIndexPath(), flags, func(file *os.File) error {
+		// Write to the position of the height rather than appending, so that the entry always
+		// ends up in the right place.
+		if _, err := file.WriteAt(encodeBlockLocation(segment, fpos), heightIndexOffset(height)); err != nil {
+			return err
+		}
+		return file.Sync()
+	})
+}
+
+// Get the block with the given height. Returns nil if there is no such block.
+func (repo *BlockRepository) GetOneWithHeight(height int64) (*blockchain.Block, error) {
+	if height < 1 || height > repo.PreviousBlockHeight() {
+		return nil, nil
+	}
+
+	// Read the location of the block from the height index.
+	location := make([]byte, blockLocationLength)
+	found := false
+
+	err := synchro.HandleFileAtomicallyIfFound(repo.heightIndexPath(), os.O_RDONLY, func(file *os.File) error {
+		if _, err := file.ReadAt(location, heightIndexOffset(height)); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		found = true
+		return nil
+	}, func() error {
+		return nil
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return repo.readBlockAt(location)
+}
+
+// Get the height of the block with the given hash. Returns 0 if there is no such block in the
+// chain. Blocks are appended in the order of their height, so the locations in the height index
+// are sorted and the location found in the hash index can be searched for in it, which takes a
+// logarithmic amount of reads rather than a walk down the chain.
+func (repo *BlockRepository) GetHeightWithHash(hash *number.Big32) (int64, error) {
+	value, err := repo.hashes.Lookup(hash.Bytes[:])
+	if err != nil || value == nil {
+		return 0, err
+	}
+	segment, fpos := decodeBlockLocation(value)
+
+	var height int64
+	err = synchro.HandleFileAtomicallyIfFound(repo.heightIndexPath(), os.O_RDONLY, func(file *os.File) error {
+		location := make([]byte, blockLocationLength)
+		low, high := int64(1), repo.PreviousBlockHeight()
+		for low <= high {
+			middle := low + (high-low)/2
+			if _, err := file.ReadAt(location, heightIndexOffset(middle)); errors.Is(err, io.EOF) {
+				high = middle - 1
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			middleSegment, middleFpos := decodeBlockLocation(location)
+			switch {
+			case middleSegment == segment && middleFpos == fpos:
+				height = middle
+				return nil
+			case middleSegment < segment || (middleSegment == segment && middleFpos < fpos):
+				low = middle + 1
+			default:
+				high = middle - 1
+			}
+		}
+		return nil
+	}, func() error {
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return height, nil
+}
+
+// Rewrites the height index by walking the chain back from the given block, which must be
+// indexed by hash. Returns the height of the given block.
+func (repo *BlockRepository) rebuildHeightIndex(tip *number.Big32) (int64, error) {
+	// Collect block locations from the tip back to the first block.
+	locations := make([][]byte, 0)
+
+	for hash := tip; !hash.IsZero(); {
+		location, err := repo.hashes.Lookup(hash.Bytes[:])
+		if err != nil {
+			return 0, err
+		}
+		var block *blockchain.Block = nil
+		if location != nil {
+			if block, err = repo.readBlockAt(location); err != nil {
+				return 0, err
+			}
+		}
+		if block == nil || !block.Hash().Equals(hash) {
+			return 0, fmt.Errorf("block %s could not be found while computing heights", hash.Hex())
+		}
+		locations = append(locations, location)
+		hash = block.PreviousHash()
+	}
+
+	// Write the locations from the first block on to a temporary file that then replaces the
+	// height index.
+	temporaryPath := repo.heightIndexPath() + ".tmp"
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+
+	err := synchro.HandleFileAtomically(temporaryPath, flags, func(file *os.File) error {
+		for i := len(locations) - 1; i >= 0; i-- {
+			if _, err := file.Write(locations[i]); err != nil {
+				return err
+			}
+		}
+		return file.Sync()
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Rename(temporaryPath, repo.heightIndexPath()); err != nil {
+		return 0, err
+	}
+
+	return int64(len(locations)), nil
+}
+
+// Head files written by earlier versions do not store the height of the head. Compute it from
+// the chain, building the height index along the way, and store it.
+func (repo *BlockRepository) migrateHeadWithoutHeight() error {
+	if repo.previousBlockHash.IsZero() {
+		return nil
+	}
+
+	logging.Log("Blockchain head has no height, computing heights from the chain")
+	height, err := repo.rebuildHeightIndex(repo.previousBlockHash)
+	if err != nil {
+		return err
+	}
+	repo.previousBlockHeight = height
+
+	return repo.writeHeadFile(
+		repo.previousBlockHash, repo.previousBlockDifficulty, repo.previousBlockTimestamp, height, nil)
+}
@@ -0,0 +1,84 @@
+package repository
+
+import (
+	"os"
+	"testing"
+
+	number "tp1.aba.distros.fi.uba.ar/common/number/big32"
+)
+
+func TestGetOneWithHeight(t *testing.T) {
+	repo, _ := CreateBlockRepository()
+	defer cleanup(repo)
+
+	chain := saveVerifiableChain(t, repo, 5)
+
+	if repo.PreviousBlockHeight() != 5 {
+		t.Fatalf("unexpected height: %d", repo.PreviousBlockHeight())
+	}
+	for i, block := range chain {
+		retrieved, err := repo.GetOneWithHeight(int64(i + 1))
+		if err != nil {
+			t.Fatalf("could not get block with height %d: %s", i+1, err.Error())
+		}
+		if retrieved == nil || !retrieved.Hash().Equals(block.Hash()) {
+			t.Fatalf("unexpected block with height %d", i+1)
+		}
+	}
+	for _, height := range []int64{0, 6} {
+		if retrieved, _ := repo.GetOneWithHeight(height); retrieved != nil {
+			t.Fatalf("found a block with height %d", height)
+		}
+	}
+
+	// The height must survive a restart.
+	repo, _ = CreateBlockRepository()
+	if repo.PreviousBlockHeight() != 5 {
+		t.Fatalf("unexpected height after restart: %d", repo.PreviousBlockHeight())
+	}
+}
+
+func TestGetHeightWithHash(t *testing.T) {
+	repo, _ := CreateBlockRepository()
+	defer cleanup(repo)
+
+	chain := saveVerifiableChain(t, repo, 7)
+
+	for i, block := range chain {
+		height, err := repo.GetHeightWithHash(block.Hash())
+		if err != nil {
+			t.Fatalf("could not get height of block %d: %s", i+1, err.Error())
+		}
+		if height != int64(i+1) {
+			t.Fatalf("unexpected height %d for block %d", height, i+1)
+		}
+	}
+	if height, _ := repo.GetHeightWithHash(number.One); height != 0 {
+		t.Fatalf("found an unknown block at height %d", height)
+	}
+}
+
+func TestHeadWithoutHeightIsMigrated(t *testing.T) {
+	repo, _ := CreateBlockRepository()
+	defer cleanup(repo)
+
+	chain := saveVerifiableChain(t, repo, 3)
+
+	// Drop the height from the head file and the height index, as left by earlier versions.
+	os.Truncate(repo.BlockchainHeadFilepath, 72)
+	os.Remove(repo.heightIndexPath())
+
+	repo, err := CreateBlockRepository()
+	if err != nil {
+		t.Fatalf("could not recreate repository: %s", err.Error())
+	}
+	if repo.PreviousBlockHeight() != 3 {
+		t.Fatalf("unexpected height: %d", repo.PreviousBlockHeight())
+	}
+	if retrieved, _ := repo.GetOneWithHeight(2); retrieved == nil || !retrieved.Hash().Equals(chain[1].Hash()) {
+		t.Fatal("unexpected block with height 2")
+	}
+	if info, _ := os.Stat(repo.BlockchainHeadFilepath); info.Size() != 80 {
+		t.Fatal("the head file was not rewritten with the height")
+	}
+}
@@ -0,0 +1,269 @@
+package repository
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"tp1.aba.distros.fi.uba.ar/common/logging"
+	"tp1.aba.distros.fi.uba.ar/common/synchro"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+
+	number "tp1.aba.distros.fi.uba.ar/common/number/big32"
+)
+
+//=================================================================================================
+// Write-ahead journal
+//-------------------------------------------------------------------------------------------------
+
+// Saving a block requires appending it to a segment, appending entries to the indexes and
+// replacing the head file. Before doing any of that, the repository writes a journal record
+// holding the block, its height, the new difficulty and retarget state, and the size that each
+// appended file had beforehand.
+// Once the record has been synced the block is considered committed: if the process crashes
+// midway, the record is replayed on the next startup by truncating all appended files back to
+// their recorded size and writing everything again. The record is deleted when the save
+// completes. A record whose checksum does not match was interrupted while being written, which
+// means that no other file was touched yet and it can be safely discarded.
+//
+// The journal file has the following format:
+//
+// * The amount of files that the commit appends to (2 bytes).
+// * For each one of those files:
+//   - The length of the path (2 bytes).
+//   - The path.
+//   - The size of the file before the commit (8 bytes).
+// * The new difficulty to store in the head file (32 bytes).
+// * The height of the block (8 bytes).
+// * The block, with metadata.
+// * The length of the retarget state (4 bytes), followed by the state. Records written by earlier
+//   versions end before it.
+// * A SHA-256 checksum of everything that precedes it (32 bytes).
+
+// A file appended to by a commit, along with its size before the commit.
+type journalTarget struct {
+	path string
+	size int64
+}
+
+type journalRecord struct {
+	targets       []*journalTarget
+	difficulty    *number.Big32
+	retargetState []byte
+	height        int64
+	block         *blockchain.Block
+}
+
+func (repo *BlockRepository) createJournalRecord(
+	block *blockchain.Block, newDifficulty *number.Big32, retargetState []byte, height int64) (*journalRecord, error) {
+
+	record := &journalRecord{}
+	record.difficulty = newDifficulty
+	record.retargetState = retargetState
+	record.height = height
+	record.block = block
+
+	// Record the current size of every file the commit will append to.
+	paths, err := repo.appendTargets(block)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		target := &journalTarget{path, 0}
+		if info, err := os.Stat(path); err == nil {
+			target.size = info.Size()
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		record.targets = append(record.targets, target)
+	}
+
+	return record, nil
+}
+
+func (record *journalRecord) encode() []byte {
+	length := 256 + int(record.block.LengthWithMetadata()) + len(record.retargetState)
+	buffer := bytes.NewBuffer(make([]byte, 0, length))
+
+	// Write the files appended to by the commit.
+	field := make([]byte, 8)
+	binary.LittleEndian.PutUint16(field[0:2], uint16(len(record.targets)))
+	buffer.Write(field[0:2])
+	for _, target := range record.targets {
+		binary.LittleEndian.PutUint16(field[0:2], uint16(len(target.path)))
+		buffer.Write(field[0:2])
+		buffer.WriteString(target.path)
+		binary.LittleEndian.PutUint64(field, uint64(target.size))
+		buffer.Write(field)
+	}
+
+	// Write the new difficulty, the height, the block and the retarget state.
+	buffer.Write(record.difficulty.Bytes[:])
+	height := make([]byte, 8)
+	binary.LittleEndian.PutUint64(height, uint64(record.height))
+	buffer.Write(height)
+	record.block.WriteWithMetadata(buffer)
+	binary.LittleEndian.PutUint32(field[0:4], uint32(len(record.retargetState)))
+	buffer.Write(field[0:4])
+	buffer.Write(record.retargetState)
+
+	// Write the checksum.
+	checksum := sha256.Sum256(buffer.Bytes())
+	buffer.Write(checksum[:])
+	return buffer.Bytes()
+}
+
+func decodeJournalRecord(data []byte) (*journalRecord, error) {
+	// Ensure that the record was completely written.
+	if len(data) < sha256.Size {
+		return nil, errors.New("the journal record is incomplete")
+	}
+	content := data[:len(data)-sha256.Size]
+	checksum := sha256.Sum256(content)
+	if !bytes.Equal(checksum[:], data[len(data)-sha256.Size:]) {
+		return nil, errors.New("the journal record checksum does not match")
+	}
+
+	record := &journalRecord{}
+	reader := bytes.NewReader(content)
+
+	field := make([]byte, 8)
+	if _, err := io.ReadFull(reader, field[0:2]); err != nil {
+		return nil, err
+	}
+	count := binary.LittleEndian.Uint16(field[0:2])
+	for i := uint16(0); i < count; i++ {
+		if _, err := io.ReadFull(reader, field[0:2]); err != nil {
+			return nil, err
+		}
+		path := make([]byte, binary.LittleEndian.Uint16(field[0:2]))
+		if _, err := io.ReadFull(reader, path); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(reader, field); err != nil {
+			return nil, err
+		}
+		size := int64(binary.LittleEndian.Uint64(field))
+		record.targets = append(record.targets, &journalTarget{string(path), size})
+	}
+
+	record.difficulty = &number.Big32{}
+	if _, err := io.ReadFull(reader, record.difficulty.Bytes[:]); err != nil {
+		return nil, err
+	}
+	height := make([]byte, 8)
+	if _, err := io.ReadFull(reader, height); err != nil {
+		return nil, err
+	}
+	record.height = int64(binary.LittleEndian.Uint64(height))
+	block, err := blockchain.ReadBlock(reader)
+	if err != nil {
+		return nil, err
+	}
+	record.block = block
+
+	if reader.Len() > 0 {
+		if _, err := io.ReadFull(reader, field[0:4]); err != nil {
+			return nil, err
+		}
+		record.retargetState = make([]byte, binary.LittleEndian.Uint32(field[0:4]))
+		if _, err := io.ReadFull(reader, record.retargetState); err != nil {
+			return nil, err
+		}
+	}
+
+	return record, nil
+}
+
+func (repo *BlockRepository) writeJournal(record *journalRecord) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	return synchro.HandleFileAtomically(repo.JournalFilepath, flags, func(file *os.File) error {
+		if _, err := file.Write(record.encode()); err != nil {
+			return err
+		}
+		// The record must be durable before any other file is touched.
+		if err := file.Sync(); err != nil {
+			return err
+		}
+		return syncDirectory(repo.JournalFilepath)
+	})
+}
+
+func (repo *BlockRepository) removeJournal() error {
+	if err := os.Remove(repo.JournalFilepath); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// The removal marks the commit as complete, so it must not be undone by a crash.
+	return syncDirectory(repo.JournalFilepath)
+}
+
+// Truncates every file appended to by the journaled commit back to its size before the commit,
+// undoing any partial write. Returns the total amount of bytes removed.
+func (repo *BlockRepository) rollback(record *journalRecord) (int64, error) {
+	var removed int64 = 0
+
+	for _, target := range record.targets {
+		info, err := os.Stat(target.path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return removed, err
+		}
+		if info.Size() <= target.size {
+			continue
+		}
+
+		err = synchro.HandleFileAtomically(target.path, os.O_WRONLY, func(file *os.File) error {
+			if err := file.Truncate(target.size); err != nil {
+				return err
+			}
+			return file.Sync()
+		})
+		if err != nil {
+			return removed, err
+		}
+		removed += info.Size() - target.size
+	}
+
+	return removed, nil
+}
+
+// Completes a commit interrupted by a crash, if there is one. Called on startup before the head
+// file is loaded.
+func (repo *BlockRepository) recoverJournal() error {
+	data, err := os.ReadFile(repo.JournalFilepath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	record, err := decodeJournalRecord(data)
+	if err != nil {
+		// The crash happened while writing the journal itself, before any other file was
+		// modified, so the block was never committed.
+		logging.LogError("Recovery - Discarding incomplete journal record", err)
+		return repo.removeJournal()
+	}
+
+	// Undo whatever part of the commit made it to disk and replay it from the start.
+	removed, err := repo.rollback(record)
+	if err != nil {
+		return err
+	}
+	if err := repo.commit(record.block, record.difficulty, record.retargetState, record.height); err != nil {
+		return err
+	}
+
+	logging.Log(fmt.Sprintf(
+		"Recovery - Replayed interrupted commit of block %s (%d partially written bytes discarded from %d files)",
+		record.block.Hash().Hex(), removed, len(record.targets)))
+
+	return repo.removeJournal()
+}
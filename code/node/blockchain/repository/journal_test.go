@@ -0,0 +1,83 @@
+package repository
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestInterruptedCommitIsReplayed(t *testing.T) {
+	repo, _ := CreateBlockRepository()
+	defer cleanup(repo)
+
+	chain := saveVerifiableChain(t, repo, 1)
+	block := verifiableBlock(t, chain[0].Hash(), time.Unix(chain[0].Timestamp(), 0))
+
+	// Simulate a crash right after writing part of the block to its data file.
+	record, err := repo.createJournalRecord(block, block.Difficulty(), []byte("retarget"), 1)
+	if err != nil {
+		t.Fatalf("could not create journal record: %s", err.Error())
+	}
+	if err := repo.writeJournal(record); err != nil {
+		t.Fatalf("could not write journal: %s", err.Error())
+	}
+	segment, _ := repo.segmentFor(block)
+	filepath := repo.segmentPath(segment)
+	file, _ := os.OpenFile(filepath, os.O_APPEND|os.O_WRONLY, 0600)
+	file.Write(block.BufferWithMetadata()[:10])
+	file.Close()
+
+	// Restarting the repository should complete the commit.
+	repo, err = CreateBlockRepository()
+	if err != nil {
+		t.Fatalf("could not recreate repository: %s", err.Error())
+	}
+	if !repo.PreviousBlockHash().Equals(block.Hash()) {
+		t.Fatal("the interrupted block was not made the head")
+	}
+	if !bytes.Equal(repo.RetargetState(), []byte("retarget")) {
+		t.Fatal("the retarget state of the interrupted block was not stored")
+	}
+	if _, err := os.Stat(repo.JournalFilepath); !os.IsNotExist(err) {
+		t.Fatal("the journal was not removed after recovery")
+	}
+	if retrieved, err := repo.GetOneWithHash(block.Hash()); err != nil || retrieved == nil {
+		t.Fatal("the interrupted block could not be retrieved after recovery")
+	}
+
+	report, err := repo.Verify()
+	if err != nil {
+		t.Fatalf("could not verify repository: %s", err.Error())
+	}
+	if !report.Ok || report.ChainLength != 2 {
+		t.Fatalf("unexpected chain after recovery: %d issues, length %d",
+			len(report.Issues), report.ChainLength)
+	}
+}
+
+func TestIncompleteJournalIsDiscarded(t *testing.T) {
+	repo, _ := CreateBlockRepository()
+	defer cleanup(repo)
+
+	chain := saveVerifiableChain(t, repo, 1)
+	block := verifiableBlock(t, chain[0].Hash(), time.Unix(chain[0].Timestamp(), 0))
+
+	// Simulate a crash while the journal record itself was being written.
+	record, _ := repo.createJournalRecord(block, block.Difficulty(), nil, 1)
+	data := record.encode()
+	if err := os.WriteFile(repo.JournalFilepath, data[:len(data)/2], 0600); err != nil {
+		t.Fatalf("could not write journal: %s", err.Error())
+	}
+
+	repo, err := CreateBlockRepository()
+	if err != nil {
+		t.Fatalf("could not recreate repository: %s", err.Error())
+	}
+	if !repo.PreviousBlockHash().Equals(chain[0].Hash()) {
+		t.Fatal("the head changed after discarding an incomplete journal")
+	}
+	if _, err := os.Stat(repo.JournalFilepath); !os.IsNotExist(err) {
+		t.Fatal("the incomplete journal was not removed")
+	}
+}
@@ -0,0 +1,164 @@
+package repository
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+
+	number "tp1.aba.distros.fi.uba.ar/common/number/big32"
+)
+
+//=================================================================================================
+// Memory Repository
+//-------------------------------------------------------------------------------------------------
+
+// A storage backend that keeps all blocks in memory. Nothing survives the process, so it is
+// only meant for tests and demos.
+type MemoryRepository struct {
+	// Blocks indexed by hash, by height (starting from 1) and by the minute they were created in.
+	blocksByHash   map[number.Big32]*blockchain.Block
+	blocksByHeight []*blockchain.Block
+	blocksByMinute map[int64][]*blockchain.Block
+	// The height of every block, indexed by hash.
+	heights map[number.Big32]int64
+	// The first location of every chunk, indexed by the hash of its data.
+	chunks map[number.Big32]*ChunkLocation
+	// Keep information about the block last added to the blockchain.
+	previousBlockHash       *number.Big32
+	previousBlockTimestamp  int64
+	previousBlockDifficulty *number.Big32
+	retargetState           []byte
+	lock                    sync.RWMutex
+}
+
+func CreateMemoryRepository() *MemoryRepository {
+	repo := &MemoryRepository{}
+	repo.Cleanup()
+	return repo
+}
+
+func (repo *MemoryRepository) GetOneWithHash(hash *number.Big32) (*blockchain.Block, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+	return repo.blocksByHash[*hash], nil
+}
+
+func (repo *MemoryRepository) GetOneWithHeight(height int64) (*blockchain.Block, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	if height < 1 || height > int64(len(repo.blocksByHeight)) {
+		return nil, nil
+	}
+	return repo.blocksByHeight[height-1], nil
+}
+
+func (repo *MemoryRepository) GetHeightWithHash(hash *number.Big32) (int64, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+	return repo.heights[*hash], nil
+}
+
+func (repo *MemoryRepository) GetBlocksFromMinute(t time.Time) ([]*blockchain.Block, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	// Return a copy, since the list keeps growing as blocks are saved.
+	stored := repo.blocksByMinute[minuteOf(t)]
+	blocks := make([]*blockchain.Block, len(stored))
+	copy(blocks, stored)
+	return blocks, nil
+}
+
+func (repo *MemoryRepository) MinutesWithBlocks(from time.Time, to time.Time) ([]time.Time, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+
+	minutes := make([]time.Time, 0)
+	for minute := range repo.blocksByMinute {
+		if minute >= minuteOf(from) && minute < to.Unix() {
+			minutes = append(minutes, time.Unix(minute, 0).UTC())
+		}
+	}
+
+	sort.Slice(minutes, func(i, j int) bool {
+		return minutes[i].Before(minutes[j])
+	})
+	return minutes, nil
+}
+
+func (repo *MemoryRepository) FindChunk(contentHash *number.Big32) (*ChunkLocation, error) {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+	return repo.chunks[*contentHash], nil
+}
+
+func (repo *MemoryRepository) Save(block *blockchain.Block, computeDifficulty func() (*number.Big32, []byte)) error {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	if err := validateNextBlock(repo.previousBlockHash, repo.previousBlockTimestamp, block); err != nil {
+		return err
+	}
+	newDifficulty, retargetState := computeDifficulty()
+
+	// Add the block to every index and make it the head.
+	minute := minuteOf(time.Unix(block.Timestamp(), 0))
+	repo.blocksByHash[*block.Hash()] = block
+	repo.blocksByHeight = append(repo.blocksByHeight, block)
+	repo.heights[*block.Hash()] = int64(len(repo.blocksByHeight))
+	repo.blocksByMinute[minute] = append(repo.blocksByMinute[minute], block)
+	forEachChunk(block, func(contentHash *number.Big32, location *ChunkLocation) error {
+		if _, found := repo.chunks[*contentHash]; !found {
+			repo.chunks[*contentHash] = location
+		}
+		return nil
+	})
+
+	repo.previousBlockHash = block.Hash()
+	repo.previousBlockTimestamp = block.Timestamp()
+	repo.previousBlockDifficulty = newDifficulty
+	repo.retargetState = retargetState
+	return nil
+}
+
+func (repo *MemoryRepository) PreviousBlockHash() *number.Big32 {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+	return repo.previousBlockHash
+}
+
+func (repo *MemoryRepository) PreviousBlockDifficulty() *number.Big32 {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+	return repo.previousBlockDifficulty
+}
+
+func (repo *MemoryRepository) PreviousBlockHeight() int64 {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+	return int64(len(repo.blocksByHeight))
+}
+
+func (repo *MemoryRepository) RetargetState() []byte {
+	repo.lock.RLock()
+	defer repo.lock.RUnlock()
+	return repo.retargetState
+}
+
+func (repo *MemoryRepository) Cleanup() {
+	repo.lock.Lock()
+	defer repo.lock.Unlock()
+
+	repo.blocksByHash = make(map[number.Big32]*blockchain.Block)
+	repo.blocksByHeight = make([]*blockchain.Block, 0)
+	repo.blocksByMinute = make(map[int64][]*blockchain.Block)
+	repo.heights = make(map[number.Big32]int64)
+	repo.chunks = make(map[number.Big32]*ChunkLocation)
+	repo.previousBlockHash = number.Zero
+	repo.previousBlockTimestamp = 0
+	repo.previousBlockDifficulty = number.One
+	repo.retargetState = nil
+}
@@ -0,0 +1,214 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"tp1.aba.distros.fi.uba.ar/common/logging"
+	"tp1.aba.distros.fi.uba.ar/common/synchro"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+)
+
+//=================================================================================================
+// Migration From Minute Files
+//-------------------------------------------------------------------------------------------------
+
+// Earlier versions stored blocks in a file per UTC minute, named after the minute as in
+// blockchain-Y-M-D-H-M, and indexed them in files named index-N. The migration moves the blocks
+// of every minute file, in chronological order, to segments, removes the old files and then
+// rebuilds all indexes and the head file from the segments.
+
+const minuteFilePrefix string = "blockchain-"
+
+var legacyIndexFilename *regexp.Regexp = regexp.MustCompile(`^index-[0-9]+$`)
+
+// A summary of the work done when migrating minute files to segments.
+type MigrationReport struct {
+	MinuteFiles    int            `json:"minuteFiles"`
+	MigratedBlocks int            `json:"migratedBlocks"`
+	TruncatedFiles int            `json:"truncatedFiles"`
+	Segments       int            `json:"segments"`
+	Reindex        *ReindexReport `json:"reindex"`
+}
+
+// Moves all blocks in minute files to segments and rebuilds indexes. Must only be run while the
+// blockchain server is stopped. If interrupted, running it again is safe: the blocks of a minute
+// file that was partially migrated end up repeated in segments, and repeated blocks are left out
+// of the indexes.
+func MigrateMinuteFiles() (*MigrationReport, error) {
+	repo := openBlockRepository()
+	report := &MigrationReport{}
+
+	if err := repo.discardJournal(); err != nil {
+		return nil, err
+	}
+
+	filenames, err := repo.minuteFilenames()
+	if err != nil {
+		return nil, err
+	}
+	report.MinuteFiles = len(filenames)
+
+	// Move blocks file by file, removing each file once all of its blocks are in segments.
+	for _, filename := range filenames {
+		filepath := path.Join(repo.BlockchainDir, filename)
+		count, truncated, err := repo.migrateMinuteFile(filepath)
+		if err != nil {
+			return nil, err
+		}
+		report.MigratedBlocks += count
+		if truncated {
+			logging.Log(fmt.Sprintf("Ignoring incomplete block at the end of %s", filename))
+			report.TruncatedFiles++
+		}
+		if err := os.Remove(filepath); err != nil {
+			return nil, err
+		}
+	}
+
+	// The legacy index points to minute files, so it is useless now.
+	if err := repo.removeLegacyIndex(); err != nil {
+		return nil, err
+	}
+
+	if report.Reindex, err = repo.Reindex(); err != nil {
+		return nil, err
+	}
+	if segments, err := repo.segments(); err != nil {
+		return nil, err
+	} else {
+		report.Segments = len(segments)
+	}
+
+	return report, nil
+}
+
+// Get the minute whose blocks are held by the minute file with the given name.
+func parseMinuteFilename(filename string) (time.Time, error) {
+	var year, month, day, hour, minute int
+	_, err := fmt.Sscanf(filename, minuteFilePrefix+"%d-%d-%d-%d-%d", &year, &month, &day, &hour, &minute)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unexpected minute file name %s: %w", filename, err)
+	}
+	return time.Date(year, time.Month(month), day, hour, minute, 0, 0, time.UTC), nil
+}
+
+// Lists the names of all minute files in chronological order.
+func (repo *BlockRepository) minuteFilenames() ([]string, error) {
+	entries, err := os.ReadDir(repo.BlockchainDir)
+	if err != nil {
+		return nil, err
+	}
+
+	filenames := make([]string, 0)
+	minutes := make(map[string]time.Time)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), minuteFilePrefix) {
+			continue
+		}
+		minute, err := parseMinuteFilename(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		filenames = append(filenames, entry.Name())
+		minutes[entry.Name()] = minute
+	}
+
+	// File names are not zero padded, so they do not sort chronologically.
+	sort.Slice(filenames, func(i, j int) bool {
+		return minutes[filenames[i]].Before(minutes[filenames[j]])
+	})
+	return filenames, nil
+}
+
+// Appends all blocks in a minute file to segments. Returns the amount of blocks moved, and
+// whether the file ended with an incomplete block.
+func (repo *BlockRepository) migrateMinuteFile(filepath string) (int, bool, error) {
+	count := 0
+	truncated := false
+
+	err := synchro.HandleFileAtomically(filepath, os.O_RDONLY, func(file *os.File) error {
+		// Get the size of the file to detect blocks that were not completely written.
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		size := info.Size()
+
+		for offset := int64(0); offset < size; {
+			block, err := blockchain.ReadBlock(file)
+			if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				return err
+			}
+			// The last block may have been interrupted while being written.
+			if block == nil {
+				truncated = true
+				return nil
+			}
+
+			segment, err := repo.segmentFor(block)
+			if err != nil {
+				return err
+			}
+			fpos, err := writeBlockToFile(block, repo.segmentPath(segment))
+			if err != nil {
+				return err
+			}
+			// The sidecar is rebuilt afterwards, but it is needed to decide when to start a
+			// new segment.
+			if err := repo.appendSidecar(segment, block.Timestamp(), fpos); err != nil {
+				return err
+			}
+
+			count++
+			offset += int64(block.LengthWithMetadata())
+		}
+
+		return nil
+	})
+
+	return count, truncated, err
+}
+
+// Undoes whatever part of an interrupted commit made it to disk, without replaying it.
+func (repo *BlockRepository) discardJournal() error {
+	data, err := os.ReadFile(repo.JournalFilepath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if record, err := decodeJournalRecord(data); err == nil {
+		logging.Log(fmt.Sprintf("Discarding interrupted commit of block %s", record.block.Hash().Hex()))
+		if _, err := repo.rollback(record); err != nil {
+			return err
+		}
+	}
+
+	return repo.removeJournal()
+}
+
+func (repo *BlockRepository) removeLegacyIndex() error {
+	entries, err := os.ReadDir(repo.IndexDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !legacyIndexFilename.MatchString(entry.Name()) {
+			continue
+		}
+		if err := os.Remove(path.Join(repo.IndexDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
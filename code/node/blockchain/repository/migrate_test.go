@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	b32 "tp1.aba.distros.fi.uba.ar/common/number/big32"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+)
+
+func TestMinuteFileMigration(t *testing.T) {
+	// Start a new segment every two seconds worth of blocks.
+	t.Setenv("SegmentMaxAge", "2")
+
+	repo, _ := CreateBlockRepository()
+	defer cleanup(repo)
+
+	// Write a chain to minute files, as earlier versions did, along with a legacy index file.
+	timebase := time.Now().UTC()
+	chain := make([]*blockchain.Block, 0)
+	previousHash := b32.Zero
+	for i := 0; i < 5; i++ {
+		creation := timebase.Add(time.Duration(i*20) * time.Second)
+		block := verifiableBlock(t, previousHash, creation)
+		if _, err := writeBlockToFile(block, path.Join(repo.BlockchainDir, minuteFilename(creation))); err != nil {
+			t.Fatalf("could not write block %d: %s", i, err.Error())
+		}
+		chain = append(chain, block)
+		previousHash = block.Hash()
+	}
+	legacyPath := path.Join(repo.IndexDir, "index-7")
+	os.WriteFile(legacyPath, []byte{1, 2, 3}, 0600)
+
+	// The repository must refuse to start until the files are migrated.
+	if _, err := CreateBlockRepository(); err == nil {
+		t.Fatal("the repository started with blocks in minute files")
+	}
+
+	report, err := MigrateMinuteFiles()
+	if err != nil {
+		t.Fatalf("could not migrate minute files: %s", err.Error())
+	}
+	if report.MigratedBlocks != 5 || report.Segments != 5 || report.Reindex.ChainLength != 5 {
+		t.Fatalf("unexpected migration: %d blocks, %d segments", report.MigratedBlocks, report.Segments)
+	}
+	if _, err := os.Stat(legacyPath); !os.IsNotExist(err) {
+		t.Fatal("the legacy index file was not removed")
+	}
+
+	repo, err = CreateBlockRepository()
+	if err != nil {
+		t.Fatalf("could not recreate repository: %s", err.Error())
+	}
+	if !repo.PreviousBlockHash().Equals(chain[4].Hash()) || repo.PreviousBlockHeight() != 5 {
+		t.Fatal("unexpected head after migrating")
+	}
+	for i, block := range chain {
+		if retrieved, _ := repo.GetOneWithHash(block.Hash()); retrieved == nil {
+			t.Fatalf("block %d could not be found by hash after migrating", i)
+		}
+		blocks, _ := repo.GetBlocksFromMinute(time.Unix(block.Timestamp(), 0))
+		found := false
+		for _, retrieved := range blocks {
+			found = found || retrieved.Hash().Equals(block.Hash())
+		}
+		if !found {
+			t.Fatalf("block %d could not be found by minute after migrating", i)
+		}
+	}
+}
+
+func TestSegmentRollover(t *testing.T) {
+	// Start a new segment once a segment holds a single block.
+	t.Setenv("SegmentMaxSize", "1")
+
+	repo, _ := CreateBlockRepository()
+	defer cleanup(repo)
+
+	chain := saveVerifiableChain(t, repo, 3)
+
+	if segments, _ := repo.segments(); len(segments) != 3 {
+		t.Fatalf("unexpected segment count: %d", len(segments))
+	}
+	for i, block := range chain {
+		if retrieved, _ := repo.GetOneWithHeight(int64(i + 1)); retrieved == nil || !retrieved.Hash().Equals(block.Hash()) {
+			t.Fatalf("unexpected block with height %d", i+1)
+		}
+	}
+}
+
+func minuteFilename(t time.Time) string {
+	t = t.UTC()
+	year, month, day := t.Date()
+	return fmt.Sprintf("%s%d-%d-%d-%d-%d", minuteFilePrefix, year, month, day, t.Hour(), t.Minute())
+}
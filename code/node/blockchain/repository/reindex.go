@@ -0,0 +1,200 @@
+package repository
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"tp1.aba.distros.fi.uba.ar/common/logging"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+
+	number "tp1.aba.distros.fi.uba.ar/common/number/big32"
+)
+
+// A summary of the work done when rebuilding indexes.
+type ReindexReport struct {
+	Files          int    `json:"files"`
+	IndexedBlocks  int    `json:"indexedBlocks"`
+	SkippedBlocks  int    `json:"skippedBlocks"`
+	TruncatedFiles int    `json:"truncatedFiles"`
+	ChainLength    int    `json:"chainLength"`
+	Tip            string `json:"tip"`
+}
+
+// A block found while rebuilding indexes, along with the length of the chain that ends in it.
+type reindexedBlock struct {
+	block  *blockchain.Block
+	length int
+}
+
+// Rebuilds all indexes, segment sidecars included, and the head file from the blocks stored in
+// the segments. The tip of the chain is the last block of the longest chain that goes back to the
+// zero hash. Must only be run while the blockchain server is stopped. Running it more than once
+// yields the same result.
+func (repo *BlockRepository) Reindex() (*ReindexReport, error) {
+	report := &ReindexReport{}
+
+	if filenames, err := repo.blockchainFilenames(); err != nil {
+		return nil, err
+	} else {
+		report.Files = len(filenames)
+	}
+
+	// Start from empty indexes.
+	logging.Log("Removing existing indexes")
+	if err := repo.hashes.reset(); err != nil {
+		return nil, err
+	}
+	if err := repo.resetSidecars(); err != nil {
+		return nil, err
+	}
+
+	// Index every block found in the blockchain files.
+	logging.Log("Indexing stored blocks")
+	blocks := make(map[number.Big32]*reindexedBlock)
+
+	err := repo.scanBlocks(func(location *BlockLocation, block *blockchain.Block) error {
+		hash := block.Hash()
+
+		// Leave out blocks whose content does not match their hash, and repeated blocks.
+		if !block.ComputeHash().Equals(hash) {
+			logging.Log(fmt.Sprintf("Skipping corrupted block %s in %s", hash.Hex(), location.Filename))
+			report.SkippedBlocks++
+			return nil
+		}
+		if _, found := blocks[*hash]; found {
+			logging.Log(fmt.Sprintf("Skipping repeated block %s in %s", hash.Hex(), location.Filename))
+			report.SkippedBlocks++
+			return nil
+		}
+
+		if err := repo.appendSidecar(location.Segment, block.Timestamp(), location.Offset); err != nil {
+			return err
+		}
+		if err := repo.indexBlock(block, location.Segment, location.Offset); err != nil {
+			return err
+		}
+		blocks[*hash] = &reindexedBlock{block, 0}
+		report.IndexedBlocks++
+		return nil
+	}, func(location *BlockLocation, size int64) error {
+		logging.Log(fmt.Sprintf("Ignoring incomplete block at the end of %s", location.Filename))
+		report.TruncatedFiles++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := repo.hashes.CompactAll(); err != nil {
+		return nil, err
+	}
+
+	// Find the tip of the chain and make it the head.
+	tip := findChainTip(blocks)
+
+	if tip == nil {
+		logging.Log("No chain could be found, resetting the head")
+		for _, filepath := range []string{repo.BlockchainHeadFilepath, repo.heightIndexPath()} {
+			if err := os.Remove(filepath); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		repo.resetPreviousBlockData()
+		if err := repo.chunks.reset(); err != nil {
+			return nil, err
+		}
+		report.Tip = number.Zero.Hex()
+		return report, nil
+	}
+
+	logging.Log("Indexing block heights")
+	height, err := repo.rebuildHeightIndex(tip.block.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	// The retarget state is not stored along with the blocks, so the difficulty of the tip is
+	// the best available estimate of the difficulty of the next block, and retargeting starts
+	// over.
+	if err := repo.updatePreviousBlockData(tip.block, tip.block.Difficulty(), nil, height); err != nil {
+		return nil, err
+	}
+
+	// Only chunks in blocks that are part of the chain are indexed.
+	logging.Log("Indexing chunks")
+	if err := repo.rebuildChunkIndex(); err != nil {
+		return nil, err
+	}
+	report.ChainLength = tip.length
+	report.Tip = tip.block.Hash().Hex()
+	return report, nil
+}
+
+// Finds the block that ends the longest chain going back to the zero hash. Ties are broken by the
+// most recent timestamp, and then by hash, so that the result does not depend on the order in
+// which blocks were found. Returns nil if no block descends from the zero hash.
+func findChainTip(blocks map[number.Big32]*reindexedBlock) *reindexedBlock {
+	var tip *reindexedBlock = nil
+
+	for _, current := range blocks {
+		length := chainLength(blocks, current)
+		if length <= 0 {
+			continue
+		}
+
+		better := tip == nil || length > tip.length
+		if !better && length == tip.length {
+			if current.block.Timestamp() != tip.block.Timestamp() {
+				better = current.block.Timestamp() > tip.block.Timestamp()
+			} else {
+				better = bytes.Compare(current.block.Hash().Bytes[:], tip.block.Hash().Bytes[:]) > 0
+			}
+		}
+		if better {
+			tip = current
+		}
+	}
+
+	return tip
+}
+
+// Computes the length of the chain that ends in the given block, memoizing it on every block
+// walked through. Chains that do not reach the zero hash have length -1.
+func chainLength(blocks map[number.Big32]*reindexedBlock, last *reindexedBlock) int {
+	// Walk back until reaching a block whose length is already known, or the start of the chain.
+	// The length of the chain that precedes the walked path is kept in a variable.
+	path := make([]*reindexedBlock, 0)
+	length := 0
+
+	for current := last; ; {
+		if current.length != 0 {
+			// Blocks still being walked are marked as broken, so cycles end up broken.
+			length = current.length
+			break
+		}
+		current.length = -1
+		path = append(path, current)
+
+		previousHash := current.block.PreviousHash()
+		if previousHash.IsZero() {
+			break
+		}
+		previous, found := blocks[*previousHash]
+		if !found {
+			length = -1
+			break
+		}
+		current = previous
+	}
+
+	// Assign lengths going forward from the start of the walk.
+	for i := len(path) - 1; i >= 0; i-- {
+		if length >= 0 {
+			length++
+		}
+		path[i].length = length
+	}
+
+	return last.length
+}
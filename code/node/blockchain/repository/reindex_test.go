@@ -0,0 +1,73 @@
+package repository
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	b32 "tp1.aba.distros.fi.uba.ar/common/number/big32"
+)
+
+func TestReindexRebuildsIndexAndHead(t *testing.T) {
+	repo, _ := CreateBlockRepository()
+	defer cleanup(repo)
+
+	chain := saveVerifiableChain(t, repo, 3)
+	tip := chain[len(chain)-1]
+
+	// Add a shorter fork, which must not become the head.
+	fork := verifiableBlock(t, chain[0].Hash(), time.Unix(tip.Timestamp()+1, 0))
+	segment, _ := repo.segmentFor(fork)
+	filepath := repo.segmentPath(segment)
+	if _, err := writeBlockToFile(fork, filepath); err != nil {
+		t.Fatalf("could not write forked block: %s", err.Error())
+	}
+
+	// Lose both the index and the head file.
+	os.RemoveAll(repo.IndexDir)
+	os.MkdirAll(repo.IndexDir, 0700)
+	os.Remove(repo.BlockchainHeadFilepath)
+
+	repo, err := CreateBlockRepository()
+	if err != nil {
+		t.Fatalf("could not recreate repository: %s", err.Error())
+	}
+
+	// Running it twice must yield the same result.
+	for i := 0; i < 2; i++ {
+		report, err := repo.Reindex()
+		if err != nil {
+			t.Fatalf("could not reindex: %s", err.Error())
+		}
+		if report.IndexedBlocks != 4 || report.ChainLength != 3 {
+			t.Fatalf("unexpected indexed blocks %d or chain length %d", report.IndexedBlocks, report.ChainLength)
+		}
+		if report.Tip != tip.Hash().Hex() {
+			t.Fatalf("unexpected tip %s", report.Tip)
+		}
+	}
+
+	for _, block := range append(chain, fork) {
+		if retrieved, _ := repo.GetOneWithHash(block.Hash()); retrieved == nil {
+			t.Fatalf("block %s could not be found after reindexing", block.Hash().Hex())
+		}
+	}
+
+	// The head file must have been rewritten.
+	repo, err = CreateBlockRepository()
+	if err != nil {
+		t.Fatalf("could not recreate repository: %s", err.Error())
+	}
+	if !repo.PreviousBlockHash().Equals(tip.Hash()) {
+		t.Fatal("the head does not point to the tip of the chain")
+	}
+	if !repo.PreviousBlockDifficulty().Equals(b32.One) {
+		t.Fatal("unexpected difficulty after reindexing")
+	}
+	if repo.PreviousBlockHeight() != 3 {
+		t.Fatalf("unexpected height after reindexing: %d", repo.PreviousBlockHeight())
+	}
+	if retrieved, _ := repo.GetOneWithHeight(3); retrieved == nil || !retrieved.Hash().Equals(tip.Hash()) {
+		t.Fatal("unexpected block with height 3 after reindexing")
+	}
+}
@@ -22,22 +22,70 @@ import (
 const defaultBlockchainDir string = "/tmp/distros/blockchain"
 const defaultIndexDir string = "/tmp/distros/blockchain/index"
 const defaultHeadPath string = "/tmp/distros/blockchain/head"
+const defaultJournalPath string = "/tmp/distros/blockchain/journal"
 
 type BlockRepository struct {
-	// The path to the directory that holds blockchain files.
+	// The path to the directory that holds blockchain segments.
 	BlockchainDir string
 	// The path to the directory that holds index files.
 	IndexDir string
 	// The path to a file that will store information about the block last written to the blockchain.
 	BlockchainHeadFilepath string
+	// The path to the write-ahead journal used to commit blocks atomically.
+	JournalFilepath string
+	// The size in bytes and the time span in seconds after which a new segment is started.
+	SegmentMaxSize int
+	SegmentMaxAge  int
+	// The index used to find blocks by hash.
+	hashes *hashIndex
+	// The index used to find chunks by the hash of their data.
+	chunks *hashIndex
 	// Keep information about the block last added to the blockchain.
 	previousBlockHash       *number.Big32
 	previousBlockTimestamp  int64
 	previousBlockDifficulty *number.Big32
-	previousBlockLock       sync.RWMutex
+	previousBlockHeight     int64
+	// The state of the retargeting that decided the difficulty of the next block, opaque to the
+	// repository.
+	retargetState     []byte
+	previousBlockLock sync.RWMutex
 }
 
 func CreateBlockRepository() (*BlockRepository, error) {
+	repo := openBlockRepository()
+
+	// Blocks stored in the per-minute layout used by earlier versions must be moved to segments
+	// with the offline migration tool first.
+	if minuteFiles, err := repo.minuteFilenames(); err != nil {
+		return nil, err
+	} else if len(minuteFiles) > 0 {
+		return nil, errors.New("found blockchain files in the legacy per-minute layout, run the migrate command first")
+	}
+
+	// Complete any block commit that may have been interrupted by a crash. This has to be done
+	// before loading the head file, which might be updated by the recovery.
+	if err := repo.recoverJournal(); err != nil {
+		return nil, err
+	}
+
+	if err := repo.loadHead(); err != nil {
+		return nil, err
+	}
+	if err := repo.migrateMissingChunkIndex(); err != nil {
+		return nil, err
+	}
+
+	logging.Log("Block repository successfully initialized")
+	logging.Log(fmt.Sprintf("Current previous hash: %s", repo.previousBlockHash.Hex()))
+	logging.Log(fmt.Sprintf("Current difficulty: %s", repo.previousBlockDifficulty.Hex()))
+	logging.Log(fmt.Sprintf("Current height: %d", repo.previousBlockHeight))
+
+	return repo, nil
+}
+
+// Instantiates a repository from configuration, creating its directories if needed, without
+// loading any data.
+func openBlockRepository() *BlockRepository {
 	// Instantiate a repository object.
 	repo := &BlockRepository{}
 
@@ -45,6 +93,9 @@ func CreateBlockRepository() (*BlockRepository, error) {
 	repo.BlockchainHeadFilepath = config.GetStringOrDefault("BlockchainHeadFilepath", defaultHeadPath)
 	repo.BlockchainDir = config.GetStringOrDefault("BlockchainDir", defaultBlockchainDir)
 	repo.IndexDir = config.GetStringOrDefault("IndexDir", defaultIndexDir)
+	repo.JournalFilepath = config.GetStringOrDefault("JournalFilepath", defaultJournalPath)
+	repo.SegmentMaxSize, _ = config.GetIntOrDefault("SegmentMaxSize", defaultSegmentMaxSize)
+	repo.SegmentMaxAge, _ = config.GetIntOrDefault("SegmentMaxAge", defaultSegmentMaxAge)
 
 	// Create directories that do not exist.
 	directories := []string{repo.BlockchainDir, repo.IndexDir}
@@ -55,17 +106,26 @@ func CreateBlockRepository() (*BlockRepository, error) {
 		}
 	}
 
+	// Instantiate the hash indexes.
+	logThreshold, _ := config.GetIntOrDefault("HashIndexLogThreshold", 64)
+	sparseInterval, _ := config.GetIntOrDefault("HashIndexSparseInterval", 64)
+	repo.hashes = createHashIndex(repo.IndexDir, "hash", blockLocationLength, logThreshold, sparseInterval)
+	repo.chunks = createHashIndex(repo.IndexDir, chunkIndexPrefix, chunkLocationLength, logThreshold, sparseInterval)
+
+	return repo
+}
+
+func (repo *BlockRepository) loadHead() error {
 	// Load the data from the blockchain head file if it exists. If it does not exist,
 	// initialize the repository records with zero. The file will be created later when
 	// a block is actually written.
 	if _, err := os.Stat(repo.BlockchainHeadFilepath); err != nil && os.IsNotExist(err) {
 		logging.Log("Blockchain head file could not be found, initializing defaults")
-		repo.previousBlockHash = number.Zero
-		repo.previousBlockDifficulty = number.One
-		repo.previousBlockTimestamp = 0
+		repo.resetPreviousBlockData()
 	} else {
 		logging.Log("Blockchain head seems to exist")
 		path := repo.BlockchainHeadFilepath
+		hasHeight := false
 		err := synchro.HandleFileAtomically(path, os.O_RDONLY, func(file *os.File) error {
 			// Read the hash of the last created block.
 			repo.previousBlockHash = &number.Big32{}
@@ -77,19 +137,34 @@ func CreateBlockRepository() (*BlockRepository, error) {
 			timestamp := make([]byte, 8)
 			file.Read(timestamp)
 			repo.previousBlockTimestamp = int64(binary.LittleEndian.Uint64(timestamp))
+			// Read the height of the last created block. Head files written by earlier
+			// versions do not have it.
+			height := make([]byte, 8)
+			if count, _ := io.ReadFull(file, height); count == len(height) {
+				repo.previousBlockHeight = int64(binary.LittleEndian.Uint64(height))
+				hasHeight = true
+			}
+			// Read the retarget state, preceded by its length. Head files written by earlier
+			// versions do not have it either.
+			rest, err := io.ReadAll(file)
+			if err != nil {
+				return err
+			}
+			if len(rest) >= 4 && int(binary.LittleEndian.Uint32(rest[0:4])) == len(rest)-4 {
+				repo.retargetState = rest[4:]
+			}
 			// Return no error.
 			return nil
 		})
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if !hasHeight {
+			return repo.migrateHeadWithoutHeight()
 		}
 	}
 
-	logging.Log("Block repository successfully initialized")
-	logging.Log(fmt.Sprintf("Current previous hash: %s", repo.previousBlockHash.Hex()))
-	logging.Log(fmt.Sprintf("Current difficulty: %s", repo.previousBlockDifficulty.Hex()))
-
-	return repo, nil
+	return nil
 }
 
 //=================================================================================================
@@ -97,140 +172,63 @@ func CreateBlockRepository() (*BlockRepository, error) {
 //-------------------------------------------------------------------------------------------------
 
 func (repo *BlockRepository) GetOneWithHash(hash *number.Big32) (*blockchain.Block, error) {
-	// Identify the index file from the hash.
-	indexFilepath := repo.getIndexPathForHash(hash)
-	// Declare a variable to hold the name of the file from which to read the block.
-	var blockFilename string = ""
-	// Declare a variable to hold the position of the block in the file in which it is stored.
-	var blockPosition int64 = 0
-
-	// Open the index file and find the name of the file that holds the block.
-	err := synchro.HandleFileAtomically(indexFilepath, os.O_RDONLY, func(file *os.File) error {
-
-		// Define a single byte buffer to hold index entry lengths.
-		b := make([]byte, 1)
-		// Define a variable to hold read errors.
-		var err error = nil
-
-		// Read entries until one matches, or until the end of the file.
-		for _, err = file.Read(b); err == nil; _, err = file.Read(b) {
-			if err != nil {
-				// This case should trigger only if the file is empty, which should in fact
-				// not happen.
-				break
-			}
-			// Proceed to read the actual entry and determine if it matches the hash we are
-			// looking for. Get the length of the entry as a byte first.
-			currentEntryLength := b[0]
-			// Read the hash.
-			currentHash := make([]byte, 32)
-			file.Read(currentHash)
-			// Read the position of the block in the file.
-			blockpos := make([]byte, 8)
-			file.Read(blockpos)
-			blockPosition = int64(binary.LittleEndian.Uint64(blockpos))
-			// Read the name of the file.
-			filename := make([]byte, currentEntryLength-byte(len(currentHash))-8)
-			file.Read(filename)
-			// If the hash matches, copy the filename and return no error.
-			if number.FromSlice(currentHash).Equals(hash) {
-				blockFilename = string(filename)
-				return nil
-			}
-		}
-
-		// Either there was an error, or EOF was reached without finding the hash.
-		// Return the error.
-		if errors.Is(err, io.EOF) {
-			return nil
-		} else {
-			return err
-		}
-	})
+	// Find the location of the block in the hash index.
+	value, err := repo.hashes.Lookup(hash.Bytes[:])
+	if err != nil || value == nil {
+		return nil, err
+	}
+	block, err := repo.readBlockAt(value)
 	if err != nil {
 		return nil, err
 	}
 
-	// Get the path to the file that holds the block.
-	blockFilepath := repo.getPathToBlockchainFile(blockFilename)
+	// Ensure that the index did not point to some other block.
+	if block != nil && !block.Hash().Equals(hash) {
+		return nil, nil
+	}
+
+	return block, nil
+}
+
+// Reads the block stored in the given location, as stored in indexes. Returns nil if there is
+// no block in that location.
+func (repo *BlockRepository) readBlockAt(location []byte) (*blockchain.Block, error) {
+	segment, blockPosition := decodeBlockLocation(location)
+
+	// Get the path to the segment that holds the block.
+	blockFilepath := repo.segmentPath(segment)
 	// Define a variable to hold the block that we will be reading.
 	var block *blockchain.Block = nil
 
 	// Now that we have the name of the file, open it and find the block.
-	err = synchro.HandleFileAtomically(blockFilepath, os.O_RDONLY, func(file *os.File) error {
+	err := synchro.HandleFileAtomicallyIfFound(blockFilepath, os.O_RDONLY, func(file *os.File) error {
 		// Seek to the target position.
 		file.Seek(blockPosition, 0)
 		// Read the block from the file.
 		block, _ = blockchain.ReadBlock(file)
 		return nil
+	}, func() error {
+		return nil
 	})
-	if err != nil {
-		return nil, err
-	}
 
-	return block, nil
+	return block, err
 }
 
 func (repo *BlockRepository) GetBlocksFromMinute(t time.Time) ([]*blockchain.Block, error) {
-	// Get the name of the file that holds the timestamp.
-	filename := getFilenameForTime(t)
-	filepath := repo.getPathToBlockchainFile(filename)
-
-	// Get the date.
-	year, month, day := t.Date()
-	// Get hour and minutes to partition storage by that.
-	h := t.Hour()
-	m := t.Minute()
-
-	// Instantiate a slice to hold blocks.
+	// Find the blocks created in the minute through the sidecars of the segments.
+	start := minuteOf(t)
 	blocks := make([]*blockchain.Block, 0)
-	// Read the file and get all blocks that fall in the specific minute from the timestamp.
-	err := synchro.HandleFileAtomicallyIfFound(filepath, os.O_RDONLY, func(file *os.File) error {
-		// Define an error object to iterate through file blocks.
-		var currentError error = nil
-		// Define a block pointer.
-		var block *blockchain.Block = nil
-
-		// Read the first block.
-		block, currentError = blockchain.ReadBlock(file)
-
-		// Read blocks until hitting EOF.
-		for ; ; block, currentError = blockchain.ReadBlock(file) {
-
-			if currentError != nil && errors.Is(currentError, io.EOF) {
-				// We found the end of the file, so we break here.
-				break
-			} else if currentError != nil {
-				// There was some error and it's not an EOF.
-				return currentError
-			}
 
-			// Get the timestamp of the block in unix time.
-			currentTime := time.Unix(block.Timestamp(), 0).UTC()
-			// Check if the minute of the current block matches that of the timestamp.
-			currentYear, currentMonth, currentDay := currentTime.Date()
-			// Get hour and minutes to partition storage by that.
-			currentH := currentTime.Hour()
-			currentM := currentTime.Minute()
-
-			matches := currentYear == year && currentMonth == month && currentDay == day
-			matches = matches && currentH == h && currentM == m
-			if matches {
-				// This block was generated in the specified minute.
-				// Save the current block to the slice.
-				blocks = append(blocks, block)
-			}
+	err := repo.forEachSidecarEntry(start, start+60, func(segment int64, entry *sidecarEntry) (bool, error) {
+		block, err := repo.readBlockAt(encodeBlockLocation(segment, entry.offset))
+		if err != nil {
+			return false, err
 		}
-
-		return nil
-	},
-		// Define the function that will handle the case in which the file is not found.
-		func() error {
-			logging.Log(fmt.Sprintf("File %s not found", filepath))
-			logging.Log("There is no file holding blocks in the given minute")
-			return nil // Just leave the block list empty.
-		})
-
+		if block != nil {
+			blocks = append(blocks, block)
+		}
+		return true, nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -244,43 +242,105 @@ func (repo *BlockRepository) GetBlocksFromMinute(t time.Time) ([]*blockchain.Blo
 //-------------------------------------------------------------------------------------------------
 
 // Saves the given block to the file storage. Not thread safe, do not call from multiple threads;
-// writes must be sequential. The block will not be available for all queries until it is written
-// to the index.
-func (repo *BlockRepository) Save(block *blockchain.Block, computeDifficulty func() *number.Big32) error {
+// writes must be sequential. The block is committed through the write-ahead journal, so that it
+// either ends up stored, indexed and set as the head, or not stored at all.
+func (repo *BlockRepository) Save(block *blockchain.Block, computeDifficulty func() (*number.Big32, []byte)) error {
 
 	// Ensure that the given block has the right properties.
 	if err := repo.validateBlock(block); err != nil {
 		return err
 	}
 
-	// Get a block specific filepath in which to store the block.
-	filepath := repo.getFilepath(block)
+	// Call the callback to get the new difficulty and retarget state, which are part of the commit.
+	newDifficulty, retargetState := computeDifficulty()
+	// The block goes right after the current head.
+	height := repo.PreviousBlockHeight() + 1
+
+	// Write the journal record before touching any other file.
+	record, err := repo.createJournalRecord(block, newDifficulty, retargetState, height)
+	if err != nil {
+		return err
+	}
+	if err := repo.writeJournal(record); err != nil {
+		return err
+	}
+
+	if err := repo.commit(block, newDifficulty, retargetState, height); err != nil {
+		// The commit failed without the process crashing. Undo partial writes right away
+		// instead of waiting for the next startup to replay it.
+		if _, rollbackErr := repo.rollback(record); rollbackErr != nil {
+			logging.LogError("Could not roll back failed commit, it will be replayed on startup", rollbackErr)
+			return err
+		}
+		repo.removeJournal()
+		return err
+	}
+
+	// The block is fully committed, so the journal record is no longer needed.
+	if err := repo.removeJournal(); err != nil {
+		return err
+	}
+
+	// Keep the hash index log short. This is done out of the commit, since merging rewrites
+	// the sorted file and cannot be undone by truncation.
+	if err := repo.hashes.Compact(block.Hash().Bytes[:]); err != nil {
+		logging.LogError("Could not compact the hash index", err)
+	}
+	if err := repo.compactChunks(block); err != nil {
+		logging.LogError("Could not compact the chunk index", err)
+	}
+	return nil
+}
+
+// Writes the block to its segment, indexes it and makes it the head of the chain.
+func (repo *BlockRepository) commit(
+	block *blockchain.Block, newDifficulty *number.Big32, retargetState []byte, height int64) error {
+	// Get the segment in which to store the block.
+	segment, err := repo.segmentFor(block)
+	if err != nil {
+		return err
+	}
 	// Keep track of the position in which the block is written.
 	var fpos int64 = 0
 
-	// Write the block to the file and get its hash.
-	if pos, err := writeBlockToFile(block, filepath); err != nil {
+	// Write the block to the segment.
+	if pos, err := writeBlockToFile(block, repo.segmentPath(segment)); err != nil {
 		return err
 	} else {
 		fpos = pos
 	}
 
 	// Write indexes for faster queries.
-	if err := repo.indexBlock(block, fpos); err != nil {
+	if err := repo.appendSidecar(segment, block.Timestamp(), fpos); err != nil {
 		return err
 	}
-
-	// Call the callback to get the new difficulty.
-	newDifficulty := computeDifficulty()
-
-	// Update the data of the previous block.
-	if err := repo.updatePreviousBlockData(block, newDifficulty); err != nil {
-		// The given block does not seem to be valid, so we reject it.
+	if err := repo.indexBlock(block, segment, fpos); err != nil {
+		return err
+	}
+	if err := repo.indexChunks(block); err != nil {
+		return err
+	}
+	if err := repo.indexHeight(height, segment, fpos); err != nil {
 		return err
 	}
 
-	// Everything went well, apparently. Return no error.
-	return nil
+	// Update the data of the previous block.
+	return repo.updatePreviousBlockData(block, newDifficulty, retargetState, height)
+}
+
+// Get the paths of all files that a commit of the given block appends to.
+func (repo *BlockRepository) appendTargets(block *blockchain.Block) ([]string, error) {
+	segment, err := repo.segmentFor(block)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{
+		repo.segmentPath(segment),
+		repo.sidecarPath(segment),
+		repo.hashes.appendTarget(block.Hash().Bytes[:]),
+		repo.heightIndexPath(),
+	}
+	return append(paths, repo.chunkAppendTargets(block)...), nil
 }
 
 func (repo *BlockRepository) PreviousBlockHash() *number.Big32 {
@@ -295,55 +355,116 @@ func (repo *BlockRepository) PreviousBlockDifficulty() *number.Big32 {
 	return repo.previousBlockDifficulty
 }
 
+// The height of the block last added to the blockchain. The first block has height 1, so the
+// height of an empty blockchain is 0.
+func (repo *BlockRepository) PreviousBlockHeight() int64 {
+	repo.previousBlockLock.Lock()
+	defer repo.previousBlockLock.Unlock()
+	return repo.previousBlockHeight
+}
+
+func (repo *BlockRepository) RetargetState() []byte {
+	repo.previousBlockLock.Lock()
+	defer repo.previousBlockLock.Unlock()
+	return repo.retargetState
+}
+
 func (repo *BlockRepository) validateBlock(block *blockchain.Block) error {
 	// Check that the block is valid. Take the lock first.
 	repo.previousBlockLock.Lock()
 	defer repo.previousBlockLock.Unlock()
+	return validateNextBlock(repo.previousBlockHash, repo.previousBlockTimestamp, block)
+}
 
-	// Ensure that the hashes match.
-	if !repo.previousBlockHash.Equals(block.PreviousHash()) {
-		return errors.New("the given block does not have the current previous hash")
-	}
+func (repo *BlockRepository) updatePreviousBlockData(
+	block *blockchain.Block, newDifficulty *number.Big32, retargetState []byte, height int64) error {
 
-	// Ensure that the timestamp is correct.
-	if repo.previousBlockTimestamp > block.Timestamp() {
-		return errors.New("the given block is older than the last created block")
+	// Persist the information so that we can retrieve it later.
+	err := repo.writeHeadFile(block.Hash(), newDifficulty, block.Timestamp(), height, retargetState)
+	if err != nil {
+		return err
 	}
 
+	// Do keep track of the update.
+	repo.previousBlockLock.Lock()
+	defer repo.previousBlockLock.Unlock()
+	repo.previousBlockHash = block.Hash()
+	repo.previousBlockDifficulty = block.Difficulty()
+	repo.previousBlockTimestamp = block.Timestamp()
+	repo.previousBlockHeight = height
+	repo.retargetState = retargetState
 	return nil
 }
 
-func (repo *BlockRepository) updatePreviousBlockData(block *blockchain.Block, newDifficulty *number.Big32) error {
-	// Persist the information so that we can retrieve it later. Open the blockchain head file
-	// for writing, and create it if it does not exist.
+func (repo *BlockRepository) writeHeadFile(
+	hash *number.Big32, difficulty *number.Big32, blockTimestamp int64, height int64, retargetState []byte) error {
+
+	// The new content is written to a temporary file which then replaces the head file, so that
+	// the head file is never left partially written.
 	filepath := repo.BlockchainHeadFilepath
-	flags := os.O_WRONLY | os.O_CREATE
+	temporaryFilepath := filepath + ".tmp"
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
 
-	err := synchro.HandleFileAtomically(filepath, flags, func(file *os.File) error {
+	err := synchro.HandleFileAtomically(temporaryFilepath, flags, func(file *os.File) error {
 
 		// Write the hash of the block to the file.
-		file.Write(block.Hash().Bytes[:])
+		file.Write(hash.Bytes[:])
 
 		// Write the NEW difficulty to the file.
-		file.Write(newDifficulty.Bytes[:])
+		file.Write(difficulty.Bytes[:])
 
 		// Write the timestamp of the block to the file.
 		timestamp := make([]byte, 8)
-		binary.LittleEndian.PutUint64(timestamp, uint64(block.Timestamp()))
+		binary.LittleEndian.PutUint64(timestamp, uint64(blockTimestamp))
 		file.Write(timestamp)
 
+		// Write the height of the block to the file.
+		heightBuffer := make([]byte, 8)
+		binary.LittleEndian.PutUint64(heightBuffer, uint64(height))
+		file.Write(heightBuffer)
+
+		// Write the retarget state to the file, preceded by its length. Without a state, the file
+		// ends here as in earlier versions.
+		if len(retargetState) > 0 {
+			length := make([]byte, 4)
+			binary.LittleEndian.PutUint32(length, uint32(len(retargetState)))
+			file.Write(length)
+			file.Write(retargetState)
+		}
+
 		// Sync and return.
 		return file.Sync()
 	})
 	if err != nil {
 		return err
 	}
+	if err := os.Rename(temporaryFilepath, filepath); err != nil {
+		return err
+	}
+	// The rename is what makes the block the head, so it must be durable too.
+	return syncDirectory(filepath)
+}
 
-	// Do keep track of the update.
-	repo.previousBlockHash = block.Hash()
-	repo.previousBlockDifficulty = block.Difficulty()
-	repo.previousBlockTimestamp = block.Timestamp()
-	return nil
+// Syncs the directory that holds the given file, so that the file being created, renamed or
+// removed survives a crash.
+func syncDirectory(filepath string) error {
+	directory, err := os.Open(path.Dir(filepath))
+	if err != nil {
+		return err
+	}
+	defer directory.Close()
+	return directory.Sync()
+}
+
+// Sets the data of the previous block to that of an empty blockchain.
+func (repo *BlockRepository) resetPreviousBlockData() {
+	repo.previousBlockLock.Lock()
+	defer repo.previousBlockLock.Unlock()
+	repo.previousBlockHash = number.Zero
+	repo.previousBlockDifficulty = number.One
+	repo.previousBlockTimestamp = 0
+	repo.previousBlockHeight = 0
+	repo.retargetState = nil
 }
 
 func writeBlockToFile(block *blockchain.Block, filepath string) (int64, error) {
@@ -358,97 +479,50 @@ func writeBlockToFile(block *blockchain.Block, filepath string) (int64, error) {
 		fpos = info.Size()
 		// Write block header to the file.
 		var writer io.Writer = file
-		err := block.WriteWithMetadata(writer)
-		// Everything went well, apparently. Return no error.
-		return err
+		if err := block.WriteWithMetadata(writer); err != nil {
+			return err
+		}
+		// The block must be durable before the journal that could roll it back is removed.
+		if err := file.Sync(); err != nil {
+			return err
+		}
+		// So must the segment itself, if the block is the first one in it.
+		if fpos == 0 {
+			return syncDirectory(filepath)
+		}
+		return nil
 	})
 
 	// Return the error, if any, or nil if everything went well.
 	return fpos, err
 }
 
-func (repo *BlockRepository) indexBlock(block *blockchain.Block, fpos int64) error {
-
-	// Get the name of the file to which the index entry should be written.
-	indexPath := repo.getIndexPath(block)
-
-	// Open the file for appending, and create it if it does not exist.
-	flags := os.O_APPEND | os.O_WRONLY | os.O_CREATE
-
-	// The index file will have the following entry format:
-	//
-	// * The length of the entry (1 byte)
-	//   - The length of the hash (32 bytes) +
-	//   - The length of the name of the file +
-	//   - The length of the position of the block in the file (8 bytes).
-	// * The hash.
-	// * The position of the block in the file.
-	// * The name of the file that holds the block.
-	err := synchro.HandleFileAtomically(indexPath, flags, func(file *os.File) error {
-		// Get the name of the file that stores the block.
-		blockfile := getFilename(block)
-		// Convert the position of the block into bytes.
-		blockpos := make([]byte, 8)
-		binary.LittleEndian.PutUint64(blockpos, uint64(fpos))
-		// Compute the length of the entry.
-		length := len(block.Hash().Bytes) + len(blockfile) + len(blockpos)
-		// Write the length of the entry to the file.
-		file.Write([]byte{byte(length)})
-		// Write the hash of the block to the file.
-		file.Write(block.Hash().Bytes[:])
-		// Write the position of the block in the file that holds it.
-		file.Write(blockpos)
-		// Write the name of the file that holds the block.
-		file.Write([]byte(blockfile))
-		// Flush contents and return.
-		return file.Sync()
-	})
-
-	// Return the error, if any, or nil if everything went well.
-	return err
-}
-
-func (repo *BlockRepository) getFilepath(block *blockchain.Block) string {
-	return path.Join(repo.BlockchainDir, getFilename(block))
+func (repo *BlockRepository) indexBlock(block *blockchain.Block, segment int64, fpos int64) error {
+	// Index the block by hash.
+	return repo.hashes.Insert(block.Hash().Bytes[:], encodeBlockLocation(segment, fpos))
 }
 
-func (repo *BlockRepository) getPathToBlockchainFile(filename string) string {
-	return path.Join(repo.BlockchainDir, filename)
-}
-
-func getFilename(block *blockchain.Block) string {
-	// Convert the timestamp into a Time object.
-	time := time.Unix(block.Timestamp(), 0).UTC()
-	return getFilenameForTime(time)
-}
-
-func getFilenameForTime(time time.Time) string {
-	// Convert to UTC.
-	time = time.UTC()
-	// Get the date.
-	year, month, day := time.Date()
-	// Get hour and minutes to partition storage by that.
-	h := time.Hour()
-	m := time.Minute()
-	// Construct the name of the file.
-	filename := fmt.Sprintf("blockchain-%d-%d-%d-%d-%d", year, month, day, h, m)
-	return filename
-}
+// Index values are the number of the segment that holds the block (8 bytes), followed by the
+// position of the block in that segment (8 bytes).
+const blockLocationLength int = 16
 
-func (repo *BlockRepository) getIndexPath(block *blockchain.Block) string {
-	return repo.getIndexPathForHash(block.Hash())
+func encodeBlockLocation(segment int64, fpos int64) []byte {
+	value := make([]byte, blockLocationLength)
+	binary.LittleEndian.PutUint64(value[0:8], uint64(segment))
+	binary.LittleEndian.PutUint64(value[8:16], uint64(fpos))
+	return value
 }
 
-func (repo *BlockRepository) getIndexPathForHash(hash *number.Big32) string {
-	// Use the last byte of the hash as an index/
-	firstByteFromHash := hash.Bytes[len(hash.Bytes)-1]
-	indexFilename := fmt.Sprintf("index-%d", firstByteFromHash)
-	return path.Join(repo.IndexDir, indexFilename)
+func decodeBlockLocation(value []byte) (int64, int64) {
+	segment := int64(binary.LittleEndian.Uint64(value[0:8]))
+	fpos := int64(binary.LittleEndian.Uint64(value[8:16]))
+	return segment, fpos
 }
 
 func (repo *BlockRepository) Cleanup() {
 	// Delete all directories and files.
 	os.Remove(repo.BlockchainHeadFilepath)
+	os.Remove(repo.JournalFilepath)
 	os.RemoveAll(repo.IndexDir)
 	os.RemoveAll(repo.BlockchainDir)
 }
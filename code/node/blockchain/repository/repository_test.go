@@ -1,6 +1,7 @@
 package repository
 
 import (
+	"bytes"
 	"crypto/rand"
 	"os"
 	"testing"
@@ -149,9 +150,45 @@ func TestBlockRetrievalByMinute(t *testing.T) {
 	}
 }
 
+func TestRetargetStateIsStoredWithHead(t *testing.T) {
+	repo, _ := CreateBlockRepository()
+	defer cleanup(repo)
+
+	block := testBlock(t, true)
+	saveState := func() (*b32.Big32, []byte) {
+		return b32.One, []byte("retarget")
+	}
+	if err := repo.Save(block, saveState); err != nil {
+		t.Fatalf("could not write block: %s", err.Error())
+	}
+
+	// The state is restored on startup.
+	repo, err := CreateBlockRepository()
+	if err != nil {
+		t.Fatalf("could not recreate repository: %s", err.Error())
+	}
+	if !bytes.Equal(repo.RetargetState(), []byte("retarget")) {
+		t.Fatal("unexpected retarget state after restarting")
+	}
+
+	// Head files written by earlier versions end after the height.
+	data, _ := os.ReadFile(repo.BlockchainHeadFilepath)
+	if err := os.WriteFile(repo.BlockchainHeadFilepath, data[:80], 0600); err != nil {
+		t.Fatalf("could not write head file: %s", err.Error())
+	}
+	repo, err = CreateBlockRepository()
+	if err != nil {
+		t.Fatalf("could not recreate repository: %s", err.Error())
+	}
+	if len(repo.RetargetState()) != 0 || repo.PreviousBlockHeight() != 1 {
+		t.Fatal("unexpected head without retarget state")
+	}
+}
+
 func cleanup(repo *BlockRepository) {
 	// Delete all directories and files.
 	os.Remove(repo.BlockchainHeadFilepath)
+	os.Remove(repo.JournalFilepath)
 	os.RemoveAll(repo.IndexDir)
 	os.RemoveAll(repo.BlockchainDir)
 }
@@ -198,6 +235,6 @@ func testEntries() *blockchain.Chunk {
 	return head
 }
 
-func computeDifficulty() *b32.Big32 {
-	return b32.Zero
+func computeDifficulty() (*b32.Big32, []byte) {
+	return b32.Zero, nil
 }
@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+
+	"tp1.aba.distros.fi.uba.ar/common/synchro"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+)
+
+// Describes where a block was found while scanning the blockchain files.
+type BlockLocation struct {
+	// The number of the segment that holds the block, and the name of its file.
+	Segment  int64
+	Filename string
+	// The position of the block, metadata included, in the file.
+	Offset int64
+}
+
+// Lists the names of all segment files, in order.
+func (repo *BlockRepository) blockchainFilenames() ([]string, error) {
+	entries, err := os.ReadDir(repo.BlockchainDir)
+	if err != nil {
+		return nil, err
+	}
+
+	filenames := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && isSegmentFilename(entry.Name()) {
+			filenames = append(filenames, entry.Name())
+		}
+	}
+
+	sort.Strings(filenames)
+	return filenames, nil
+}
+
+// Reads every block stored in the blockchain files, calling the given callback once for each one
+// of them along with its location. The truncated callback is called whenever a file ends with an
+// incomplete block; the incomplete block is not handed to the block callback.
+func (repo *BlockRepository) scanBlocks(
+	callback func(location *BlockLocation, block *blockchain.Block) error,
+	truncated func(location *BlockLocation, size int64) error) error {
+
+	segments, err := repo.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		filename := segmentFilename(segment)
+		filepath := repo.segmentPath(segment)
+
+		err := synchro.HandleFileAtomically(filepath, os.O_RDONLY, func(file *os.File) error {
+			// Get the size of the file to detect blocks that were not completely written.
+			info, err := file.Stat()
+			if err != nil {
+				return err
+			}
+			size := info.Size()
+
+			for offset := int64(0); offset < size; {
+				location := &BlockLocation{segment, filename, offset}
+				block, err := blockchain.ReadBlock(file)
+
+				if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+					return err
+				}
+				// A block whose length goes past the end of the file was interrupted while
+				// being written.
+				if block == nil {
+					if truncated != nil {
+						return truncated(location, size)
+					}
+					return nil
+				}
+				if err := callback(location, block); err != nil {
+					return err
+				}
+
+				offset += int64(block.LengthWithMetadata())
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,254 @@
+package repository
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"tp1.aba.distros.fi.uba.ar/common/synchro"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+)
+
+//=================================================================================================
+// Segments
+//-------------------------------------------------------------------------------------------------
+
+// Blocks are appended to segment files, numbered from 1. A new segment is started once the last
+// one grows past a maximum size, or once it holds blocks spanning more than a maximum age. Since
+// blocks are always appended to the head of the chain, and blocks are never older than their
+// parent, blocks are sorted by timestamp both within a segment and across segments.
+//
+// Each segment has a sidecar file with an entry for every block in it, holding the timestamp of
+// the block (8 bytes) and its position in the segment (8 bytes). Since entries are sorted by
+// timestamp, the sidecar gives the time range covered by the segment, and allows finding the
+// first block created after a given time with a binary search.
+
+const segmentFilePrefix string = "segment-"
+const sidecarSuffix string = ".idx"
+const sidecarEntryLength int = 16
+
+// Default limits after which a new segment is started.
+const defaultSegmentMaxSize int = 64 * 1024 * 1024
+const defaultSegmentMaxAge int = 24 * 60 * 60
+
+type sidecarEntry struct {
+	timestamp int64
+	offset    int64
+}
+
+func segmentFilename(segment int64) string {
+	// Pad the number so that segment files sort by name.
+	return fmt.Sprintf("%s%010d", segmentFilePrefix, segment)
+}
+
+func (repo *BlockRepository) segmentPath(segment int64) string {
+	return path.Join(repo.BlockchainDir, segmentFilename(segment))
+}
+
+func (repo *BlockRepository) sidecarPath(segment int64) string {
+	return repo.segmentPath(segment) + sidecarSuffix
+}
+
+func isSegmentFilename(filename string) bool {
+	return strings.HasPrefix(filename, segmentFilePrefix) && !strings.HasSuffix(filename, sidecarSuffix)
+}
+
+// Lists the numbers of all existing segments, in order.
+func (repo *BlockRepository) segments() ([]int64, error) {
+	filenames, err := repo.blockchainFilenames()
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]int64, 0, len(filenames))
+	for _, filename := range filenames {
+		var segment int64
+		if _, err := fmt.Sscanf(filename, segmentFilePrefix+"%d", &segment); err != nil {
+			return nil, fmt.Errorf("unexpected segment file name %s: %w", filename, err)
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// Get the segment that the given block is to be appended to. This only depends on the files on
+// disk, so replaying an interrupted commit after rolling it back picks the same segment.
+func (repo *BlockRepository) segmentFor(block *blockchain.Block) (int64, error) {
+	segments, err := repo.segments()
+	if err != nil {
+		return 0, err
+	}
+	if len(segments) == 0 {
+		return 1, nil
+	}
+	last := segments[len(segments)-1]
+
+	// Start a new segment if the last one is too large.
+	if info, err := os.Stat(repo.segmentPath(last)); err != nil {
+		return 0, err
+	} else if info.Size() >= int64(repo.SegmentMaxSize) {
+		return last + 1, nil
+	}
+
+	// Start a new segment if the block is too far apart from the first one in the last segment.
+	if first, err := repo.readSidecar(last, 0, 1); err != nil {
+		return 0, err
+	} else if len(first) > 0 && block.Timestamp()-first[0].timestamp >= int64(repo.SegmentMaxAge) {
+		return last + 1, nil
+	}
+
+	return last, nil
+}
+
+// Appends an entry for a block written to a segment to the sidecar of the segment.
+func (repo *BlockRepository) appendSidecar(segment int64, timestamp int64, offset int64) error {
+	flags := os.O_APPEND | os.O_WRONLY | os.O_CREATE
+	return synchro.HandleFileAtomically(repo.sidecarPath(segment), flags, func(file *os.File) error {
+		entry := make([]byte, sidecarEntryLength)
+		binary.LittleEndian.PutUint64(entry[0:8], uint64(timestamp))
+		binary.LittleEndian.PutUint64(entry[8:16], uint64(offset))
+		if _, err := file.Write(entry); err != nil {
+			return err
+		}
+		return file.Sync()
+	})
+}
+
+// Removes the sidecars of all segments.
+func (repo *BlockRepository) resetSidecars() error {
+	segments, err := repo.segments()
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if err := os.Remove(repo.sidecarPath(segment)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the amount of entries in the sidecar of a segment.
+func (repo *BlockRepository) sidecarLength(segment int64) (int, error) {
+	info, err := os.Stat(repo.sidecarPath(segment))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return int(info.Size()) / sidecarEntryLength, nil
+}
+
+// Reads up to count entries from the sidecar of a segment, starting from the entry in the given
+// position. A missing sidecar has no entries.
+func (repo *BlockRepository) readSidecar(segment int64, first int, count int) ([]*sidecarEntry, error) {
+	entries := make([]*sidecarEntry, 0)
+
+	err := synchro.HandleFileAtomicallyIfFound(repo.sidecarPath(segment), os.O_RDONLY, func(file *os.File) error {
+		buffer := make([]byte, count*sidecarEntryLength)
+		read, err := file.ReadAt(buffer, int64(first*sidecarEntryLength))
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		// Leave out a trailing incomplete entry.
+		for i := 0; i+sidecarEntryLength <= read; i += sidecarEntryLength {
+			entry := &sidecarEntry{}
+			entry.timestamp = int64(binary.LittleEndian.Uint64(buffer[i : i+8]))
+			entry.offset = int64(binary.LittleEndian.Uint64(buffer[i+8 : i+16]))
+			entries = append(entries, entry)
+		}
+		return nil
+	}, func() error {
+		return nil
+	})
+
+	return entries, err
+}
+
+// Calls the callback with every sidecar entry, across all segments, whose timestamp falls in the
+// given range, in order. Returning false from the callback stops the iteration.
+func (repo *BlockRepository) forEachSidecarEntry(
+	from int64, to int64, callback func(segment int64, entry *sidecarEntry) (bool, error)) error {
+
+	segments, err := repo.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		length, err := repo.sidecarLength(segment)
+		if err != nil {
+			return err
+		}
+		if length == 0 {
+			continue
+		}
+
+		// Skip segments that end before the range, and stop at the first one that starts after.
+		if last, err := repo.readSidecar(segment, length-1, 1); err != nil || len(last) == 0 {
+			return err
+		} else if last[0].timestamp < from {
+			continue
+		}
+		if first, err := repo.readSidecar(segment, 0, 1); err != nil {
+			return err
+		} else if first[0].timestamp >= to {
+			return nil
+		}
+
+		// Find the first entry in the range.
+		var searchErr error = nil
+		position := sort.Search(length, func(i int) bool {
+			entry, err := repo.readSidecar(segment, i, 1)
+			if err != nil || len(entry) == 0 {
+				searchErr = err
+				return true
+			}
+			return entry[0].timestamp >= from
+		})
+		if searchErr != nil {
+			return searchErr
+		}
+
+		// Go through entries in batches until leaving the range.
+		const batchLength int = 1024
+		for ; position < length; position += batchLength {
+			entries, err := repo.readSidecar(segment, position, batchLength)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if entry.timestamp >= to {
+					return nil
+				}
+				if more, err := callback(segment, entry); err != nil || !more {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Lists the minutes in which blocks were created, from the one the first time falls in up to the
+// one before the last time, in chronological order.
+func (repo *BlockRepository) MinutesWithBlocks(from time.Time, to time.Time) ([]time.Time, error) {
+	minutes := make([]time.Time, 0)
+
+	err := repo.forEachSidecarEntry(minuteOf(from), to.Unix(), func(segment int64, entry *sidecarEntry) (bool, error) {
+		minute := time.Unix(minuteOf(time.Unix(entry.timestamp, 0)), 0).UTC()
+		if len(minutes) == 0 || !minutes[len(minutes)-1].Equal(minute) {
+			minutes = append(minutes, minute)
+		}
+		return true, nil
+	})
+
+	return minutes, err
+}
@@ -0,0 +1,94 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"tp1.aba.distros.fi.uba.ar/common/config"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+
+	number "tp1.aba.distros.fi.uba.ar/common/number/big32"
+)
+
+//=================================================================================================
+// Storage
+//-------------------------------------------------------------------------------------------------
+
+// Names of the storage backends that can be selected through the StorageBackend setting.
+const StorageBackendFile string = "file"
+const StorageBackendMemory string = "memory"
+
+// A place in which to store the blockchain. Keeps track of the head of the chain, which is the
+// block that the next saved block must point to.
+type Storage interface {
+	blockchain.IBlockchainRead
+	// Get the block with the given height, or nil if there is none.
+	GetOneWithHeight(height int64) (*blockchain.Block, error)
+	// Get the height of the block with the given hash, or 0 if there is no such block in the
+	// chain.
+	GetHeightWithHash(hash *number.Big32) (int64, error)
+	// Lists the minutes in which blocks were created, from the one the first time falls in up
+	// to the one before the last time, in chronological order.
+	MinutesWithBlocks(from time.Time, to time.Time) ([]time.Time, error)
+	// Find where the chunk whose data has the given SHA-256 hash is stored, or nil if there is
+	// no such chunk.
+	FindChunk(contentHash *number.Big32) (*ChunkLocation, error)
+	// Saves the given block as the new head of the chain. Writes must be sequential. The callback
+	// is only called if the block is valid, to get the difficulty for the next block along with
+	// the state of the retargeting that decided it, which is stored with the head as is.
+	Save(block *blockchain.Block, computeDifficulty func() (*number.Big32, []byte)) error
+	// Information about the head of the chain.
+	PreviousBlockHash() *number.Big32
+	PreviousBlockDifficulty() *number.Big32
+	PreviousBlockHeight() int64
+	// The retarget state stored along with the head, which is empty if there is none.
+	RetargetState() []byte
+	// Removes everything stored.
+	Cleanup()
+}
+
+// Describes where a chunk is stored in the blockchain.
+type ChunkLocation struct {
+	// The hash of the block that holds the chunk.
+	BlockHash *number.Big32
+	// The position of the chunk among the entries of the block, starting from 0.
+	Entry int
+	// The timestamp of the block.
+	Timestamp int64
+}
+
+// Instantiates the storage backend selected in configuration. Defaults to the file repository.
+func CreateStorage() (Storage, error) {
+	backend := config.GetStringOrDefault("StorageBackend", StorageBackendFile)
+
+	switch backend {
+	case StorageBackendFile:
+		return CreateBlockRepository()
+	case StorageBackendMemory:
+		return CreateMemoryRepository(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %s", backend)
+	}
+}
+
+// Checks that the given block can be appended to a chain whose head has the given hash and
+// timestamp.
+func validateNextBlock(previousHash *number.Big32, previousTimestamp int64, block *blockchain.Block) error {
+	// Ensure that the hashes match.
+	if !previousHash.Equals(block.PreviousHash()) {
+		return errors.New("the given block does not have the current previous hash")
+	}
+
+	// Ensure that the timestamp is correct.
+	if previousTimestamp > block.Timestamp() {
+		return errors.New("the given block is older than the last created block")
+	}
+
+	return nil
+}
+
+// Get the start of the minute the given time falls in.
+func minuteOf(t time.Time) int64 {
+	return t.UTC().Truncate(time.Minute).Unix()
+}
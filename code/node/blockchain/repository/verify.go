@@ -0,0 +1,199 @@
+package repository
+
+import (
+	"fmt"
+	"sort"
+
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+
+	number "tp1.aba.distros.fi.uba.ar/common/number/big32"
+)
+
+// Define the kinds of problems that can be found when verifying the blockchain.
+const IssueBrokenLink string = "broken-link"
+const IssueOrphanedBlock string = "orphaned-block"
+const IssueHashMismatch string = "hash-mismatch"
+const IssueInvalidHash string = "invalid-hash"
+const IssueNonMonotonicTimestamp string = "non-monotonic-timestamp"
+const IssueDuplicatedBlock string = "duplicated-block"
+const IssueMissingHead string = "missing-head"
+const IssueTruncatedFile string = "truncated-file"
+
+// A single problem found while verifying the blockchain.
+type VerificationIssue struct {
+	Kind   string `json:"kind"`
+	Hash   string `json:"hash,omitempty"`
+	File   string `json:"file,omitempty"`
+	Offset int64  `json:"offset"`
+	Detail string `json:"detail"`
+}
+
+// The result of verifying the whole of the blockchain stored on disk.
+type VerificationReport struct {
+	Ok          bool                 `json:"ok"`
+	Files       int                  `json:"files"`
+	Blocks      int                  `json:"blocks"`
+	ChainLength int                  `json:"chainLength"`
+	Head        string               `json:"head"`
+	IssueCounts map[string]int       `json:"issueCounts"`
+	Issues      []*VerificationIssue `json:"issues"`
+}
+
+func (report *VerificationReport) addIssue(issue *VerificationIssue) {
+	report.Issues = append(report.Issues, issue)
+	report.IssueCounts[issue.Kind]++
+	report.Ok = false
+}
+
+// Keep track of the data needed to verify a single stored block.
+type verifiedBlock struct {
+	location *BlockLocation
+	block    *blockchain.Block
+	visited  bool
+}
+
+// Walks every block file and checks that the blocks in them still form a valid chain going from
+// the head stored in the head file back to the zero hash used as the parent of the first block.
+// The repository should not be written to while verification is in progress.
+func (repo *BlockRepository) Verify() (*VerificationReport, error) {
+	report := &VerificationReport{}
+	report.Ok = true
+	report.IssueCounts = make(map[string]int)
+	report.Issues = make([]*VerificationIssue, 0)
+
+	// Load all blocks into a map indexed by the hash stored in their metadata, which is the
+	// hash that other blocks use to reference them.
+	blocks := make(map[number.Big32]*verifiedBlock)
+
+	if filenames, err := repo.blockchainFilenames(); err != nil {
+		return nil, err
+	} else {
+		report.Files = len(filenames)
+	}
+
+	err := repo.scanBlocks(func(location *BlockLocation, block *blockchain.Block) error {
+		report.Blocks++
+		storedHash := block.Hash()
+
+		// Ensure that the stored hash matches the content of the block.
+		computedHash := block.ComputeHash()
+		if !computedHash.Equals(storedHash) {
+			report.addIssue(&VerificationIssue{
+				Kind:   IssueHashMismatch,
+				Hash:   storedHash.Hex(),
+				File:   location.Filename,
+				Offset: location.Offset,
+				Detail: fmt.Sprintf("the content of the block hashes to %s", computedHash.Hex()),
+			})
+		}
+
+		// Ensure that the actual hash of the block meets its own difficulty.
+		recomputed := blockchain.CreateBlockFromBuffer(computedHash, block.Buffer(), block.DataLength())
+		if !recomputed.IsHashValidForDifficulty() {
+			report.addIssue(&VerificationIssue{
+				Kind:   IssueInvalidHash,
+				Hash:   storedHash.Hex(),
+				File:   location.Filename,
+				Offset: location.Offset,
+				Detail: fmt.Sprintf("the hash does not meet difficulty %s", block.Difficulty().Hex()),
+			})
+		}
+
+		if existing, found := blocks[*storedHash]; found {
+			report.addIssue(&VerificationIssue{
+				Kind:   IssueDuplicatedBlock,
+				Hash:   storedHash.Hex(),
+				File:   location.Filename,
+				Offset: location.Offset,
+				Detail: fmt.Sprintf("the block was already found in %s at offset %d",
+					existing.location.Filename, existing.location.Offset),
+			})
+			return nil
+		}
+
+		blocks[*storedHash] = &verifiedBlock{location, block, false}
+		return nil
+	}, func(location *BlockLocation, size int64) error {
+		report.addIssue(&VerificationIssue{
+			Kind:   IssueTruncatedFile,
+			File:   location.Filename,
+			Offset: location.Offset,
+			Detail: fmt.Sprintf("the file ends with an incomplete block (size %d)", size),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Report all blocks whose parent cannot be found.
+	for hash, current := range blocks {
+		previousHash := current.block.PreviousHash()
+		if _, found := blocks[*previousHash]; !found && !previousHash.IsZero() {
+			report.addIssue(&VerificationIssue{
+				Kind:   IssueBrokenLink,
+				Hash:   hash.Hex(),
+				File:   current.location.Filename,
+				Offset: current.location.Offset,
+				Detail: fmt.Sprintf("previous block %s could not be found", previousHash.Hex()),
+			})
+		}
+	}
+
+	// Walk the chain from the head back to the first block.
+	head := repo.PreviousBlockHash()
+	report.Head = head.Hex()
+
+	if _, found := blocks[*head]; !found && !head.IsZero() {
+		report.addIssue(&VerificationIssue{
+			Kind:   IssueMissingHead,
+			Hash:   head.Hex(),
+			Detail: "the block referenced by the head file could not be found",
+		})
+	}
+
+	for current, found := blocks[*head]; found && !current.visited; {
+		current.visited = true
+		report.ChainLength++
+
+		previous, previousFound := blocks[*current.block.PreviousHash()]
+		if !previousFound {
+			break
+		}
+		if previous.block.Timestamp() > current.block.Timestamp() {
+			report.addIssue(&VerificationIssue{
+				Kind:   IssueNonMonotonicTimestamp,
+				Hash:   current.block.Hash().Hex(),
+				File:   current.location.Filename,
+				Offset: current.location.Offset,
+				Detail: fmt.Sprintf("timestamp %d is older than the previous block timestamp %d",
+					current.block.Timestamp(), previous.block.Timestamp()),
+			})
+		}
+		current, found = previous, previousFound
+	}
+
+	// Every block that could not be reached from the head is an orphan.
+	for hash, current := range blocks {
+		if !current.visited {
+			report.addIssue(&VerificationIssue{
+				Kind:   IssueOrphanedBlock,
+				Hash:   hash.Hex(),
+				File:   current.location.Filename,
+				Offset: current.location.Offset,
+				Detail: "the block cannot be reached from the head of the chain",
+			})
+		}
+	}
+
+	// Sort issues by their position in storage for the report to be stable between runs.
+	sort.SliceStable(report.Issues, func(i, j int) bool {
+		a, b := report.Issues[i], report.Issues[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Offset < b.Offset
+	})
+
+	return report, nil
+}
@@ -0,0 +1,119 @@
+package repository
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	b32 "tp1.aba.distros.fi.uba.ar/common/number/big32"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+)
+
+func TestVerifyValidChain(t *testing.T) {
+	repo, _ := CreateBlockRepository()
+	defer cleanup(repo)
+
+	saveVerifiableChain(t, repo, 3)
+
+	report, err := repo.Verify()
+	if err != nil {
+		t.Fatalf("could not verify repository: %s", err.Error())
+	}
+	if !report.Ok {
+		t.Fatalf("unexpected issues in a valid chain: %d", len(report.Issues))
+	}
+	if report.Blocks != 3 || report.ChainLength != 3 {
+		t.Fatalf("unexpected block count %d or chain length %d", report.Blocks, report.ChainLength)
+	}
+}
+
+func TestVerifyOrphanedBlock(t *testing.T) {
+	repo, _ := CreateBlockRepository()
+	defer cleanup(repo)
+
+	chain := saveVerifiableChain(t, repo, 2)
+
+	// Write a block whose parent does not exist straight into a blockchain file, bypassing
+	// validation, as a manual copy would.
+	orphan := verifiableBlock(t, random32(), time.Unix(chain[1].Timestamp(), 0))
+	segment, _ := repo.segmentFor(orphan)
+	filepath := repo.segmentPath(segment)
+	if _, err := writeBlockToFile(orphan, filepath); err != nil {
+		t.Fatalf("could not write orphaned block: %s", err.Error())
+	}
+
+	report, err := repo.Verify()
+	if err != nil {
+		t.Fatalf("could not verify repository: %s", err.Error())
+	}
+	if report.Ok {
+		t.Fatal("orphaned block not detected")
+	}
+	if report.IssueCounts[IssueBrokenLink] != 1 {
+		t.Fatalf("unexpected broken link count: %d", report.IssueCounts[IssueBrokenLink])
+	}
+	if report.IssueCounts[IssueOrphanedBlock] != 1 {
+		t.Fatalf("unexpected orphaned block count: %d", report.IssueCounts[IssueOrphanedBlock])
+	}
+	if report.ChainLength != 2 {
+		t.Fatalf("unexpected chain length: %d", report.ChainLength)
+	}
+}
+
+func TestVerifyCorruptedAndTruncatedFile(t *testing.T) {
+	repo, _ := CreateBlockRepository()
+	defer cleanup(repo)
+
+	chain := saveVerifiableChain(t, repo, 1)
+	segment, _ := repo.segmentFor(chain[0])
+	filepath := repo.segmentPath(segment)
+
+	// Flip the last byte of the block data so that it no longer matches the stored hash.
+	data, err := os.ReadFile(filepath)
+	if err != nil {
+		t.Fatalf("could not read block file: %s", err.Error())
+	}
+	data[len(data)-1] ^= 0xff
+	// Append an incomplete block to the file as well.
+	data = append(data, 1, 2, 3)
+
+	if err := os.WriteFile(filepath, data, 0600); err != nil {
+		t.Fatalf("could not write block file: %s", err.Error())
+	}
+
+	report, err := repo.Verify()
+	if err != nil {
+		t.Fatalf("could not verify repository: %s", err.Error())
+	}
+	if report.IssueCounts[IssueHashMismatch] != 1 {
+		t.Fatal("hash mismatch not detected")
+	}
+	if report.IssueCounts[IssueTruncatedFile] != 1 {
+		t.Fatal("truncated file not detected")
+	}
+}
+
+// Saves a chain of the given length to the repository, using blocks that meet their difficulty.
+func saveVerifiableChain(t *testing.T, repo *BlockRepository, length int) []*blockchain.Block {
+	chain := make([]*blockchain.Block, 0, length)
+	timebase := time.Now().UTC()
+
+	for i := 0; i < length; i++ {
+		block := verifiableBlock(t, repo.PreviousBlockHash(), timebase.Add(time.Duration(i)*time.Second))
+		if err := repo.Save(block, computeDifficulty); err != nil {
+			t.Fatalf("could not save block %d: %s", i, err.Error())
+		}
+		chain = append(chain, block)
+	}
+
+	return chain
+}
+
+func verifiableBlock(t *testing.T, previousHash *b32.Big32, creation time.Time) *blockchain.Block {
+	block, err := blockchain.CreateBlock(previousHash, b32.One, testEntries())
+	if err != nil {
+		t.Fatal("could not create block")
+	}
+	block.SetCreationTime(creation)
+	return block
+}
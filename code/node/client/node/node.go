@@ -4,18 +4,24 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"tp1.aba.distros.fi.uba.ar/common/config"
 	"tp1.aba.distros.fi.uba.ar/common/logging"
 	"tp1.aba.distros.fi.uba.ar/common/number/big32"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
 	"tp1.aba.distros.fi.uba.ar/interface/message"
 )
 
 const DefaultReadServerPort = 9000
 const DefaultWriteServerPort = 9010
 
+// The amount of latest blocks mined shown by "stats --history" unless given.
+const defaultHistoryLength = 20
+
 const clientConfigPath = "/etc/distros/config/client.env"
 
 func Run() {
@@ -34,6 +40,22 @@ func Run() {
 		handleBlocksInMinuteRequest()
 	case "stats":
 		handleGetMiningStats()
+	case "height":
+		handleHeightRequest()
+	case "range":
+		handleBlocksInRangeRequest()
+	case "cachestats":
+		handleGetCacheStats()
+	case "deadletters":
+		handleGetDeadLetters()
+	case "chunk":
+		handleFindChunkRequest()
+	case "follow":
+		handleFollowRequest()
+	}
+
+	if _, received := message.CompressionStatistics(); received.Messages > 0 {
+		logging.Log(fmt.Sprintf("Compressed responses received: %s", received))
 	}
 }
 
@@ -51,13 +73,18 @@ func handleWrite() {
 		logging.Log("Sending write chunk request")
 	}
 
-	// Instantiate the write chunk request.
-	request := message.CreateWriteChunk(data, uint16(len(data)))
+	// Instantiate the write chunk request, signed if credentials are configured.
+	request, err := message.Sign(message.CreateWriteChunk(data, uint16(len(data))))
+	if err != nil {
+		logging.LogError("Could not sign write request", err)
+		return
+	}
 	serverPort, _ := config.GetIntOrDefault("WriteServerPort", DefaultWriteServerPort)
 	response, err := send(request, serverPort)
 
 	if err != nil {
 		logging.LogError("Chunk could not be written", err)
+		return
 	}
 
 	r := response.(*message.WriteChunkResponse)
@@ -97,6 +124,79 @@ func handleBlockRequest() {
 	}
 }
 
+func handleHeightRequest() {
+	serverPort, _ := config.GetIntOrDefault("ReadServerPort", DefaultReadServerPort)
+
+	// Without arguments, just display the current height of the blockchain.
+	if len(os.Args) < 3 {
+		logging.Log("Sending mining info request")
+		if response, err := send(message.CreateGetMiningInfoRequest(), serverPort); err != nil {
+			logging.LogError("The request could not be processed", err)
+		} else {
+			r := response.(*message.GetMiningInfoResponse)
+			logging.Log(fmt.Sprintf("Current height: %d", r.Height()))
+			logging.Log(fmt.Sprintf("Current previous hash: %s", r.PreviousHash().Hex()))
+		}
+		return
+	}
+
+	// Get the height of the block being requested.
+	height, err := strconv.ParseInt(os.Args[2], 10, 64)
+	if err != nil {
+		logging.LogError("Could not parse height", err)
+		return
+	}
+	request := message.CreateGetBlockByHeightRequest(height)
+
+	logging.Log(fmt.Sprintf("Sending block request for height %d", height))
+	if response, err := send(request, serverPort); err != nil {
+		logging.LogError("Could not retrieve block", err)
+	} else {
+		r := response.(*message.GetBlockByHeightResponse)
+
+		if r.Found() {
+			block := r.Block()
+			logging.Log(fmt.Sprintf("Retrieved block %s", block.Hash().Hex()))
+
+			for it := block.Entries(); it.HasNext(); it.Advance() {
+				chunk := it.Chunk()
+				logging.Log(fmt.Sprintf("Found entry: %s", string(chunk.Data)))
+			}
+
+		} else {
+			logging.Log("Block could not be found")
+		}
+	}
+}
+
+func handleFindChunkRequest() {
+	// The data of the chunk being looked for is the second argument. Only its hash is sent.
+	data := []byte(os.Args[2])
+
+	if len(data) > 65535 {
+		data = data[:65535]
+	}
+
+	contentHash := blockchain.CreateChunk(data).ContentHash()
+	request := message.CreateFindChunkRequest(contentHash)
+
+	logging.Log(fmt.Sprintf("Sending find chunk request: %s", contentHash.Hex()))
+	serverPort, _ := config.GetIntOrDefault("ReadServerPort", DefaultReadServerPort)
+	if response, err := send(request, serverPort); err != nil {
+		logging.LogError("Could not find chunk", err)
+	} else {
+		r := response.(*message.FindChunkResponse)
+
+		if r.Found() {
+			logging.Log(fmt.Sprintf("Chunk found in block %s", r.BlockHash().Hex()))
+			logging.Log(fmt.Sprintf("Entry: %d", r.Entry()))
+			logging.Log(fmt.Sprintf("Block timestamp: %d (%s)", r.Timestamp(), time.Unix(r.Timestamp(), 0).UTC()))
+		} else {
+			logging.Log("Chunk could not be found")
+		}
+	}
+}
+
 func handleBlocksInMinuteRequest() {
 	// Get year, month, day, hour and minute as arguments.
 	yearStr, monthStr, dayStr, hourStr, minuteStr :=
@@ -143,6 +243,114 @@ func handleBlocksInMinuteRequest() {
 	}
 }
 
+func handleBlocksInRangeRequest() {
+	// Get the UNIX timestamps that delimit the range, and optionally the amount of blocks to
+	// fetch with each request.
+	_, from, err := parseTimestamp(os.Args[2])
+	if err != nil {
+		logging.LogError("Could not parse start timestamp", err)
+		return
+	}
+	_, to, err := parseTimestamp(os.Args[3])
+	if err != nil {
+		logging.LogError("Could not parse end timestamp", err)
+		return
+	}
+	limit := uint64(0)
+	if len(os.Args) > 4 {
+		if limit, err = strconv.ParseUint(os.Args[4], 10, 32); err != nil {
+			logging.LogError("Could not parse limit", err)
+			return
+		}
+	}
+
+	serverPort, _ := config.GetIntOrDefault("ReadServerPort", DefaultReadServerPort)
+	logging.Log(fmt.Sprintf("Sending query for blocks from %d to %d", from, to))
+
+	// Keep requesting pages until the server returns no cursor.
+	total := 0
+	var cursor *message.RangeCursor = nil
+
+	for page := true; page; {
+		request := message.CreateReadBlocksInRange(from, to, uint32(limit), cursor)
+		count := 0
+
+		err := stream(request, serverPort, func(response message.Message) error {
+			r := response.(*message.ReadBlocksInRangeResponse)
+			// Display blocks as they arrive.
+			for block, err := r.Next(); block != nil || err != nil; block, err = r.Next() {
+				if err != nil {
+					return err
+				}
+				count++
+				logging.Log(fmt.Sprintf("Found block %s", block.Hash().Hex()))
+				for it := block.Entries(); it.HasNext(); it.Advance() {
+					chunk := it.Chunk()
+					logging.Log(fmt.Sprintf("Found entry: %s", string(chunk.Data)))
+				}
+			}
+			cursor = r.Cursor()
+			return nil
+		})
+		if err != nil {
+			logging.LogError("The request could not be processed", err)
+			return
+		}
+
+		total += count
+		page = cursor != nil
+	}
+
+	logging.Log(fmt.Sprintf("Found %d blocks", total))
+}
+
+func handleFollowRequest() {
+	// Optionally catch up from a block given by its hash, and only display headers if asked to.
+	var from *big32.Big32 = nil
+	headersOnly := false
+	for _, arg := range os.Args[2:] {
+		if arg == "headers" {
+			headersOnly = true
+		} else {
+			from = big32.FromHexString(arg)
+		}
+	}
+
+	// Follow the blockchain until interrupted.
+	done := make(chan struct{})
+	sigchannel := make(chan os.Signal, 1)
+	signal.Notify(sigchannel, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigchannel
+		close(done)
+	}()
+
+	serverPort, _ := config.GetIntOrDefault("ReadServerPort", DefaultReadServerPort)
+	serverName := config.GetStringOrDefault("ServiceHostName", "localhost")
+	address := net.JoinHostPort(serverName, strconv.Itoa(serverPort))
+	logging.Log("Following new blocks")
+
+	request := message.CreateSubscribeBlocks(from, headersOnly)
+	err := message.Subscribe(address, request, done, func(response message.Message) error {
+		r := response.(*message.BlockNotification)
+		header := r.Header()
+		logging.Log(fmt.Sprintf("Block %s at height %d", header.Hash().Hex(), r.Height()))
+		logging.Log(fmt.Sprintf("Entries: %d, timestamp: %d", header.EntryCount(), header.Timestamp()))
+
+		// Display entries as they arrive, if they were sent.
+		if block := r.Block(); block != nil {
+			for it := block.Entries(); it.HasNext(); it.Advance() {
+				chunk := it.Chunk()
+				logging.Log(fmt.Sprintf("Found entry: %s", string(chunk.Data)))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logging.LogError("Stopped following blocks", err)
+	}
+}
+
 func parseTimestamp(unixTimestamp string) (time.Time, int64, error) {
 	if timestampInt, err := strconv.ParseInt(unixTimestamp, 10, 64); err != nil {
 		return time.Now(), 0, err
@@ -168,29 +376,121 @@ func handleGetMiningStats() {
 			logging.Log(fmt.Sprintf("Failed mining attempts: %d", stat.MiningFailureCount))
 		}
 	}
+
+	// Display the attempts made on each range of nonces.
+	if response, err := send(message.CreateGetMiningRanges(), serverPort); err != nil {
+		logging.LogError("Could not retrieve nonce ranges", err)
+	} else {
+		for _, stat := range response.(*message.GetMiningRangesResponse).Ranges() {
+			logging.Log(fmt.Sprintf("Nonce range %d (miner %d): %d attempts, exhausted %d times",
+				stat.RangeId, stat.MinerId, stat.Attempts, stat.Exhausted))
+		}
+	}
+
+	// Display totals and hashrate, along with the latest blocks mined if asked for with
+	// "--history [count]".
+	historyLength := 0
+	if len(os.Args) > 2 && os.Args[2] == "--history" {
+		historyLength = defaultHistoryLength
+		if len(os.Args) > 3 {
+			if count, err := strconv.ParseUint(os.Args[3], 10, 16); err == nil {
+				historyLength = int(count)
+			}
+		}
+	}
+	if response, err := send(message.CreateGetMiningTelemetry(uint16(historyLength)), serverPort); err != nil {
+		logging.LogError("Could not retrieve mining telemetry", err)
+	} else {
+		telemetry := response.(*message.GetMiningTelemetryResponse).Telemetry()
+		logging.Log(fmt.Sprintf("Blocks mined: %d, in %s after %d attempts",
+			telemetry.BlocksMined, telemetry.MiningTime, telemetry.Attempts))
+		logging.Log(fmt.Sprintf("Hashrate: %.0f/s (1m), %.0f/s (5m), %.0f/s (15m)",
+			telemetry.Hashrate[0], telemetry.Hashrate[1], telemetry.Hashrate[2]))
+		for _, stats := range telemetry.History {
+			logging.Log(fmt.Sprintf("Block %s mined at %s by miner %d: %d attempts in %s, difficulty %s",
+				stats.Hash.Hex(), stats.MinedAt.Format(time.RFC3339), stats.MinerId,
+				stats.Attempts, stats.Duration, stats.Difficulty.ToBig().String()))
+		}
+	}
 }
 
-func send(request message.Message, serverPort int) (message.Message, error) {
-	// Open a connection with the blockchain service.
-	serverName := config.GetStringOrDefault("ServiceHostName", "localhost")
+func handleGetCacheStats() {
+	// Instantiate the request.
+	request := message.CreateGetCacheStatistics()
+	serverPort, _ := config.GetIntOrDefault("ReadServerPort", DefaultReadServerPort)
+	if response, err := send(request, serverPort); err != nil {
+		logging.LogError("The request could not be processed", err)
+	} else {
+		r := response.(*message.GetCacheStatisticsResponse)
+		// Display statistics for each cache.
+		logCacheStats("Block", r.BlockCacheStats())
+		logCacheStats("Minute", r.MinuteCacheStats())
+	}
+}
+
+func handleGetDeadLetters() {
+	serverPort, _ := config.GetIntOrDefault("ReadServerPort", DefaultReadServerPort)
+	if response, err := send(message.CreateGetDeadLetters(), serverPort); err != nil {
+		logging.LogError("Could not retrieve dead letters", err)
+	} else {
+		letters := response.(*message.GetDeadLettersResponse).Letters()
+		logging.Log(fmt.Sprintf("Chunks given up on: %d", len(letters)))
+		for _, letter := range letters {
+			logging.Log(fmt.Sprintf("Chunk %s (%d bytes) failed %d times, last in block %s at %s: %s",
+				letter.ContentHash.Hex(), letter.Length, letter.Failures, letter.BlockHash.Hex(),
+				letter.FailedAt.Format(time.RFC3339), letter.Reason))
+		}
+	}
+}
+
+func logCacheStats(name string, stats *message.CacheStats) {
+	logging.Log(fmt.Sprintf("%s cache: %d/%d entries", name, stats.Entries, stats.Capacity))
+	logging.Log(fmt.Sprintf("%s cache hits: %d", name, stats.Hits))
+	logging.Log(fmt.Sprintf("%s cache misses: %d", name, stats.Misses))
+}
 
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", serverName, serverPort))
+// Connections to the service, by port. They are kept open so that commands that send several
+// requests do not connect again for each one.
+var connections map[int]*message.Client = make(map[int]*message.Client)
 
+// Get the connection to the service listening on the given port, connecting if needed.
+func connect(serverPort int) (*message.Client, error) {
+	if client, found := connections[serverPort]; found && !client.Broken() {
+		return client, nil
+	}
+
+	serverName := config.GetStringOrDefault("ServiceHostName", "localhost")
+	client, err := message.Dial(net.JoinHostPort(serverName, strconv.Itoa(serverPort)))
 	if err != nil {
-		logging.LogError("Could not connect to server", err)
+		return nil, err
 	}
+	connections[serverPort] = client
+	return client, nil
+}
 
-	defer conn.Close()
+// Sends the request and hands the response to the given callback before reading anything else
+// from the connection, for responses that are read as they arrive.
+func stream(request message.Message, serverPort int, callback func(message.Message) error) error {
+	client, err := connect(serverPort)
+	if err != nil {
+		return err
+	}
+	return client.Stream(request, callback)
+}
 
-	// Send the request through the channel.
-	if err := request.Write(conn); err != nil {
-		logging.LogError("Could not send message", err)
+func send(request message.Message, serverPort int) (message.Message, error) {
+	// Get a connection with the blockchain service.
+	client, err := connect(serverPort)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to server: %w", err)
 	}
-	// Attempt to receive a response.
-	response, err := message.ReadMessage(conn)
+
+	// Send the request and wait for the response. Error responses are turned into errors.
+	response, err := client.Request(request)
 
 	if err != nil {
-		logging.LogError("Could not receive response", err)
+		return nil, fmt.Errorf("request failed: %w", err)
 	}
 
 	return response, nil
@@ -3,6 +3,7 @@ package domain
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"tp1.aba.distros.fi.uba.ar/common/config"
 	"tp1.aba.distros.fi.uba.ar/common/logging"
@@ -17,6 +18,8 @@ const BlockWriterStateBooting = 0
 const BlockWriterStateWaitingForBlock = 1
 const BlockWriterStateWaitingForMiners = 2
 
+const defaultBlockWriteRetryDelay int = 1000
+
 type BlockWriter struct {
 	stopping bool
 	state    int
@@ -25,6 +28,8 @@ type BlockWriter struct {
 	blockchain *middleware.Blockchain
 	// A queue through which the writer receives blocks for writing.
 	inputQueue <-chan *blockchain.Block
+	// The queue that the chunks of blocks that could not be written go back to.
+	chunkQueue *ChunkQueue
 	// A queue through which the writer will send writer responses.
 	responseQueue chan<- *message.WriteBlockResponse
 	// A channel used to tell the writer to stop.
@@ -37,15 +42,25 @@ type BlockWriter struct {
 	currentMiningRequest *MiningRequest
 	// The collection of miners under this writer.
 	miners []*Miner
+	// The nonces to be tried by the miners, split in ranges.
+	nonces *NonceSpace
+	// How blocks were mined.
+	telemetry *MiningTelemetry
+	// The chunks of blocks that could not be written, and those given up on.
+	deadLetters *DeadLetters
+	// How long to wait before mining again after failing to reach the server.
+	retryDelay time.Duration
 }
 
 func CreateBlockWriter(
 	blockchain *middleware.Blockchain,
+	chunkQueue *ChunkQueue,
 	inputQueue <-chan *blockchain.Block,
 	responseQueue chan<- *message.WriteBlockResponse) *BlockWriter {
 
 	writer := &BlockWriter{}
 	writer.blockchain = blockchain
+	writer.chunkQueue = chunkQueue
 	writer.inputQueue = inputQueue
 	writer.responseQueue = responseQueue
 	writer.state = BlockWriterStateBooting
@@ -57,9 +72,14 @@ func CreateBlockWriter(
 	minerCount, _ := config.GetIntOrDefault("MinerCount", 4)
 	writer.miners = make([]*Miner, minerCount)
 	writer.minerWaitGroup = &sync.WaitGroup{}
+	writer.nonces = CreateNonceSpace()
+	writer.telemetry = CreateMiningTelemetry()
+	writer.deadLetters = CreateDeadLetters()
+	retryDelay, _ := config.GetIntOrDefault("BlockWriteRetryDelay", defaultBlockWriteRetryDelay)
+	writer.retryDelay = time.Duration(retryDelay) * time.Millisecond
 
 	for i := 0; i < len(writer.miners); i++ {
-		writer.miners[i] = CreateMiner(i)
+		writer.miners[i] = CreateMiner(i, writer.nonces, writer.telemetry)
 		writer.miners[i].RegisterOnWaitGroup(writer.minerWaitGroup)
 	}
 
@@ -97,6 +117,8 @@ func (writer *BlockWriter) Run() {
 	// Wait for miners to finish.
 	logging.Log("Waiting for miners to finish")
 	writer.minerWaitGroup.Wait()
+	// Save the attempts made since the last block mined.
+	writer.telemetry.Save(writer.MiningStats())
 	// Send notification of writer termination.
 	if writer.waitGroup != nil {
 		writer.waitGroup.Done()
@@ -113,6 +135,21 @@ func (wr *BlockWriter) MiningStats() []*message.MiningStats {
 	return stats
 }
 
+// Get the statistics of the ranges of nonces handed out to the miners.
+func (wr *BlockWriter) RangeStats() []*message.RangeStats {
+	return wr.nonces.RangeStats()
+}
+
+// Get the statistics kept about mining, with up to the given amount of the latest blocks mined.
+func (wr *BlockWriter) Telemetry(historyLength int) *message.MiningTelemetry {
+	return wr.telemetry.Snapshot(historyLength, wr.MiningStats())
+}
+
+// Get the chunks that the writer gave up on, oldest first.
+func (wr *BlockWriter) DeadLetters() []*message.DeadLetter {
+	return wr.deadLetters.Letters()
+}
+
 func (wr *BlockWriter) loop() {
 	// Proceed depending on current state.
 	switch wr.state {
@@ -147,11 +184,12 @@ func (wr *BlockWriter) awaitBlock() {
 func (wr *BlockWriter) handleIncomingBlock(block *blockchain.Block) {
 	logging.Log("Block writer now handling an incoming block")
 	// Create a channel for the miners to answer through.
-	channel := make(chan *blockchain.Block, len(wr.miners))
+	channel := make(chan *MinedBlock, len(wr.miners))
 	// Create a mining request and send to each miner for mining.
 	wr.currentMiningRequest = CreateMiningRequest(block, channel)
 	// Send the request to the miners.
 	logging.Log("Pushing mining request to the miners")
+	wr.telemetry.StartBlock()
 	for _, miner := range wr.miners {
 		miner.StartMining(wr.currentMiningRequest)
 	}
@@ -162,32 +200,81 @@ func (wr *BlockWriter) handleIncomingBlock(block *blockchain.Block) {
 func (wr *BlockWriter) awaitMiners() {
 	logging.Log("Block writer now waiting for the miners to finish mining the current block")
 	select {
-	case block := <-wr.currentMiningRequest.ResponseChannel():
-		wr.handleMiningResponse(block)
+	case mined := <-wr.currentMiningRequest.ResponseChannel():
+		wr.handleMiningResponse(mined)
 	case <-wr.quitChannel:
 		wr.finalize()
 	}
 }
 
-func (wr *BlockWriter) handleMiningResponse(block *blockchain.Block) {
+func (wr *BlockWriter) handleMiningResponse(mined *MinedBlock) {
 	logging.Log("Block writer now handling a response from the miners")
+	// Notify all remaining miners that mining for the current block is done and they should stop.
+	// If the block cannot be written, its chunks are mined again in a new block.
+	for _, miner := range wr.miners {
+		miner.StopMining()
+	}
+	wr.currentMiningRequest = nil
+	wr.state = BlockWriterStateWaitingForBlock
+
 	// Send the mined block to the blockchain server. Create a write request first.
-	blockRequest := message.CreateWriteBlock(block)
+	blockRequest := message.CreateWriteBlock(mined.Block)
 	// Send the request to the server.
-	if blockResponse, err := wr.blockchain.WriteBlock(blockRequest); err != nil {
+	blockResponse, err := wr.blockchain.WriteBlock(blockRequest)
+	if err != nil {
 		logging.LogError("Write request failed", err)
-	} else {
-		// Notify all remaining miners that mining for the current block is done and they should stop.
-		for _, miner := range wr.miners {
-			miner.StopMining()
-		}
-		// Send the response back upstream to notify results and change state.
+		blockResponse = wr.recoverFromFailedWrite(mined.Block, err)
+	} else if !blockResponse.Ok() {
+		logging.Log(fmt.Sprintf("Block %s was rejected by the blockchain server", mined.Block.Hash().Hex()))
+		wr.requeueChunks(mined.Block, "rejected by the blockchain server")
+	}
+
+	if blockResponse.Ok() {
+		wr.deadLetters.BlockWritten(mined.Block)
+		// Every miner stopped, so the attempts made for the block are known.
+		wr.telemetry.FinishBlock(mined.Block, mined.MinerId, wr.MiningStats())
+	}
+	// Send the response back upstream to notify results, so that the packer creates the next block
+	// on top of the head that it carries.
+	if !wr.stopping {
 		wr.responseQueue <- blockResponse
-		wr.currentMiningRequest = nil
-		wr.state = BlockWriterStateWaitingForBlock
 	}
 }
 
+// Finds out whether a block whose write failed was written anyway, with only the response being
+// lost, and puts its chunks back in the queue if it was not. Returns the response that the server
+// would have sent. When the server cannot be reached, the head is assumed not to have changed, so
+// the chunks may end up written twice if the write did go through.
+func (wr *BlockWriter) recoverFromFailedWrite(block *blockchain.Block, cause error) *message.WriteBlockResponse {
+	if err := wr.blockchain.RefreshMiningInfo(); err != nil {
+		logging.LogError("Could not refresh mining info", err)
+	}
+	previousHash := wr.blockchain.CurrentPreviousHash()
+	difficulty := wr.blockchain.CurrentDifficulty()
+	if previousHash.Equals(block.Hash()) {
+		logging.Log(fmt.Sprintf("Block %s was written despite the failed request", block.Hash().Hex()))
+		return message.CreateWriteBlockResponse(true, previousHash, difficulty)
+	}
+
+	wr.requeueChunks(block, cause.Error())
+	// Give the server time to come back before mining again, unless told to stop.
+	select {
+	case <-time.After(wr.retryDelay):
+	case <-wr.quitChannel:
+		wr.finalize()
+	}
+	return message.CreateWriteBlockResponse(false, previousHash, difficulty)
+}
+
+// Puts the chunks of a block that could not be written back at the front of the chunk queue,
+// except for those that failed too many times already.
+func (wr *BlockWriter) requeueChunks(block *blockchain.Block, reason string) {
+	retries := wr.deadLetters.BlockFailed(block, reason)
+	logging.Log(fmt.Sprintf("Queueing %d of the %d chunks of block %s again",
+		len(retries), block.EntryCount(), block.Hash().Hex()))
+	wr.chunkQueue.Requeue(retries)
+}
+
 func (wr *BlockWriter) finalize() {
 	logging.Log("Block writer received stop signal")
 	wr.stopping = true
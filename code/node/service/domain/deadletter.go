@@ -0,0 +1,106 @@
+package domain
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"tp1.aba.distros.fi.uba.ar/common/config"
+	"tp1.aba.distros.fi.uba.ar/common/logging"
+	"tp1.aba.distros.fi.uba.ar/common/number/big32"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+	"tp1.aba.distros.fi.uba.ar/interface/message"
+)
+
+//=================================================================================================
+// Dead letters
+//-------------------------------------------------------------------------------------------------
+
+const defaultBlockWriteRetryLimit int = 3
+const defaultDeadLetterCapacity int = 100
+
+// Keeps track of the chunks in blocks that could not be written. Chunks are tried again in later
+// blocks up to BlockWriteRetryLimit times, after which they become dead letters: they are given
+// up on and kept for operators to inspect, up to the latest DeadLetterCapacity of them. Safe for
+// concurrent use.
+type DeadLetters struct {
+	lock       sync.Mutex
+	retryLimit int
+	capacity   int
+	// The amount of failed writes of the chunks that are still being tried, by the hash of their
+	// data.
+	failures map[big32.Big32]int
+	// The chunks given up on, oldest first.
+	letters []*message.DeadLetter
+}
+
+func CreateDeadLetters() *DeadLetters {
+	deadLetters := &DeadLetters{}
+	deadLetters.retryLimit, _ = config.GetIntOrDefault("BlockWriteRetryLimit", defaultBlockWriteRetryLimit)
+	if deadLetters.retryLimit < 0 {
+		deadLetters.retryLimit = defaultBlockWriteRetryLimit
+	}
+	deadLetters.capacity, _ = config.GetIntOrDefault("DeadLetterCapacity", defaultDeadLetterCapacity)
+	if deadLetters.capacity < 0 {
+		deadLetters.capacity = defaultDeadLetterCapacity
+	}
+	deadLetters.failures = make(map[big32.Big32]int)
+	deadLetters.letters = make([]*message.DeadLetter, 0)
+	return deadLetters
+}
+
+// Records that the given block could not be written for the given reason. Returns copies of the
+// chunks in it that can be tried again, in the order they had in the block, and keeps the rest
+// as dead letters.
+func (deadLetters *DeadLetters) BlockFailed(block *blockchain.Block, reason string) []*blockchain.Chunk {
+	deadLetters.lock.Lock()
+	defer deadLetters.lock.Unlock()
+
+	retries := make([]*blockchain.Chunk, 0, block.EntryCount())
+	for it := block.Entries(); it.HasNext(); it.Advance() {
+		// The chunk points into the buffer of the block, so its data is copied.
+		chunk := blockchain.CreateChunk(it.Chunk().Data)
+		contentHash := chunk.ContentHash()
+		failures := deadLetters.failures[*contentHash] + 1
+		if failures <= deadLetters.retryLimit {
+			deadLetters.failures[*contentHash] = failures
+			retries = append(retries, chunk)
+			continue
+		}
+
+		delete(deadLetters.failures, *contentHash)
+		letter := &message.DeadLetter{}
+		letter.ContentHash = contentHash
+		letter.Length = int(chunk.Length)
+		letter.BlockHash = block.Hash()
+		letter.Failures = failures
+		letter.FailedAt = time.Now().UTC()
+		letter.Reason = reason
+		deadLetters.letters = append(deadLetters.letters, letter)
+		logging.Log(fmt.Sprintf("Giving up on chunk %s after %d failed writes", contentHash.Hex(), failures))
+	}
+
+	if excess := len(deadLetters.letters) - deadLetters.capacity; excess > 0 {
+		deadLetters.letters = deadLetters.letters[excess:]
+	}
+	return retries
+}
+
+// Forgets the failed writes of the chunks in the given block, which was written.
+func (deadLetters *DeadLetters) BlockWritten(block *blockchain.Block) {
+	deadLetters.lock.Lock()
+	defer deadLetters.lock.Unlock()
+	if len(deadLetters.failures) == 0 {
+		return
+	}
+	for it := block.Entries(); it.HasNext(); it.Advance() {
+		delete(deadLetters.failures, *it.Chunk().ContentHash())
+	}
+}
+
+// Get the chunks given up on, oldest first.
+func (deadLetters *DeadLetters) Letters() []*message.DeadLetter {
+	deadLetters.lock.Lock()
+	defer deadLetters.lock.Unlock()
+	return append([]*message.DeadLetter{}, deadLetters.letters...)
+}
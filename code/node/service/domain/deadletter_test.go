@@ -0,0 +1,76 @@
+package domain
+
+import (
+	"testing"
+
+	"tp1.aba.distros.fi.uba.ar/common/number/big32"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+)
+
+// Creates a block holding chunks with the given data.
+func blockWithChunks(t *testing.T, data ...string) *blockchain.Block {
+	chunks := make([]*blockchain.Chunk, len(data))
+	for i := range data {
+		chunks[i] = blockchain.CreateChunk([]byte(data[i]))
+		if i > 0 {
+			chunks[i-1].SetNext(chunks[i])
+		}
+	}
+	block, err := blockchain.CreateBlock(big32.Zero, big32.One, chunks[0])
+	if err != nil {
+		t.Fatalf("could not create block: %s", err.Error())
+	}
+	return block
+}
+
+func TestChunksAreRetriedUpToTheLimit(t *testing.T) {
+	t.Setenv("BlockWriteRetryLimit", "2")
+	deadLetters := CreateDeadLetters()
+
+	// Chunks that fail again are counted from their earlier failures, along with new ones.
+	if retries := deadLetters.BlockFailed(blockWithChunks(t, "a", "b"), "rejected"); len(retries) != 2 {
+		t.Fatal("expected every chunk to be retried")
+	}
+	retries := deadLetters.BlockFailed(blockWithChunks(t, "a", "b", "c"), "rejected")
+	if len(retries) != 3 || string(retries[0].Data) != "a" || string(retries[2].Data) != "c" {
+		t.Fatal("unexpected chunks to retry")
+	}
+	block := blockWithChunks(t, "c", "a")
+	if retries := deadLetters.BlockFailed(block, "timeout"); len(retries) != 1 || string(retries[0].Data) != "c" {
+		t.Fatal("expected only the chunk under the limit to be retried")
+	}
+
+	letters := deadLetters.Letters()
+	if len(letters) != 1 {
+		t.Fatal("unexpected dead letters")
+	}
+	expected := blockchain.CreateChunk([]byte("a")).ContentHash()
+	if !letters[0].ContentHash.Equals(expected) || !letters[0].BlockHash.Equals(block.Hash()) ||
+		letters[0].Failures != 3 || letters[0].Length != 1 || letters[0].Reason != "timeout" {
+		t.Fatal("unexpected dead letter")
+	}
+}
+
+func TestWrittenChunksAreForgotten(t *testing.T) {
+	t.Setenv("BlockWriteRetryLimit", "1")
+	deadLetters := CreateDeadLetters()
+
+	deadLetters.BlockFailed(blockWithChunks(t, "a"), "rejected")
+	deadLetters.BlockWritten(blockWithChunks(t, "a"))
+	// The chunk failing later on starts counting again.
+	if retries := deadLetters.BlockFailed(blockWithChunks(t, "a"), "rejected"); len(retries) != 1 {
+		t.Fatal("expected the chunk to be retried")
+	}
+}
+
+func TestOldestDeadLettersAreDropped(t *testing.T) {
+	t.Setenv("BlockWriteRetryLimit", "0")
+	t.Setenv("DeadLetterCapacity", "2")
+	deadLetters := CreateDeadLetters()
+
+	deadLetters.BlockFailed(blockWithChunks(t, "a", "b", "c"), "rejected")
+	letters := deadLetters.Letters()
+	if len(letters) != 2 || !letters[0].ContentHash.Equals(blockchain.CreateChunk([]byte("b")).ContentHash()) {
+		t.Fatal("unexpected dead letters")
+	}
+}
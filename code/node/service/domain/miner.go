@@ -18,20 +18,26 @@ type MiningRequest struct {
 	// The block to mine.
 	block *blockchain.Block
 	// The channel to which the result should be written.
-	responseChannel chan *blockchain.Block
+	responseChannel chan *MinedBlock
+}
+
+// A block mined, along with the ID of the miner that found its nonce.
+type MinedBlock struct {
+	Block   *blockchain.Block
+	MinerId int
 }
 
 // Given a block, create a request for the miners to mine that block. Once mined, the complete
 // block with nonce and hash will be written to the given output channel. To prevent issues,
 // the output channel should be non blocking.
-func CreateMiningRequest(block *blockchain.Block, output chan *blockchain.Block) *MiningRequest {
+func CreateMiningRequest(block *blockchain.Block, output chan *MinedBlock) *MiningRequest {
 	request := &MiningRequest{}
 	request.block = block
 	request.responseChannel = output
 	return request
 }
 
-func (request *MiningRequest) ResponseChannel() <-chan *blockchain.Block {
+func (request *MiningRequest) ResponseChannel() <-chan *MinedBlock {
 	return request.responseChannel
 }
 
@@ -45,6 +51,10 @@ const MinerOpStopMining int = 1
 const MinerStateIdle int = 0
 const MinerStateMining int = 1
 
+// The amount of nonces tried between checks for signals, which keeps checking them and updating
+// statistics out of the way of hashing.
+const attemptsPerCheck int = 256
+
 type Miner struct {
 	id             int
 	stopping       bool
@@ -53,22 +63,34 @@ type Miner struct {
 	controlChannel chan int
 	requestChannel chan *MiningRequest
 	currentRequest *MiningRequest
+	// The range of nonces the miner goes through, which no other miner tries.
+	nonces *NonceRange
+	// The target that the hash of the current block must stay below.
+	target *blockchain.Target
+	// Where the attempts of the miner are recorded.
+	telemetry *MiningTelemetry
 	// Keep statistics of the amount of mined blocks.
 	miningSuccessCount   int
 	miningFailureCount   int
 	miningStatisticsLock *sync.RWMutex
 }
 
-func CreateMiner(id int) *Miner {
+// Creates a miner that goes through a range of nonces taken from the given space, and gives it
+// back once stopped. Its counters start from those restored by the given telemetry, where its
+// attempts are recorded.
+func CreateMiner(id int, space *NonceSpace, telemetry *MiningTelemetry) *Miner {
+	restored := telemetry.RestoredMinerStats(id)
 	miner := &Miner{}
 	miner.id = id
+	miner.nonces = space.Acquire(id)
+	miner.telemetry = telemetry
 	miner.state = MinerStateIdle
 	miner.stopping = false
 	miner.controlChannel = make(chan int)
 	miner.requestChannel = make(chan *MiningRequest)
 	miner.currentRequest = nil
-	miner.miningSuccessCount = 0
-	miner.miningFailureCount = 0
+	miner.miningSuccessCount = restored.MiningSuccessCount
+	miner.miningFailureCount = restored.MiningFailureCount
 	miner.miningStatisticsLock = &sync.RWMutex{}
 	return miner
 }
@@ -85,6 +107,7 @@ func (miner *Miner) Run() {
 	}
 	// Begin finalization procedures.
 	logging.Log(fmt.Sprintf("Miner %d now stopping", miner.id))
+	miner.nonces.space.Release(miner.nonces)
 	if miner.waitGroup != nil {
 		miner.waitGroup.Done()
 	}
@@ -144,6 +167,8 @@ func (miner *Miner) handleMiningRequest(request *MiningRequest) {
 	// Create a copy of the request, with the mutable copy of the block.
 	// Set request for mining and transition to the mining state.
 	miner.currentRequest = CreateMiningRequest(block, request.responseChannel)
+	miner.target = blockchain.CreateTarget(block.Difficulty())
+	miner.nonces.Restart()
 	miner.state = MinerStateMining
 }
 
@@ -167,25 +192,35 @@ func (miner *Miner) mine() {
 		// There are no signals to be handled. Continue with the code
 		// that follows.
 	}
-	// Get the current block and update values to generate a new hash.
+	// Get the current block and try the next nonces in the range of the miner, until the hash
+	// is less than the target.
 	currentBlock := miner.currentRequest.block
-	// Determine whether the current hash value is less than the computed value.
-	if currentBlock.AttemptHash() {
+	found := false
+	attempts := 0
+	for attempts < attemptsPerCheck && !found {
+		miner.nonces.Next(currentBlock)
+		found = currentBlock.MeetsTarget(miner.target)
+		attempts++
+	}
+	miner.telemetry.RecordAttempts(attempts)
+	if found {
 		// The hash is less than the maximum value, so we take this as a valid block.
 		// Send the block with the nonce through the response channel.
 		logging.Log(fmt.Sprintf("Miner %d found a valid block", miner.id))
-		miner.currentRequest.responseChannel <- miner.currentRequest.block
+		miner.currentRequest.responseChannel <- &MinedBlock{miner.currentRequest.block, miner.id}
 		// Increase the count of successfully mined blocks.
 		miner.miningStatisticsLock.Lock()
 		miner.miningSuccessCount++
+		miner.miningFailureCount += attempts - 1
 		miner.miningStatisticsLock.Unlock()
 		// Move back to the idle state.
 		miner.currentRequest = nil
+		miner.target = nil
 		miner.state = MinerStateIdle
 	} else {
 		// Increase the count of mining failures.
 		miner.miningStatisticsLock.Lock()
-		miner.miningFailureCount++
+		miner.miningFailureCount += attempts
 		miner.miningStatisticsLock.Unlock()
 	}
 }
@@ -0,0 +1,141 @@
+package domain
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tp1.aba.distros.fi.uba.ar/common/config"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+	"tp1.aba.distros.fi.uba.ar/interface/message"
+)
+
+//=================================================================================================
+// Nonce space
+//-------------------------------------------------------------------------------------------------
+
+// Hands out disjoint ranges of nonces to miners, so that no two miners ever try the same nonce
+// for a block. Ranges given back by miners that stop are handed out again to miners that join
+// later. Safe for concurrent use.
+type NonceSpace struct {
+	lock sync.Mutex
+	// The amount of nonces in each range.
+	rangeSize uint64
+	// The ID of the next range never handed out, and the ranges given back.
+	nextRangeId uint64
+	released    []*NonceRange
+	// Every range handed out so far, by ID.
+	ranges map[uint64]*NonceRange
+}
+
+func CreateNonceSpace() *NonceSpace {
+	rangeSize, _ := config.GetIntOrDefault("NonceRangeSize", 1<<32)
+	if rangeSize < 1 {
+		rangeSize = 1
+	}
+	space := &NonceSpace{}
+	space.rangeSize = uint64(rangeSize)
+	space.ranges = make(map[uint64]*NonceRange)
+	return space
+}
+
+// Hands out a range of nonces to the given miner.
+func (space *NonceSpace) Acquire(minerId int) *NonceRange {
+	space.lock.Lock()
+	defer space.lock.Unlock()
+
+	var nonces *NonceRange
+	if count := len(space.released); count > 0 {
+		nonces = space.released[count-1]
+		space.released = space.released[:count-1]
+	} else {
+		nonces = &NonceRange{}
+		nonces.space = space
+		nonces.id = space.nextRangeId
+		space.ranges[nonces.id] = nonces
+		space.nextRangeId++
+	}
+	atomic.StoreInt64(&nonces.minerId, int64(minerId))
+	return nonces
+}
+
+// Gives back a range, so that it can be handed out again.
+func (space *NonceSpace) Release(nonces *NonceRange) {
+	space.lock.Lock()
+	defer space.lock.Unlock()
+	atomic.StoreInt64(&nonces.minerId, -1)
+	space.released = append(space.released, nonces)
+}
+
+// Get the statistics of every range handed out so far, sorted by ID.
+func (space *NonceSpace) RangeStats() []*message.RangeStats {
+	space.lock.Lock()
+	defer space.lock.Unlock()
+
+	stats := make([]*message.RangeStats, 0, len(space.ranges))
+	for _, nonces := range space.ranges {
+		stats = append(stats, nonces.stats())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].RangeId < stats[j].RangeId
+	})
+	return stats
+}
+
+//=================================================================================================
+// Nonce range
+//-------------------------------------------------------------------------------------------------
+
+// A range of nonces that a single miner goes through in order.
+type NonceRange struct {
+	space *NonceSpace
+	id    uint64
+	// The position of the next nonce to try for the current block.
+	position uint64
+	// The ID of the miner the range was handed out to, or -1 if none.
+	minerId int64
+	// The amount of nonces tried, and the amount of times that the whole range was tried.
+	attempts  uint64
+	exhausted uint64
+}
+
+func (nonces *NonceRange) Id() uint64 {
+	return nonces.id
+}
+
+// Starts going through the range from the beginning, for a new block.
+func (nonces *NonceRange) Restart() {
+	nonces.position = 0
+}
+
+// Sets the nonce of the block to the next one in the range. Once all of them were tried, the
+// timestamp of the block is moved forward, which makes every nonce worth trying again.
+func (nonces *NonceRange) Next(block *blockchain.Block) {
+	if nonces.position == nonces.space.rangeSize {
+		nonces.position = 0
+		atomic.AddUint64(&nonces.exhausted, 1)
+		refreshTimestamp(block)
+	}
+	block.SetNonce(nonces.id, nonces.position)
+	nonces.position++
+	atomic.AddUint64(&nonces.attempts, 1)
+}
+
+func (nonces *NonceRange) stats() *message.RangeStats {
+	stats := &message.RangeStats{}
+	stats.RangeId = nonces.id
+	stats.MinerId = int(atomic.LoadInt64(&nonces.minerId))
+	stats.Attempts = atomic.LoadUint64(&nonces.attempts)
+	stats.Exhausted = atomic.LoadUint64(&nonces.exhausted)
+	return stats
+}
+
+// Moves the timestamp of the block to now, or a second later than it was if that is not later.
+func refreshTimestamp(block *blockchain.Block) {
+	now := time.Now().UTC()
+	if now.Unix() <= block.Timestamp() {
+		now = time.Unix(block.Timestamp()+1, 0)
+	}
+	block.SetCreationTime(now)
+}
@@ -0,0 +1,75 @@
+package domain
+
+import (
+	"testing"
+
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+)
+
+func TestNonceRangesAreDisjoint(t *testing.T) {
+	t.Setenv("NonceRangeSize", "100")
+	space := CreateNonceSpace()
+	first := space.Acquire(0)
+	second := space.Acquire(1)
+
+	// Every nonce tried by either miner is only tried once.
+	block := blockchain.CreateDummyBlock()
+	tried := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		for _, nonces := range []*NonceRange{first, second} {
+			nonces.Next(block)
+			if nonce := block.Nonce().Hex(); tried[nonce] {
+				t.Fatalf("nonce %s tried twice", nonce)
+			} else {
+				tried[nonce] = true
+			}
+		}
+	}
+
+	stats := space.RangeStats()
+	if len(stats) != 2 || stats[0].MinerId != 0 || stats[1].MinerId != 1 {
+		t.Fatal("unexpected ranges")
+	}
+	if stats[0].Attempts != 50 || stats[1].Attempts != 50 {
+		t.Fatal("unexpected attempts")
+	}
+}
+
+func TestExhaustedRangeRefreshesTimestamp(t *testing.T) {
+	t.Setenv("NonceRangeSize", "3")
+	nonces := CreateNonceSpace().Acquire(0)
+	block := blockchain.CreateDummyBlock()
+	timestamp := block.Timestamp()
+
+	for i := 0; i < 3; i++ {
+		nonces.Next(block)
+	}
+	if block.Timestamp() != timestamp {
+		t.Fatal("timestamp refreshed before exhausting the range")
+	}
+	nonces.Next(block)
+	if block.Timestamp() <= timestamp {
+		t.Fatal("timestamp not refreshed after exhausting the range")
+	}
+	if stats := nonces.stats(); stats.Exhausted != 1 || stats.Attempts != 4 {
+		t.Fatal("unexpected range statistics")
+	}
+}
+
+func TestReleasedRangesAreHandedOutAgain(t *testing.T) {
+	space := CreateNonceSpace()
+	first := space.Acquire(0)
+	space.Acquire(1)
+
+	// Miners that join later get ranges given back first, and new ones afterwards.
+	space.Release(first)
+	if stats := space.RangeStats(); stats[0].MinerId != -1 {
+		t.Fatal("released range still handed out")
+	}
+	if space.Acquire(2) != first {
+		t.Fatal("expected the released range to be handed out again")
+	}
+	if space.Acquire(3).Id() != 2 {
+		t.Fatal("expected a new range")
+	}
+}
@@ -75,20 +75,66 @@ func (q *ChunkQueue) Count() int {
 	return q.count
 }
 
+// Takes as many chunks from the front of the queue as fit in a single block, leaving the rest
+// queued. The queue may hold more than that once chunks are put back into it. The first chunk is
+// always taken, even if it does not fit on its own.
 func (q *ChunkQueue) PopChunks() *blockchain.Chunk {
 	q.lock.Lock()
 	defer q.lock.Unlock()
-	// Get the list of all chunks in the queue.
+	if q.count == 0 {
+		return nil
+	}
+
+	// Find the last chunk that fits.
+	maxLength := blockchain.MaxBlockLength()
+	length := blockchain.HeaderLength + q.head.EntryLength()
+	last := q.head
+	taken := 1
+	for next := last.Next(); next != nil && taken < blockchain.MaxEntryCount; next = next.Next() {
+		if length+next.EntryLength() > maxLength {
+			break
+		}
+		length += next.EntryLength()
+		last = next
+		taken++
+	}
+
+	// Split the list after it.
 	chunks := q.head
-	// Leave the queue as empty.
-	q.head = nil
-	q.tail = nil
-	q.count = 0
+	q.head = last.Next()
+	last.SetNext(nil)
+	q.count -= taken
+	if q.count == 0 {
+		q.tail = nil
+	}
 	return chunks
 }
 
+// Puts the given chunks back at the front of the queue, ahead of those queued since, so that they
+// go into the next block. They were accepted once already, so they are queued even if that leaves
+// the queue over its capacity.
+func (q *ChunkQueue) Requeue(chunks []*blockchain.Chunk) {
+	if len(chunks) == 0 {
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	// Link the chunks in order, followed by the chunks in the queue.
+	for i := 0; i < len(chunks)-1; i++ {
+		chunks[i].SetNext(chunks[i+1])
+	}
+	last := chunks[len(chunks)-1]
+	last.SetNext(q.head)
+	if q.count == 0 {
+		q.tail = last
+	}
+	q.head = chunks[0]
+	q.count += len(chunks)
+}
+
 func (q *ChunkQueue) isFull() bool {
-	return q.count == q.capacity
+	return q.count >= q.capacity
 }
 
 //=================================================================================================
@@ -208,6 +254,11 @@ func (packer *BlockPacker) evaluateWriteBlockResponse(response *message.WriteBlo
 	logging.Log(fmt.Sprintf("Packer received new difficulty: %s", packer.currentDifficulty.Hex()))
 	// Register that the downstream services are ready to handle new blocks.
 	packer.isDownstreamReady = true
+	// The chunks of a block that could not be written are back in the queue. Pack them again on
+	// top of the new previous hash right away.
+	if !response.Ok() {
+		packer.evaluateBlockCreation(true)
+	}
 }
 
 func (packer *BlockPacker) handleInterrupt() {
@@ -239,7 +290,7 @@ func (packer *BlockPacker) evaluateBlockCreation(ignoreThreshold bool) {
 	}
 
 	if queuedCount >= packer.chunkThreshold || ignoreThreshold {
-		// Get all chunks from the queue and create a block.
+		// Get as many chunks from the queue as fit and create a block.
 		logging.Log("Creating new block for mining")
 		chunks := packer.inputQueue.PopChunks()
 		// Construct a block from the chunks.
@@ -248,7 +299,13 @@ func (packer *BlockPacker) evaluateBlockCreation(ignoreThreshold bool) {
 			packer.currentDifficulty, chunks)
 
 		if err != nil {
+			// Keep the chunks for the next attempt rather than losing them.
 			logging.LogError("Packer could not create block", err)
+			requeued := make([]*blockchain.Chunk, 0)
+			for chunk := chunks; chunk != nil; chunk = chunk.Next() {
+				requeued = append(requeued, chunk)
+			}
+			packer.inputQueue.Requeue(requeued)
 			return
 		}
 
@@ -0,0 +1,88 @@
+package domain
+
+import (
+	"fmt"
+	"testing"
+
+	"tp1.aba.distros.fi.uba.ar/common/number/big32"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+	"tp1.aba.distros.fi.uba.ar/interface/message"
+)
+
+func writeChunk(data string) *message.WriteChunk {
+	return message.CreateWriteChunk([]byte(data), uint16(len(data)))
+}
+
+func TestRequeuedChunksGoFirst(t *testing.T) {
+	t.Setenv("InputChunkQueueCapacity", "2")
+	queue := CreateChunkQueue()
+	queue.PushRequest(writeChunk("c"))
+	queue.PushRequest(writeChunk("d"))
+
+	// Requeued chunks are kept even if the queue is full, and make it reject new ones.
+	queue.Requeue([]*blockchain.Chunk{blockchain.CreateChunk([]byte("a")), blockchain.CreateChunk([]byte("b"))})
+	if queue.Count() != 4 {
+		t.Fatalf("unexpected count %d", queue.Count())
+	}
+	if queue.PushRequest(writeChunk("e")).Accepted() {
+		t.Fatal("expected the full queue to reject chunks")
+	}
+
+	block, err := blockchain.CreateBlock(big32.Zero, big32.One, queue.PopChunks())
+	if err != nil {
+		t.Fatalf("could not create block: %s", err.Error())
+	}
+	order := ""
+	for it := block.Entries(); it.HasNext(); it.Advance() {
+		order += string(it.Chunk().Data)
+	}
+	if order != "abcd" {
+		t.Fatalf("unexpected order of chunks %s", order)
+	}
+}
+
+func TestPopChunksThatFitInABlock(t *testing.T) {
+	// Room for the header and two entries of two bytes each.
+	t.Setenv("MaxBlockSize", fmt.Sprint(blockchain.HeaderLength+8))
+	t.Setenv("InputChunkQueueCapacity", "2")
+	queue := CreateChunkQueue()
+	queue.PushRequest(writeChunk("cc"))
+	queue.PushRequest(writeChunk("dd"))
+	queue.Requeue([]*blockchain.Chunk{blockchain.CreateChunk([]byte("aa")), blockchain.CreateChunk([]byte("bb"))})
+
+	// The chunks that do not fit stay queued for the next block.
+	order := ""
+	for blocks := 0; queue.Count() > 0; blocks++ {
+		if blocks == 2 {
+			t.Fatal("expected the chunks to fit in two blocks")
+		}
+		block, err := blockchain.CreateBlock(big32.Zero, big32.One, queue.PopChunks())
+		if err != nil {
+			t.Fatalf("could not create block: %s", err.Error())
+		}
+		for it := block.Entries(); it.HasNext(); it.Advance() {
+			order += string(it.Chunk().Data)
+		}
+	}
+	if order != "aabbccdd" {
+		t.Fatalf("unexpected order of chunks %s", order)
+	}
+
+	// The queue is usable once emptied.
+	queue.PushRequest(writeChunk("ee"))
+	if chunks := queue.PopChunks(); chunks == nil || string(chunks.Data) != "ee" || chunks.Next() != nil {
+		t.Fatal("unexpected chunks after emptying the queue")
+	}
+}
+
+func TestRequeueIntoEmptyQueue(t *testing.T) {
+	queue := CreateChunkQueue()
+	queue.Requeue([]*blockchain.Chunk{blockchain.CreateChunk([]byte("a"))})
+	queue.PushRequest(writeChunk("b"))
+
+	chunks := queue.PopChunks()
+	block, err := blockchain.CreateBlock(big32.Zero, big32.One, chunks)
+	if err != nil || block.EntryCount() != 2 {
+		t.Fatal("expected chunks pushed after requeueing to follow the requeued ones")
+	}
+}
@@ -64,7 +64,7 @@ func (svc *BlockchainService) Run() {
 
 	// Run writer.
 	logging.Log("Starting block writer")
-	svc.writer = CreateBlockWriter(svc.blockchain, packer.BlockQueue(), packer.ResponseChannel())
+	svc.writer = CreateBlockWriter(svc.blockchain, svc.inputQueue, packer.BlockQueue(), packer.ResponseChannel())
 	svc.writer.RegisterOnWaitGroup(svcGroup)
 	go svc.writer.Run()
 
@@ -83,6 +83,8 @@ func (svc *BlockchainService) Run() {
 	svc.writer.Stop()
 	// Wait for subservices to finish.
 	svcGroup.Wait()
+	// Close connections to the blockchain server.
+	svc.blockchain.Close()
 	// Indicate termination if part of a wait group.
 	if svc.waitGroup != nil {
 		svc.waitGroup.Done()
@@ -105,19 +107,63 @@ func (svc *BlockchainService) HandleGetBlock(req *message.GetBlockByHashRequest)
 	// Simply delegate the request to the blockchain middleware.
 	response, err := svc.blockchain.GetOneWithHash(req)
 
-	if err == nil {
+	if err == nil && response.Found() {
 		hash := response.Block().Hash().Hex()
 		logging.Log(fmt.Sprintf("Retrieved block with hash %s", hash))
 	}
 	return response, err
 }
 
+func (svc *BlockchainService) HandleGetBlockByHeight(req *message.GetBlockByHeightRequest) (
+	*message.GetBlockByHeightResponse, error) {
+	// Simply delegate the request to the blockchain middleware.
+	response, err := svc.blockchain.GetOneWithHeight(req)
+
+	if err == nil && response.Found() {
+		hash := response.Block().Hash().Hex()
+		logging.Log(fmt.Sprintf("Retrieved block with height %d: %s", req.Height(), hash))
+	}
+	return response, err
+}
+
+func (svc *BlockchainService) HandleGetMiningInfo(req *message.GetMiningInfo) (
+	*message.GetMiningInfoResponse, error) {
+	// Simply delegate the request to the blockchain middleware.
+	return svc.blockchain.GetMiningInfo(req)
+}
+
 func (svc *BlockchainService) HandleGetBlocksFromMinute(req *message.ReadBlocksInMinuteRequest) (
 	*message.ReadBlocksInMinuteResponse, error) {
 	// Simply delegate the request to the blockchain middleware.
 	return svc.blockchain.GetBlocksFromMinute(req)
 }
 
+func (svc *BlockchainService) HandleGetBlocksInRange(req *message.ReadBlocksInRangeRequest, client message.ResponseWriter) error {
+	// Blocks are streamed, so the response is written straight to the client.
+	return svc.blockchain.StreamBlocksInRange(req, client)
+}
+
+func (svc *BlockchainService) HandleSubscribeBlocks(req *message.SubscribeBlocksRequest, client message.ResponseWriter) error {
+	// Blocks are pushed as they are written, so they are written straight to the client.
+	return svc.blockchain.SubscribeBlocks(req, client)
+}
+
+func (svc *BlockchainService) HandleGetMiningRanges(req *message.GetMiningRanges) (
+	*message.GetMiningRangesResponse, error) {
+	return message.CreateGetMiningRangesResponse(svc.writer.RangeStats()), nil
+}
+
+func (svc *BlockchainService) HandleGetMiningTelemetry(req *message.GetMiningTelemetry) (
+	*message.GetMiningTelemetryResponse, error) {
+	telemetry := svc.writer.Telemetry(int(req.HistoryLength()))
+	return message.CreateGetMiningTelemetryResponse(telemetry), nil
+}
+
+func (svc *BlockchainService) HandleGetDeadLetters(req *message.GetDeadLetters) (
+	*message.GetDeadLettersResponse, error) {
+	return message.CreateGetDeadLettersResponse(svc.writer.DeadLetters()), nil
+}
+
 func (svc *BlockchainService) HandleGetMiningStatistics(req *message.GetMiningStatistics) (
 	*message.GetMiningStatisticsResponse, error) {
 	// Get mining statistics from the writer.
@@ -127,6 +173,24 @@ func (svc *BlockchainService) HandleGetMiningStatistics(req *message.GetMiningSt
 	return res, nil
 }
 
+func (svc *BlockchainService) HandleFindChunk(req *message.FindChunkRequest) (
+	*message.FindChunkResponse, error) {
+	// Simply delegate the request to the blockchain middleware.
+	response, err := svc.blockchain.FindChunk(req)
+
+	if err == nil && response.Found() {
+		hash := response.BlockHash().Hex()
+		logging.Log(fmt.Sprintf("Found chunk %s in block %s", req.ContentHash().Hex(), hash))
+	}
+	return response, err
+}
+
+func (svc *BlockchainService) HandleGetCacheStatistics(req *message.GetCacheStatistics) (
+	*message.GetCacheStatisticsResponse, error) {
+	// Simply delegate the request to the blockchain middleware.
+	return svc.blockchain.GetCacheStatistics(req)
+}
+
 //=================================================================================================
 // Write
 //-------------------------------------------------------------------------------------------------
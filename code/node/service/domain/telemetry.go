@@ -0,0 +1,253 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"tp1.aba.distros.fi.uba.ar/common/config"
+	"tp1.aba.distros.fi.uba.ar/common/logging"
+	"tp1.aba.distros.fi.uba.ar/common/synchro"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+	"tp1.aba.distros.fi.uba.ar/interface/message"
+)
+
+//=================================================================================================
+// Mining telemetry
+//-------------------------------------------------------------------------------------------------
+
+// The windows over which the hashrate is computed.
+var hashrateWindows [3]time.Duration = [3]time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// The amount of seconds whose attempts are kept, enough for the longest window.
+const attemptBucketCount int64 = 15 * 60
+
+const defaultMiningHistorySize int = 100
+
+// The attempts made during a single second.
+type attemptBucket struct {
+	second   int64
+	attempts uint64
+}
+
+// Records how blocks are mined: the attempts and time each block took, the miner that found it
+// and its difficulty, along with the hashrate over the last minutes. When MiningStatsFilepath is
+// configured, totals, the counters of each miner and the history are saved there after each
+// block mined, so that they survive restarts. Safe for concurrent use.
+type MiningTelemetry struct {
+	lock     sync.Mutex
+	filepath string
+	started  time.Time
+	// The attempts made in each of the last seconds, by unix time modulo the amount of buckets.
+	buckets [attemptBucketCount]attemptBucket
+	// Totals, including those restored from disk.
+	blocksMined uint64
+	attempts    uint64
+	miningTime  time.Duration
+	// The latest blocks mined, oldest first, and how many of them are kept.
+	history     []*message.MinedBlockStats
+	historySize int
+	// The counters of each miner restored from disk, by miner ID.
+	restored map[int]*message.MiningStats
+	// When mining of the current block started, and the attempts made before it.
+	blockStarted  time.Time
+	blockAttempts uint64
+}
+
+// Creates the telemetry, restoring it from disk if configured to be saved.
+func CreateMiningTelemetry() *MiningTelemetry {
+	telemetry := &MiningTelemetry{}
+	telemetry.filepath = config.GetStringOrDefault("MiningStatsFilepath", "")
+	telemetry.started = time.Now()
+	telemetry.historySize, _ = config.GetIntOrDefault("MiningHistorySize", defaultMiningHistorySize)
+	if telemetry.historySize < 0 || telemetry.historySize > 0xffff {
+		telemetry.historySize = defaultMiningHistorySize
+	}
+	telemetry.history = make([]*message.MinedBlockStats, 0)
+	telemetry.restored = make(map[int]*message.MiningStats)
+
+	if telemetry.filepath != "" {
+		if err := telemetry.restore(); err != nil {
+			logging.LogError("Could not restore mining statistics", err)
+		}
+	}
+	return telemetry
+}
+
+// Get the counters of the given miner restored from disk, which are zero if none were saved.
+func (telemetry *MiningTelemetry) RestoredMinerStats(minerId int) *message.MiningStats {
+	telemetry.lock.Lock()
+	defer telemetry.lock.Unlock()
+	if stats, found := telemetry.restored[minerId]; found {
+		return stats
+	}
+	return message.CreateMiningStats(minerId, 0, 0)
+}
+
+// Records attempts made by a miner.
+func (telemetry *MiningTelemetry) RecordAttempts(count int) {
+	telemetry.lock.Lock()
+	defer telemetry.lock.Unlock()
+	second := time.Now().Unix()
+	bucket := &telemetry.buckets[second%attemptBucketCount]
+	if bucket.second != second {
+		bucket.second = second
+		bucket.attempts = 0
+	}
+	bucket.attempts += uint64(count)
+	telemetry.attempts += uint64(count)
+}
+
+// Marks the start of mining a new block.
+func (telemetry *MiningTelemetry) StartBlock() {
+	telemetry.lock.Lock()
+	defer telemetry.lock.Unlock()
+	telemetry.blockStarted = time.Now()
+	telemetry.blockAttempts = telemetry.attempts
+}
+
+// Records that the block being mined was found by the given miner, once every miner stopped, and
+// saves the telemetry along with the given counters of each miner if configured to.
+func (telemetry *MiningTelemetry) FinishBlock(block *blockchain.Block, minerId int, miners []*message.MiningStats) {
+	telemetry.lock.Lock()
+	defer telemetry.lock.Unlock()
+
+	stats := &message.MinedBlockStats{}
+	stats.Hash = block.Hash()
+	stats.Difficulty = block.Difficulty()
+	stats.MinedAt = time.Now().UTC()
+	stats.Duration = stats.MinedAt.Sub(telemetry.blockStarted)
+	stats.Attempts = telemetry.attempts - telemetry.blockAttempts
+	stats.MinerId = minerId
+
+	telemetry.blocksMined++
+	telemetry.miningTime += stats.Duration
+	telemetry.history = append(telemetry.history, stats)
+	if excess := len(telemetry.history) - telemetry.historySize; excess > 0 {
+		telemetry.history = telemetry.history[excess:]
+	}
+	logging.Log(fmt.Sprintf("Block %s mined by miner %d after %d attempts in %s",
+		stats.Hash.Hex(), minerId, stats.Attempts, stats.Duration))
+
+	telemetry.saveLocked(miners)
+}
+
+// Saves the telemetry along with the given counters of each miner, if configured to.
+func (telemetry *MiningTelemetry) Save(miners []*message.MiningStats) {
+	telemetry.lock.Lock()
+	defer telemetry.lock.Unlock()
+	telemetry.saveLocked(miners)
+}
+
+// Get the attempts per second over the last 1, 5 and 15 minutes. Windows longer than the time
+// since the service started are averaged over that time instead.
+func (telemetry *MiningTelemetry) Hashrate() [3]float64 {
+	telemetry.lock.Lock()
+	defer telemetry.lock.Unlock()
+	return telemetry.hashrateLocked(time.Now())
+}
+
+// Get the statistics kept so far with the given counters of each miner, and up to the given amount
+// of the latest blocks mined.
+func (telemetry *MiningTelemetry) Snapshot(historyLength int, miners []*message.MiningStats) *message.MiningTelemetry {
+	telemetry.lock.Lock()
+	defer telemetry.lock.Unlock()
+	return telemetry.snapshotLocked(historyLength, miners)
+}
+
+func (telemetry *MiningTelemetry) snapshotLocked(historyLength int, miners []*message.MiningStats) *message.MiningTelemetry {
+	snapshot := &message.MiningTelemetry{}
+	snapshot.BlocksMined = telemetry.blocksMined
+	snapshot.Attempts = telemetry.attempts
+	snapshot.MiningTime = telemetry.miningTime
+	snapshot.Hashrate = telemetry.hashrateLocked(time.Now())
+	snapshot.Miners = miners
+	if historyLength > len(telemetry.history) {
+		historyLength = len(telemetry.history)
+	}
+	snapshot.History = append([]*message.MinedBlockStats{},
+		telemetry.history[len(telemetry.history)-historyLength:]...)
+	return snapshot
+}
+
+func (telemetry *MiningTelemetry) hashrateLocked(now time.Time) [3]float64 {
+	var hashrate [3]float64
+	uptime := now.Sub(telemetry.started)
+	for i, window := range hashrateWindows {
+		// Only full seconds are counted, which leaves out the current one.
+		first := now.Unix() - int64(window/time.Second)
+		attempts := uint64(0)
+		for _, bucket := range telemetry.buckets {
+			if bucket.second >= first && bucket.second < now.Unix() {
+				attempts += bucket.attempts
+			}
+		}
+		if uptime < window {
+			window = uptime.Truncate(time.Second)
+		}
+		if window >= time.Second {
+			hashrate[i] = float64(attempts) / window.Seconds()
+		}
+	}
+	return hashrate
+}
+
+//-------------------------------------------------------------------------------------------------
+
+// The telemetry is saved in the format of the response that carries it, which is versioned.
+func (telemetry *MiningTelemetry) saveLocked(miners []*message.MiningStats) {
+	if telemetry.filepath == "" {
+		return
+	}
+	response := message.CreateGetMiningTelemetryResponse(telemetry.snapshotLocked(telemetry.historySize, miners))
+
+	temporaryPath := telemetry.filepath + ".tmp"
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	err := synchro.HandleFileAtomically(temporaryPath, flags, func(file *os.File) error {
+		if err := response.Write(file); err != nil {
+			return err
+		}
+		return file.Sync()
+	})
+	if err == nil {
+		err = os.Rename(temporaryPath, telemetry.filepath)
+	}
+	if err != nil {
+		logging.LogError("Could not save mining statistics", err)
+	}
+}
+
+func (telemetry *MiningTelemetry) restore() error {
+	file, err := os.Open(telemetry.filepath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	msg, err := message.ReadMessage(file)
+	if err != nil {
+		return err
+	}
+	response, ok := msg.(*message.GetMiningTelemetryResponse)
+	if !ok {
+		return fmt.Errorf("unexpected message with opcode %d in %s", msg.Opcode(), telemetry.filepath)
+	}
+
+	saved := response.Telemetry()
+	telemetry.blocksMined = saved.BlocksMined
+	telemetry.attempts = saved.Attempts
+	telemetry.miningTime = saved.MiningTime
+	telemetry.history = saved.History
+	if excess := len(telemetry.history) - telemetry.historySize; excess > 0 {
+		telemetry.history = telemetry.history[excess:]
+	}
+	for _, stats := range saved.Miners {
+		telemetry.restored[stats.MinerId] = stats
+	}
+	logging.Log(fmt.Sprintf("Restored mining statistics for %d blocks", telemetry.blocksMined))
+	return nil
+}
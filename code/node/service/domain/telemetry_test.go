@@ -0,0 +1,104 @@
+package domain
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+	"tp1.aba.distros.fi.uba.ar/interface/message"
+)
+
+// Records a block mined by the given miner after the given attempts.
+func mineBlock(telemetry *MiningTelemetry, minerId int, attempts int, miners []*message.MiningStats) *blockchain.Block {
+	block := blockchain.CreateDummyBlock()
+	telemetry.StartBlock()
+	telemetry.RecordAttempts(attempts)
+	telemetry.FinishBlock(block, minerId, miners)
+	return block
+}
+
+func TestMinedBlocksAreRecorded(t *testing.T) {
+	t.Setenv("MiningHistorySize", "2")
+	telemetry := CreateMiningTelemetry()
+
+	// Attempts made before mining a block are not counted for it.
+	telemetry.RecordAttempts(7)
+	mineBlock(telemetry, 0, 10, nil)
+	second := mineBlock(telemetry, 1, 20, nil)
+	third := mineBlock(telemetry, 0, 30, nil)
+
+	snapshot := telemetry.Snapshot(5, nil)
+	if snapshot.BlocksMined != 3 || snapshot.Attempts != 67 {
+		t.Fatal("unexpected totals")
+	}
+	// Only the latest blocks are kept, oldest first.
+	if len(snapshot.History) != 2 {
+		t.Fatal("unexpected history length")
+	}
+	if !snapshot.History[0].Hash.Equals(second.Hash()) || snapshot.History[0].Attempts != 20 ||
+		snapshot.History[0].MinerId != 1 {
+		t.Fatal("unexpected first block in history")
+	}
+	if !snapshot.History[1].Hash.Equals(third.Hash()) || !snapshot.History[1].Difficulty.Equals(third.Difficulty()) {
+		t.Fatal("unexpected second block in history")
+	}
+	if len(telemetry.Snapshot(1, nil).History) != 1 || len(telemetry.Snapshot(0, nil).History) != 0 {
+		t.Fatal("unexpected history length when asking for fewer blocks")
+	}
+}
+
+func TestHashrate(t *testing.T) {
+	telemetry := CreateMiningTelemetry()
+	now := time.Now()
+	telemetry.started = now.Add(-time.Hour)
+
+	// A hundred attempts every second over the last ten minutes, and a thousand in the current
+	// second, which is not over yet.
+	for i := int64(1); i <= 600; i++ {
+		second := now.Unix() - i
+		telemetry.buckets[second%attemptBucketCount] = attemptBucket{second, 100}
+	}
+	telemetry.buckets[now.Unix()%attemptBucketCount] = attemptBucket{now.Unix(), 1000}
+
+	hashrate := telemetry.hashrateLocked(now)
+	if hashrate[0] != 100 || hashrate[1] != 100 || hashrate[2] != 100*600/900.0 {
+		t.Fatalf("unexpected hashrate %v", hashrate)
+	}
+
+	// Windows longer than the time since starting are averaged over that time.
+	telemetry.started = now.Add(-2 * time.Minute)
+	if hashrate := telemetry.hashrateLocked(now); hashrate[2] != 100*600/120.0 {
+		t.Fatalf("unexpected hashrate %v", hashrate)
+	}
+}
+
+func TestTelemetrySurvivesRestarts(t *testing.T) {
+	t.Setenv("MiningStatsFilepath", filepath.Join(t.TempDir(), "mining.stats"))
+	telemetry := CreateMiningTelemetry()
+	miners := []*message.MiningStats{message.CreateMiningStats(0, 1, 9), message.CreateMiningStats(1, 0, 0)}
+	block := mineBlock(telemetry, 0, 10, miners)
+
+	// Attempts made since the last block mined are saved on request.
+	telemetry.RecordAttempts(5)
+	miners[1].MiningFailureCount = 5
+	telemetry.Save(miners)
+
+	restored := CreateMiningTelemetry()
+	snapshot := restored.Snapshot(10, nil)
+	if snapshot.BlocksMined != 1 || snapshot.Attempts != 15 {
+		t.Fatal("unexpected restored totals")
+	}
+	if len(snapshot.History) != 1 || !snapshot.History[0].Hash.Equals(block.Hash()) {
+		t.Fatal("unexpected restored history")
+	}
+	if stats := restored.RestoredMinerStats(0); stats.MiningSuccessCount != 1 || stats.MiningFailureCount != 9 {
+		t.Fatal("unexpected restored counters for the first miner")
+	}
+	if stats := restored.RestoredMinerStats(1); stats.MiningFailureCount != 5 {
+		t.Fatal("unexpected restored counters for the second miner")
+	}
+	if stats := restored.RestoredMinerStats(2); stats.MiningSuccessCount != 0 || stats.MiningFailureCount != 0 {
+		t.Fatal("unexpected counters for a new miner")
+	}
+}
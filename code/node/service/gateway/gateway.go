@@ -0,0 +1,421 @@
+package gateway
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tp1.aba.distros.fi.uba.ar/common/logging"
+	"tp1.aba.distros.fi.uba.ar/common/security"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+	"tp1.aba.distros.fi.uba.ar/interface/message"
+
+	number "tp1.aba.distros.fi.uba.ar/common/number/big32"
+)
+
+//=================================================================================================
+// Gateway
+//-------------------------------------------------------------------------------------------------
+
+// Serves part of the blockchain service over HTTP, with JSON bodies, for clients that cannot
+// speak the binary protocol:
+//
+// POST /chunks             : writes the base64 encoded data in the body, {"data": "..."}
+// GET  /blocks/{hash}      : gets the block with the given hash
+// GET  /blocks?minute={ts} : gets the blocks created in the minute of the given unix timestamp
+// GET  /stats/mining       : gets mining statistics, per miner and per range of nonces, with
+//                            totals and hashrate, and the latest {n} blocks mined if given
+//                            ?history={n}
+//
+// Errors are answered with the matching status code and {"error": "..."} as body.
+//
+// When writes must be signed, chunk writes must carry the ID of the client in the X-Client-Id
+// header, the unix timestamp in seconds in X-Timestamp, a random nonce of up to 64 characters in
+// X-Nonce, and in X-Signature the hex encoded HMAC-SHA256 of the timestamp, the nonce and the
+// body, each of the first two followed by a line break.
+
+// The part of the blockchain service exposed through the gateway.
+type Service interface {
+	HandleWriteChunk(req *message.WriteChunk) (*message.WriteChunkResponse, error)
+	HandleGetBlock(req *message.GetBlockByHashRequest) (*message.GetBlockByHashResponse, error)
+	HandleGetBlocksFromMinute(req *message.ReadBlocksInMinuteRequest) (*message.ReadBlocksInMinuteResponse, error)
+	HandleGetMiningStatistics(req *message.GetMiningStatistics) (*message.GetMiningStatisticsResponse, error)
+	HandleGetMiningRanges(req *message.GetMiningRanges) (*message.GetMiningRangesResponse, error)
+	HandleGetMiningTelemetry(req *message.GetMiningTelemetry) (*message.GetMiningTelemetryResponse, error)
+}
+
+const maxNonceLength int = 64
+const shutdownTimeout time.Duration = 10 * time.Second
+
+type Gateway struct {
+	service   Service
+	verifier  *security.Verifier
+	server    *http.Server
+	waitGroup *sync.WaitGroup
+}
+
+// Creates a gateway to the given service on the given port. Chunk writes must be signed unless
+// the verifier is nil.
+func CreateGateway(service Service, port uint16, verifier *security.Verifier) *Gateway {
+	gateway := &Gateway{}
+	gateway.service = service
+	gateway.verifier = verifier
+	gateway.server = &http.Server{}
+	gateway.server.Addr = fmt.Sprintf(":%d", port)
+	gateway.server.Handler = gateway.Handler()
+	return gateway
+}
+
+func (gateway *Gateway) RegisterOnWaitGroup(wg *sync.WaitGroup) error {
+	if gateway.waitGroup != nil {
+		return errors.New("already registered on WG")
+	}
+	gateway.waitGroup = wg
+	gateway.waitGroup.Add(1)
+	return nil
+}
+
+// Serves requests until stopped. Uses TLS if configured, like every other listener.
+func (gateway *Gateway) Run() error {
+	if gateway.waitGroup != nil {
+		defer gateway.waitGroup.Done()
+	}
+
+	logging.Log(fmt.Sprintf("Starting HTTP gateway on %s", gateway.server.Addr))
+	listener, err := security.Listen(gateway.server.Addr)
+	if err != nil {
+		logging.LogError("Could not start HTTP gateway", err)
+		return err
+	}
+	if err := gateway.server.Serve(listener); err != http.ErrServerClosed {
+		logging.LogError("HTTP gateway failed", err)
+		return err
+	}
+	logging.Log("HTTP gateway stopped")
+	return nil
+}
+
+// Stops accepting requests, and waits for the ones being handled to finish.
+func (gateway *Gateway) Stop() {
+	logging.Log("Stopping HTTP gateway")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := gateway.server.Shutdown(ctx); err != nil {
+		logging.LogError("Could not stop HTTP gateway gracefully", err)
+	}
+}
+
+// The handler for all routes of the gateway.
+func (gateway *Gateway) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chunks", gateway.handleChunks)
+	mux.HandleFunc("/blocks", gateway.handleBlocks)
+	mux.HandleFunc("/blocks/", gateway.handleBlocks)
+	mux.HandleFunc("/stats/mining", gateway.handleMiningStatistics)
+	return mux
+}
+
+//=================================================================================================
+// Handlers
+//-------------------------------------------------------------------------------------------------
+
+type writeChunkRequest struct {
+	Data []byte `json:"data"`
+}
+
+type writeChunkResponse struct {
+	Accepted bool `json:"accepted"`
+}
+
+func (gateway *Gateway) handleChunks(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	// Base64 takes 4 bytes for every 3, so leave room for that and for the rest of the JSON.
+	maxBodyLength := int64(blockchain.MaxChunkLength())*4/3 + 1024
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyLength))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, "request body too long")
+		return
+	}
+	if err := gateway.authenticate(r, body); err != nil {
+		logging.LogError("Unauthorized HTTP write request", err)
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	request := &writeChunkRequest{}
+	if err := json.Unmarshal(body, request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("malformed request: %s", err.Error()))
+		return
+	}
+	if len(request.Data) > int(blockchain.MaxChunkLength()) {
+		writeError(w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("chunk longer than the maximum of %d bytes", blockchain.MaxChunkLength()))
+		return
+	}
+
+	response, err := gateway.service.HandleWriteChunk(
+		message.CreateWriteChunk(request.Data, uint16(len(request.Data))))
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	// The chunk is rejected when the service cannot take any more for the moment.
+	status := http.StatusAccepted
+	if !response.Accepted() {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, &writeChunkResponse{response.Accepted()})
+}
+
+type blocksInMinuteResponse struct {
+	Minute int64        `json:"minute"`
+	Blocks []*blockJSON `json:"blocks"`
+}
+
+func (gateway *Gateway) handleBlocks(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	if hash := strings.TrimPrefix(r.URL.Path, "/blocks/"); hash != r.URL.Path {
+		gateway.handleGetBlock(w, hash)
+		return
+	}
+
+	minute, err := strconv.ParseInt(r.URL.Query().Get("minute"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "expected a unix timestamp as minute")
+		return
+	}
+	response, err := gateway.service.HandleGetBlocksFromMinute(message.CreateReadBlocksInMinute(minute))
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	result := &blocksInMinuteResponse{response.Timestamp(), make([]*blockJSON, 0)}
+	for _, block := range response.Blocks() {
+		result.Blocks = append(result.Blocks, encodeBlock(block))
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (gateway *Gateway) handleGetBlock(w http.ResponseWriter, hashx string) {
+	hash, err := hex.DecodeString(hashx)
+	if err != nil || len(hash) != 32 {
+		writeError(w, http.StatusBadRequest, "expected a block hash of 64 hex digits")
+		return
+	}
+
+	response, err := gateway.service.HandleGetBlock(message.CreateGetBlockByHashRequest(number.FromSlice(hash)))
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if !response.Found() {
+		writeError(w, http.StatusNotFound, "block not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, encodeBlock(response.Block()))
+}
+
+// Hashrates are attempts per second over the last 1, 5 and 15 minutes.
+type miningStatisticsResponse struct {
+	Miners       []*minerStatistics      `json:"miners"`
+	Ranges       []*rangeStatistics      `json:"ranges"`
+	BlocksMined  uint64                  `json:"blocksMined"`
+	Attempts     uint64                  `json:"attempts"`
+	MiningTimeMs int64                   `json:"miningTimeMs"`
+	Hashrate     [3]float64              `json:"hashrate"`
+	History      []*minedBlockStatistics `json:"history"`
+}
+
+type minerStatistics struct {
+	MinerId   int `json:"minerId"`
+	Successes int `json:"successes"`
+	Failures  int `json:"failures"`
+}
+
+// Miner IDs are -1 for ranges not handed out to any miner.
+type rangeStatistics struct {
+	RangeId   uint64 `json:"rangeId"`
+	MinerId   int    `json:"minerId"`
+	Attempts  uint64 `json:"attempts"`
+	Exhausted uint64 `json:"exhausted"`
+}
+
+type minedBlockStatistics struct {
+	Hash       string `json:"hash"`
+	Difficulty string `json:"difficulty"`
+	MinedAt    int64  `json:"minedAt"`
+	DurationMs int64  `json:"durationMs"`
+	Attempts   uint64 `json:"attempts"`
+	MinerId    int    `json:"minerId"`
+}
+
+func (gateway *Gateway) handleMiningStatistics(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	historyLength := uint64(0)
+	if history := r.URL.Query().Get("history"); history != "" {
+		var err error
+		if historyLength, err = strconv.ParseUint(history, 10, 16); err != nil {
+			writeError(w, http.StatusBadRequest, "expected an amount of blocks as history")
+			return
+		}
+	}
+
+	response, err := gateway.service.HandleGetMiningStatistics(message.CreateGetMiningStatistics())
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	ranges, err := gateway.service.HandleGetMiningRanges(message.CreateGetMiningRanges())
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	request := message.CreateGetMiningTelemetry(uint16(historyLength))
+	telemetryResponse, err := gateway.service.HandleGetMiningTelemetry(request)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	result := &miningStatisticsResponse{}
+	result.Miners = make([]*minerStatistics, 0)
+	result.Ranges = make([]*rangeStatistics, 0)
+	result.History = make([]*minedBlockStatistics, 0)
+	for _, stats := range response.MinerStats() {
+		result.Miners = append(result.Miners,
+			&minerStatistics{stats.MinerId, stats.MiningSuccessCount, stats.MiningFailureCount})
+	}
+	for _, stats := range ranges.Ranges() {
+		result.Ranges = append(result.Ranges,
+			&rangeStatistics{stats.RangeId, stats.MinerId, stats.Attempts, stats.Exhausted})
+	}
+	telemetry := telemetryResponse.Telemetry()
+	result.BlocksMined = telemetry.BlocksMined
+	result.Attempts = telemetry.Attempts
+	result.MiningTimeMs = telemetry.MiningTime.Milliseconds()
+	result.Hashrate = telemetry.Hashrate
+	for _, stats := range telemetry.History {
+		result.History = append(result.History, &minedBlockStatistics{
+			stats.Hash.Hex(), stats.Difficulty.Hex(), stats.MinedAt.Unix(),
+			stats.Duration.Milliseconds(), stats.Attempts, stats.MinerId})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+//=================================================================================================
+// Encoding
+//-------------------------------------------------------------------------------------------------
+
+// Hashes are hex encoded, and the data of entries is base64 encoded.
+type blockJSON struct {
+	Hash         string   `json:"hash"`
+	PreviousHash string   `json:"previousHash"`
+	Difficulty   string   `json:"difficulty"`
+	Nonce        string   `json:"nonce"`
+	Timestamp    int64    `json:"timestamp"`
+	Entries      [][]byte `json:"entries"`
+}
+
+func encodeBlock(block *blockchain.Block) *blockJSON {
+	encoded := &blockJSON{}
+	encoded.Hash = block.Hash().Hex()
+	encoded.PreviousHash = block.PreviousHash().Hex()
+	encoded.Difficulty = block.Difficulty().Hex()
+	encoded.Nonce = block.Nonce().Hex()
+	encoded.Timestamp = block.Timestamp()
+	encoded.Entries = make([][]byte, 0, block.EntryCount())
+	for it := block.Entries(); it.HasNext(); it.Advance() {
+		encoded.Entries = append(encoded.Entries, it.Chunk().Data)
+	}
+	return encoded
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logging.LogError("Could not write HTTP response", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, reason string) {
+	writeJSON(w, status, &errorResponse{reason})
+}
+
+// Answers with the status code matching the error, as sent by the blockchain server.
+func writeServiceError(w http.ResponseWriter, err error) {
+	status := http.StatusServiceUnavailable
+	switch {
+	case errors.Is(err, message.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, message.ErrBadRequest):
+		status = http.StatusBadRequest
+	case errors.Is(err, message.ErrRejected):
+		status = http.StatusConflict
+	case errors.Is(err, message.ErrUnauthorized):
+		status = http.StatusUnauthorized
+	}
+	logging.LogError("HTTP request failed", err)
+	writeError(w, status, err.Error())
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("only %s is allowed", method))
+		return false
+	}
+	return true
+}
+
+// Checks the signature of a write request, if writes must be signed.
+func (gateway *Gateway) authenticate(r *http.Request, body []byte) error {
+	if gateway.verifier == nil {
+		return nil
+	}
+
+	clientId := r.Header.Get("X-Client-Id")
+	timestampx := r.Header.Get("X-Timestamp")
+	nonce := r.Header.Get("X-Nonce")
+	if clientId == "" || timestampx == "" || nonce == "" || r.Header.Get("X-Signature") == "" {
+		return errors.New("request not signed")
+	}
+	timestamp, err := strconv.ParseInt(timestampx, 10, 64)
+	if err != nil {
+		return errors.New("malformed timestamp")
+	}
+	if len(nonce) > maxNonceLength {
+		return errors.New("nonce too long")
+	}
+	signature, err := hex.DecodeString(r.Header.Get("X-Signature"))
+	if err != nil {
+		return errors.New("malformed signature")
+	}
+
+	content := []byte(timestampx + "\n" + nonce + "\n")
+	content = append(content, body...)
+	return gateway.verifier.Verify(clientId, time.Unix(timestamp, 0), []byte(nonce), content, signature)
+}
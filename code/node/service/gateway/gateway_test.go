@@ -0,0 +1,239 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"tp1.aba.distros.fi.uba.ar/common/security"
+	"tp1.aba.distros.fi.uba.ar/interface/blockchain"
+	"tp1.aba.distros.fi.uba.ar/interface/message"
+)
+
+// A service that holds a single block, and accepts chunks until full.
+type fakeService struct {
+	block  *blockchain.Block
+	chunks [][]byte
+	full   bool
+}
+
+func (svc *fakeService) HandleWriteChunk(req *message.WriteChunk) (*message.WriteChunkResponse, error) {
+	if svc.full {
+		return message.CreateWriteChunkResponse(false), nil
+	}
+	svc.chunks = append(svc.chunks, req.ChunkData())
+	return message.CreateWriteChunkResponse(true), nil
+}
+
+func (svc *fakeService) HandleGetBlock(req *message.GetBlockByHashRequest) (*message.GetBlockByHashResponse, error) {
+	if req.Hash().Equals(svc.block.Hash()) {
+		return message.CreateGetBlockByHashResponse(svc.block), nil
+	}
+	return message.CreateGetBlockByHashResponse(nil), nil
+}
+
+func (svc *fakeService) HandleGetBlocksFromMinute(req *message.ReadBlocksInMinuteRequest) (*message.ReadBlocksInMinuteResponse, error) {
+	if req.Timestamp() < 0 {
+		return nil, fmt.Errorf("%w: negative timestamp", message.ErrBadRequest)
+	}
+	return message.CreateReadBlocksInMinuteResponse(req.Timestamp(), []*blockchain.Block{svc.block})
+}
+
+func (svc *fakeService) HandleGetMiningStatistics(req *message.GetMiningStatistics) (*message.GetMiningStatisticsResponse, error) {
+	return message.CreateGetMiningStatisticsResponse([]*message.MiningStats{message.CreateMiningStats(1, 2, 3)}), nil
+}
+
+func (svc *fakeService) HandleGetMiningRanges(req *message.GetMiningRanges) (*message.GetMiningRangesResponse, error) {
+	return message.CreateGetMiningRangesResponse([]*message.RangeStats{{RangeId: 1, MinerId: 1, Attempts: 5}}), nil
+}
+
+func (svc *fakeService) HandleGetMiningTelemetry(req *message.GetMiningTelemetry) (*message.GetMiningTelemetryResponse, error) {
+	telemetry := &message.MiningTelemetry{}
+	telemetry.BlocksMined = 1
+	telemetry.Attempts = 5
+	telemetry.Hashrate = [3]float64{2, 1, 0.5}
+	if req.HistoryLength() > 0 {
+		stats := &message.MinedBlockStats{}
+		stats.Hash = svc.block.Hash()
+		stats.Difficulty = svc.block.Difficulty()
+		stats.MinedAt = time.Unix(1600000000, 0)
+		stats.Duration = time.Second
+		stats.Attempts = 5
+		stats.MinerId = 1
+		telemetry.History = []*message.MinedBlockStats{stats}
+	}
+	return message.CreateGetMiningTelemetryResponse(telemetry), nil
+}
+
+func createTestGateway(verifier *security.Verifier) (*fakeService, http.Handler) {
+	svc := &fakeService{}
+	svc.block = blockchain.CreateDummyBlock()
+	return svc, CreateGateway(svc, 0, verifier).Handler()
+}
+
+// Sends the request to the handler and decodes the JSON response into the given value.
+func serve(t *testing.T, handler http.Handler, r *http.Request, body interface{}) int {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, r)
+	if body != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), body); err != nil {
+			t.Fatalf("could not decode response: %s", err.Error())
+		}
+	}
+	return recorder.Code
+}
+
+func TestWriteChunk(t *testing.T) {
+	svc, handler := createTestGateway(nil)
+
+	response := &writeChunkResponse{}
+	r := httptest.NewRequest(http.MethodPost, "/chunks", bytes.NewBufferString(`{"data": "aGVsbG8="}`))
+	if status := serve(t, handler, r, response); status != http.StatusAccepted || !response.Accepted {
+		t.Fatalf("unexpected status %d", status)
+	}
+	if len(svc.chunks) != 1 || string(svc.chunks[0]) != "hello" {
+		t.Fatal("unexpected chunk written")
+	}
+
+	// Rejected chunks, malformed bodies and other methods.
+	svc.full = true
+	r = httptest.NewRequest(http.MethodPost, "/chunks", bytes.NewBufferString(`{"data": "aGVsbG8="}`))
+	if status := serve(t, handler, r, nil); status != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status %d for a rejected chunk", status)
+	}
+	r = httptest.NewRequest(http.MethodPost, "/chunks", bytes.NewBufferString(`{"data": 1}`))
+	if status := serve(t, handler, r, nil); status != http.StatusBadRequest {
+		t.Fatalf("unexpected status %d for a malformed body", status)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/chunks", nil)
+	if status := serve(t, handler, r, nil); status != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status %d for GET", status)
+	}
+}
+
+func TestGetBlock(t *testing.T) {
+	svc, handler := createTestGateway(nil)
+
+	block := &blockJSON{}
+	r := httptest.NewRequest(http.MethodGet, "/blocks/"+svc.block.Hash().Hex(), nil)
+	if status := serve(t, handler, r, block); status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+	if block.Hash != svc.block.Hash().Hex() || block.Timestamp != svc.block.Timestamp() {
+		t.Fatal("unexpected block")
+	}
+	if len(block.Entries) != int(svc.block.EntryCount()) {
+		t.Fatal("unexpected entries")
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/blocks/"+hex.EncodeToString(make([]byte, 32)), nil)
+	if status := serve(t, handler, r, nil); status != http.StatusNotFound {
+		t.Fatalf("unexpected status %d for a missing block", status)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/blocks/1234", nil)
+	if status := serve(t, handler, r, nil); status != http.StatusBadRequest {
+		t.Fatalf("unexpected status %d for a malformed hash", status)
+	}
+}
+
+func TestGetBlocksInMinute(t *testing.T) {
+	_, handler := createTestGateway(nil)
+
+	response := &blocksInMinuteResponse{}
+	r := httptest.NewRequest(http.MethodGet, "/blocks?minute=120", nil)
+	if status := serve(t, handler, r, response); status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+	if response.Minute != 120 || len(response.Blocks) != 1 {
+		t.Fatal("unexpected blocks")
+	}
+
+	// Errors from the service are answered with the matching status.
+	r = httptest.NewRequest(http.MethodGet, "/blocks?minute=-60", nil)
+	if status := serve(t, handler, r, nil); status != http.StatusBadRequest {
+		t.Fatalf("unexpected status %d for a bad request", status)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/blocks?minute=now", nil)
+	if status := serve(t, handler, r, nil); status != http.StatusBadRequest {
+		t.Fatalf("unexpected status %d for a malformed minute", status)
+	}
+}
+
+func TestGetMiningStatistics(t *testing.T) {
+	_, handler := createTestGateway(nil)
+
+	response := &miningStatisticsResponse{}
+	r := httptest.NewRequest(http.MethodGet, "/stats/mining", nil)
+	if status := serve(t, handler, r, response); status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+	if len(response.Miners) != 1 || *response.Miners[0] != (minerStatistics{1, 2, 3}) {
+		t.Fatal("unexpected statistics")
+	}
+	if len(response.Ranges) != 1 || *response.Ranges[0] != (rangeStatistics{1, 1, 5, 0}) {
+		t.Fatal("unexpected range statistics")
+	}
+	if response.BlocksMined != 1 || response.Hashrate != [3]float64{2, 1, 0.5} || len(response.History) != 0 {
+		t.Fatal("unexpected telemetry")
+	}
+
+	// The latest blocks mined are included when asked for.
+	response = &miningStatisticsResponse{}
+	r = httptest.NewRequest(http.MethodGet, "/stats/mining?history=5", nil)
+	if status := serve(t, handler, r, response); status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+	if len(response.History) != 1 || response.History[0].DurationMs != 1000 ||
+		response.History[0].MinedAt != 1600000000 || response.History[0].MinerId != 1 {
+		t.Fatal("unexpected history")
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/stats/mining?history=many", nil)
+	if status := serve(t, handler, r, nil); status != http.StatusBadRequest {
+		t.Fatalf("unexpected status %d", status)
+	}
+}
+
+func TestSignedWrites(t *testing.T) {
+	verifier := security.CreateVerifier(map[string][]byte{"client": []byte("secret")}, time.Minute)
+	svc, handler := createTestGateway(verifier)
+	body := `{"data": "aGVsbG8="}`
+
+	signedRequest := func(secret string, nonce string) *http.Request {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(timestamp + "\n" + nonce + "\n" + body))
+
+		r := httptest.NewRequest(http.MethodPost, "/chunks", bytes.NewBufferString(body))
+		r.Header.Set("X-Client-Id", "client")
+		r.Header.Set("X-Timestamp", timestamp)
+		r.Header.Set("X-Nonce", nonce)
+		r.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+		return r
+	}
+
+	if status := serve(t, handler, signedRequest("secret", "1"), nil); status != http.StatusAccepted {
+		t.Fatalf("unexpected status %d for a signed request", status)
+	}
+	if status := serve(t, handler, signedRequest("secret", "1"), nil); status != http.StatusUnauthorized {
+		t.Fatalf("unexpected status %d for a replayed request", status)
+	}
+	if status := serve(t, handler, signedRequest("guess", "2"), nil); status != http.StatusUnauthorized {
+		t.Fatalf("unexpected status %d for a wrong signature", status)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/chunks", bytes.NewBufferString(body))
+	if status := serve(t, handler, r, nil); status != http.StatusUnauthorized {
+		t.Fatalf("unexpected status %d for an unsigned request", status)
+	}
+	if len(svc.chunks) != 1 {
+		t.Fatal("unexpected chunks written")
+	}
+}
@@ -14,10 +14,25 @@ import (
 type Blockchain struct {
 	currentPreviousHash *big32.Big32
 	currentDifficulty   *big32.Big32
+	// Connections to the read and write servers of the blockchain, kept open between requests.
+	reads  *message.Pool
+	writes *message.Pool
+	// Subscriptions get a connection of their own to the read server.
+	readAddress string
 }
 
 func CreateBlockchain() (*Blockchain, error) {
+	serverName := config.GetStringOrDefault("BlockchainServerName", "localhost")
+	readPort := config.GetStringOrDefault("BlockchainReadPort", "8000")
+	writePort := config.GetStringOrDefault("BlockchainWritePort", "8010")
+	readConnections, _ := config.GetIntOrDefault("BlockchainReadConnections", 4)
+	// Blocks are written one at a time, so a single connection is enough.
+	writeConnections, _ := config.GetIntOrDefault("BlockchainWriteConnections", 1)
+
 	blockchain := &Blockchain{}
+	blockchain.readAddress = net.JoinHostPort(serverName, readPort)
+	blockchain.reads = message.CreatePool(blockchain.readAddress, readConnections)
+	blockchain.writes = message.CreatePool(net.JoinHostPort(serverName, writePort), writeConnections)
 	if err := blockchain.initializeMiningInfo(); err != nil {
 		return nil, err
 	} else {
@@ -33,39 +48,38 @@ func (b *Blockchain) CurrentDifficulty() *big32.Big32 {
 	return b.currentDifficulty
 }
 
+// Asks the server for the current previous hash and difficulty, for when the response to a
+// write was lost.
+func (b *Blockchain) RefreshMiningInfo() error {
+	return b.initializeMiningInfo()
+}
+
 func (b *Blockchain) initializeMiningInfo() error {
-	logging.Log("Requesting initial mining info")
-	if conn, err := b.openReadConnection(); err != nil {
+	logging.Log("Requesting mining info")
+	if res, err := b.GetMiningInfo(message.CreateGetMiningInfoRequest()); err != nil {
 		return err
 	} else {
-		req := message.CreateGetMiningInfoRequest()
-		if res, err := b.delegate(req, conn); err != nil {
-			return err
-		} else {
-			r := res.(*message.GetMiningInfoResponse)
-			b.currentDifficulty = r.Difficulty()
-			b.currentPreviousHash = r.PreviousHash()
-			logging.Log(fmt.Sprintf("Current previous hash: %s", b.currentPreviousHash.Hex()))
-			logging.Log(fmt.Sprintf("Current difficulty: %s", b.currentDifficulty.Hex()))
-			return nil
-		}
+		b.currentDifficulty = res.Difficulty()
+		b.currentPreviousHash = res.PreviousHash()
+		logging.Log(fmt.Sprintf("Current previous hash: %s", b.currentPreviousHash.Hex()))
+		logging.Log(fmt.Sprintf("Current difficulty: %s", b.currentDifficulty.Hex()))
+		logging.Log(fmt.Sprintf("Current height: %d", res.Height()))
+		return nil
 	}
 }
 
 func (b *Blockchain) WriteBlock(req *message.WriteBlock) (*message.WriteBlockResponse, error) {
 	logging.Log("Sending write block request")
-	if conn, err := b.openWriteConnection(); err != nil {
+	// Sign the request if credentials are configured.
+	signed, err := message.Sign(req)
+	if err != nil {
+		return nil, err
+	}
+	// Delegate the request to the server. From the response, update current difficulty and
+	// previous hash.
+	if res1, err := b.writes.Request(signed); err != nil {
 		return nil, err
 	} else {
-		defer conn.Close()
-		// Delegate the request to the server. From the response, update current difficulty
-		// and previous hash.
-		res1, err := b.delegate(req, conn)
-
-		if err != nil {
-			return nil, err
-		}
-
 		res2 := res1.(*message.WriteBlockResponse)
 		b.currentPreviousHash = res2.NewPreviousHash()
 		b.currentDifficulty = res2.NewDifficulty()
@@ -80,49 +94,73 @@ func (b *Blockchain) WriteBlock(req *message.WriteBlock) (*message.WriteBlockRes
 }
 
 func (b *Blockchain) GetOneWithHash(req *message.GetBlockByHashRequest) (*message.GetBlockByHashResponse, error) {
-	if conn, err := b.openReadConnection(); err != nil {
+	if res, err := b.reads.Request(req); err != nil {
+		return nil, err
+	} else {
+		return res.(*message.GetBlockByHashResponse), nil
+	}
+}
+
+func (b *Blockchain) GetMiningInfo(req message.Message) (*message.GetMiningInfoResponse, error) {
+	if res, err := b.reads.Request(req); err != nil {
 		return nil, err
 	} else {
-		defer conn.Close()
-		res, err := b.delegate(req, conn)
-		return res.(*message.GetBlockByHashResponse), err
+		return res.(*message.GetMiningInfoResponse), nil
+	}
+}
+
+func (b *Blockchain) GetOneWithHeight(req *message.GetBlockByHeightRequest) (*message.GetBlockByHeightResponse, error) {
+	if res, err := b.reads.Request(req); err != nil {
+		return nil, err
+	} else {
+		return res.(*message.GetBlockByHeightResponse), nil
 	}
 }
 
 func (b *Blockchain) GetBlocksFromMinute(req *message.ReadBlocksInMinuteRequest) (*message.ReadBlocksInMinuteResponse, error) {
-	if conn, err := b.openReadConnection(); err != nil {
+	if res, err := b.reads.Request(req); err != nil {
 		return nil, err
 	} else {
-		defer conn.Close()
-		if res, err := b.delegate(req, conn); err != nil {
-			return nil, err
-		} else {
-			return res.(*message.ReadBlocksInMinuteResponse), nil
-		}
+		return res.(*message.ReadBlocksInMinuteResponse), nil
 	}
 }
 
-func (b *Blockchain) delegate(req message.Message, conn net.Conn) (message.Message, error) {
-	// Send the request.
-	if err := req.Write(conn); err != nil {
+func (b *Blockchain) FindChunk(req *message.FindChunkRequest) (*message.FindChunkResponse, error) {
+	if res, err := b.reads.Request(req); err != nil {
 		return nil, err
+	} else {
+		return res.(*message.FindChunkResponse), nil
 	}
-	// Read the response.
-	if response, err := message.ReadMessage(conn); err != nil {
+}
+
+func (b *Blockchain) GetCacheStatistics(req *message.GetCacheStatistics) (*message.GetCacheStatisticsResponse, error) {
+	if res, err := b.reads.Request(req); err != nil {
 		return nil, err
 	} else {
-		return response, nil
+		return res.(*message.GetCacheStatisticsResponse), nil
 	}
 }
 
-func (b *Blockchain) openReadConnection() (net.Conn, error) {
-	serverName := config.GetStringOrDefault("BlockchainServerName", "localhost")
-	serverPort := config.GetStringOrDefault("BlockchainReadPort", "8000")
-	return net.Dial("tcp", fmt.Sprintf("%s:%s", serverName, serverPort))
+// Forwards the blocks of a range query to the given client as they arrive from the server,
+// without holding them in memory.
+func (b *Blockchain) StreamBlocksInRange(req *message.ReadBlocksInRangeRequest, client message.ResponseWriter) error {
+	// The response reads blocks from the connection as they are written, so it must be completely
+	// forwarded before the connection is used for anything else.
+	return b.reads.Stream(req, func(res message.Message) error {
+		return client.WriteMessage(res)
+	})
 }
 
-func (b *Blockchain) openWriteConnection() (net.Conn, error) {
-	serverName := config.GetStringOrDefault("BlockchainServerName", "localhost")
-	serverPort := config.GetStringOrDefault("BlockchainWritePort", "8010")
-	return net.Dial("tcp", fmt.Sprintf("%s:%s", serverName, serverPort))
+// Forwards the blocks written to the blockchain to the given client as they arrive from the
+// server, until either of them hangs up.
+func (b *Blockchain) SubscribeBlocks(req *message.SubscribeBlocksRequest, client message.ResponseWriter) error {
+	return message.Subscribe(b.readAddress, req, client.Done(), func(res message.Message) error {
+		return client.WriteMessage(res)
+	})
+}
+
+// Closes all connections to the blockchain server.
+func (b *Blockchain) Close() {
+	b.reads.Close()
+	b.writes.Close()
 }
@@ -10,9 +10,11 @@ import (
 
 	"tp1.aba.distros.fi.uba.ar/common/config"
 	"tp1.aba.distros.fi.uba.ar/common/logging"
+	"tp1.aba.distros.fi.uba.ar/common/security"
 	"tp1.aba.distros.fi.uba.ar/common/server"
 	"tp1.aba.distros.fi.uba.ar/interface/message"
 	"tp1.aba.distros.fi.uba.ar/node/service/domain"
+	"tp1.aba.distros.fi.uba.ar/node/service/gateway"
 )
 
 // Define a configuration path.
@@ -40,6 +42,13 @@ func Run() {
 		svc.RegisterOnWaitGroup(waitGroup)
 	}
 
+	// Load the keys of the clients allowed to write, if writes must be signed.
+	verifier, err := security.ServerVerifier()
+	if err != nil {
+		logging.LogError("Could not load client keys", err)
+		return
+	}
+
 	// Instantiate read and write server configuration.
 	logging.Log("Reading server configuration")
 	rServerPort, _ := config.GetIntOrDefault("ReadServerPort", 9000)
@@ -55,19 +64,26 @@ func Run() {
 	}
 
 	// Instantiate the servers.
-	wServer := server.CreateNew(wServerConfig, func(conn *net.Conn) {
-		handleWriteConnection(svc, *conn)
+	wServer := server.CreateNew(wServerConfig, func(conn *net.Conn, submit func(func())) {
+		handleWriteConnection(svc, verifier, *conn, submit)
 	})
-	rServer := server.CreateNew(rServerConfig, func(conn *net.Conn) {
-		handleReadConnection(svc, *conn)
+	rServer := server.CreateNew(rServerConfig, func(conn *net.Conn, submit func(func())) {
+		handleReadConnection(svc, *conn, submit)
 	})
 
 	wServer.RegisterOnWaitGroup(waitGroup)
 	rServer.RegisterOnWaitGroup(waitGroup)
 
+	// Instantiate the HTTP gateway, if enabled.
+	var httpGateway *gateway.Gateway
+	if httpPort, _ := config.GetIntOrDefault("HTTPPort", 0); httpPort > 0 {
+		httpGateway = gateway.CreateGateway(svc, uint16(httpPort), verifier)
+		httpGateway.RegisterOnWaitGroup(waitGroup)
+	}
+
 	// Handle control connections.
 	logging.Log("Setting up signal handlers")
-	go handleSignals([]*server.Server{wServer, rServer}, svc)
+	go handleSignals([]*server.Server{wServer, rServer}, httpGateway, svc)
 
 	// Run the blockchain service.
 	logging.Log("Launching service goroutines")
@@ -78,6 +94,9 @@ func Run() {
 	logging.Log("Launching server")
 	go wServer.Run()
 	go rServer.Run()
+	if httpGateway != nil {
+		go httpGateway.Run()
+	}
 
 	// Wait for services to finish.
 	waitGroup.Wait()
@@ -86,7 +105,7 @@ func Run() {
 // Initialize signal handling to quit the server when any of the specified
 // signals are provided. When a signal is received, all given servers will
 // be told to stop.
-func handleSignals(servers []*server.Server, svc *domain.BlockchainService) {
+func handleSignals(servers []*server.Server, httpGateway *gateway.Gateway, svc *domain.BlockchainService) {
 	sigchannel := make(chan os.Signal, 1)
 	signal.Notify(sigchannel, syscall.SIGINT, syscall.SIGTERM)
 	// There are only quit signals to handle. The program should
@@ -97,27 +116,58 @@ func handleSignals(servers []*server.Server, svc *domain.BlockchainService) {
 		logging.Log(fmt.Sprintf("Stopping server %d", i))
 		srv.Stop()
 	}
+	if httpGateway != nil {
+		httpGateway.Stop()
+	}
 	// Stop the service as well.
 	logging.Log("Stopping service goroutines")
 	svc.Stop()
+
+	sent, received := message.CompressionStatistics()
+	logging.Log(fmt.Sprintf("Compressed responses sent: %s", sent))
+	logging.Log(fmt.Sprintf("Compressed responses received: %s", received))
 }
 
 //-------------------------------------------------------------------------------------------------
 // Write connections
 //-------------------------------------------------------------------------------------------------
 
-func handleWriteConnection(svc *domain.BlockchainService, conn net.Conn) {
-	// Read incoming message.
-	msg, err := message.ReadMessage(conn)
+func handleWriteConnection(
+	svc *domain.BlockchainService, verifier *security.Verifier, netConn net.Conn, submit func(func())) {
+
+	conn, err := accept(netConn)
+	if err != nil {
+		logging.LogError("Could not start write connection", err)
+		return
+	}
+
+	// Handle incoming messages until the client hangs up.
+	err = conn.Serve(func(msg message.Message, writer message.ResponseWriter) {
+		handleWriteRequest(svc, verifier, msg, writer)
+	}, submit)
 
 	if err != nil {
 		logging.LogError("Could not read client message", err)
+		writeError(conn, message.CreateErrorResponse(message.ErrorCodeBadRequest, err.Error()))
+	}
+}
+
+func handleWriteRequest(
+	svc *domain.BlockchainService, verifier *security.Verifier, signedMsg message.Message, conn message.ResponseWriter) {
+
+	// Check that the request comes from a known client, if required.
+	msg, err := message.Authenticate(signedMsg, verifier)
+	if err != nil {
+		logging.LogError("Unauthorized write request", err)
+		writeError(conn, message.CreateErrorResponseFromError(err))
 		return
 	}
 
 	// Only accept WriteChunk requests.
 	if msg.Opcode() != message.OpWriteChunk {
 		logging.Log("Unexpected request type")
+		reason := fmt.Sprintf("unexpected opcode %d", msg.Opcode())
+		writeError(conn, message.CreateErrorResponse(message.ErrorCodeBadRequest, reason))
 		return
 	}
 
@@ -125,8 +175,9 @@ func handleWriteConnection(svc *domain.BlockchainService, conn net.Conn) {
 	request := msg.(*message.WriteChunk)
 	if response, err := svc.HandleWriteChunk(request); err != nil {
 		logging.LogError("Could not handle write request", err)
+		writeError(conn, message.CreateErrorResponseFromError(err))
 	} else {
-		response.Write(conn)
+		conn.WriteMessage(response)
 	}
 }
 
@@ -134,15 +185,26 @@ func handleWriteConnection(svc *domain.BlockchainService, conn net.Conn) {
 // Read connections
 //-------------------------------------------------------------------------------------------------
 
-func handleReadConnection(svc *domain.BlockchainService, conn net.Conn) {
-	// Read incoming message.
-	msg, err := message.ReadMessage(conn)
+func handleReadConnection(svc *domain.BlockchainService, netConn net.Conn, submit func(func())) {
+	conn, err := accept(netConn)
+	if err != nil {
+		logging.LogError("Could not start read connection", err)
+		return
+	}
+
+	// Handle incoming messages until the client hangs up. Responses are sent as soon as they are
+	// ready, which may not be in the order the requests arrived.
+	err = conn.Serve(func(msg message.Message, writer message.ResponseWriter) {
+		handleReadRequest(svc, msg, writer)
+	}, submit)
 
 	if err != nil {
 		logging.LogError("Could not read client message", err)
-		return
+		writeError(conn, message.CreateErrorResponse(message.ErrorCodeBadRequest, err.Error()))
 	}
+}
 
+func handleReadRequest(svc *domain.BlockchainService, msg message.Message, conn message.ResponseWriter) {
 	// Handle the message depending on opcode.
 	switch msg.Opcode() {
 	case message.OpGetBlockWithHash:
@@ -151,35 +213,179 @@ func handleReadConnection(svc *domain.BlockchainService, conn net.Conn) {
 		handleGetBlocksInMinute(svc, msg, conn)
 	case message.OpGetMiningStatistics:
 		handleGetMiningStatistics(svc, msg, conn)
+	case message.OpGetMiningRanges:
+		handleGetMiningRanges(svc, msg, conn)
+	case message.OpGetMiningTelemetry:
+		handleGetMiningTelemetry(svc, msg, conn)
+	case message.OpGetDeadLetters:
+		handleGetDeadLetters(svc, msg, conn)
+	case message.OpGetBlockByHeight:
+		handleGetBlockWithHeightRequest(svc, msg, conn)
+	case message.OpGetMiningInfo:
+		handleGetMiningInfo(svc, msg, conn)
+	case message.OpReadBlocksInRange:
+		handleGetBlocksInRange(svc, msg, conn)
+	case message.OpGetCacheStatistics:
+		handleGetCacheStatistics(svc, msg, conn)
+	case message.OpFindChunk:
+		handleFindChunk(svc, msg, conn)
+	case message.OpSubscribeBlocks:
+		handleSubscribeBlocks(svc, msg, conn)
+	default:
+		logging.Log("Unexpected request type")
+		reason := fmt.Sprintf("unexpected opcode %d", msg.Opcode())
+		writeError(conn, message.CreateErrorResponse(message.ErrorCodeBadRequest, reason))
+	}
+}
+
+// Starts a connection with a client. Clients that do not frame their messages are served as long
+// as allowed by configuration.
+func accept(conn net.Conn) (*message.Conn, error) {
+	allowLegacy, _ := config.GetIntOrDefault("AllowLegacyProtocol", 1)
+	return message.Accept(conn, allowLegacy != 0)
+}
+
+// Sends an error response to the client. The connection may already be broken, so failing to
+// send it is only logged.
+func writeError(conn message.ResponseWriter, response *message.ErrorResponse) {
+	if err := conn.WriteMessage(response); err != nil {
+		logging.LogError("Could not send error response", err)
 	}
 }
 
-func handleGetBlockWithHashRequest(svc *domain.BlockchainService, msg message.Message, conn net.Conn) {
+func handleGetBlockWithHashRequest(svc *domain.BlockchainService, msg message.Message, conn message.ResponseWriter) {
 	logging.Log("Handling get block by hash request")
 	if response, err := svc.HandleGetBlock(msg.(*message.GetBlockByHashRequest)); err != nil {
 		logging.LogError("Find with hash request failed", err)
+		writeError(conn, message.CreateErrorResponseFromError(err))
+	} else {
+		logging.Log("Writing response")
+		conn.WriteMessage(response)
+	}
+}
+
+func handleGetBlockWithHeightRequest(svc *domain.BlockchainService, msg message.Message, conn message.ResponseWriter) {
+	logging.Log("Handling get block by height request")
+	if response, err := svc.HandleGetBlockByHeight(msg.(*message.GetBlockByHeightRequest)); err != nil {
+		logging.LogError("Find with height request failed", err)
+		writeError(conn, message.CreateErrorResponseFromError(err))
+	} else {
+		logging.Log("Writing response")
+		conn.WriteMessage(response)
+	}
+}
+
+func handleFindChunk(svc *domain.BlockchainService, msg message.Message, conn message.ResponseWriter) {
+	logging.Log("Handling find chunk request")
+	if response, err := svc.HandleFindChunk(msg.(*message.FindChunkRequest)); err != nil {
+		logging.LogError("Find chunk request failed", err)
+		writeError(conn, message.CreateErrorResponseFromError(err))
+	} else {
+		logging.Log("Writing response")
+		conn.WriteMessage(response)
+	}
+}
+
+func handleGetMiningInfo(svc *domain.BlockchainService, msg message.Message, conn message.ResponseWriter) {
+	logging.Log("Handling get mining info request")
+	if response, err := svc.HandleGetMiningInfo(msg.(*message.GetMiningInfo)); err != nil {
+		logging.LogError("Get mining info request failed", err)
+		writeError(conn, message.CreateErrorResponseFromError(err))
 	} else {
 		logging.Log("Writing response")
-		response.Write(conn)
+		conn.WriteMessage(response)
 	}
 }
 
-func handleGetBlocksInMinute(svc *domain.BlockchainService, msg message.Message, conn net.Conn) {
+func handleGetBlocksInMinute(svc *domain.BlockchainService, msg message.Message, conn message.ResponseWriter) {
 	logging.Log("Handling get blocks in minute request")
 	if response, err := svc.HandleGetBlocksFromMinute(msg.(*message.ReadBlocksInMinuteRequest)); err != nil {
 		logging.LogError("Find in minute request failed", err)
+		writeError(conn, message.CreateErrorResponseFromError(err))
 	} else {
 		logging.Log("Writing response")
-		response.Write(conn)
+		conn.WriteMessage(response)
 	}
 }
 
-func handleGetMiningStatistics(svc *domain.BlockchainService, msg message.Message, conn net.Conn) {
+func handleGetBlocksInRange(svc *domain.BlockchainService, msg message.Message, conn message.ResponseWriter) {
+	logging.Log("Handling get blocks in range request")
+	if err := svc.HandleGetBlocksInRange(msg.(*message.ReadBlocksInRangeRequest), conn); err != nil {
+		logging.LogError("Find in range request failed", err)
+		// If blocks were already being forwarded, the client fails to read the response anyway.
+		writeError(conn, message.CreateErrorResponseFromError(err))
+	}
+}
+
+func handleGetCacheStatistics(svc *domain.BlockchainService, msg message.Message, conn message.ResponseWriter) {
+	logging.Log("Handling get cache statistics request")
+	if response, err := svc.HandleGetCacheStatistics(msg.(*message.GetCacheStatistics)); err != nil {
+		logging.LogError("Get cache statistics request failed", err)
+		writeError(conn, message.CreateErrorResponseFromError(err))
+	} else {
+		logging.Log("Writing response")
+		conn.WriteMessage(response)
+	}
+}
+
+func handleGetMiningStatistics(svc *domain.BlockchainService, msg message.Message, conn message.ResponseWriter) {
 	logging.Log("Handling get mining statistics request")
 	if response, err := svc.HandleGetMiningStatistics(msg.(*message.GetMiningStatistics)); err != nil {
 		logging.LogError("Get mining statistics request failed", err)
+		writeError(conn, message.CreateErrorResponseFromError(err))
 	} else {
 		logging.Log("Writing response")
-		response.Write(conn)
+		conn.WriteMessage(response)
 	}
 }
+
+func handleGetMiningRanges(svc *domain.BlockchainService, msg message.Message, conn message.ResponseWriter) {
+	logging.Log("Handling get mining ranges request")
+	if response, err := svc.HandleGetMiningRanges(msg.(*message.GetMiningRanges)); err != nil {
+		logging.LogError("Get mining ranges request failed", err)
+		writeError(conn, message.CreateErrorResponseFromError(err))
+	} else {
+		logging.Log("Writing response")
+		conn.WriteMessage(response)
+	}
+}
+
+func handleGetMiningTelemetry(svc *domain.BlockchainService, msg message.Message, conn message.ResponseWriter) {
+	logging.Log("Handling get mining telemetry request")
+	if response, err := svc.HandleGetMiningTelemetry(msg.(*message.GetMiningTelemetry)); err != nil {
+		logging.LogError("Get mining telemetry request failed", err)
+		writeError(conn, message.CreateErrorResponseFromError(err))
+	} else {
+		logging.Log("Writing response")
+		conn.WriteMessage(response)
+	}
+}
+
+func handleGetDeadLetters(svc *domain.BlockchainService, msg message.Message, conn message.ResponseWriter) {
+	logging.Log("Handling get dead letters request")
+	if response, err := svc.HandleGetDeadLetters(msg.(*message.GetDeadLetters)); err != nil {
+		logging.LogError("Get dead letters request failed", err)
+		writeError(conn, message.CreateErrorResponseFromError(err))
+	} else {
+		logging.Log("Writing response")
+		conn.WriteMessage(response)
+	}
+}
+
+func handleSubscribeBlocks(svc *domain.BlockchainService, msg message.Message, conn message.ResponseWriter) {
+	logging.Log("Handling subscribe blocks request")
+	if !message.SupportsPush(conn) {
+		reason := "subscriptions require a framed connection"
+		writeError(conn, message.CreateErrorResponse(message.ErrorCodeBadRequest, reason))
+		return
+	}
+
+	// Relay blocks from a goroutine of its own, so that the subscription does not hold a worker
+	// for as long as the client stays connected.
+	go func() {
+		if err := svc.HandleSubscribeBlocks(msg.(*message.SubscribeBlocksRequest), conn); err != nil {
+			logging.LogError("Subscription ended", err)
+			writeError(conn, message.CreateErrorResponseFromError(err))
+		}
+	}()
+}